@@ -2,11 +2,28 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
-	"log"
+	"errors"
+	"fmt"
 	"time"
 )
 
+// MaxFutureTimestamp how far ahead of the current time a block timestamp is allowed to be
+const MaxFutureTimestamp = 2 * time.Hour
+
+// ErrNoTransactions is returned when a block is created without any transactions
+var ErrNoTransactions = errors.New("block has no transactions")
+
+var (
+	// ErrInvalidTimestamp is returned when a block timestamp is too far in the future, or before the timestamp of the previous block
+	ErrInvalidTimestamp = errors.New("invalid block timestamp")
+	// ErrTimestampTooFar is returned when a block timestamp is further in the future than MaxFutureTimestamp
+	ErrTimestampTooFar = fmt.Errorf("%w: block timestamp is too far in the future", ErrInvalidTimestamp)
+	// ErrInvalidTxBloom is returned when the bloom filter of a block does not match its transactions
+	ErrInvalidTxBloom = errors.New("bloom filter does not match the block transactions")
+)
+
 // Block represents a block on the blockchain. Including the Transactions, prev hash, current hash and nonce
 //
 // different peers will have different copies of these blocks.
@@ -20,71 +37,210 @@ type Block struct {
 	Nonce    int
 	// index of the block in the chain, important for comparing blockchains with other peers
 	Height int
+	// bloom filter of the transaction ids, allows us to skip blocks that don't contain a transaction
+	//
+	// the PoW doesn't cover it, so a peer could send any filter. AddBlock rebuilds it from the transactions
+	TxBloom []byte
+	// the difficulty the block was mined with. Zero for blocks mined before retargeting, those use the Difficulty constant
+	Difficulty int
+}
+
+// BlockHeader is a block without its transactions
+//
+// headers are enough to validate the PoW and link blocks together, so peers can sync them before downloading the full blocks
+type BlockHeader struct {
+	Timestamp int64
+	Hash      []byte
+	PrevHash  []byte
+	// merkle root of the block transactions
+	MerkleRoot []byte
+	Nonce      int
+	Height     int
+	Difficulty int
 }
 
-// HashTransactions represent all transactions in a unique hash for PoW
-func (b *Block) HashTransactions() []byte {
+// Header creates the header of the block
+func (b *Block) Header() (BlockHeader, error) {
+	merkleRoot, err := b.HashTransactions()
+	if err != nil {
+		return BlockHeader{}, err
+	}
+	return BlockHeader{b.Timestamp, b.Hash, b.PrevHash, merkleRoot, b.Nonce, b.Height, b.Difficulty}, nil
+}
+
+// HashTransactions represent all transactions in a unique hash for PoW. Returns ErrNoTransactions for a block without any
+func (b *Block) HashTransactions() ([]byte, error) {
+	if len(b.Transactions) == 0 {
+		return nil, ErrNoTransactions
+	}
+
 	var txHashes [][]byte
 
 	// add each transaction to the 2d slice
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.Serialize())
+		data, err := tx.Serialize()
+		if err != nil {
+			return nil, err
+		}
+		txHashes = append(txHashes, data)
 	}
 
 	// create a merkle tree
-	tree := NewMerkleTree(txHashes)
+	tree, err := NewMerkleTree(txHashes)
+	if err != nil {
+		return nil, err
+	}
 
 	// the root of the tree will serve as the unique identifier for each transaction
-	return tree.RootNode.Data
+	return tree.RootNode.Data, nil
+}
+
+// CreateBlock creates a block with the given difficulty. Returns ErrNoTransactions when there are no transactions to put in it
+//
+// blocks that are added to a chain should use the difficulty from RetargetDifficulty
+func CreateBlock(txs []*Transaction, prevHash []byte, height, difficulty int) (*Block, error) {
+	return CreateBlockContext(context.Background(), txs, prevHash, height, difficulty)
+}
 
+// CreateBlockContext creates a block, the PoW is abandoned when the context is cancelled
+func CreateBlockContext(ctx context.Context, txs []*Transaction, prevHash []byte, height, difficulty int) (*Block, error) {
+	return createBlock(ctx, txs, prevHash, height, difficulty, 1, nil)
 }
 
-// CreateBlock creates a block
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
+// createBlock creates a block and reports the PoW progress to the progress func, when it is set
+//
+// the PoW runs in parallel when there is more than 1 worker
+func createBlock(ctx context.Context, txs []*Transaction, prevHash []byte, height, difficulty, workers int, progress func(nonce int, hash []byte)) (*Block, error) {
+	// the merkle tree can't be built without any transactions
+	if len(txs) == 0 {
+		return nil, ErrNoTransactions
+	}
+
+	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height, txBloom(txs), difficulty}
+
 	// creates a new proof of work
-	pow := NewProof(block)
-	nonce, hash := pow.Run()
+	pow, err := NewProof(block, difficulty)
+	if err != nil {
+		return nil, err
+	}
+	pow.Progress = progress
+	nonce, hash, err := pow.RunParallel(ctx, workers)
+	// every nonce has been tried. Move the timestamp forward to change the hash input and try again
+	for err == ErrNonceExhausted {
+		block.Timestamp++
+		if block.Timestamp > time.Now().Add(MaxFutureTimestamp).Unix() {
+			return nil, ErrTimestampTooFar
+		}
+		nonce, hash, err = pow.RunParallel(ctx, workers)
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	// save the hash in the block
 	block.Hash = hash[:]
 	block.Nonce = nonce
 
-	return block
+	return block, nil
+}
+
+// txBloom adds every transaction id to a bloom filter
+func txBloom(txs []*Transaction) BloomFilter {
+	bloom := NewBloomFilter(len(txs))
+	for _, tx := range txs {
+		bloom.Add(tx.ID)
+	}
+	return bloom
+}
+
+// BlockFromHeader rebuilds a block from its header and transactions, eg. when a peer only sent the transaction ids
+//
+// returns an error when the transactions don't match the merkle root of the header
+func BlockFromHeader(header BlockHeader, txs []*Transaction) (*Block, error) {
+	block := &Block{header.Timestamp, header.Hash, txs, header.PrevHash, header.Nonce, header.Height, txBloom(txs), header.Difficulty}
+
+	merkleRoot, err := block.HashTransactions()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(merkleRoot, header.MerkleRoot) {
+		return nil, errors.New("transactions do not match the merkle root of the header")
+	}
+
+	return block, nil
 }
 
 // Genesis creates the very first block in the blockchain. The genesis block will not have a previous data hash
-func Genesis(coinbase *Transaction) *Block {
+func Genesis(coinbase *Transaction) (*Block, error) {
 	// height of the genesis block is always zero
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, Difficulty)
 }
 
-// Serialize turns a block into bytes
-func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
-
-	if err := encoder.Encode(b); err != nil {
-		log.Panic(err)
+// checkTxBloom checks that the bloom filter holds exactly the transaction ids of the block. Blocks without a filter pass,
+// MayContainTx never rules a transaction out for them
+func (b *Block) checkTxBloom() error {
+	if len(b.TxBloom) == 0 || bytes.Equal(b.TxBloom, txBloom(b.Transactions)) {
+		return nil
 	}
-	return res.Bytes()
+	return ErrInvalidTxBloom
+}
+
+// MayContainTx tests the bloom filter to see if the transaction might be in the block
+//
+// false means the transaction is definitely not in the block. Blocks created before the filter existed always return true
+func (b *Block) MayContainTx(txID []byte) bool {
+	return BloomFilter(b.TxBloom).MayContain(txID)
 }
 
-// Deserialize deserializes bytes into a block
-func Deserialize(data []byte) *Block {
+// Serialize turns a block into bytes using the binary block format
+func (b *Block) Serialize() []byte {
+	// the binary encoding writes into memory and never fails
+	data, _ := b.MarshalBinary()
+	return data
+}
+
+// gobBlock has the same fields as Block without the binary marshaling methods, so gob decodes it as a plain struct
+type gobBlock Block
+
+// Deserialize deserializes bytes into a block. Blocks that were stored with gob before the binary format are still readable
+func Deserialize(data []byte) (*Block, error) {
 	var b Block
 
+	if isBinaryBlock(data) {
+		if err := b.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		b.sealTransactions()
+		return &b, nil
+	}
+
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 
-	if err := decoder.Decode(&b); err != nil {
-		log.Panic(err)
+	if err := decoder.Decode((*gobBlock)(&b)); err != nil {
+		return nil, err
 	}
+	b.sealTransactions()
 
-	return &b
+	return &b, nil
 }
 
-func handle(err error) {
-	if err != nil {
-		log.Panic(err)
+// sealTransactions seals the transactions of a decoded block, like received transactions they are final
+func (b *Block) sealTransactions() {
+	for _, tx := range b.Transactions {
+		tx.sealed = true
 	}
 }
+
+// checkTimestamp checks that a block isn't from too far in the future and doesn't come before its previous block
+//
+// the clocks of the nodes drift, so blocks from a few seconds ahead are fine. The genesis block has no previous block, pass nil
+func checkTimestamp(block, prev *Block) error {
+	if block.Timestamp > time.Now().Add(MaxFutureTimestamp).Unix() {
+		return ErrTimestampTooFar
+	}
+	if prev != nil && block.Timestamp < prev.Timestamp {
+		return fmt.Errorf("%w: block timestamp %d is before the timestamp %d of the previous block", ErrInvalidTimestamp, block.Timestamp, prev.Timestamp)
+	}
+
+	return nil
+}
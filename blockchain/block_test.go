@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// forgedBlock creates a block on top of the last block whose bloom filter rules out its own coinbase
+func forgedBlock(t *testing.T, chain *Blockchain, address string) *Block {
+	t.Helper()
+
+	last, err := chain.GetBlock(chain.GetLastHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := CoinbaseTx(address, "", last.Height+1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := CreateBlock([]*Transaction{coinbase}, last.Hash, last.Height+1, Difficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block.TxBloom = make([]byte, len(block.TxBloom))
+	if block.MayContainTx(coinbase.ID) {
+		t.Fatal("the empty filter should rule out the coinbase")
+	}
+	return block
+}
+
+func TestVerifyBlockRejectsForgedTxBloom(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	block := forgedBlock(t, chain, address)
+	if err := chain.VerifyBlock(block); !errors.Is(err, ErrInvalidTxBloom) {
+		t.Errorf("VerifyBlock returned %v, want ErrInvalidTxBloom", err)
+	}
+}
+
+func TestAddBlockRebuildsTxBloom(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	block := forgedBlock(t, chain, address)
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := chain.GetBlock(block.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stored.checkTxBloom(); err != nil {
+		t.Fatal(err)
+	}
+	if !stored.MayContainTx(block.Transactions[0].ID) {
+		t.Error("the stored filter rules out the coinbase of the block")
+	}
+}
+
+// blockAt creates a block on top of prev with the timestamp, the PoW is redone for the timestamp
+func blockAt(t *testing.T, prev *Block, address string, timestamp int64) *Block {
+	t.Helper()
+
+	block := blockOn(t, prev, address)
+	if block == nil {
+		t.FailNow()
+	}
+	block.Timestamp = timestamp
+	pow, err := NewProof(block, block.Difficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Nonce, block.Hash, err = pow.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestAddBlockChecksTimestamps(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := addBlocks(t, chain, genesis, address, 1)[0]
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name      string
+		timestamp int64
+		want      error
+	}{
+		{"same second as the previous block", prev.Timestamp, nil},
+		{"a minute ahead", now + 60, nil},
+		{"just within the future limit", now + int64(MaxFutureTimestamp.Seconds()) - 60, nil},
+		{"before the previous block", prev.Timestamp - 1, ErrInvalidTimestamp},
+		{"a day in the past", prev.Timestamp - 24*60*60, ErrInvalidTimestamp},
+		{"three hours ahead", now + 3*60*60, ErrTimestampTooFar},
+	}
+	for _, test := range tests {
+		// every block is a fork of the same previous block, none of them has more work than the others
+		block := blockAt(t, prev, address, test.timestamp)
+		err := chain.AddBlock(block)
+		if test.want == nil && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if test.want != nil {
+			if !errors.Is(err, test.want) || !errors.Is(err, ErrInvalidTimestamp) {
+				t.Errorf("%s: returned %v, want %v", test.name, err, test.want)
+			}
+			if _, err := chain.GetBlock(block.Hash); err == nil {
+				t.Errorf("%s: the block was stored", test.name)
+			}
+		}
+	}
+
+	// a block from the future is refused before its previous block is looked up
+	orphan := blockAt(t, &Block{Hash: []byte("unknown"), Height: 5}, address, now+3*60*60)
+	if err := chain.AddBlock(orphan); !errors.Is(err, ErrTimestampTooFar) || len(chain.OrphanPool) != 0 {
+		t.Errorf("an orphan from the future returned %v and left %d orphans, want ErrTimestampTooFar and none", err, len(chain.OrphanPool))
+	}
+}
+
+func TestCreateBlockRejectsEmptyTransactions(t *testing.T) {
+	for name, txs := range map[string][]*Transaction{"nil": nil, "empty": {}} {
+		block, err := CreateBlock(txs, []byte("prev"), 1, Difficulty)
+		if !errors.Is(err, ErrNoTransactions) || block != nil {
+			t.Errorf("%s transactions: returned %v, %v, want ErrNoTransactions", name, block, err)
+		}
+	}
+
+	chain, closeChain, err := NewTestChain(string(wallet.MakeWallet().Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+	if _, err := chain.MineBlock(nil); !errors.Is(err, ErrNoTransactions) {
+		t.Errorf("MineBlock without transactions returned %v, want ErrNoTransactions", err)
+	}
+}
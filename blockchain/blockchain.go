@@ -2,17 +2,22 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger"
+	"github.com/qhenkart/blockchain/blockchain/metrics"
+	"github.com/qhenkart/blockchain/wallet"
 )
 
 const (
@@ -21,10 +26,49 @@ const (
 	genesisData = "First Transaction from Genesis"
 )
 
+var (
+	// ErrBlockchainNotFound is returned when continuing a blockchain that was never initialized
+	ErrBlockchainNotFound = errors.New("no existing blockchain found, must be initialized first")
+	// ErrBlockchainExists is returned when initializing a blockchain that already exists
+	ErrBlockchainExists = errors.New("blockchain already exists")
+	// ErrMiningTimeout is returned when the PoW did not finish before the timeout
+	ErrMiningTimeout = errors.New("mining timed out")
+	// ErrStaleTip is returned when another block was added to the chain while a block was mined, the mined block is dropped
+	ErrStaleTip = errors.New("the last block changed while the block was mined")
+	// ErrRangeTooLarge is returned when a height range holds more than MaxRangeSize blocks
+	ErrRangeTooLarge = errors.New("height range is too large")
+	// ErrInvalidRange is returned for height ranges that start below 0 or end before they start
+	ErrInvalidRange = errors.New("invalid height range")
+
+	// MaxRangeSize the maximum amount of blocks GetBlocksByHeightRange returns at once, every block is read into memory
+	MaxRangeSize = 500
+
+	// the height index maps a block height to the block hash so blocks can be fetched without iterating the chain
+	heightPrefix = []byte("height-")
+	// the transaction index maps a transaction id to the hash of the block that contains it
+	txPrefix = []byte("tx-")
+)
+
 // Blockchain defines the blockchain and database access for the node
 type Blockchain struct {
-	LastHash []byte
-	Database *badger.DB
+	// hash of the last block, use GetLastHash to read it
+	lastHash []byte
+	Database Storage
+	// guards lastHash and serializes the writes that compare and update the last hash
+	mu sync.RWMutex
+	// directory of the database, used to open more handles to it
+	path string
+	// the node the chain belongs to, NewTransaction loads the wallets of this node. Empty for chains that aren't stored on disk
+	nodeID string
+	// Config the consensus settings, eg. the target block time
+	Config ChainConfig
+	// OrphanPool the blocks whose previous block is not known yet, keyed by the hex encoded hash.
+	// AddBlock adds them to the chain once their previous block arrives. Guarded by the chain lock
+	OrphanPool map[string]*Block
+	// the keys of OrphanPool in the order the orphans arrived, the oldest is evicted first
+	orphanOrder []string
+	// receives an event for every reorganization, created by Reorgs
+	reorgs chan ChainReorg
 }
 
 // checks to see if the database exists or not
@@ -39,105 +83,210 @@ func dbExists(path string) bool {
 // Init Initializes the database,
 //
 // initializes the blockchain with the first genesis block and first coinbase transaction
-func Init(address, nodeID string) *Blockchain {
+func Init(address, nodeID string) (*Blockchain, error) {
 	path := fmt.Sprintf(dbPath, nodeID)
 
 	if dbExists(path) {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+		return nil, ErrBlockchainExists
 	}
 
 	opts := badger.DefaultOptions(path)
 	opts.Logger = nil
 	db, err := openDB(path, opts)
-	handle(err)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := InitWithStorage(&BadgerStorage{db}, address)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	chain.path = path
+	chain.nodeID = nodeID
+	return chain, nil
+}
 
+// InitWithStorage initializes a blockchain with a genesis block in an empty storage, eg. a MemoryStorage
+func InitWithStorage(db Storage, address string) (*Blockchain, error) {
 	var lastHash []byte
-	err = db.Update(func(txn *badger.Txn) error {
+	err := db.Update(func(txn StorageTxn) error {
 		// address will be the first miner who gets the first reward
-		cbtx := CoinbaseTx(address, genesisData)
-		genesis := Genesis(cbtx)
+		cbtx, err := CoinbaseTx(address, genesisData, 0, 0)
+		if err != nil {
+			return err
+		}
+		genesis, err := Genesis(cbtx)
+		if err != nil {
+			return err
+		}
+
+		slog.Info("Genesis created", "blockHash", hex.EncodeToString(genesis.Hash))
+		if err := txn.Set(genesis.Hash, genesis.Serialize()); err != nil {
+			return err
+		}
 
-		fmt.Println("Genesis created")
-		err = txn.Set(genesis.Hash, genesis.Serialize())
-		handle(err)
+		if err := indexBlock(txn, genesis); err != nil {
+			return err
+		}
+
+		if err := setSchemaVersion(txn, CurrentSchemaVersion); err != nil {
+			return err
+		}
 
 		// set the hash to the last hash
-		err := txn.Set([]byte("lh"), genesis.Hash)
+		err = txn.Set([]byte("lh"), genesis.Hash)
 		lastHash = genesis.Hash
 		return err
 
 	})
-	handle(err)
+	if err != nil {
+		return nil, err
+	}
 
 	//create new block chain in memory
-	blockchain := Blockchain{lastHash, db}
-	return &blockchain
+	blockchain := Blockchain{lastHash: lastHash, Database: db, Config: DefaultChainConfig()}
+	return &blockchain, nil
 }
 
 // Continue continues the blockchain when the coinbase and genesis have already been initialized
-func Continue(nodeID string) *Blockchain {
+func Continue(nodeID string) (*Blockchain, error) {
 	path := fmt.Sprintf(dbPath, nodeID)
 	if !dbExists(path) {
-		fmt.Println("No existing blockchain found, must be initialized first ")
-		runtime.Goexit()
+		return nil, ErrBlockchainNotFound
 	}
 
-	var lastHash []byte
 	opts := badger.DefaultOptions(path)
 	opts.Logger = nil
 	db, err := openDB(path, opts)
-	handle(err)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := ContinueWithStorage(&BadgerStorage{db})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	chain.path = path
+	chain.nodeID = nodeID
+	return chain, nil
+}
+
+// ContinueWithStorage continues the blockchain kept in a storage
+//
+// a database with an older schema version is migrated first. Returns ErrSchemaTooNew when it was written by newer software
+func ContinueWithStorage(db Storage) (*Blockchain, error) {
+	if err := migrateSchema(db, CurrentSchemaVersion); err != nil {
+		return nil, err
+	}
+
+	return loadChain(db)
+}
 
-	err = db.Update(func(txn *badger.Txn) error {
+// loadChain reads the last hash of the chain in the storage, without looking at the schema version
+func loadChain(db Storage) (*Blockchain, error) {
+	var lastHash []byte
+	err := db.View(func(txn StorageTxn) error {
 		item, err := txn.Get([]byte("lh"))
-		handle(err)
-		lastHash = valueHash(item)
-		return nil
+		if err != nil {
+			return err
+		}
+		lastHash, err = valueHash(item)
+		return err
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	chain := Blockchain{lastHash, db}
-	return &chain
+	return &Blockchain{lastHash: lastHash, Database: db, Config: DefaultChainConfig()}, nil
 }
 
-// GetBestHeight retrieves the last (best) height
-func (chain *Blockchain) GetBestHeight() int {
-	var lastBlock Block
+// ReadOnly opens a second, read-only handle to the database of the chain
+//
+// explorers and analytics tools should use the read-only chain so their queries never run on the handle that writes blocks.
+// Badger keeps an exclusive lock on the directory while a writable handle is open, so this fails until the writable chain is closed
+// eg. a block explorer running against the database of a stopped node
+func (chain *Blockchain) ReadOnly() (*Blockchain, error) {
+	// eg. a chain in a MemoryStorage
+	if chain.path == "" {
+		return nil, errors.New("the chain is not stored in a database directory")
+	}
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		// get the last hash
-		item, err := txn.Get([]byte("lh"))
-		handle(err)
-		lastHash := valueHash(item)
+	opts := badger.DefaultOptions(chain.path)
+	opts.Logger = nil
+	opts.ReadOnly = true
+	// never use openDB here, removing the lock file would break the writable handle
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	readOnly, err := ContinueWithStorage(&BadgerStorage{db})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	readOnly.path = chain.path
+	readOnly.nodeID = chain.nodeID
+	readOnly.Config = chain.Config
+	return readOnly, nil
+}
+
+// GetLastHash returns the hash of the last block in the chain
+func (chain *Blockchain) GetLastHash() []byte {
+	chain.mu.RLock()
+	defer chain.mu.RUnlock()
 
-		// last block from the last hash
-		item, err = txn.Get(lastHash)
-		handle(err)
-		lastBlockData := valueHash(item)
+	return chain.lastHash
+}
 
-		lastBlock = *Deserialize(lastBlockData)
+// GetBestHeight retrieves the last (best) height
+func (chain *Blockchain) GetBestHeight() (int, error) {
+	var lastBlock *Block
 
-		return nil
+	err := chain.Database.View(func(txn StorageTxn) error {
+		// get the last block from the last hash
+		var err error
+		lastBlock, err = lastBlockOf(txn)
+		return err
 	})
-	handle(err)
+	if err != nil {
+		return 0, err
+	}
 
 	// return lastblock height
-	return lastBlock.Height
+	return lastBlock.Height, nil
+}
+
+// CountBlocks returns the amount of blocks in the chain. Heights start at zero so this is the best height plus one
+func (chain *Blockchain) CountBlocks() (int, error) {
+	height, err := chain.GetBestHeight()
+	return height + 1, err
+}
+
+// IsEmpty checks whether the chain only contains the genesis block
+func (chain *Blockchain) IsEmpty() (bool, error) {
+	height, err := chain.GetBestHeight()
+	return height == 0, err
 }
 
 // GetBlock retrieves a block based on a block hash from the blockchain
 func (chain *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
-	if err := chain.Database.View(func(txn *badger.Txn) error {
+	if err := chain.Database.View(func(txn StorageTxn) error {
 		item, err := txn.Get(blockHash)
 		if err != nil {
 			return errors.New("Block is not found")
 		}
 
 		// get the block and assign it to the closure
-		blockData := valueHash(item)
-		block = *Deserialize(blockData)
+		b, err := readBlock(item)
+		if err != nil {
+			return err
+		}
+		block = *b
 
 		return nil
 	}); err != nil {
@@ -147,238 +296,1143 @@ func (chain *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
-// GetBlockHashes retrieves all of the block hashes from the blockchain
-func (chain *Blockchain) GetBlockHashes() [][]byte {
-	var blocks [][]byte
-
-	iter := chain.Iterator()
-
-	for {
-		block := iter.Next()
-
-		// adds the block hash
-		blocks = append(blocks, block.Hash)
+// GetBlockByHeight retrieves a block using the height index
+func (chain *Blockchain) GetBlockByHeight(height int) (Block, error) {
+	var block Block
 
-		if len(block.PrevHash) == 0 {
-			break
+	err := chain.Database.View(func(txn StorageTxn) error {
+		item, err := txn.Get(heightKey(height))
+		if err != nil {
+			return fmt.Errorf("no block at height %d", height)
 		}
-	}
-
-	return blocks
-}
-
-// AddBlock takes a block ptr and adds it to the blockchain if it doesn't already exist
-func (chain *Blockchain) AddBlock(block *Block) {
-	err := chain.Database.Update(func(txn *badger.Txn) error {
-		// if the block is already in the db, skip
-		if _, err := txn.Get(block.Hash); err == nil {
-			return nil
+		hash, err := valueHash(item)
+		if err != nil {
+			return err
 		}
 
-		blockData := block.Serialize()
-		// add the block to the db
-		err := txn.Set(block.Hash, blockData)
-		handle(err)
-
-		// get the last hash
-		item, err := txn.Get([]byte("lh"))
-		handle(err)
-		lastHash := valueHash(item)
-
-		// get the last block from the lasthash
-		item, err = txn.Get(lastHash)
-		handle(err)
-		lastBlockData := valueHash(item)
-
-		lastBlock := Deserialize(lastBlockData)
-
-		// compare the block height with the last block height
-		// if it is larger, then set the new block to the last hash
-		if block.Height > lastBlock.Height {
-			err = txn.Set([]byte("lh"), block.Hash)
-			handle(err)
-			chain.LastHash = block.Hash
+		item, err = txn.Get(hash)
+		if err != nil {
+			return errors.New("Block is not found")
+		}
+		b, err := readBlock(item)
+		if err != nil {
+			return err
 		}
+		block = *b
 
 		return nil
 	})
-	handle(err)
-}
 
-// MineBlock adds a block to the block chain.
-// pulls the last hash from the database, creates a new block with the transaction history and the last hash
-// then adds the new block into the database and updates the lasthash key with the latest block
-func (chain *Blockchain) MineBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-	var lastHeight int
+	return block, err
+}
 
-	for _, tx := range transactions {
-		if chain.VerifyTransaction(tx) != true {
-			log.Panic("Invalid Transaction")
-		}
+// GetBlocksByHeightRange retrieves the blocks from one height up to and including another, ordered by height
+//
+// returns ErrInvalidRange when from is below 0 or to is below from, and ErrRangeTooLarge when the range holds more than
+// MaxRangeSize blocks. Heights above the last block and heights that are missing from the index are skipped
+//
+// the height keys are big endian, so badger keeps them sorted by height and the whole range is read with a single scan
+func (chain *Blockchain) GetBlocksByHeightRange(from, to int) ([]*Block, error) {
+	if from < 0 || to < from {
+		return nil, ErrInvalidRange
+	}
+	// to-from+1 would overflow for a range up to the largest int
+	if to-from >= MaxRangeSize {
+		return nil, ErrRangeTooLarge
 	}
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		// get the last hash
-		item, err := txn.Get([]byte("lh"))
-		handle(err)
-		lastHash = valueHash(item)
+	var blocks []*Block
+	last := heightKey(to)
 
-		// use the last hash to get the last block
-		item, err = txn.Get(lastHash)
-		handle(err)
-		lastBlockData := valueHash(item)
+	err := chain.Database.View(func(txn StorageTxn) error {
+		opts := DefaultIteratorOptions
+		opts.Prefix = heightPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
 
-		lastBlock := Deserialize(lastBlockData)
+		for it.Seek(heightKey(from)); it.ValidForPrefix(heightPrefix); it.Next() {
+			// the keys after the last height are outside of the range
+			if bytes.Compare(it.Item().Key(), last) > 0 {
+				break
+			}
 
-		// get the last height from the last block
-		lastHeight = lastBlock.Height
+			hash, err := valueHash(it.Item())
+			if err != nil {
+				return err
+			}
+			item, err := txn.Get(hash)
+			if err != nil {
+				return err
+			}
+			block, err := readBlock(item)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+		}
 
-		return err
+		return nil
 	})
 
-	handle(err)
-
-	// increment the last height in the block
-	newBlock := CreateBlock(transactions, lastHash, lastHeight+1)
+	return blocks, err
+}
 
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		handle(err)
+// Genesis retrieves the genesis block using the height index
+//
+// chains created before the height index existed are iterated until the block without a previous hash is found
+func (chain *Blockchain) Genesis() (*Block, error) {
+	var genesis *Block
 
-		err = txn.Set([]byte("lh"), newBlock.Hash)
+	err := chain.Database.View(func(txn StorageTxn) error {
+		item, err := txn.Get(heightKey(0))
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-		chain.LastHash = newBlock.Hash
+		hash, err := valueHash(item)
+		if err != nil {
+			return err
+		}
 
+		item, err = txn.Get(hash)
+		if err != nil {
+			return errors.New("Genesis block is not found")
+		}
+		genesis, err = readBlock(item)
 		return err
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	handle(err)
-
-	return newBlock
-}
-
-// FindUTXO find all unspent transactions outputs and return a map of unspent transaction outputs organized by transaction id
-func (chain *Blockchain) FindUTXO() map[string]TxOutputs {
-	UTXO := make(map[string]TxOutputs)
-	spentTXOs := make(map[string][]int)
+	if genesis != nil {
+		return genesis, nil
+	}
 
 	iter := chain.Iterator()
-
 	for {
-		// iterate through each block from reverse, starting with the very last unspent transactions and continueing up the chain
-		block := iter.Next()
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if len(block.PrevHash) == 0 {
+			return block, nil
+		}
+	}
+}
 
-		Outputs:
-			// iterate through each output
-			for outIdx, out := range tx.Outputs {
-				// if a transaction id exists in the spent transactions array iterate through the indexes to see if there is a match
-				// if there is a match then we know it's a spent output and we can skip it
-				if spentTXOs[txID] != nil {
-					for _, spentOut := range spentTXOs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
-				}
+// GenesisHash retrieves the hash of the genesis block
+func (chain *Blockchain) GenesisHash() ([]byte, error) {
+	genesis, err := chain.Genesis()
+	if err != nil {
+		return nil, err
+	}
 
-				// take the entire map into the outs variable that matches the transaction id
-				outs := UTXO[txID]
-				// put each output into the txOutputs value of the map
-				outs.Outputs = append(outs.Outputs, out)
-				// put the updated TXoutputs back into the map
-				UTXO[txID] = outs
+	return genesis.Hash, nil
+}
+
+// GetBlockHeaders retrieves the headers of the provided block hashes using a single database transaction
+//
+// hashes of blocks we don't have are skipped, so the result can be shorter than the hashes. Compare the hashes of the
+// headers to find the missing ones
+func (chain *Blockchain) GetBlockHeaders(hashes [][]byte) ([]BlockHeader, error) {
+	headers := make([]BlockHeader, 0, len(hashes))
+
+	if err := chain.Database.View(func(txn StorageTxn) error {
+		for _, hash := range hashes {
+			item, err := txn.Get(hash)
+			if err == ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
 			}
 
-			if !tx.IsCoinbase() {
-				for _, in := range tx.Inputs {
-					inTxID := hex.EncodeToString(in.ID)
-					// inputs reference used outputs by index, so add inputs to the spentTXOs map so we can match them in the next (previous) block
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Out)
-				}
+			// headers are not stored separately, so derive them from the block
+			block, err := readBlock(item)
+			if err != nil {
+				return err
 			}
+			header, err := block.Header()
+			if err != nil {
+				return err
+			}
+			headers = append(headers, header)
 		}
-		if len(block.PrevHash) == 0 {
-			break
-		}
+
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
-	return UTXO
+	return headers, nil
 }
 
-// FindTransaction finds a transaction in the block chain
-func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+// GetBlockHashes retrieves all of the block hashes from the blockchain
+func (chain *Blockchain) GetBlockHashes() ([][]byte, error) {
+	var blocks [][]byte
+
 	iter := chain.Iterator()
 
 	for {
-		block := iter.Next()
-
-		// for each transaction, compare the transaction id with the passed id
-		//
-		// if there is a match. return the transaction
-		for _, tx := range block.Transactions {
-			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
-			}
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
 		}
 
+		// adds the block hash
+		blocks = append(blocks, block.Hash)
+
 		if len(block.PrevHash) == 0 {
 			break
 		}
 	}
 
-	return Transaction{}, errors.New("Transaction does not exist")
+	return blocks, nil
 }
 
-// SignTransaction takes a transaction, collects all tthe previous transactions and signs it
-func (chain *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
+// AddBlock takes a block ptr and adds it to the blockchain if it doesn't already exist
+//
+// a block on top of the last block extends the chain. A block on a fork is stored, and once its fork has more work than the
+// chain the chain is reorganized onto it (see Reorganize). A block whose previous block is unknown goes into the OrphanPool and
+// ErrOrphanBlock is returned, it is added as soon as its previous block is.
+//
+// the work comparison and the last hash update happen while holding the chain lock, so concurrent calls can't interleave
+func (chain *Blockchain) AddBlock(block *Block) error {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
 
-	for _, in := range tx.Inputs {
-		// add each previous transaction to the prvious transaction map
-		prevTX, err := chain.FindTransaction(in.ID)
-		handle(err)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	if err := chain.addBlock(block); err != nil {
+		return err
 	}
 
-	// sign the previous key and previous transactions
-	tx.Sign(privKey, prevTXs)
+	return chain.connectOrphans(block.Hash)
 }
 
-// VerifyTransaction verifies each previous transaction
-func (chain *Blockchain) VerifyTransaction(tx *Transaction) bool {
-	if tx.IsCoinbase() {
-		return true
+// addBlock stores a block and moves the chain onto it when it is the new tip. The chain lock must be held
+//
+// returns ErrTimestampTooFar when the block is too far in the future. A block that breaks the consensus rules, eg. its PoW,
+// height, timestamp, difficulty or a transaction is invalid, is not stored and an error matching ErrInvalidBlock is returned
+func (chain *Blockchain) addBlock(block *Block) error {
+	// a block from the future is refused before it can take a place in the orphan pool
+	if err := checkTimestamp(block, nil); err != nil {
+		return err
 	}
 
-	prevTXs := make(map[string]Transaction)
-
-	for _, in := range tx.Inputs {
-		// add each previous transaction to the prvious transaction map
-		prevTX, err := chain.FindTransaction(in.ID)
-		handle(err)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	// a chain only has one genesis block
+	if len(block.PrevHash) == 0 {
+		if _, err := chain.GetBlock(block.Hash); err == nil {
+			return nil
+		}
+		return errors.New("block has no previous block")
 	}
 
-	// sign the previous key and previous transactions
-	return tx.Verify(prevTXs)
+	// the PoW is checked before the block is stored anywhere, so neither the db nor the orphan pool can be filled for free
+	if err := checkProof(block); err != nil {
+		return invalidBlock{err}
+	}
 
-}
+	var prevBlock *Block
+	known := false
+	err := chain.Database.View(func(txn StorageTxn) error {
+		// if the block is already in the db, skip
+		if _, err := txn.Get(block.Hash); err == nil {
+			known = true
+			return nil
+		}
 
-// valueHash shortcut method to quickly retrieve the hash value from a db item
-func valueHash(item *badger.Item) []byte {
-	var hash []byte
-	err := item.Value(func(val []byte) error {
-		hash = append([]byte{}, val...)
-		return nil
+		prevItem, err := txn.Get(block.PrevHash)
+		if err == ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		prevBlock, err = readBlock(prevItem)
+		return err
 	})
-
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	if known {
+		return nil
 	}
-	return hash
+
+	// the block can't be placed in the chain until its previous block arrives
+	if prevBlock == nil {
+		chain.addOrphan(block)
+		return ErrOrphanBlock
+	}
+	if err := chain.checkParent(block, prevBlock); err != nil {
+		return invalidBlock{err}
+	}
+
+	// the filter isn't part of the PoW, so the one the peer sent can't be trusted
+	block.TxBloom = txBloom(block.Transactions)
+
+	// the block, the indexes and the last hash are written in the same transaction. If any write fails, none of them are committed
+	extended := false
+	err = chain.Database.Update(func(txn StorageTxn) error {
+		lastBlock, err := lastBlockOf(txn)
+		if err != nil {
+			return err
+		}
+
+		// blocks on a fork are only stored, the indexes only hold the blocks of the chain. Their transactions are verified
+		// once the chain moves onto the fork
+		if !bytes.Equal(block.PrevHash, lastBlock.Hash) {
+			return txn.Set(block.Hash, block.Serialize())
+		}
+
+		if err := chain.verifyTransactions(txn, block); err != nil {
+			return invalidBlock{err}
+		}
+		// add the block to the db and index it by its height and transactions
+		if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		if err := indexBlock(txn, block); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("lh"), block.Hash); err != nil {
+			return err
+		}
+		extended = true
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// only update the memory once the transaction is committed
+	metrics.BlocksTotal.Inc()
+	metrics.TransactionsTotal.Add(float64(len(block.Transactions)))
+	if extended {
+		chain.lastHash = block.Hash
+		metrics.ChainHeight.Set(float64(block.Height))
+		return nil
+	}
+
+	// a fork can claim any height, the chain only moves onto it once it has more work. On the same work the first block wins
+	fork, err := chain.forkTo(block)
+	if err != nil {
+		return err
+	}
+	if chainWork(fork.Connected).Cmp(chainWork(fork.Disconnected)) <= 0 {
+		return nil
+	}
+	return chain.reorganize(fork)
+}
+
+// VerifyBlock checks a block before it is added to the chain. Returns an error describing why the block is invalid
+//
+// the PoW and hash must match, the previous block must be known and every transaction must be signed correctly
+func (chain *Blockchain) VerifyBlock(block *Block) error {
+	if err := checkProof(block); err != nil {
+		return err
+	}
+	if err := block.checkTxBloom(); err != nil {
+		return err
+	}
+
+	if err := checkTimestamp(block, nil); err != nil {
+		return err
+	}
+
+	// a chain only has one genesis block
+	if len(block.PrevHash) == 0 {
+		return errors.New("block has no previous block")
+	}
+	prevBlock, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return fmt.Errorf("previous block %x is not in the chain", block.PrevHash)
+	}
+	if err := chain.checkParent(block, &prevBlock); err != nil {
+		return err
+	}
+
+	return chain.Database.View(func(txn StorageTxn) error {
+		return chain.verifyTransactions(txn, block)
+	})
+}
+
+// Verify walks the stored chain from the genesis block to the tip and checks that it is consistent
+//
+// every block must link to the block before it, its hash must match its data, meet the difficulty and every transaction
+// must be signed correctly. Returns an error with the height and hash of the first block that fails
+func (chain *Blockchain) Verify() error {
+	return chain.VerifyWithProgress(nil)
+}
+
+// VerifyWithProgress verifies the chain and calls progress with the height of every block once it passed
+func (chain *Blockchain) VerifyWithProgress(progress func(height int)) error {
+	tip := chain.GetLastHash()
+	iter := chain.ForwardIterator(0)
+
+	var prev *Block
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if block == nil {
+			break
+		}
+
+		if err := chain.verifyStoredBlock(block, prev); err != nil {
+			return fmt.Errorf("block %d (%x): %w", block.Height, block.Hash, err)
+		}
+		if progress != nil {
+			progress(block.Height)
+		}
+		prev = block
+	}
+
+	// the height index has to end at the last hash, otherwise blocks of the chain are missing from it
+	if prev == nil {
+		return errors.New("the chain has no blocks")
+	}
+	if !bytes.Equal(prev.Hash, tip) {
+		return fmt.Errorf("the last block %d (%x) is not the tip of the chain %x", prev.Height, prev.Hash, tip)
+	}
+
+	return nil
+}
+
+// verifyStoredBlock checks a block of the chain against the block before it, prev is nil for the genesis block
+func (chain *Blockchain) verifyStoredBlock(block, prev *Block) error {
+	if prev == nil {
+		if block.Height != 0 || len(block.PrevHash) != 0 {
+			return errors.New("the first block is not a genesis block")
+		}
+	} else {
+		if !bytes.Equal(block.PrevHash, prev.Hash) {
+			return fmt.Errorf("previous hash %x does not match the hash of block %d", block.PrevHash, prev.Height)
+		}
+		if block.Height != prev.Height+1 {
+			return fmt.Errorf("height does not follow the previous block height %d", prev.Height)
+		}
+	}
+
+	if err := checkProof(block); err != nil {
+		return err
+	}
+	// FindTransaction skips the blocks the filter rules out
+	if err := block.checkTxBloom(); err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		valid, err := chain.VerifyTransaction(tx)
+		if err != nil {
+			return fmt.Errorf("transaction %x: %w", tx.ID, err)
+		}
+		if !valid {
+			return fmt.Errorf("transaction %x has an invalid signature", tx.ID)
+		}
+	}
+
+	return nil
+}
+
+// MineBlock adds a block to the block chain.
+// pulls the last hash from the database, creates a new block with the transaction history and the last hash
+// then adds the new block into the database and updates the lasthash key with the latest block
+//
+// the PoW runs on the workers of the optional miner config, without a config it uses DefaultMinerConfig. Returns ErrStaleTip
+// when another block was added while mining
+func (chain *Blockchain) MineBlock(transactions []*Transaction, config ...MinerConfig) (*Block, error) {
+	miner := DefaultMinerConfig()
+	if len(config) > 0 {
+		miner = config[0]
+	}
+
+	return chain.mineBlock(context.Background(), transactions, miner.NumWorkers, nil)
+}
+
+// MineBlockContext adds a block to the blockchain like MineBlock. The PoW stops and ctx.Err() is returned when the context is cancelled
+//
+// eg. a miner cancels the context when a peer sends a block for the same height, the block being mined would be stale
+func (chain *Blockchain) MineBlockContext(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	return chain.mineBlock(ctx, transactions, 1, nil)
+}
+
+// MineBlockWithProgress adds a block to the blockchain like MineBlockContext and calls progress every 10,000 nonces with the latest hash
+//
+// a nil progress func keeps the default output of the PoW
+func (chain *Blockchain) MineBlockWithProgress(ctx context.Context, transactions []*Transaction, progress func(nonce int, hash []byte)) (*Block, error) {
+	return chain.mineBlock(ctx, transactions, 1, progress)
+}
+
+// MineBlockWithTimeout adds a block to the blockchain like MineBlock, but abandons the PoW when it runs longer than the timeout
+func (chain *Blockchain) MineBlockWithTimeout(transactions []*Transaction, timeout time.Duration) (*Block, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	block, err := chain.mineBlock(ctx, transactions, 1, nil)
+	if err == context.DeadlineExceeded {
+		return nil, ErrMiningTimeout
+	}
+
+	return block, err
+}
+
+// mineBlock mines and stores a new block, the PoW stops when the context is cancelled. More than 1 worker runs the PoW in parallel
+func (chain *Blockchain) mineBlock(ctx context.Context, transactions []*Transaction, workers int, progress func(nonce int, hash []byte)) (*Block, error) {
+	var lastHash []byte
+	var lastHeight int
+
+	if len(transactions) == 0 {
+		return nil, ErrNoTransactions
+	}
+
+	for _, tx := range transactions {
+		valid, err := chain.VerifyTransaction(tx)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return nil, fmt.Errorf("transaction %x is invalid", tx.ID)
+		}
+	}
+
+	err := chain.Database.View(func(txn StorageTxn) error {
+		// use the last hash to get the last block
+		lastBlock, err := lastBlockOf(txn)
+		if err != nil {
+			return err
+		}
+
+		// get the last hash and height from the last block
+		lastHash = lastBlock.Hash
+		lastHeight = lastBlock.Height
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// transactions that are still locked can't be part of the new block
+	now := time.Now().Unix()
+	for _, tx := range transactions {
+		if !tx.IsMatured(lastHeight+1, now) {
+			return nil, fmt.Errorf("transaction %x is locked until %d", tx.ID, tx.LockTime)
+		}
+	}
+
+	// increment the last height in the block
+	difficulty, err := chain.difficultyAfter(lastHash, chain.Config.RetargetWindow)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	newBlock, err := createBlock(ctx, transactions, lastHash, lastHeight+1, difficulty, workers, progress)
+	metrics.MineDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	err = chain.Database.Update(func(txn StorageTxn) error {
+		// the PoW runs without the lock, a block received in the meantime already took the height
+		lastBlock, err := lastBlockOf(txn)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(lastBlock.Hash, lastHash) {
+			return ErrStaleTip
+		}
+
+		if err := txn.Set(newBlock.Hash, newBlock.Serialize()); err != nil {
+			return err
+		}
+
+		if err := indexBlock(txn, newBlock); err != nil {
+			return err
+		}
+
+		return txn.Set([]byte("lh"), newBlock.Hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// only update the memory once the transaction is committed
+	chain.lastHash = newBlock.Hash
+	metrics.BlocksTotal.Inc()
+	metrics.TransactionsTotal.Add(float64(len(newBlock.Transactions)))
+	metrics.ChainHeight.Set(float64(newBlock.Height))
+
+	return newBlock, nil
+}
+
+// FindUTXO find all unspent transactions outputs and return a map of unspent transaction outputs organized by transaction id
+func (chain *Blockchain) FindUTXO() (map[string]TxOutputs, error) {
+	UTXO := make(map[string]TxOutputs)
+	spentTXOs := make(map[string][]int)
+
+	iter := chain.Iterator()
+
+	for {
+		// iterate through each block from reverse, starting with the very last unspent transactions and continueing up the chain
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range block.Transactions {
+			txID := hex.EncodeToString(tx.ID)
+
+		Outputs:
+			// iterate through each output
+			for outIdx, out := range tx.Outputs {
+				// data outputs can't be spent, so they are never unspent either
+				if out.IsData() {
+					continue
+				}
+
+				// if a transaction id exists in the spent transactions array iterate through the indexes to see if there is a match
+				// if there is a match then we know it's a spent output and we can skip it
+				if spentTXOs[txID] != nil {
+					for _, spentOut := range spentTXOs[txID] {
+						if spentOut == outIdx {
+							continue Outputs
+						}
+					}
+				}
+
+				// take the entire map into the outs variable that matches the transaction id
+				outs := UTXO[txID]
+				outs.Height = block.Height
+				// put each output into the txOutputs value of the map
+				out.FromCoinbase = tx.IsCoinbase()
+				outs.add(out, outIdx)
+				// put the updated TXoutputs back into the map
+				UTXO[txID] = outs
+			}
+
+			if !tx.IsCoinbase() {
+				for _, in := range tx.Inputs {
+					inTxID := hex.EncodeToString(in.ID)
+					// inputs reference used outputs by index, so add inputs to the spentTXOs map so we can match them in the next (previous) block
+					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Out)
+				}
+			}
+		}
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return UTXO, nil
+}
+
+// FindUTXOForInputs finds the outputs referenced by a list of inputs, organized by transaction id
+//
+// unlike FindUTXO it stops iterating as soon as every referenced transaction has been found.
+// The outputs keep their original index so they can be looked up with the input's Out field
+func (chain *Blockchain) FindUTXOForInputs(inputs []TxInput) (map[string]TxOutputs, error) {
+	UTXO := make(map[string]TxOutputs)
+	spentTXOs := make(map[string][]int)
+
+	// collect the transaction ids we need to find
+	wanted := make(map[string]bool)
+	for _, in := range inputs {
+		wanted[hex.EncodeToString(in.ID)] = true
+	}
+
+	iter := chain.Iterator()
+
+	for len(wanted) > 0 {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range block.Transactions {
+			txID := hex.EncodeToString(tx.ID)
+
+			if wanted[txID] {
+				UTXO[txID] = TxOutputs{Outputs: tx.Outputs, Height: block.Height}
+				delete(wanted, txID)
+			}
+
+			// outputs spent in newer blocks are no longer unspent
+			if !tx.IsCoinbase() {
+				for _, in := range tx.Inputs {
+					inTxID := hex.EncodeToString(in.ID)
+					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Out)
+				}
+			}
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	for _, in := range inputs {
+		txID := hex.EncodeToString(in.ID)
+
+		outs, ok := UTXO[txID]
+		if !ok || in.Out < 0 || in.Out >= len(outs.Outputs) {
+			return nil, ErrInputNotFound(txID)
+		}
+
+		for _, spentOut := range spentTXOs[txID] {
+			if spentOut == in.Out {
+				return nil, ErrInputNotFound(txID)
+			}
+		}
+	}
+
+	return UTXO, nil
+}
+
+// GetAddressTransactions finds every transaction that spends from or pays to the address, ordered by height
+//
+// every block of the chain is read, there is no index of the addresses yet
+func (chain *Blockchain) GetAddressTransactions(address string) ([]*Transaction, error) {
+	if _, err := wallet.ValidateAddress(address); err != nil {
+		return nil, err
+	}
+	_, pubKeyHash, _, err := wallet.AddressToComponents(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var txs []*Transaction
+	iter := chain.ForwardIterator(0)
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			break
+		}
+
+		for _, tx := range block.Transactions {
+			if tx.involves(pubKeyHash) {
+				txs = append(txs, tx)
+			}
+		}
+	}
+
+	return txs, nil
+}
+
+// involves checks if the transaction spends an output of the key hash or creates one
+func (tx *Transaction) involves(pubKeyHash []byte) bool {
+	for _, out := range tx.Outputs {
+		if out.IsLockedWithKey(pubKeyHash) {
+			return true
+		}
+	}
+
+	// the input of a coinbase carries data instead of a key
+	if tx.IsCoinbase() {
+		return false
+	}
+	for _, in := range tx.Inputs {
+		if in.UsesKey(pubKeyHash) {
+			return true
+		}
+		// inputs that spend a multi signature output carry the keys with their signatures
+		for _, sig := range in.MultiSig {
+			if bytes.Equal(wallet.PublicKeyHash(sig.PubKey), pubKeyHash) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FindTransaction finds a transaction in the block chain
+func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+	// look up the block in the transaction index first
+	var blockHash []byte
+	err := chain.Database.View(func(txn StorageTxn) error {
+		item, err := txn.Get(txKey(ID))
+		if err != nil {
+			return err
+		}
+		blockHash, err = valueHash(item)
+		return err
+	})
+	if err == nil {
+		if block, err := chain.GetBlock(blockHash); err == nil {
+			for _, tx := range block.Transactions {
+				if bytes.Equal(tx.ID, ID) {
+					return *tx, nil
+				}
+			}
+		}
+	}
+
+	// blocks stored before the transaction index existed are only found by scanning the chain
+	iter := chain.Iterator()
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return Transaction{}, err
+		}
+
+		// skip the block when the bloom filter rules the transaction out
+		if !block.MayContainTx(ID) {
+			if len(block.PrevHash) == 0 {
+				break
+			}
+			continue
+		}
+
+		// for each transaction, compare the transaction id with the passed id
+		//
+		// if there is a match. return the transaction
+		for _, tx := range block.Transactions {
+			if bytes.Compare(tx.ID, ID) == 0 {
+				return *tx, nil
+			}
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return Transaction{}, errors.New("Transaction does not exist")
+}
+
+// TxFee calculates the fee of a transaction, the value of the spent outputs that is not sent to any output
+func (chain *Blockchain) TxFee(tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	utxoSet, err := NewUTXOSet(chain)
+	if err != nil {
+		return 0, err
+	}
+
+	in := 0
+	for _, input := range tx.Inputs {
+		// spent outputs are no longer in the UTXO set, so look them up in the chain
+		out, ok, err := utxoSet.FindOutput(input.ID, input.Out)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			prevTX, err := chain.FindTransaction(input.ID)
+			if err != nil {
+				return 0, err
+			}
+			if input.Out < 0 || input.Out >= len(prevTX.Outputs) {
+				return 0, fmt.Errorf("transaction %x has no output %d", input.ID, input.Out)
+			}
+			out = prevTX.Outputs[input.Out]
+		}
+		in += out.Value
+	}
+
+	out := 0
+	for _, output := range tx.Outputs {
+		out += output.Value
+	}
+
+	if out > in {
+		return 0, fmt.Errorf("transaction %x spends more than its inputs", tx.ID)
+	}
+
+	return in - out, nil
+}
+
+// TotalFees adds up the fees of the transactions, eg. to pay the miner of a block
+func (chain *Blockchain) TotalFees(txs []*Transaction) (int, error) {
+	total := 0
+	for _, tx := range txs {
+		fee, err := chain.TxFee(tx)
+		if err != nil {
+			return 0, err
+		}
+		total += fee
+	}
+
+	return total, nil
+}
+
+// FeeRate calculates the fee of a transaction per byte of its serialized size. Miners prefer the transactions with the highest rate
+func (chain *Blockchain) FeeRate(tx *Transaction) (float64, error) {
+	fee, err := chain.TxFee(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := tx.Serialize()
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(fee) / float64(len(data)), nil
+}
+
+// SpendingTransaction finds the transaction that spends an output. It is the inverse of FindTransaction
+func (chain *Blockchain) SpendingTransaction(txID []byte, outIdx int) (*Transaction, error) {
+	iter := chain.Iterator()
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		created := false
+
+		// compare each input with the output, the first match is the spending transaction
+		for _, tx := range block.Transactions {
+			if bytes.Compare(tx.ID, txID) == 0 {
+				created = true
+			}
+
+			for _, in := range tx.Inputs {
+				if bytes.Compare(in.ID, txID) == 0 && in.Out == outIdx {
+					return tx, nil
+				}
+			}
+		}
+
+		// the output can only be spent after it was created, there is no need to look at older blocks
+		if created || len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return nil, errors.New("Output is not spent")
+}
+
+// SignTransaction takes a transaction, collects all tthe previous transactions and signs it
+func (chain *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
+	prevTXs := make(map[string]Transaction)
+
+	for _, in := range tx.Inputs {
+		// add each previous transaction to the prvious transaction map
+		prevTX, err := chain.FindTransaction(in.ID)
+		if err != nil {
+			return err
+		}
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
+
+	// sign the previous key and previous transactions
+	return tx.Sign(privKey, prevTXs)
+}
+
+// SignMultiSig signs the inputs of a transaction that spend multi signature outputs
+//
+// every key signs the inputs whose output it is part of, keys that aren't part of an output are skipped.
+// The keys don't need to sign at once, another party can add its signatures to the transaction later
+func SignMultiSig(tx *Transaction, privKeys []ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
+	if tx.IsSealed() {
+		return errors.New("cannot sign a sealed transaction")
+	}
+
+	hash, err := tx.unsignedHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(tx.ID, hash) {
+		return errors.New("transaction is corrupted, the ID does not match the hash")
+	}
+
+	for inID, in := range tx.Inputs {
+		prevTX, ok := prevTXs[hex.EncodeToString(in.ID)]
+		if !ok || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return errors.New("the previous transaction does not exist")
+		}
+
+		prevOut := prevTX.Outputs[in.Out]
+		if !prevOut.IsMultiSig() {
+			continue
+		}
+
+		data, err := tx.multiSigData(inID, prevOut)
+		if err != nil {
+			return err
+		}
+		for _, privKey := range privKeys {
+			keyType, ok := keyTypeOf(privKey)
+			if !ok {
+				return errors.New("the private key uses an unknown curve")
+			}
+
+			pubKey := wallet.PublicKeyBytes(&privKey.PublicKey)
+			if prevOut.keyIndex(wallet.PublicKeyHash(pubKey)) == -1 || tx.Inputs[inID].signedBy(pubKey) {
+				continue
+			}
+
+			r, s, err := ecdsa.Sign(rand.Reader, &privKey, data)
+			if err != nil {
+				return err
+			}
+			signature := signatureBytes(privKey.Curve, r, s)
+
+			tx.Inputs[inID].MultiSig = append(tx.Inputs[inID].MultiSig, MultiSigSignature{pubKey, keyType, signature})
+		}
+	}
+
+	return nil
+}
+
+// keyTypeOf finds the key type of the curve of a private key
+func keyTypeOf(privKey ecdsa.PrivateKey) (byte, bool) {
+	for _, keyType := range []byte{wallet.KeyTypeP256, wallet.KeyTypeSecp256k1} {
+		if privKey.Curve.Params().Name == wallet.Curve(keyType).Params().Name {
+			return keyType, true
+		}
+	}
+	return 0, false
+}
+
+// VerifyTransaction verifies each previous transaction
+//
+// the referenced outputs are looked up in the UTXO set first, then through the transaction index. The chain is only scanned
+// for blocks stored before the index existed. Returns ErrImmatureCoinbase when a coinbase output wouldn't have
+// CoinbaseMaturity confirmations in the next block
+func (chain *Blockchain) VerifyTransaction(tx *Transaction) (bool, error) {
+	if tx.IsCoinbase() {
+		return true, nil
+	}
+	if err := checkDataOutputs(tx); err != nil {
+		return false, err
+	}
+
+	prevTXs := make(map[string]Transaction)
+	utxoSet, err := NewUTXOSet(chain)
+	if err != nil {
+		return false, err
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return false, err
+	}
+
+	for _, in := range tx.Inputs {
+		txID := hex.EncodeToString(in.ID)
+
+		// only the referenced output is needed to verify, so rebuild a partial previous transaction from the UTXO set
+		out, height, ok, err := utxoSet.findOutput(in.ID, in.Out)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			err = chain.Database.View(func(txn StorageTxn) error {
+				out, height, err = spentOutput(txn, in)
+				return err
+			})
+			ok = err == nil
+		}
+		if ok {
+			if !isMature(out, height, bestHeight+1) {
+				return false, fmt.Errorf("%w: output %d of transaction %x", ErrImmatureCoinbase, in.Out, in.ID)
+			}
+			prevTX := prevTXs[txID]
+			prevTX.ID = in.ID
+			for len(prevTX.Outputs) <= in.Out {
+				prevTX.Outputs = append(prevTX.Outputs, TxOutput{})
+			}
+			prevTX.Outputs[in.Out] = out
+			prevTXs[txID] = prevTX
+			continue
+		}
+
+		// add each previous transaction to the prvious transaction map
+		prevTX, err := chain.FindTransaction(in.ID)
+		if err != nil {
+			return false, err
+		}
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
+
+	// sign the previous key and previous transactions
+	return tx.Verify(prevTXs), nil
+}
+
+// ErrInputNotFound is returned when the output an input references can't be found or is already spent
+type ErrInputNotFound string
+
+func (e ErrInputNotFound) Error() string {
+	return fmt.Sprintf("input %s not found", string(e))
+}
+
+// indexBlock writes the height and transaction index entries of a block
+func indexBlock(txn StorageTxn, block *Block) error {
+	if err := txn.Set(heightKey(block.Height), block.Hash); err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		if err := txn.Set(txKey(tx.ID), block.Hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// txKey creates the transaction index key of a transaction id
+func txKey(id []byte) []byte {
+	return append(append([]byte{}, txPrefix...), hex.EncodeToString(id)...)
+}
+
+// heightKey creates the height index key of a block height
+func heightKey(height int) []byte {
+	return append(append([]byte{}, heightPrefix...), ToHex(int64(height))...)
+}
+
+// lastBlockOf reads the block the last hash points to
+func lastBlockOf(txn StorageTxn) (*Block, error) {
+	item, err := txn.Get([]byte("lh"))
+	if err != nil {
+		return nil, err
+	}
+	lastHash, err := valueHash(item)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err = txn.Get(lastHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return readBlock(item)
+}
+
+// readBlock deserializes the block stored in a db item
+func readBlock(item StorageItem) (*Block, error) {
+	data, err := valueHash(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return Deserialize(data)
+}
+
+// valueHash shortcut method to quickly retrieve the hash value from a db item
+func valueHash(item StorageItem) ([]byte, error) {
+	var hash []byte
+	err := item.Value(func(val []byte) error {
+		hash = append([]byte{}, val...)
+		return nil
+	})
+
+	return hash, err
 }
 
 // retry if we corrupt the data in the database, we can retrieve the data and rebuild
@@ -403,10 +1457,10 @@ func openDB(dir string, opts badger.Options) (*badger.DB, error) {
 	if err != nil {
 		if strings.Contains(err.Error(), "LOCK") {
 			if db, err := retry(dir, opts); err == nil {
-				log.Println("database unlocked, value log truncated")
+				slog.Info("Database unlocked, value log truncated", "dir", dir)
 				return db, nil
 			}
-			log.Println("could not unlock database:", err)
+			slog.Error("Could not unlock the database", "dir", dir, "err", err)
 		}
 		return nil, err
 	}
@@ -0,0 +1,471 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// blockOn creates a block with a fresh coinbase on top of prev
+func blockOn(t *testing.T, prev *Block, address string) *Block {
+	t.Helper()
+
+	coinbase, err := CoinbaseTx(address, "", prev.Height+1, 0)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	block, err := CreateBlock([]*Transaction{coinbase}, prev.Hash, prev.Height+1, Difficulty)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	return block
+}
+
+// run with go test -race, the test only fails on its own when the chain ends up in a wrong state
+func TestAddBlockAndGetBestHeightConcurrently(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	// every goroutine adds a block on top of the genesis block and then one on top of its own block
+	const goroutines = 10
+	var wg sync.WaitGroup
+	tips := make([][]byte, goroutines)
+	errs := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			genesis, err := chain.Genesis()
+			if err != nil {
+				errs <- err
+				return
+			}
+			prev := genesis
+			for height := 1; height <= 2; height++ {
+				block := blockOn(t, prev, address)
+				if block == nil {
+					return
+				}
+				if err := chain.AddBlock(block); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := chain.GetBestHeight(); err != nil {
+					errs <- err
+					return
+				}
+				prev = block
+			}
+			tips[i] = prev.Hash
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 2 {
+		t.Errorf("best height %d, want 2", height)
+	}
+
+	// the last hash has to be the tip of one of the branches at that height
+	last := chain.GetLastHash()
+	found := false
+	for _, tip := range tips {
+		found = found || bytes.Equal(tip, last)
+	}
+	if !found {
+		t.Errorf("the last hash %x is none of the tips", last)
+	}
+}
+
+// storeTip stores a block without validating it and makes it the tip of the chain
+func storeTip(t testing.TB, chain *Blockchain, block *Block) {
+	t.Helper()
+
+	storeBlock(t, chain, block)
+	if err := chain.Database.Update(func(txn StorageTxn) error {
+		return txn.Set([]byte("lh"), block.Hash)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	chain.mu.Lock()
+	chain.lastHash = block.Hash
+	chain.mu.Unlock()
+}
+
+// matureGenesis stores CoinbaseMaturity-1 blocks on top of the genesis block without validating them, the next block can
+// spend the genesis coinbase
+func matureGenesis(t *testing.T, chain *Blockchain, address string) {
+	t.Helper()
+
+	prev, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := 1; height < CoinbaseMaturity; height++ {
+		coinbase, err := CoinbaseTx(address, "", height, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := CreateBlock([]*Transaction{coinbase}, prev.Hash, height, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storeTip(t, chain, block)
+		prev = block
+	}
+}
+
+// signedBlock mines a block on top of the tip with a coinbase and a transaction of the wallet that spends the genesis coinbase.
+// change is applied to the signed transaction before the block is mined
+func signedBlock(t *testing.T, chain *Blockchain, w *wallet.Wallet, change func(tx *Transaction)) *Block {
+	t.Helper()
+
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := chain.GetBlock(chain.GetLastHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spend := signedSpend(t, w, genesis.Transactions[0])
+	if change != nil {
+		change(spend)
+	}
+	coinbase, err := CoinbaseTx(string(w.Address()), "", last.Height+1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := CreateBlock([]*Transaction{coinbase, spend}, last.Hash, last.Height+1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestVerifyAcceptsAValidChain(t *testing.T) {
+	w := wallet.MakeWallet()
+	chain, closeChain, err := NewTestChain(string(w.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	matureGenesis(t, chain, string(w.Address()))
+	storeTip(t, chain, signedBlock(t, chain, w, nil))
+
+	var verified []int
+	if err := chain.VerifyWithProgress(func(height int) { verified = append(verified, height) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(verified) != CoinbaseMaturity+1 {
+		t.Errorf("verified %d heights, want 0 to %d", len(verified), CoinbaseMaturity)
+	}
+}
+
+func TestVerifyRejectsACorruptedChain(t *testing.T) {
+	w := wallet.MakeWallet()
+
+	tests := map[string]func(t *testing.T, chain *Blockchain) *Block{
+		// the block is mined correctly, but its transaction was changed after it was signed
+		"changed transaction": func(t *testing.T, chain *Blockchain) *Block {
+			return signedBlock(t, chain, w, func(tx *Transaction) {
+				tx.Outputs[0].PubKeyHash = wallet.MakeWallet().PubKeyHash()
+				hashTx(t, tx)
+			})
+		},
+		// the block was changed after it was mined
+		"changed block": func(t *testing.T, chain *Blockchain) *Block {
+			block := signedBlock(t, chain, w, nil)
+			block.Transactions[1].Outputs[0].Value++
+			return block
+		},
+		// the block doesn't link to the block before it
+		"broken link": func(t *testing.T, chain *Blockchain) *Block {
+			block := signedBlock(t, chain, w, nil)
+			block.PrevHash = []byte("unknown block")
+			return block
+		},
+	}
+
+	for name, corrupt := range tests {
+		t.Run(name, func(t *testing.T) {
+			chain, closeChain, err := NewTestChain(string(w.Address()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeChain()
+
+			matureGenesis(t, chain, string(w.Address()))
+			block := corrupt(t, chain)
+			storeTip(t, chain, block)
+
+			err = chain.Verify()
+			if err == nil {
+				t.Fatal("the corrupted chain verifies")
+			}
+			if want := fmt.Sprintf("block %d (%x)", CoinbaseMaturity, block.Hash); !strings.HasPrefix(err.Error(), want) {
+				t.Errorf("Verify returned %q, want an error for %s", err, want)
+			}
+		})
+	}
+}
+
+func TestMineBlockRejectsAStaleTip(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := blockOn(t, genesis, address)
+	coinbase, err := CoinbaseTx(address, "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a peer's block for the same height arrives while the PoW runs
+	var once sync.Once
+	mined, err := chain.MineBlockWithProgress(context.Background(), []*Transaction{coinbase}, func(int, []byte) {
+		once.Do(func() {
+			if err := chain.AddBlock(received); err != nil {
+				t.Error(err)
+			}
+		})
+	})
+	if !errors.Is(err, ErrStaleTip) {
+		t.Fatalf("MineBlockWithProgress returned %v, want ErrStaleTip", err)
+	}
+	if mined != nil {
+		t.Error("the stale block was returned")
+	}
+	if !bytes.Equal(chain.GetLastHash(), received.Hash) {
+		t.Error("the received block is not the tip")
+	}
+}
+
+// errKilled is returned by killedStorage in place of the write the node was killed at
+var errKilled = errors.New("the node was killed")
+
+// killedStorage closes the Badger database in the middle of an Update once killAfter writes were made, like a node that is
+// killed while it writes a block. A negative killAfter only counts the writes
+type killedStorage struct {
+	*BadgerStorage
+	killAfter int
+	writes    int
+}
+
+func (s *killedStorage) Update(fn func(txn StorageTxn) error) error {
+	return s.BadgerStorage.Update(func(txn StorageTxn) error {
+		return fn(killedTxn{txn, s})
+	})
+}
+
+type killedTxn struct {
+	StorageTxn
+	storage *killedStorage
+}
+
+func (t killedTxn) Set(key, value []byte) error {
+	if t.storage.writes == t.storage.killAfter {
+		t.storage.DB.Close()
+		return errKilled
+	}
+	t.storage.writes++
+	return t.StorageTxn.Set(key, value)
+}
+
+func TestAddBlockWritesNothingWhenTheNodeIsKilled(t *testing.T) {
+	if raceEnabled {
+		t.Skip("Badger is left out when the tests run with the race detector")
+	}
+
+	open := func(dir string) *BadgerStorage {
+		t.Helper()
+		opts := badger.DefaultOptions(dir)
+		opts.Logger = nil
+		db, err := openDB(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &BadgerStorage{db}
+	}
+	address := string(wallet.MakeWallet().Address())
+
+	// addBlock adds a block on top of the genesis block of a new chain and kills the node after killAfter writes. Returns the
+	// directory of the chain and the block
+	addBlock := func(killAfter int) (string, *Block, *killedStorage, error) {
+		t.Helper()
+		dir := t.TempDir()
+		db := open(dir)
+		chain, err := InitWithStorage(db, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		genesis, err := chain.Genesis()
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := blockOn(t, genesis, address)
+		db.Close()
+
+		killed := &killedStorage{BadgerStorage: open(dir), killAfter: killAfter}
+		if chain, err = ContinueWithStorage(killed); err != nil {
+			t.Fatal(err)
+		}
+		killed.writes = 0
+		return dir, block, killed, chain.AddBlock(block)
+	}
+
+	_, _, counted, err := addBlock(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted.Close()
+	// the block, its height, its coinbase and the last hash
+	if counted.writes < 4 {
+		t.Fatalf("AddBlock made %d writes, want at least 4", counted.writes)
+	}
+
+	for killAfter := 0; killAfter < counted.writes; killAfter++ {
+		dir, block, _, err := addBlock(killAfter)
+		if !errors.Is(err, errKilled) {
+			t.Fatalf("killed after %d writes: AddBlock returned %v, want errKilled", killAfter, err)
+		}
+
+		// on restart the chain still ends with the genesis block, and no index points to the block
+		db := open(dir)
+		chain, err := ContinueWithStorage(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height, err := chain.GetBestHeight(); err != nil || height != 0 {
+			t.Errorf("killed after %d writes: best height %d, %v, want 0", killAfter, height, err)
+		}
+		if !bytes.Equal(chain.GetLastHash(), block.PrevHash) {
+			t.Errorf("killed after %d writes: the last hash moved", killAfter)
+		}
+		if _, err := chain.GetBlock(block.Hash); err == nil {
+			t.Errorf("killed after %d writes: the block was stored", killAfter)
+		}
+		if _, err := chain.GetBlockByHeight(1); err == nil {
+			t.Errorf("killed after %d writes: height 1 is indexed", killAfter)
+		}
+		if _, err := chain.FindTransaction(block.Transactions[0].ID); err == nil {
+			t.Errorf("killed after %d writes: the coinbase is indexed", killAfter)
+		}
+
+		// the restarted node can add the block again
+		if err := chain.AddBlock(block); err != nil {
+			t.Errorf("killed after %d writes: adding the block after the restart returned %v", killAfter, err)
+		} else if stored, err := chain.GetBlockByHeight(1); err != nil || !bytes.Equal(stored.Hash, block.Hash) {
+			t.Errorf("killed after %d writes: height 1 is not the block after the restart, %v", killAfter, err)
+		}
+		db.Close()
+	}
+}
+
+func TestGetAddressTransactionsReturnsTheHistoryInOrder(t *testing.T) {
+	owner, other := wallet.MakeWallet(), wallet.MakeWallet()
+	address := string(owner.Address())
+	chain, closeChain, err := NewTestChain(string(other.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	coinbase := func(to *wallet.Wallet, height int) *Transaction {
+		tx, err := CoinbaseTx(string(to.Address()), "", height, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	// payment from other to the owner, it spends an output that isn't in the chain but the history doesn't check that
+	payment := &Transaction{
+		Inputs:  []TxInput{{ID: []byte("unknown"), Out: 0, PubKey: other.PublicKey, KeyType: other.KeyType}},
+		Outputs: []TxOutput{{Value: 5, PubKeyHash: owner.PubKeyHash()}},
+	}
+	hashTx(t, payment)
+
+	first := coinbase(owner, 1)
+	third := coinbase(owner, 3)
+	// the transactions of the owner are marked with true
+	blocks := [][]struct {
+		tx    *Transaction
+		owner bool
+	}{
+		{{first, true}, {signedSpend(t, owner, first), true}, {signedSpend(t, other, coinbase(other, 0)), false}},
+		{{coinbase(other, 2), false}, {payment, true}},
+		{{third, true}, {signedSpend(t, owner, third), true}},
+	}
+
+	prev, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want [][]byte
+	for i, txs := range blocks {
+		var blockTxs []*Transaction
+		for _, tx := range txs {
+			blockTxs = append(blockTxs, tx.tx)
+			if tx.owner {
+				want = append(want, tx.tx.ID)
+			}
+		}
+		block, err := CreateBlock(blockTxs, prev.Hash, i+1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storeTip(t, chain, block)
+		prev = block
+	}
+
+	history, err := chain.GetAddressTransactions(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 5 {
+		t.Fatalf("%d transactions in the history, want 5", len(history))
+	}
+	for i, tx := range history {
+		if !bytes.Equal(tx.ID, want[i]) {
+			t.Errorf("transaction %d of the history is %x, want %x", i, tx.ID, want[i])
+		}
+	}
+
+	if history, err := chain.GetAddressTransactions(string(wallet.MakeWallet().Address())); err != nil || len(history) != 0 {
+		t.Errorf("a new address has %d transactions, %v", len(history), err)
+	}
+	if _, err := chain.GetAddressTransactions("invalid"); err == nil {
+		t.Error("returned the history of an invalid address")
+	}
+}
@@ -0,0 +1,119 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+)
+
+const (
+	// amount of hash functions used by the bloom filter
+	bloomHashes = 3
+	// bits per item. With 3 hash functions this keeps the false positive rate below 0.1%
+	bloomBitsPerItem = 29
+	// the smallest filter we create, in bytes
+	bloomMinBytes = 8
+)
+
+// BloomConfig sets the size of a bloom filter that is not sized by its items, like the one of the UTXO set
+type BloomConfig struct {
+	// the amount of bits in the filter, rounded up to whole bytes
+	Bits int
+	// the amount of hash functions, each item sets this many bits
+	Hashes int
+}
+
+// DefaultBloomConfig returns 64k bits (8 KB) and 3 hash functions. Keeps the false positive rate below 0.01% for a thousand items
+func DefaultBloomConfig() BloomConfig {
+	return BloomConfig{Bits: 1 << 16, Hashes: 3}
+}
+
+// NewBloomFilterWithConfig creates an empty filter with the amount of bits of the config
+func NewBloomFilterWithConfig(config BloomConfig) BloomFilter {
+	size := (config.Bits + 7) / 8
+	if size < bloomMinBytes {
+		size = bloomMinBytes
+	}
+
+	return make(BloomFilter, size)
+}
+
+// BloomFilter is a probabilistic set. It can tell us that an item is definitely not in the set, or that it might be
+//
+// each item sets 3 bits in the filter. If any of those bits is not set when testing an item, the item was never added
+type BloomFilter []byte
+
+// NewBloomFilter creates a filter sized for the amount of items
+func NewBloomFilter(items int) BloomFilter {
+	size := (items*bloomBitsPerItem + 7) / 8
+	if size < bloomMinBytes {
+		size = bloomMinBytes
+	}
+
+	return make(BloomFilter, size)
+}
+
+// Add adds an item to the filter
+func (f BloomFilter) Add(item []byte) {
+	f.add(item, bloomHashes)
+}
+
+// add adds an item by setting the bits of the given amount of hash functions
+func (f BloomFilter) add(item []byte, hashes int) {
+	for _, bit := range f.positions(item, hashes) {
+		f[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// MayContain tests if an item might be in the filter. An empty filter can't rule anything out
+func (f BloomFilter) MayContain(item []byte) bool {
+	return f.mayContain(item, bloomHashes)
+}
+
+// mayContain tests an item with the given amount of hash functions, it has to be the same amount the items were added with
+func (f BloomFilter) mayContain(item []byte, hashes int) bool {
+	if len(f) == 0 {
+		return true
+	}
+
+	for _, bit := range f.positions(item, hashes) {
+		if f[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// falsePositiveRate estimates the chance that an item that was never added passes the filter
+//
+// every hash function has to hit a set bit, so the rate is the share of set bits to the power of the hash functions
+func (f BloomFilter) falsePositiveRate(hashes int) float64 {
+	if len(f) == 0 {
+		return 1
+	}
+
+	set := 0
+	for _, b := range f {
+		for ; b != 0; b &= b - 1 {
+			set++
+		}
+	}
+
+	return math.Pow(float64(set)/float64(len(f)*8), float64(hashes))
+}
+
+// positions calculates the bits of an item by combining 2 halves of its hash (double hashing)
+func (f BloomFilter) positions(item []byte, hashes int) []uint64 {
+	hash := sha256.Sum256(item)
+	h1 := binary.BigEndian.Uint64(hash[0:8])
+	h2 := binary.BigEndian.Uint64(hash[8:16])
+
+	bits := uint64(len(f)) * 8
+	positions := make([]uint64, hashes)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % bits
+	}
+
+	return positions
+}
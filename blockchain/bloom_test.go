@@ -0,0 +1,179 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// randomKeyHash a key hash that no wallet of the test owns
+func randomKeyHash(tb testing.TB) []byte {
+	tb.Helper()
+
+	hash := make([]byte, 20)
+	if _, err := rand.Read(hash); err != nil {
+		tb.Fatal(err)
+	}
+	return hash
+}
+
+// utxoSetOfSize creates a UTXO set that holds the genesis coinbase and n outputs, each one paying another key hash
+func utxoSetOfSize(tb testing.TB, n int) (*UTXOSet, func()) {
+	tb.Helper()
+
+	chain, closeChain, err := NewTestChain(string(wallet.MakeWallet().Address()))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	genesis, err := chain.Genesis()
+	if err != nil {
+		closeChain()
+		tb.Fatal(err)
+	}
+
+	txs := make([]*Transaction, n)
+	for i := range txs {
+		txs[i] = &Transaction{Outputs: []TxOutput{{Value: 1, PubKeyHash: randomKeyHash(tb)}}}
+		hashTx(tb, txs[i])
+	}
+	hash := sha256.Sum256([]byte("outputs"))
+	storeTip(tb, chain, &Block{Hash: hash[:], Transactions: txs, PrevHash: genesis.Hash, Height: 1})
+
+	utxoSet, err := NewUTXOSet(chain)
+	if err != nil {
+		closeChain()
+		tb.Fatal(err)
+	}
+	if err := utxoSet.Reindex(); err != nil {
+		closeChain()
+		tb.Fatal(err)
+	}
+	return utxoSet, closeChain
+}
+
+func TestBloomFilterHasNoFalseNegatives(t *testing.T) {
+	filter := NewBloomFilter(1000)
+	var added [][]byte
+	for i := 0; i < 1000; i++ {
+		item := randomKeyHash(t)
+		filter.Add(item)
+		added = append(added, item)
+	}
+	for _, item := range added {
+		if !filter.MayContain(item) {
+			t.Fatalf("%x was added but is not in the filter", item)
+		}
+	}
+
+	// the filter is sized for a false positive rate below 0.1%, allow some luck
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.MayContain(randomKeyHash(t)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("%d false positives in 10000 lookups", falsePositives)
+	}
+
+	// a filter without bits can't rule anything out
+	if !BloomFilter(nil).MayContain(added[0]) {
+		t.Error("an empty filter ruled out an item")
+	}
+}
+
+func TestUTXOBloomFilterFollowsTheSet(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	utxoSet, closeChain := newIndexedUTXOSet(t, address)
+	defer closeChain()
+	chain := utxoSet.Blockchain
+
+	if utxoSet.BloomFilter == nil {
+		t.Fatal("Reindex did not build a bloom filter")
+	}
+	if rate := utxoSet.BloomFalsePositiveRate(); rate <= 0 || rate >= 0.001 {
+		t.Errorf("false positive rate %f with a single output", rate)
+	}
+	// a key hash the filter rules out, the first one is almost certainly not a false positive
+	absent := randomKeyHash(t)
+	for utxoSet.BloomFilter.mayContain(absent, utxoSet.BloomConfig.Hashes) {
+		absent = randomKeyHash(t)
+	}
+
+	// a block that pays a new address adds it to the filter
+	other := wallet.MakeWallet()
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := blockOn(t, genesis, string(other.Address()))
+	if block == nil {
+		t.FailNow()
+	}
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if err := utxoSet.Update(block); err != nil {
+		t.Fatal(err)
+	}
+	if outs, err := utxoSet.FindUnspentTransactions(other.PubKeyHash()); err != nil || len(outs) != 1 {
+		t.Errorf("found %d outputs, %v, want the coinbase of the new block", len(outs), err)
+	}
+
+	// the filter is stored with the set, a new set of the chain loads it
+	loaded, err := NewUTXOSet(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded.BloomFilter) != string(utxoSet.BloomFilter) {
+		t.Error("the loaded filter differs from the updated one")
+	}
+	if outs, err := loaded.FindUnspentTransactions(absent); err != nil || len(outs) != 0 {
+		t.Errorf("found %d outputs, %v for a key hash without outputs", len(outs), err)
+	}
+
+	// a filter that was built with another config is not used
+	loaded.BloomConfig = BloomConfig{Bits: 1 << 10, Hashes: 2}
+	if err := loaded.ReloadBloom(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.BloomFilter != nil {
+		t.Error("loaded a filter of another config")
+	}
+	if outs, err := loaded.FindUnspentTransactions(other.PubKeyHash()); err != nil || len(outs) != 1 {
+		t.Errorf("found %d outputs, %v without a filter, want the coinbase of the new block", len(outs), err)
+	}
+}
+
+// BenchmarkFindUnspentTransactions looks up addresses without outputs in a set of 5000 outputs. The filter answers most
+// lookups without reading the set, without it every lookup scans all of it
+func BenchmarkFindUnspentTransactions(b *testing.B) {
+	utxoSet, closeChain := utxoSetOfSize(b, 5000)
+	defer closeChain()
+
+	absent := make([][]byte, 1000)
+	for i := range absent {
+		absent[i] = randomKeyHash(b)
+	}
+
+	run := func(b *testing.B, u UTXOSet) {
+		for i := 0; i < b.N; i++ {
+			if _, err := u.FindUnspentTransactions(absent[i%len(absent)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("bloom", func(b *testing.B) {
+		b.ReportMetric(utxoSet.BloomFalsePositiveRate(), "false-positive-rate")
+		run(b, *utxoSet)
+	})
+
+	b.Run("no bloom", func(b *testing.B) {
+		withoutFilter := *utxoSet
+		withoutFilter.BloomFilter = nil
+		run(b, withoutFilter)
+	})
+}
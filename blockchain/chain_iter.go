@@ -1,37 +1,84 @@
 package blockchain
 
-import "github.com/dgraph-io/badger"
-
 // Iterator Creates a cursor for the blockchain that traverses the blockchain in reverse (starting from the last block)
 type Iterator struct {
 	CurrentHash []byte
-	Database    *badger.DB
+	Database    Storage
 }
 
 // Iterator creates an iterator for the blockchain. The chain iterates backwards
 func (chain *Blockchain) Iterator() *Iterator {
-	return &Iterator{chain.LastHash, chain.Database}
+	return &Iterator{chain.GetLastHash(), chain.Database}
 }
 
 // Next loops to retrieve the previous hash
-func (iter *Iterator) Next() *Block {
+func (iter *Iterator) Next() (*Block, error) {
 	var b *Block
 
-	err := iter.Database.View(func(txn *badger.Txn) error {
+	err := iter.Database.View(func(txn StorageTxn) error {
 		// retrieve the last block
 		item, err := txn.Get(iter.CurrentHash)
-		handle(err)
+		if err != nil {
+			return err
+		}
 
-		// get the hash representation of the block
-		encodedBlock := valueHash(item)
 		// deserialize it into our block struct
-		b = Deserialize(encodedBlock)
+		b, err = readBlock(item)
 		return err
 	})
-
-	handle(err)
+	if err != nil {
+		return nil, err
+	}
 
 	// update the currentHash field for looping
 	iter.CurrentHash = b.PrevHash
-	return b
+	return b, nil
+}
+
+// ForwardIterator traverses the blockchain from a height up to the last block, using the height index
+type ForwardIterator struct {
+	// the height of the block Next returns, it moves up with every block
+	StartHeight int
+	Database    Storage
+}
+
+// ForwardIterator creates an iterator that starts at the block with the height and iterates forwards. Use 0 to start at the genesis block
+func (chain *Blockchain) ForwardIterator(startHeight int) *ForwardIterator {
+	if startHeight < 0 {
+		startHeight = 0
+	}
+	return &ForwardIterator{startHeight, chain.Database}
+}
+
+// Next retrieves the block at the current height and moves to the next height. Returns a nil block after the last block
+func (iter *ForwardIterator) Next() (*Block, error) {
+	var b *Block
+
+	err := iter.Database.View(func(txn StorageTxn) error {
+		item, err := txn.Get(heightKey(iter.StartHeight))
+		if err == ErrKeyNotFound {
+			// there is no block above the last one
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hash, err := valueHash(item)
+		if err != nil {
+			return err
+		}
+
+		item, err = txn.Get(hash)
+		if err != nil {
+			return err
+		}
+		b, err = readBlock(item)
+		return err
+	})
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	iter.StartHeight++
+	return b, nil
 }
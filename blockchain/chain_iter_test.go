@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+func TestForwardIteratorWalksUpTheChain(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+	chain.Config.RetargetWindow = 0
+
+	// mined and received blocks are both indexed by height
+	for height := 1; height <= 5; height++ {
+		coinbase, err := CoinbaseTx(address, "", height, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := chain.MineBlock([]*Transaction{coinbase}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last, err := chain.GetBlock(chain.GetLastHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addBlocks(t, chain, &last, address, 5)
+
+	// the backward iterator gives the expected hashes, newest first
+	var hashes [][]byte
+	for iter := chain.Iterator(); ; {
+		block, err := iter.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append([][]byte{block.Hash}, hashes...)
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	if len(hashes) != 11 {
+		t.Fatalf("%d blocks, want the genesis block and 10 on top of it", len(hashes))
+	}
+
+	for _, start := range []int{0, 4, 10, 11, -1} {
+		iter := chain.ForwardIterator(start)
+		want := start
+		if want < 0 {
+			want = 0
+		}
+		for {
+			block, err := iter.Next()
+			if err != nil {
+				t.Fatalf("start %d: %v", start, err)
+			}
+			if block == nil {
+				break
+			}
+			if block.Height != want || !bytes.Equal(block.Hash, hashes[want]) {
+				t.Fatalf("start %d: block %d, want block %d", start, block.Height, want)
+			}
+			want++
+		}
+		if want != len(hashes) {
+			t.Errorf("start %d: stopped before block %d, want to stop after the last block", start, want)
+		}
+
+		// the end of the chain stays the end
+		if block, err := iter.Next(); block != nil || err != nil {
+			t.Errorf("start %d: Next after the last block returned %v, %v", start, block, err)
+		}
+	}
+}
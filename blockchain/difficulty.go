@@ -0,0 +1,134 @@
+package blockchain
+
+import (
+	"math"
+	"math/big"
+	"time"
+)
+
+// ChainConfig the consensus settings of a chain
+type ChainConfig struct {
+	// how long it should take on average to mine a block
+	TargetBlockTime time.Duration
+	// the amount of previous blocks used to calculate the average block time
+	RetargetWindow int
+	// the difficulty never goes below or above these bounds
+	MinDifficulty int
+	MaxDifficulty int
+	// the maximum amount the difficulty can change between two blocks
+	MaxRetargetStep int
+	// the reward of the genesis block, it halves every HalvingInterval blocks. See BlockReward
+	InitialReward   int
+	HalvingInterval int
+	// the maximum amount of blocks in the orphan pool, a peer could otherwise fill our memory with blocks that never connect
+	MaxOrphanBlocks int
+}
+
+// DefaultChainConfig the settings used by Init and Continue
+func DefaultChainConfig() ChainConfig {
+	return ChainConfig{
+		TargetBlockTime: 10 * time.Second,
+		RetargetWindow:  10,
+		MinDifficulty:   Difficulty,
+		MaxDifficulty:   32,
+		MaxRetargetStep: 2,
+		InitialReward:   50,
+		HalvingInterval: 210000,
+		MaxOrphanBlocks: 100,
+	}
+}
+
+// RetargetDifficulty calculates the difficulty of the next block from the average time between the last windowSize blocks
+//
+// each difficulty step doubles the work, so the difficulty changes by log2(target time / average time).
+// eg. blocks that come in twice as fast as the target increase the difficulty by 1
+func RetargetDifficulty(chain *Blockchain, windowSize int) (int, error) {
+	return chain.difficultyAfter(chain.GetLastHash(), windowSize)
+}
+
+// difficultyAfter calculates the difficulty of the block that follows the block with the given hash
+func (chain *Blockchain) difficultyAfter(hash []byte, windowSize int) (int, error) {
+	config := chain.Config
+
+	// the timestamps of the last windowSize+1 blocks give us windowSize intervals, newest first
+	var timestamps []int64
+	current := 0
+
+	iter := &Iterator{hash, chain.Database}
+	for len(timestamps) <= windowSize {
+		block, err := iter.Next()
+		if err != nil {
+			return 0, err
+		}
+		if current == 0 {
+			current = block.EffectiveDifficulty()
+		}
+		timestamps = append(timestamps, block.Timestamp)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	// the chain is too short to say anything about the block time
+	if windowSize < 1 || len(timestamps) <= windowSize {
+		return current, nil
+	}
+
+	average := float64(timestamps[0]-timestamps[windowSize]) / float64(windowSize)
+	// timestamps only have second precision, treat blocks in the same second as half a second apart
+	if average < 0.5 {
+		average = 0.5
+	}
+
+	step := int(math.Round(math.Log2(config.TargetBlockTime.Seconds() / average)))
+	if step > config.MaxRetargetStep {
+		step = config.MaxRetargetStep
+	}
+	if step < -config.MaxRetargetStep {
+		step = -config.MaxRetargetStep
+	}
+
+	difficulty := current + step
+	if difficulty < config.MinDifficulty {
+		difficulty = config.MinDifficulty
+	}
+	if difficulty > config.MaxDifficulty {
+		difficulty = config.MaxDifficulty
+	}
+
+	return difficulty, nil
+}
+
+// EffectiveDifficulty returns the difficulty the block was mined with
+func (b *Block) EffectiveDifficulty() int {
+	return effectiveDifficulty(b.Difficulty)
+}
+
+// Work returns the amount of hashes it takes on average to mine the block, every difficulty step doubles it
+//
+// the chain with the most work is the valid one, a fork can claim any height but can't fake the work
+func (b *Block) Work() *big.Int {
+	difficulty := b.EffectiveDifficulty()
+	if difficulty < 0 {
+		difficulty = 0
+	}
+	return new(big.Int).Lsh(big.NewInt(1), uint(difficulty))
+}
+
+// chainWork adds up the work of the blocks
+func chainWork(blocks []*Block) *big.Int {
+	work := new(big.Int)
+	for _, block := range blocks {
+		work.Add(work, block.Work())
+	}
+	return work
+}
+
+// effectiveDifficulty blocks from before retargeting don't store their difficulty, they were all mined with the Difficulty constant
+func effectiveDifficulty(difficulty int) int {
+	if difficulty == 0 {
+		return Difficulty
+	}
+	return difficulty
+}
@@ -0,0 +1,81 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// chainWithInterval stores n blocks of the difficulty on top of the genesis block, each one interval seconds after the block
+// before it. The blocks aren't mined, only their timestamps and difficulty matter
+func chainWithInterval(t *testing.T, n int, interval int64, difficulty int) (*Blockchain, func()) {
+	t.Helper()
+
+	chain, closeChain, err := NewTestChain(string(wallet.MakeWallet().Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev, err := chain.Genesis()
+	if err != nil {
+		closeChain()
+		t.Fatal(err)
+	}
+	for height := 1; height <= n; height++ {
+		hash := sha256.Sum256([]byte(fmt.Sprintf("block %d", height)))
+		block := &Block{
+			Hash:         hash[:],
+			Transactions: prev.Transactions,
+			PrevHash:     prev.Hash,
+			Height:       height,
+			Timestamp:    prev.Timestamp + interval,
+			Difficulty:   difficulty,
+		}
+		storeTip(t, chain, block)
+		prev = block
+	}
+	return chain, closeChain
+}
+
+func TestRetargetDifficulty(t *testing.T) {
+	config := DefaultChainConfig()
+	window := config.RetargetWindow
+	target := int64(config.TargetBlockTime.Seconds())
+
+	tests := []struct {
+		name       string
+		blocks     int
+		interval   int64
+		difficulty int
+		want       int
+	}{
+		{"on target", window, target, 16, 16},
+		// twice as fast doubles the work, one step
+		{"twice as fast", window, target / 2, 16, 17},
+		{"ten times as fast", window, 1, 16, 16 + config.MaxRetargetStep},
+		// blocks in the same second count as half a second apart
+		{"same second", window, 0, 16, 16 + config.MaxRetargetStep},
+		{"twice as slow", window, target * 2, 16, 15},
+		{"four times as slow", window, target * 4, 16, 14},
+		{"a hundred times as slow", window, target * 100, 16, 16 - config.MaxRetargetStep},
+		{"slow at the minimum", window, target * 4, config.MinDifficulty, config.MinDifficulty},
+		{"fast at the maximum", window, 1, config.MaxDifficulty, config.MaxDifficulty},
+		// the chain needs window intervals, the genesis block included
+		{"chain shorter than the window", window - 1, 1, 16, 16},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain, closeChain := chainWithInterval(t, test.blocks, test.interval, test.difficulty)
+			defer closeChain()
+
+			difficulty, err := RetargetDifficulty(chain, window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if difficulty != test.want {
+				t.Errorf("difficulty %d after blocks %ds apart at difficulty %d, want %d", difficulty, test.interval, test.difficulty, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// blockMagic marks a block encoded with the binary format ("QCOI")
+	blockMagic = uint32(0x51434F49)
+	// blockFormatVersion the version of the binary block format
+	//
+	// version 2 added the input sequence numbers, version 3 the block difficulty, version 4 multi signature inputs and outputs,
+	// version 5 the transaction lock time
+	blockFormatVersion = byte(5)
+)
+
+// ErrInvalidBlockEncoding is returned when binary block data can't be decoded
+var ErrInvalidBlockEncoding = errors.New("invalid block encoding")
+
+// MarshalBinary encodes the block with the versioned binary format
+//
+// integers are fixed size big endian values and variable fields are prefixed with their length.
+// Unlike gob, the format is stable and can be parsed by tools that aren't written in Go
+func (b *Block) MarshalBinary() ([]byte, error) {
+	w := &binaryWriter{}
+
+	w.uint32(blockMagic)
+	w.byte(blockFormatVersion)
+
+	w.int64(b.Timestamp)
+	w.bytes(b.Hash)
+	w.bytes(b.PrevHash)
+	w.int64(int64(b.Nonce))
+	w.int64(int64(b.Height))
+	w.bytes(b.TxBloom)
+	w.int64(int64(b.Difficulty))
+
+	w.uint32(uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		w.bytes(tx.ID)
+		w.int64(tx.LockTime)
+
+		w.uint32(uint32(len(tx.Inputs)))
+		for _, in := range tx.Inputs {
+			w.bytes(in.ID)
+			w.int64(int64(in.Out))
+			w.bytes(in.Signature)
+			w.bytes(in.PubKey)
+			w.byte(in.KeyType)
+			w.uint32(in.InvertedSequence)
+
+			w.uint32(uint32(len(in.MultiSig)))
+			for _, sig := range in.MultiSig {
+				w.bytes(sig.PubKey)
+				w.byte(sig.KeyType)
+				w.bytes(sig.Signature)
+			}
+		}
+
+		w.uint32(uint32(len(tx.Outputs)))
+		for _, out := range tx.Outputs {
+			w.int64(int64(out.Value))
+			w.bytes(out.PubKeyHash)
+			w.byte(out.ScriptType)
+
+			w.int64(int64(out.Required))
+			w.uint32(uint32(len(out.PubKeyHashes)))
+			for _, hash := range out.PubKeyHashes {
+				w.bytes(hash)
+			}
+		}
+	}
+
+	return w.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a block encoded with MarshalBinary
+func (b *Block) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{r: bytes.NewReader(data)}
+
+	if r.uint32() != blockMagic {
+		return ErrInvalidBlockEncoding
+	}
+	// older versions are still readable, the fields they don't have keep their zero value
+	formatVersion := r.byte()
+	if formatVersion < 1 || formatVersion > blockFormatVersion {
+		return errors.New("unsupported block format version")
+	}
+
+	var block Block
+	block.Timestamp = r.int64()
+	block.Hash = r.bytes()
+	block.PrevHash = r.bytes()
+	block.Nonce = int(r.int64())
+	block.Height = int(r.int64())
+	block.TxBloom = r.bytes()
+	if formatVersion >= 3 {
+		block.Difficulty = int(r.int64())
+	}
+
+	txCount := r.count()
+	for i := 0; i < txCount && r.err == nil; i++ {
+		tx := &Transaction{ID: r.bytes()}
+		if formatVersion >= 5 {
+			tx.LockTime = r.int64()
+		}
+
+		inCount := r.count()
+		for j := 0; j < inCount && r.err == nil; j++ {
+			var in TxInput
+			in.ID = r.bytes()
+			in.Out = int(r.int64())
+			in.Signature = r.bytes()
+			in.PubKey = r.bytes()
+			in.KeyType = r.byte()
+			if formatVersion >= 2 {
+				in.InvertedSequence = r.uint32()
+			}
+			if formatVersion >= 4 {
+				sigCount := r.count()
+				for k := 0; k < sigCount && r.err == nil; k++ {
+					in.MultiSig = append(in.MultiSig, MultiSigSignature{r.bytes(), r.byte(), r.bytes()})
+				}
+			}
+			tx.Inputs = append(tx.Inputs, in)
+		}
+
+		outCount := r.count()
+		for j := 0; j < outCount && r.err == nil; j++ {
+			var out TxOutput
+			out.Value = int(r.int64())
+			out.PubKeyHash = r.bytes()
+			out.ScriptType = r.byte()
+			if formatVersion >= 4 {
+				out.Required = int(r.int64())
+				hashCount := r.count()
+				for k := 0; k < hashCount && r.err == nil; k++ {
+					out.PubKeyHashes = append(out.PubKeyHashes, r.bytes())
+				}
+			}
+			tx.Outputs = append(tx.Outputs, out)
+		}
+
+		block.Transactions = append(block.Transactions, tx)
+	}
+
+	if r.err != nil {
+		return ErrInvalidBlockEncoding
+	}
+
+	*b = block
+	return nil
+}
+
+// isBinaryBlock checks if the data starts with the binary block magic number
+func isBinaryBlock(data []byte) bool {
+	return len(data) >= 4 && binary.BigEndian.Uint32(data) == blockMagic
+}
+
+// binaryWriter writes big endian values into a buffer
+type binaryWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *binaryWriter) byte(v byte) {
+	w.buf.WriteByte(v)
+}
+
+func (w *binaryWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *binaryWriter) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	w.buf.Write(b[:])
+}
+
+// bytes writes a length prefixed byte slice
+func (w *binaryWriter) bytes(v []byte) {
+	w.uint32(uint32(len(v)))
+	w.buf.Write(v)
+}
+
+// binaryReader reads big endian values. The first error is kept and every read after it returns zero values
+type binaryReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *binaryReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	// never allocate more than what is left in the data
+	if n > r.r.Len() {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		r.err = err
+		return nil
+	}
+	return b
+}
+
+func (r *binaryReader) byte() byte {
+	b := r.read(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *binaryReader) uint32() uint32 {
+	b := r.read(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *binaryReader) int64() int64 {
+	b := r.read(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// count reads an element count. It can't be larger than the remaining data, which protects against huge allocations
+func (r *binaryReader) count() int {
+	n := int(r.uint32())
+	if r.err == nil && n > r.r.Len() {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	return n
+}
+
+// bytes reads a length prefixed byte slice. Empty slices are returned as nil, the same as gob
+func (r *binaryReader) bytes() []byte {
+	n := int(r.uint32())
+	if n == 0 {
+		return nil
+	}
+	return r.read(n)
+}
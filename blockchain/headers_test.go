@@ -0,0 +1,126 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// appendBlocks stores n blocks on top of the genesis block without mining them and returns their hashes
+func appendBlocks(tb testing.TB, chain *Blockchain, n int) [][]byte {
+	tb.Helper()
+
+	genesis, err := chain.Genesis()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	hashes := make([][]byte, 0, n)
+	prev := genesis
+	for i := 1; i <= n; i++ {
+		hash := sha256.Sum256([]byte(fmt.Sprintf("block %d", i)))
+		block := &Block{Hash: hash[:], Transactions: prev.Transactions, PrevHash: prev.Hash, Height: i}
+		storeBlock(tb, chain, block)
+		hashes = append(hashes, block.Hash)
+		prev = block
+	}
+	return hashes
+}
+
+func TestGetBlockHeadersSkipsUnknownHashes(t *testing.T) {
+	chain, closeChain, err := NewTestChain(string(wallet.MakeWallet().Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	stored := appendBlocks(t, chain, 3)
+	unknown := []byte("unknown block")
+
+	headers, err := chain.GetBlockHeaders([][]byte{stored[0], unknown, stored[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 {
+		t.Fatalf("%d headers, want 2", len(headers))
+	}
+	if !bytes.Equal(headers[0].Hash, stored[0]) || !bytes.Equal(headers[1].Hash, stored[2]) {
+		t.Errorf("headers %x and %x, want %x and %x", headers[0].Hash, headers[1].Hash, stored[0], stored[2])
+	}
+}
+
+// BenchmarkGetBlockHeaders compares reading 2000 headers in a single transaction with reading the blocks one at a time
+func BenchmarkGetBlockHeaders(b *testing.B) {
+	chain, err := InitWithStorage(openTestBadger(b), string(wallet.MakeWallet().Address()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	hashes := appendBlocks(b, chain, 2000)
+
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := chain.GetBlockHeaders(hashes); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("one by one", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, hash := range hashes {
+				block, err := chain.GetBlock(hash)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := block.Header(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestGetBlocksByHeightRangeBoundaries(t *testing.T) {
+	chain, closeChain, err := NewTestChain(string(wallet.MakeWallet().Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+	appendBlocks(t, chain, 3)
+
+	const maxInt = int(^uint(0) >> 1)
+	tests := []struct {
+		name     string
+		from, to int
+		heights  []int
+		err      error
+	}{
+		{"genesis block", 0, 0, []int{0}, nil},
+		{"whole chain", 0, 3, []int{0, 1, 2, 3}, nil},
+		{"past the tip", 2, 10, []int{2, 3}, nil},
+		{"above the tip", 4, 10, nil, nil},
+		{"MaxRangeSize blocks", 0, MaxRangeSize - 1, []int{0, 1, 2, 3}, nil},
+		{"one block more than MaxRangeSize", 0, MaxRangeSize, nil, ErrRangeTooLarge},
+		{"up to the largest int", 0, maxInt, nil, ErrRangeTooLarge},
+		{"below the genesis block", -1, 0, nil, ErrInvalidRange},
+		{"end before the start", 2, 1, nil, ErrInvalidRange},
+	}
+	for _, test := range tests {
+		blocks, err := chain.GetBlocksByHeightRange(test.from, test.to)
+		if err != test.err {
+			t.Errorf("%s: returned %v, want %v", test.name, err, test.err)
+			continue
+		}
+
+		var heights []int
+		for _, block := range blocks {
+			heights = append(heights, block.Height)
+		}
+		if fmt.Sprint(heights) != fmt.Sprint(test.heights) {
+			t.Errorf("%s: heights %v, want %v", test.name, heights, test.heights)
+		}
+	}
+}
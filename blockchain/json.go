@@ -0,0 +1,267 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// the JSON types use hex strings for hashes and keys, base64 byte slices are unreadable in an API response
+
+type blockJSON struct {
+	Hash         string         `json:"hash"`
+	PrevHash     string         `json:"prevHash"`
+	Height       int            `json:"height"`
+	Timestamp    time.Time      `json:"timestamp"`
+	Nonce        int            `json:"nonce"`
+	Difficulty   int            `json:"difficulty"`
+	MerkleRoot   string         `json:"merkleRoot"`
+	Transactions []*Transaction `json:"transactions"`
+}
+
+type transactionJSON struct {
+	ID       string     `json:"id"`
+	Coinbase bool       `json:"coinbase"`
+	LockTime int64      `json:"lockTime,omitempty"`
+	Inputs   []TxInput  `json:"inputs"`
+	Outputs  []TxOutput `json:"outputs"`
+}
+
+type inputJSON struct {
+	TxID      string          `json:"txid"`
+	Out       int             `json:"out"`
+	Signature string          `json:"signature,omitempty"`
+	PubKey    string          `json:"pubKey,omitempty"`
+	KeyType   byte            `json:"keyType"`
+	Sequence  uint32          `json:"sequence"`
+	MultiSig  []signatureJSON `json:"multiSig,omitempty"`
+}
+
+type signatureJSON struct {
+	PubKey    string `json:"pubKey"`
+	KeyType   byte   `json:"keyType"`
+	Signature string `json:"signature"`
+}
+
+type outputJSON struct {
+	Value      int    `json:"value"`
+	ScriptType byte   `json:"scriptType"`
+	PubKeyHash string `json:"pubKeyHash,omitempty"`
+	// empty for data outputs and non-standard scripts
+	Address string `json:"address,omitempty"`
+	// set for multi signature outputs
+	Required  int      `json:"required,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	// the hex encoded data of a data output
+	Data string `json:"data,omitempty"`
+}
+
+// decodeHex decodes a hex field, empty fields stay nil like they do after a gob round trip
+func decodeHex(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return hex.DecodeString(s)
+}
+
+// MarshalJSON encodes the block with hex encoded hashes and an RFC3339 timestamp
+func (b Block) MarshalJSON() ([]byte, error) {
+	merkleRoot, err := b.HashTransactions()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(blockJSON{
+		Hash:         hex.EncodeToString(b.Hash),
+		PrevHash:     hex.EncodeToString(b.PrevHash),
+		Height:       b.Height,
+		Timestamp:    time.Unix(b.Timestamp, 0).UTC(),
+		Nonce:        b.Nonce,
+		Difficulty:   b.Difficulty,
+		MerkleRoot:   hex.EncodeToString(merkleRoot),
+		Transactions: b.Transactions,
+	})
+}
+
+// UnmarshalJSON decodes a block encoded by MarshalJSON. The bloom filter is rebuilt from the transactions
+//
+// returns an error when the transactions don't match the merkle root
+func (b *Block) UnmarshalJSON(data []byte) error {
+	var in blockJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	hash, err := decodeHex(in.Hash)
+	if err != nil {
+		return err
+	}
+	prevHash, err := decodeHex(in.PrevHash)
+	if err != nil {
+		return err
+	}
+	merkleRoot, err := decodeHex(in.MerkleRoot)
+	if err != nil {
+		return err
+	}
+
+	block := Block{in.Timestamp.Unix(), hash, in.Transactions, prevHash, in.Nonce, in.Height, txBloom(in.Transactions), in.Difficulty}
+	blockRoot, err := block.HashTransactions()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(blockRoot, merkleRoot) {
+		return errors.New("transactions do not match the merkle root of the block")
+	}
+
+	*b = block
+	return nil
+}
+
+// MarshalJSON encodes the transaction with hex encoded ids and keys, and the addresses of its outputs
+func (tx Transaction) MarshalJSON() ([]byte, error) {
+	out := transactionJSON{
+		ID:       hex.EncodeToString(tx.ID),
+		Coinbase: tx.IsCoinbase(),
+		LockTime: tx.LockTime,
+		Inputs:   tx.Inputs,
+		Outputs:  tx.Outputs,
+	}
+	// an empty array reads better than null
+	if out.Inputs == nil {
+		out.Inputs = []TxInput{}
+	}
+	if out.Outputs == nil {
+		out.Outputs = []TxOutput{}
+	}
+
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes a transaction encoded by MarshalJSON. Like received transactions it is sealed
+func (tx *Transaction) UnmarshalJSON(data []byte) error {
+	var in transactionJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	id, err := decodeHex(in.ID)
+	if err != nil {
+		return err
+	}
+
+	*tx = Transaction{ID: id, Inputs: in.Inputs, Outputs: in.Outputs, LockTime: in.LockTime, sealed: true}
+	return nil
+}
+
+// MarshalJSON encodes the input with hex encoded ids, keys and signatures
+func (in TxInput) MarshalJSON() ([]byte, error) {
+	input := inputJSON{
+		TxID:      hex.EncodeToString(in.ID),
+		Out:       in.Out,
+		Signature: hex.EncodeToString(in.Signature),
+		PubKey:    hex.EncodeToString(in.PubKey),
+		KeyType:   in.KeyType,
+		Sequence:  in.Sequence(),
+	}
+	for _, sig := range in.MultiSig {
+		input.MultiSig = append(input.MultiSig, signatureJSON{hex.EncodeToString(sig.PubKey), sig.KeyType, hex.EncodeToString(sig.Signature)})
+	}
+
+	return json.Marshal(input)
+}
+
+// UnmarshalJSON decodes an input encoded by MarshalJSON
+func (in *TxInput) UnmarshalJSON(data []byte) error {
+	var input inputJSON
+	if err := json.Unmarshal(data, &input); err != nil {
+		return err
+	}
+
+	var err error
+	decoded := TxInput{Out: input.Out, KeyType: input.KeyType}
+	if decoded.ID, err = decodeHex(input.TxID); err != nil {
+		return err
+	}
+	if decoded.Signature, err = decodeHex(input.Signature); err != nil {
+		return err
+	}
+	if decoded.PubKey, err = decodeHex(input.PubKey); err != nil {
+		return err
+	}
+	decoded.SetSequence(input.Sequence)
+
+	for _, s := range input.MultiSig {
+		sig := MultiSigSignature{KeyType: s.KeyType}
+		if sig.PubKey, err = decodeHex(s.PubKey); err != nil {
+			return err
+		}
+		if sig.Signature, err = decodeHex(s.Signature); err != nil {
+			return err
+		}
+		decoded.MultiSig = append(decoded.MultiSig, sig)
+	}
+
+	*in = decoded
+	return nil
+}
+
+// MarshalJSON encodes the output with the address it is locked to, the addresses of a multi signature output or the data of a data output
+func (o TxOutput) MarshalJSON() ([]byte, error) {
+	output := outputJSON{Value: o.Value, ScriptType: o.ScriptType}
+	switch {
+	case o.IsData():
+		output.Data = hex.EncodeToString(o.Data())
+	case o.IsMultiSig():
+		output.Required = o.Required
+		for _, hash := range o.PubKeyHashes {
+			output.Addresses = append(output.Addresses, string(wallet.AddressFromPubKeyHash(hash)))
+		}
+	default:
+		output.PubKeyHash = hex.EncodeToString(o.PubKeyHash)
+		if address, ok := o.Address(); ok {
+			output.Address = address
+		}
+	}
+
+	return json.Marshal(output)
+}
+
+// UnmarshalJSON decodes an output encoded by MarshalJSON. The key hashes of multi signature outputs are read from their addresses
+func (o *TxOutput) UnmarshalJSON(data []byte) error {
+	var output outputJSON
+	if err := json.Unmarshal(data, &output); err != nil {
+		return err
+	}
+
+	decoded := TxOutput{Value: output.Value, ScriptType: output.ScriptType, Required: output.Required}
+	switch {
+	case output.ScriptType == ScriptTypeData && output.PubKeyHash == "":
+		content, err := decodeHex(output.Data)
+		if err != nil {
+			return err
+		}
+		decoded.PubKeyHash = append([]byte{dataOutputMarker}, content...)
+	case output.ScriptType == ScriptTypeMultiSig:
+		for _, address := range output.Addresses {
+			_, pubKeyHash, _, err := wallet.AddressToComponents(address)
+			if err != nil {
+				return err
+			}
+			decoded.PubKeyHashes = append(decoded.PubKeyHashes, pubKeyHash)
+		}
+	default:
+		pubKeyHash, err := decodeHex(output.PubKeyHash)
+		if err != nil {
+			return err
+		}
+		decoded.PubKeyHash = pubKeyHash
+	}
+
+	*o = decoded
+	return nil
+}
@@ -0,0 +1,149 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// jsonTestBlock a block with a coinbase and a transaction that uses every kind of input and output
+func jsonTestBlock(t *testing.T) *Block {
+	t.Helper()
+
+	owners := []*wallet.Wallet{wallet.MakeWallet(), wallet.MakeWallet()}
+	coinbase, err := CoinbaseTx(string(owners[0].Address()), "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payment, err := NewTXOutput(5, string(owners[1].Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiSig, err := NewMultiSigTXOutput(3, 2, []string{string(owners[0].Address()), string(owners[1].Address())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := NewDataTXOutput([]byte("some data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := TxInput{ID: coinbase.ID, Out: 0, Signature: []byte("signature"), PubKey: owners[0].PublicKey, KeyType: owners[0].KeyType}
+	in.SetSequence(SequenceFinal - 2)
+	multiSigIn := TxInput{ID: []byte("multi signature"), Out: 1, MultiSig: []MultiSigSignature{{owners[1].PublicKey, owners[1].KeyType, []byte("other signature")}}}
+	tx := &Transaction{Inputs: []TxInput{in, multiSigIn}, Outputs: []TxOutput{*payment, *multiSig, *data}, LockTime: 50}
+	hashTx(t, tx)
+
+	txs := []*Transaction{coinbase, tx}
+	return &Block{Timestamp: 1600000000, Hash: []byte("block hash"), Transactions: txs, PrevHash: []byte("previous hash"), Nonce: 7, Height: 1, TxBloom: txBloom(txs), Difficulty: 12}
+}
+
+func TestBlockJSONRoundTrip(t *testing.T) {
+	block := jsonTestBlock(t)
+
+	data, err := json.Marshal(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Block
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	// the binary format holds every stored field, so equal encodings mean equal blocks
+	want, err := block.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decoded.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("the decoded block differs\ngot  %+v\nwant %+v", decoded, *block)
+	}
+	for _, tx := range decoded.Transactions {
+		if !tx.IsSealed() {
+			t.Errorf("decoded transaction %x is not sealed", tx.ID)
+		}
+	}
+}
+
+func TestTransactionJSONUsesHex(t *testing.T) {
+	tx := jsonTestBlock(t).Transactions[1]
+
+	data, err := json.Marshal(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields struct {
+		ID     string `json:"id"`
+		Inputs []struct {
+			TxID string `json:"txid"`
+		} `json:"inputs"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if want := hex.EncodeToString(tx.ID); fields.ID != want {
+		t.Errorf("id %q, want %q", fields.ID, want)
+	}
+	if want := "6d756c7469207369676e6174757265"; fields.Inputs[1].TxID != want {
+		t.Errorf("txid %q, want %q", fields.Inputs[1].TxID, want)
+	}
+}
+
+func TestBlockJSONRejectsMalformedInput(t *testing.T) {
+	data, err := json.Marshal(jsonTestBlock(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]func(block map[string]interface{}){
+		"hash is not hex":       func(block map[string]interface{}) { block["hash"] = "not hex" },
+		"prevHash is not hex":   func(block map[string]interface{}) { block["prevHash"] = "zz" },
+		"no transactions":       func(block map[string]interface{}) { block["transactions"] = []interface{}{} },
+		"changed transaction":   func(block map[string]interface{}) { output(block, 1, 0)["value"] = 500 },
+		"merkle root not hex":   func(block map[string]interface{}) { block["merkleRoot"] = "xyz" },
+		"timestamp not RFC3339": func(block map[string]interface{}) { block["timestamp"] = "yesterday" },
+		"invalid address":       func(block map[string]interface{}) { output(block, 1, 1)["addresses"] = []interface{}{"not an address"} },
+		"signature is not hex": func(block map[string]interface{}) {
+			tx := block["transactions"].([]interface{})[1].(map[string]interface{})
+			tx["inputs"].([]interface{})[0].(map[string]interface{})["signature"] = "no"
+		},
+	}
+
+	for name, corrupt := range tests {
+		t.Run(name, func(t *testing.T) {
+			// every case starts from its own copy of the block
+			var copied map[string]interface{}
+			if err := json.Unmarshal(data, &copied); err != nil {
+				t.Fatal(err)
+			}
+			corrupt(copied)
+			malformed, err := json.Marshal(copied)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded Block
+			if err := json.Unmarshal(malformed, &decoded); err == nil {
+				t.Errorf("decoded a malformed block %s", malformed)
+			}
+		})
+	}
+
+	var decoded Block
+	if err := json.Unmarshal(data[:len(data)/2], &decoded); err == nil {
+		t.Error("decoded a truncated block")
+	}
+}
+
+// output returns an output of a transaction in a block decoded into a map
+func output(block map[string]interface{}, tx, out int) map[string]interface{} {
+	transaction := block["transactions"].([]interface{})[tx].(map[string]interface{})
+	return transaction["outputs"].([]interface{})[out].(map[string]interface{})
+}
@@ -0,0 +1,204 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrReadOnlyTxn is returned when a View transaction of a MemoryStorage tries to write
+var ErrReadOnlyTxn = errors.New("no writes are allowed in a read only transaction")
+
+// MemoryStorage keeps the chain in memory, eg. for tests that shouldn't need a database directory
+//
+// writes are serialized. Reads don't see the writes of an Update before it commits, but a View can see the commit of an
+// Update that finishes while the View runs
+type MemoryStorage struct {
+	// guards data. It is only held while a key is read or an Update commits, so transactions can run inside each other like they can with Badger
+	mu   sync.RWMutex
+	data map[string][]byte
+	// serializes the Update transactions
+	writeMu sync.Mutex
+}
+
+// NewMemoryStorage creates an empty in memory storage
+func NewMemoryStorage() Storage {
+	return &MemoryStorage{data: make(map[string][]byte)}
+}
+
+// NewTestChain creates a chain with a genesis block for the address in a MemoryStorage. The returned function closes the chain
+//
+// returns an error when the genesis block can't be created, eg. because the address is invalid
+func NewTestChain(address string) (*Blockchain, func(), error) {
+	chain, err := InitWithStorage(NewMemoryStorage(), address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return chain, func() { chain.Database.Close() }, nil
+}
+
+// View runs a read only transaction
+func (s *MemoryStorage) View(fn func(txn StorageTxn) error) error {
+	return fn(&memoryTxn{storage: s})
+}
+
+// Update runs a read write transaction, its writes are applied when fn returns nil
+func (s *MemoryStorage) Update(fn func(txn StorageTxn) error) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	txn := &memoryTxn{storage: s, writable: true, writes: make(map[string]*memoryItem)}
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, item := range txn.writes {
+		if item.deleted {
+			delete(s.data, key)
+		} else {
+			s.data[key] = item.value
+		}
+	}
+	return nil
+}
+
+// Sync does nothing, the data is never written to disk
+func (s *MemoryStorage) Sync() error {
+	return nil
+}
+
+// Close does nothing, the data is dropped with the storage
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+type memoryItem struct {
+	key, value []byte
+	deleted    bool
+}
+
+func (i *memoryItem) Key() []byte {
+	return i.key
+}
+
+func (i *memoryItem) KeyCopy(dst []byte) []byte {
+	return append(dst[:0], i.key...)
+}
+
+func (i *memoryItem) Value(fn func(val []byte) error) error {
+	return fn(i.value)
+}
+
+func (i *memoryItem) ValueCopy(dst []byte) ([]byte, error) {
+	return append(dst[:0], i.value...), nil
+}
+
+type memoryTxn struct {
+	storage  *MemoryStorage
+	writable bool
+	// the pending writes of an Update, keyed by the key
+	writes map[string]*memoryItem
+}
+
+func (t *memoryTxn) Get(key []byte) (StorageItem, error) {
+	if item, ok := t.writes[string(key)]; ok {
+		if item.deleted {
+			return nil, ErrKeyNotFound
+		}
+		return item, nil
+	}
+
+	t.storage.mu.RLock()
+	value, ok := t.storage.data[string(key)]
+	t.storage.mu.RUnlock()
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return &memoryItem{key: append([]byte{}, key...), value: value}, nil
+}
+
+func (t *memoryTxn) Set(key, value []byte) error {
+	if !t.writable {
+		return ErrReadOnlyTxn
+	}
+	// the caller may reuse its slices after the call
+	t.writes[string(key)] = &memoryItem{key: append([]byte{}, key...), value: append([]byte{}, value...)}
+	return nil
+}
+
+func (t *memoryTxn) Delete(key []byte) error {
+	if !t.writable {
+		return ErrReadOnlyTxn
+	}
+	t.writes[string(key)] = &memoryItem{key: append([]byte{}, key...), deleted: true}
+	return nil
+}
+
+// NewIterator iterates over a sorted copy of the keys, with the pending writes of the transaction applied
+func (t *memoryTxn) NewIterator(opts IteratorOptions) StorageIterator {
+	items := make(map[string]*memoryItem)
+	t.storage.mu.RLock()
+	for k, value := range t.storage.data {
+		if bytes.HasPrefix([]byte(k), opts.Prefix) {
+			items[k] = &memoryItem{key: []byte(k), value: value}
+		}
+	}
+	t.storage.mu.RUnlock()
+
+	for k, item := range t.writes {
+		if !bytes.HasPrefix([]byte(k), opts.Prefix) {
+			continue
+		}
+		if item.deleted {
+			delete(items, k)
+		} else {
+			items[k] = item
+		}
+	}
+
+	it := &memoryIterator{items: make([]*memoryItem, 0, len(items))}
+	for _, item := range items {
+		it.items = append(it.items, item)
+	}
+	sort.Slice(it.items, func(i, j int) bool {
+		return bytes.Compare(it.items[i].key, it.items[j].key) < 0
+	})
+	return it
+}
+
+type memoryIterator struct {
+	items []*memoryItem
+	pos   int
+}
+
+func (it *memoryIterator) Seek(key []byte) {
+	it.pos = sort.Search(len(it.items), func(i int) bool {
+		return bytes.Compare(it.items[i].key, key) >= 0
+	})
+}
+
+func (it *memoryIterator) Rewind() {
+	it.pos = 0
+}
+
+func (it *memoryIterator) Valid() bool {
+	return it.pos < len(it.items)
+}
+
+func (it *memoryIterator) ValidForPrefix(prefix []byte) bool {
+	return it.Valid() && bytes.HasPrefix(it.items[it.pos].key, prefix)
+}
+
+func (it *memoryIterator) Next() {
+	it.pos++
+}
+
+func (it *memoryIterator) Item() StorageItem {
+	return it.items[it.pos]
+}
+
+func (it *memoryIterator) Close() {}
@@ -0,0 +1,238 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// openTestBadger opens a Badger database in a temp directory, it is closed when the test ends. Tests that need a
+// chain should use NewTestChain, this is for the tests that compare against Badger
+func openTestBadger(tb testing.TB) *BadgerStorage {
+	tb.Helper()
+
+	dir := tb.TempDir()
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = nil
+	db, err := openDB(dir, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+
+	return &BadgerStorage{db}
+}
+
+// storages returns the storages the tests run against. MemoryStorage has to behave like Badger, which is left out when
+// the tests run with the race detector
+func storages(t *testing.T) map[string]Storage {
+	t.Helper()
+
+	if raceEnabled {
+		return map[string]Storage{"memory": NewMemoryStorage()}
+	}
+	return map[string]Storage{"memory": NewMemoryStorage(), "badger": openTestBadger(t)}
+}
+
+// get reads a key in its own transaction
+func get(t *testing.T, db Storage, key string) ([]byte, error) {
+	t.Helper()
+
+	var value []byte
+	err := db.View(func(txn StorageTxn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	return value, err
+}
+
+// keys iterates over the keys with the prefix, starting at seek
+func keys(t *testing.T, txn StorageTxn, prefix, seek string) []string {
+	t.Helper()
+
+	opts := DefaultIteratorOptions
+	opts.Prefix = []byte(prefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var found []string
+	for it.Seek([]byte(seek)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+		found = append(found, string(it.Item().KeyCopy(nil)))
+	}
+	return found
+}
+
+func TestStorageGetSetDelete(t *testing.T) {
+	for name, db := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := get(t, db, "key"); err != ErrKeyNotFound {
+				t.Fatalf("reading a missing key returned %v, want ErrKeyNotFound", err)
+			}
+
+			value := []byte("value")
+			if err := db.Update(func(txn StorageTxn) error {
+				if err := txn.Set([]byte("key"), value); err != nil {
+					return err
+				}
+				// the transaction sees its own write
+				item, err := txn.Get([]byte("key"))
+				if err != nil {
+					return err
+				}
+				return item.Value(func(val []byte) error {
+					if string(val) != "value" {
+						t.Errorf("read %q inside the transaction, want value", val)
+					}
+					return nil
+				})
+			}); err != nil {
+				t.Fatal(err)
+			}
+			// the storage keeps its own copy
+			value[0] = 'x'
+			if got, err := get(t, db, "key"); err != nil || string(got) != "value" {
+				t.Errorf("read %q, err %v, want value", got, err)
+			}
+
+			if err := db.Update(func(txn StorageTxn) error {
+				return txn.Delete([]byte("key"))
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := get(t, db, "key"); err != ErrKeyNotFound {
+				t.Errorf("reading a deleted key returned %v, want ErrKeyNotFound", err)
+			}
+		})
+	}
+}
+
+func TestStorageDiscardsFailedUpdates(t *testing.T) {
+	for name, db := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			failed := errors.New("failed")
+			err := db.Update(func(txn StorageTxn) error {
+				if err := txn.Set([]byte("key"), []byte("value")); err != nil {
+					return err
+				}
+				return failed
+			})
+			if err != failed {
+				t.Fatalf("Update returned %v, want the error of the transaction", err)
+			}
+			if _, err := get(t, db, "key"); err != ErrKeyNotFound {
+				t.Errorf("the write of a failed update is stored, err %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryStorageViewIsReadOnly(t *testing.T) {
+	db := NewMemoryStorage()
+	err := db.View(func(txn StorageTxn) error {
+		if err := txn.Set([]byte("key"), []byte("value")); err != ErrReadOnlyTxn {
+			t.Errorf("Set returned %v, want ErrReadOnlyTxn", err)
+		}
+		if err := txn.Delete([]byte("key")); err != ErrReadOnlyTxn {
+			t.Errorf("Delete returned %v, want ErrReadOnlyTxn", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageIteration(t *testing.T) {
+	for name, db := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := db.Update(func(txn StorageTxn) error {
+				for _, key := range []string{"utxo-c", "block", "utxo-a", "utxo-b", "zzz"} {
+					if err := txn.Set([]byte(key), []byte(key)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.View(func(txn StorageTxn) error {
+				if got := keys(t, txn, "utxo-", "utxo-"); !equalKeys(got, "utxo-a", "utxo-b", "utxo-c") {
+					t.Errorf("iterated %q, want the utxo keys in order", got)
+				}
+				if got := keys(t, txn, "utxo-", "utxo-b"); !equalKeys(got, "utxo-b", "utxo-c") {
+					t.Errorf("iterated %q after seeking utxo-b", got)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// an update iterates over its pending writes, without the keys it deleted
+			if err := db.Update(func(txn StorageTxn) error {
+				if err := txn.Delete([]byte("utxo-a")); err != nil {
+					return err
+				}
+				if err := txn.Set([]byte("utxo-d"), []byte("utxo-d")); err != nil {
+					return err
+				}
+				if got := keys(t, txn, "utxo-", "utxo-"); !equalKeys(got, "utxo-b", "utxo-c", "utxo-d") {
+					t.Errorf("iterated %q inside the update", got)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func equalKeys(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// BenchmarkNewChain compares the setup of a test chain in memory with a chain in a Badger database
+func BenchmarkNewChain(b *testing.B) {
+	address := string(wallet.MakeWallet().Address())
+
+	b.Run("memory", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, closeChain, err := NewTestChain(address)
+			if err != nil {
+				b.Fatal(err)
+			}
+			closeChain()
+		}
+	})
+
+	b.Run("badger", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			storage := openTestBadger(b)
+			if _, err := InitWithStorage(storage, address); err != nil {
+				b.Fatal(err)
+			}
+			// don't keep the databases open until the benchmark ends
+			storage.Close()
+		}
+	})
+}
+
+func TestNewTestChainRejectsInvalidAddresses(t *testing.T) {
+	if _, _, err := NewTestChain("not an address"); err == nil {
+		t.Error("a chain was created for an invalid address")
+	}
+}
@@ -1,10 +1,14 @@
 package blockchain
 
 import (
+	"bytes"
 	"crypto/sha256"
-	"log"
+	"errors"
 )
 
+// ErrEmptyMerkleTree is returned when a merkle tree is created without any data, there is no root to hash
+var ErrEmptyMerkleTree = errors.New("merkle tree needs at least one leaf")
+
 // MerkleTree is a system to simplify the process of verifying a transaction exists inside of a block without requiring the entire blockchain to confirm it
 //
 // this keeps every coin user from having the entire blockchain database on their computer
@@ -12,7 +16,8 @@ import (
 // By applying a merkle tree, we make a hash of each transaction, then add it up the tree until we reach the merkle root.
 // The merkle root will be a hash that allows us to quickly verify the existence of the transactions
 //
-// Leafs of the tree must always be even. So if we only have 3 transactions, the 4th transaction would just be a copy of tx 3
+// Leafs of the tree must always be even. So if we only have 3 transactions, the 4th leaf is a padding node with the hash of nothing.
+// Duplicating tx 3 instead would let two different transaction lists produce the same root (CVE-2012-2459)
 //
 //
 // ||———————————————————————————————————————————————————————————————————————————————————————————————————————— ||
@@ -30,6 +35,8 @@ import (
 //————————————————————————————————————————————————————————————————————————————————————————————————————————————
 type MerkleTree struct {
 	RootNode *MerkleNode
+	// the amount of data items the tree was built from, the padding nodes are not part of it
+	leaves int
 }
 
 // MerkleNode is a recursive tree structure
@@ -37,8 +44,13 @@ type MerkleNode struct {
 	Left  *MerkleNode
 	Right *MerkleNode
 	Data  []byte
+	// padding nodes fill the last spot of a level, they don't hold any data
+	padding bool
 }
 
+// paddingHash fills the last spot of a level with an odd amount of nodes
+var paddingHash = sha256.Sum256(nil)
+
 // NewMerkleNode creates a new merkle node
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	node := MerkleNode{}
@@ -53,13 +65,15 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 		prevHashes := append(left.Data, right.Data...)
 		hash := sha256.Sum256(prevHashes)
 		node.Data = hash[:]
+		node.Left = left
+		node.Right = right
 	}
 
 	return &node
 }
 
-// NewMerkleTree creates a new Merkle Tree
-func NewMerkleTree(data [][]byte) *MerkleTree {
+// NewMerkleTree creates a new Merkle Tree. Returns ErrEmptyMerkleTree without any data
+func NewMerkleTree(data [][]byte) (*MerkleTree, error) {
 	var nodes []MerkleNode
 
 	// pass in the transaction data and create the first branches
@@ -71,16 +85,16 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 	}
 
 	if len(nodes) == 0 {
-		log.Panic("No merkel nodes")
+		return nil, ErrEmptyMerkleTree
 	}
 	// iterate through the nodes and connect them into the next branch
 
 	// each node represents 2 transactions, so we know i should be the length of the transactions divided by 2
 
 	for len(nodes) > 1 {
-		// make sure that the leafs will be even, otherwise duplicate the last one
+		// make sure that the leafs will be even, otherwise pad the level with an empty node
 		if len(nodes)%2 != 0 {
-			nodes = append(nodes, nodes[len(nodes)-1])
+			nodes = append(nodes, MerkleNode{Data: paddingHash[:], padding: true})
 		}
 
 		// create an array to represent levels of branches
@@ -95,8 +109,111 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 		nodes = level
 	}
 	// pass the only node of the final iteration to be the root
-	tree := MerkleTree{&nodes[0]}
+	tree := MerkleTree{RootNode: &nodes[0], leaves: len(data)}
+
+	return &tree, nil
+
+}
+
+// proofLeftSibling is set in the first byte of a proof entry when the sibling is the left branch
+const proofLeftSibling = byte(0x80)
+
+// Proof creates an inclusion proof for the transaction at txIndex. Returns nil when the index is out of range
+//
+// each entry is a direction byte followed by the hash of the sibling branch, ordered from the leaf up to the root.
+// The high bit of the direction byte is set when the sibling is on the left
+func (t *MerkleTree) Proof(txIndex int) [][]byte {
+	if txIndex < 0 || txIndex >= t.LeafCount() {
+		return nil
+	}
+
+	// padding only ever happens on the right, so every real leaf is at the bottom level and the bits of the index are the path to it
+	var proof [][]byte
+	node := t.RootNode
+	for level := t.Depth() - 2; level >= 0; level-- {
+		if txIndex&(1<<uint(level)) == 0 {
+			proof = append(proof, append([]byte{0}, node.Right.Data...))
+			node = node.Left
+		} else {
+			proof = append(proof, append([]byte{proofLeftSibling}, node.Left.Data...))
+			node = node.Right
+		}
+	}
+
+	// the path was walked from the root down, the proof goes from the leaf up
+	for i, j := 0, len(proof)-1; i < j; i, j = i+1, j-1 {
+		proof[i], proof[j] = proof[j], proof[i]
+	}
+
+	return proof
+}
 
-	return &tree
+// VerifyMerkleProof checks that a transaction is part of the tree with the given root, see Proof
+//
+// txHash is the leaf hash of the transaction, the sha256 of the serialized transaction. A SPV client only needs the merkle root of the block header
+func VerifyMerkleProof(txHash []byte, proof [][]byte, root []byte) bool {
+	hash := txHash
+	for _, entry := range proof {
+		if len(entry) != 1+sha256.Size {
+			return false
+		}
+
+		var sum [sha256.Size]byte
+		if entry[0]&proofLeftSibling != 0 {
+			sum = sha256.Sum256(append(append([]byte{}, entry[1:]...), hash...))
+		} else {
+			sum = sha256.Sum256(append(append([]byte{}, hash...), entry[1:]...))
+		}
+		hash = sum[:]
+	}
+
+	return bytes.Equal(hash, root)
+}
+
+// Depth returns the number of levels in the tree, including the root and the leaves
+func (t *MerkleTree) Depth() int {
+	depth, _, _ := t.RootNode.shape()
+	return depth
+}
+
+// LeafCount returns the number of data items the tree was built from, not counting the padding nodes
+func (t *MerkleTree) LeafCount() int {
+	if t.leaves > 0 {
+		return t.leaves
+	}
+
+	// the tree was put together without NewMerkleTree
+	_, leaves, _ := t.RootNode.shape()
+	return leaves
+}
+
+// Nodes returns the total number of nodes in the tree
+func (t *MerkleTree) Nodes() int {
+	_, _, nodes := t.RootNode.shape()
+	return nodes
+}
+
+// shape walks the tree once and returns the depth, the amount of original leaves and the total amount of nodes
+func (n *MerkleNode) shape() (depth, leaves, nodes int) {
+	if n == nil {
+		return 0, 0, 0
+	}
+
+	// leafs don't have any branches. Padding nodes don't hold any data
+	if n.Left == nil && n.Right == nil {
+		if n.padding {
+			return 1, 0, 1
+		}
+		return 1, 1, 1
+	}
+
+	leftDepth, leftLeaves, leftNodes := n.Left.shape()
+	rightDepth, rightLeaves, rightNodes := n.Right.shape()
+
+	depth = leftDepth
+	if rightDepth > depth {
+		depth = rightDepth
+	}
 
+	return depth + 1, leftLeaves + rightLeaves, leftNodes + rightNodes + 1
 }
@@ -0,0 +1,216 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMerkleTreeShape(t *testing.T) {
+	tests := []struct {
+		leaves, depth, nodes int
+	}{
+		{1, 1, 1},
+		{2, 2, 3},
+		// the third leaf is paired with a padding node
+		{3, 3, 7},
+		{4, 3, 7},
+		// 5 leaves and a padding node, then 3 branches and a padding node, then 2 branches and the root
+		{5, 4, 13},
+		{8, 4, 15},
+	}
+
+	for _, test := range tests {
+		var data [][]byte
+		for i := 0; i < test.leaves; i++ {
+			data = append(data, []byte(fmt.Sprintf("tx %d", i)))
+		}
+		tree, err := NewMerkleTree(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := tree.LeafCount(); got != test.leaves {
+			t.Errorf("%d leaves: LeafCount %d", test.leaves, got)
+		}
+		if got := tree.Depth(); got != test.depth {
+			t.Errorf("%d leaves: Depth %d, want %d", test.leaves, got, test.depth)
+		}
+		if got := tree.Nodes(); got != test.nodes {
+			t.Errorf("%d leaves: Nodes %d, want %d", test.leaves, got, test.nodes)
+		}
+	}
+}
+
+func TestMerkleTreeCountsLeavesThatLookLikePadding(t *testing.T) {
+	// the hash of an empty data item is the padding hash
+	data := [][]byte{[]byte("tx"), {}, {}}
+	tree, err := NewMerkleTree(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tree.LeafCount(); got != len(data) {
+		t.Errorf("LeafCount %d, want %d", got, len(data))
+	}
+
+	// the proofs of every leaf are found, the last leaf included
+	for i, d := range data {
+		hash := sha256.Sum256(d)
+		if !VerifyMerkleProof(hash[:], tree.Proof(i), tree.RootNode.Data) {
+			t.Errorf("the proof of leaf %d does not verify", i)
+		}
+	}
+}
+
+func TestNewMerkleTreeRejectsEmptyData(t *testing.T) {
+	if _, err := NewMerkleTree(nil); !errors.Is(err, ErrEmptyMerkleTree) {
+		t.Errorf("NewMerkleTree returned %v, want ErrEmptyMerkleTree", err)
+	}
+	if _, err := (&Block{}).HashTransactions(); !errors.Is(err, ErrNoTransactions) {
+		t.Errorf("HashTransactions returned %v, want ErrNoTransactions", err)
+	}
+}
+
+// duplicatingRoot calculates the merkle root the way the tree used to, by duplicating the last node of odd levels
+func duplicatingRoot(data [][]byte) []byte {
+	var level [][]byte
+	for _, d := range data {
+		hash := sha256.Sum256(d)
+		level = append(level, hash[:])
+	}
+	for len(level) > 1 {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			hash := sha256.Sum256(append(append([]byte{}, level[i]...), level[i+1]...))
+			next = append(next, hash[:])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+func TestMerkleRootsOfDuplicatedTransactionsDiffer(t *testing.T) {
+	txs := func(names ...string) [][]byte {
+		var data [][]byte
+		for _, name := range names {
+			data = append(data, []byte(name))
+		}
+		return data
+	}
+
+	// CVE-2012-2459, repeating the last transactions of an odd level gave the same root
+	tests := map[string][2][][]byte{
+		"3 transactions": {txs("a", "b", "c"), txs("a", "b", "c", "c")},
+		"6 transactions": {txs("1", "2", "3", "4", "5", "6"), txs("1", "2", "3", "4", "5", "6", "5", "6")},
+	}
+	for name, sets := range tests {
+		if !bytes.Equal(duplicatingRoot(sets[0]), duplicatingRoot(sets[1])) {
+			t.Fatalf("%s: the sets never collided", name)
+		}
+
+		first, err := NewMerkleTree(sets[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := NewMerkleTree(sets[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(first.RootNode.Data, second.RootNode.Data) {
+			t.Errorf("%s: %d and %d transactions have the same root %x", name, len(sets[0]), len(sets[1]), first.RootNode.Data)
+		}
+	}
+}
+
+func TestMerkleProofsVerify(t *testing.T) {
+	for _, leaves := range []int{1, 2, 3, 5, 7, 8} {
+		var data [][]byte
+		for i := 0; i < leaves; i++ {
+			data = append(data, []byte(fmt.Sprintf("tx %d", i)))
+		}
+		tree, err := NewMerkleTree(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := tree.RootNode.Data
+
+		// ceil(log2(leaves)), a single transaction is the root itself
+		length := 0
+		for 1<<uint(length) < leaves {
+			length++
+		}
+
+		for i, d := range data {
+			hash := sha256.Sum256(d)
+			proof := tree.Proof(i)
+			if len(proof) != length {
+				t.Errorf("%d leaves: proof of leaf %d has %d hashes, want %d", leaves, i, len(proof), length)
+			}
+			if !VerifyMerkleProof(hash[:], proof, root) {
+				t.Errorf("%d leaves: the proof of leaf %d does not verify", leaves, i)
+			}
+
+			other := sha256.Sum256([]byte("another tx"))
+			if VerifyMerkleProof(other[:], proof, root) {
+				t.Errorf("%d leaves: the proof of leaf %d verifies another transaction", leaves, i)
+			}
+		}
+
+		if tree.Proof(-1) != nil || tree.Proof(leaves) != nil {
+			t.Errorf("%d leaves: a proof was created for a leaf outside of the tree", leaves)
+		}
+	}
+}
+
+func TestMerkleProofsRejectTampering(t *testing.T) {
+	var data [][]byte
+	for i := 0; i < 5; i++ {
+		data = append(data, []byte(fmt.Sprintf("tx %d", i)))
+	}
+	tree, err := NewMerkleTree(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data[4])
+
+	tests := map[string]func(proof [][]byte) [][]byte{
+		"changed sibling hash": func(proof [][]byte) [][]byte {
+			proof[1][5] ^= 1
+			return proof
+		},
+		"changed direction": func(proof [][]byte) [][]byte {
+			proof[0][0] ^= proofLeftSibling
+			return proof
+		},
+		"missing hash": func(proof [][]byte) [][]byte {
+			return proof[:len(proof)-1]
+		},
+		"extra hash": func(proof [][]byte) [][]byte {
+			return append(proof, proof[0])
+		},
+		"cut off hash": func(proof [][]byte) [][]byte {
+			proof[2] = proof[2][:sha256.Size]
+			return proof
+		},
+	}
+	for name, tamper := range tests {
+		// every test changes its own copy of the proof
+		var proof [][]byte
+		for _, entry := range tree.Proof(4) {
+			proof = append(proof, append([]byte{}, entry...))
+		}
+		if VerifyMerkleProof(hash[:], tamper(proof), tree.RootNode.Data) {
+			t.Errorf("%s: the tampered proof verifies", name)
+		}
+	}
+
+	if VerifyMerkleProof(hash[:], tree.Proof(4), hash[:]) {
+		t.Error("the proof verifies against another root")
+	}
+}
@@ -0,0 +1,297 @@
+// Package metrics holds the metrics of a node and serves them in the Prometheus text format
+//
+// the node only needs counters, gauges and a histogram without labels, and the text format is a few lines per metric, so
+// the package writes it itself instead of depending on the Prometheus client library and the packages it pulls in.
+// Prometheus scrapes it the same way
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// the metrics of the node, they are registered in DefaultRegistry
+var (
+	// BlocksTotal the amount of blocks the node added to its chain, mined or received
+	BlocksTotal = NewCounter("questcoin_blocks_total", "Blocks added to the chain")
+	// TransactionsTotal the amount of transactions in the blocks the node added, coinbase transactions included
+	TransactionsTotal = NewCounter("questcoin_transactions_total", "Transactions in the blocks added to the chain")
+	// MempoolSize the amount of transactions that wait to be mined
+	MempoolSize = NewGauge("questcoin_mempool_size", "Transactions in the memory pool")
+	// UTXOCount the amount of transactions with unspent outputs
+	UTXOCount = NewGauge("questcoin_utxo_count", "Transactions with unspent outputs in the UTXO set")
+	// PeerCount the amount of known nodes
+	PeerCount = NewGauge("questcoin_peer_count", "Known peers")
+	// ChainHeight the height of the last block
+	ChainHeight = NewGauge("questcoin_chain_height", "Height of the last block")
+	// MineDuration how long mining a block took, cancelled and failed attempts included
+	MineDuration = NewHistogram("questcoin_mine_duration_seconds", "Time spent mining a block", []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600})
+)
+
+// DefaultRegistry the registry of the node metrics, served by Handler
+var DefaultRegistry = NewRegistry()
+
+func init() {
+	DefaultRegistry.MustRegister(BlocksTotal, TransactionsTotal, MempoolSize, UTXOCount, PeerCount, ChainHeight, MineDuration)
+}
+
+// Handler serves the metrics of DefaultRegistry
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+// Collector a metric that can be registered
+type Collector interface {
+	Name() string
+	// write writes the metric in the Prometheus text format
+	write(w io.Writer) error
+}
+
+// Counter a value that only goes up
+type Counter struct {
+	name, help string
+	mu         sync.Mutex
+	value      float64
+}
+
+// NewCounter creates a counter that starts at zero
+func NewCounter(name, help string) *Counter {
+	return &Counter{name: name, help: help}
+}
+
+// Name returns the name of the counter
+func (c *Counter) Name() string {
+	return c.name
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds to the counter, negative values are ignored since a counter never goes down
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.value += v
+	c.mu.Unlock()
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+func (c *Counter) write(w io.Writer) error {
+	return writeSample(w, c.name, c.help, "counter", c.Value())
+}
+
+// Gauge a value that goes up and down
+type Gauge struct {
+	name, help string
+	mu         sync.Mutex
+	value      float64
+}
+
+// NewGauge creates a gauge that starts at zero
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{name: name, help: help}
+}
+
+// Name returns the name of the gauge
+func (g *Gauge) Name() string {
+	return g.name
+}
+
+// Set replaces the value of the gauge
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	g.value = v
+	g.mu.Unlock()
+}
+
+// Add adds to the gauge, use a negative value to subtract
+func (g *Gauge) Add(v float64) {
+	g.mu.Lock()
+	g.value += v
+	g.mu.Unlock()
+}
+
+// Value returns the current value of the gauge
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	return writeSample(w, g.name, g.help, "gauge", g.Value())
+}
+
+// Histogram counts observations in buckets, eg. durations
+type Histogram struct {
+	name, help string
+	// upper bounds of the buckets, sorted
+	bounds []float64
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a histogram with the upper bounds of its buckets. A +Inf bucket is always added
+func NewHistogram(name, help string, bounds []float64) *Histogram {
+	sorted := append([]float64{}, bounds...)
+	sort.Float64s(sorted)
+	return &Histogram{name: name, help: help, bounds: sorted, counts: make([]uint64, len(sorted))}
+}
+
+// Name returns the name of the histogram
+func (h *Histogram) Name() string {
+	return h.name
+}
+
+// Observe adds a value to the histogram
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Count returns the amount of observations
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// Sum returns the sum of the observations
+func (h *Histogram) Sum() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sum
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name); err != nil {
+		return err
+	}
+	// the buckets are cumulative, every observation is counted in each bucket it fits in
+	for i, bound := range h.bounds {
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(bound), h.counts[i]); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", h.name, h.count, h.name, formatFloat(h.sum), h.name, h.count)
+	return err
+}
+
+// Registry a set of metrics that are written together
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]Collector
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]Collector)}
+}
+
+// Register adds metrics to the registry. Names have to be unique
+func (r *Registry) Register(collectors ...Collector) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// nothing is registered when one of the names is taken
+	names := make(map[string]bool, len(collectors))
+	for _, c := range collectors {
+		if _, ok := r.metrics[c.Name()]; ok || names[c.Name()] {
+			return fmt.Errorf("metric %s is already registered", c.Name())
+		}
+		names[c.Name()] = true
+	}
+	for _, c := range collectors {
+		r.metrics[c.Name()] = c
+	}
+	return nil
+}
+
+// MustRegister adds metrics to the registry and panics when a name is already registered
+//
+// it is meant for metrics with fixed names that are registered at start up, like the ones of DefaultRegistry in init.
+// A taken name is a bug in the code that registers them, there is nothing the node could do about it at run time. Use
+// Register for names that are only known at run time
+func (r *Registry) MustRegister(collectors ...Collector) {
+	if err := r.Register(collectors...); err != nil {
+		panic(err)
+	}
+}
+
+// Write writes all metrics in the Prometheus text format, ordered by name
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	collectors := make([]Collector, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		collectors = append(collectors, r.metrics[name])
+	}
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics of the registry for Prometheus to scrape
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := r.Write(w); err != nil {
+			slog.Error("Could not write the metrics", "err", err)
+		}
+	})
+}
+
+// writeSample writes a metric with a single value
+func writeSample(w io.Writer, name, help, kind string, value float64) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, formatFloat(value))
+	return err
+}
+
+// formatFloat formats a value the way Prometheus expects it
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
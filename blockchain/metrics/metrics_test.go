@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWritesThePrometheusFormat(t *testing.T) {
+	counter := NewCounter("test_total", "A counter")
+	gauge := NewGauge("test_size", "A gauge")
+	histogram := NewHistogram("test_seconds", "A histogram", []float64{5, 0.5})
+
+	registry := NewRegistry()
+	registry.MustRegister(counter, gauge, histogram)
+
+	counter.Inc()
+	counter.Add(2)
+	gauge.Set(10)
+	gauge.Add(-3)
+	for _, v := range []float64{0.1, 1, 100} {
+		histogram.Observe(v)
+	}
+
+	// ordered by name, the buckets of the histogram are cumulative
+	want := `# HELP test_seconds A histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.5"} 1
+test_seconds_bucket{le="5"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 101.1
+test_seconds_count 3
+# HELP test_size A gauge
+# TYPE test_size gauge
+test_size 7
+# HELP test_total A counter
+# TYPE test_total counter
+test_total 3
+`
+	var buf bytes.Buffer
+	if err := registry.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("wrote\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	rec := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") || rec.Body.String() != want {
+		t.Errorf("served %q as %s, want the written metrics as text", rec.Body.String(), rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestCounterNeverGoesDown(t *testing.T) {
+	counter := NewCounter("test_total", "A counter")
+	counter.Add(2)
+	counter.Add(-1)
+	if v := counter.Value(); v != 2 {
+		t.Errorf("counter %v, want 2", v)
+	}
+}
+
+func TestRegisterRejectsTakenNames(t *testing.T) {
+	registry := NewRegistry()
+	registry.MustRegister(NewCounter("test_total", "A counter"))
+
+	if err := registry.Register(NewGauge("test_total", "A gauge")); err == nil {
+		t.Error("registered a taken name")
+	}
+	// nothing is registered when one of the names is taken
+	if err := registry.Register(NewGauge("test_size", "A gauge"), NewGauge("test_size", "Another gauge")); err == nil {
+		t.Error("registered the same name twice")
+	}
+	if err := registry.Register(NewGauge("test_size", "A gauge")); err != nil {
+		t.Errorf("the name of a rejected registration is taken: %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("MustRegister did not panic on a taken name")
+		}
+	}()
+	registry.MustRegister(NewCounter("test_total", "A counter"))
+}
+
+func TestDefaultRegistryHoldsTheNodeMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	if err := DefaultRegistry.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"questcoin_blocks_total", "questcoin_transactions_total", "questcoin_mempool_size", "questcoin_utxo_count",
+		"questcoin_peer_count", "questcoin_chain_height", "questcoin_mine_duration_seconds",
+	} {
+		if !strings.Contains(buf.String(), "# TYPE "+name+" ") {
+			t.Errorf("%s is not registered", name)
+		}
+	}
+}
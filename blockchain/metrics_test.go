@@ -0,0 +1,93 @@
+package blockchain
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/qhenkart/blockchain/blockchain/metrics"
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// scrape reads the samples of the registry the way Prometheus does, by the name of each sample
+func scrape(t *testing.T, registry *metrics.Registry) map[string]float64 {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := registry.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		value, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		samples[fields[0]] = value
+	}
+	return samples
+}
+
+func TestAddingBlocksUpdatesTheMetrics(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	utxoSet, closeChain := newIndexedUTXOSet(t, address)
+	defer closeChain()
+	chain := utxoSet.Blockchain
+	// keep the difficulty of the genesis block, the blocks are mined as fast as possible
+	chain.Config.RetargetWindow = 0
+
+	// the node metrics are package globals, a registry of our own only holds the ones the chain updates
+	registry := metrics.NewRegistry()
+	registry.MustRegister(metrics.BlocksTotal, metrics.TransactionsTotal, metrics.ChainHeight, metrics.UTXOCount, metrics.MineDuration)
+	before := scrape(t, registry)
+
+	// two mined blocks and a received one
+	var last *Block
+	for height := 1; height <= 2; height++ {
+		coinbase, err := CoinbaseTx(address, "", height, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last, err = chain.MineBlock([]*Transaction{coinbase}); err != nil {
+			t.Fatal(err)
+		}
+		if err := utxoSet.Update(last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := addBlocks(t, chain, last, address, 1)[0]
+	if err := utxoSet.Update(received); err != nil {
+		t.Fatal(err)
+	}
+
+	after := scrape(t, registry)
+	increments := map[string]float64{
+		"questcoin_blocks_total":                3,
+		"questcoin_transactions_total":          3,
+		"questcoin_mine_duration_seconds_count": 2,
+	}
+	for name, want := range increments {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s went up by %v, want %v", name, got, want)
+		}
+	}
+	// the genesis coinbase and the one of each block are unspent
+	if after["questcoin_chain_height"] != 3 || after["questcoin_utxo_count"] != 4 {
+		t.Errorf("height %v and %v unspent transactions, want 3 and 4", after["questcoin_chain_height"], after["questcoin_utxo_count"])
+	}
+
+	// counting the set corrects the gauge
+	metrics.UTXOCount.Set(0)
+	count, err := utxoSet.CountTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := scrape(t, registry)["questcoin_utxo_count"]; got != float64(count) || count != 4 {
+		t.Errorf("counted %d unspent transactions and the gauge is %v, want 4", count, got)
+	}
+}
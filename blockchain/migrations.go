@@ -0,0 +1,141 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// CurrentSchemaVersion the version of the database layout this code reads and writes. Increase it together with a migration
+//
+// version 2 stores the index of every output in the UTXO set
+const CurrentSchemaVersion uint32 = 2
+
+// ErrSchemaTooNew is returned when the database was written by a newer version of the software
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of the software supports")
+
+// the key of the schema version, databases without it were created before the version was stored and are version 1
+var schemaKey = []byte("schema")
+
+// the registered migrations, keyed by the version they upgrade from
+var (
+	migrations   = make(map[uint32]migration)
+	migrationsMu sync.Mutex
+)
+
+type migration struct {
+	to uint32
+	fn func(Storage) error
+}
+
+func init() {
+	RegisterMigration(1, 2, reindexUTXO)
+}
+
+// reindexUTXO rebuilds the UTXO set, so every unspent output is stored with its index
+func reindexUTXO(db Storage) error {
+	chain, err := loadChain(db)
+	if err == ErrKeyNotFound {
+		// there is no chain yet, so there is no UTXO set either
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	utxoSet, err := NewUTXOSet(chain)
+	if err != nil {
+		return err
+	}
+	return utxoSet.Reindex()
+}
+
+// RegisterMigration adds a migration that upgrades a database from one schema version to a later one. Continue runs the
+// migrations in order until the database has the CurrentSchemaVersion
+//
+// the version is only stored after fn returned without an error, so a failed migration runs again on the next start
+func RegisterMigration(from, to uint32, fn func(Storage) error) {
+	if to <= from {
+		panic(fmt.Sprintf("migration from schema %d to %d does not upgrade", from, to))
+	}
+
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	if _, ok := migrations[from]; ok {
+		panic(fmt.Sprintf("a migration from schema %d is already registered", from))
+	}
+	migrations[from] = migration{to, fn}
+}
+
+// SchemaVersion reads the schema version of a database
+func SchemaVersion(db Storage) (uint32, error) {
+	version := uint32(1)
+	err := db.View(func(txn StorageTxn) error {
+		item, err := txn.Get(schemaKey)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if len(data) != 4 {
+			return fmt.Errorf("invalid schema version %x", data)
+		}
+		version = binary.BigEndian.Uint32(data)
+		return nil
+	})
+	return version, err
+}
+
+// setSchemaVersion stores the schema version in a transaction
+func setSchemaVersion(txn StorageTxn, version uint32) error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, version)
+	return txn.Set(schemaKey, data)
+}
+
+// migrateSchema runs the migrations that bring the database from its schema version to the target version
+//
+// nothing is written when the database already has the target version, so read only databases of the same version open fine
+func migrateSchema(db Storage, target uint32) error {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > target {
+		return fmt.Errorf("%w: the database has schema %d, the highest supported is %d", ErrSchemaTooNew, version, target)
+	}
+
+	for version < target {
+		migrationsMu.Lock()
+		m, ok := migrations[version]
+		migrationsMu.Unlock()
+		if !ok {
+			return fmt.Errorf("no migration from schema %d is registered", version)
+		}
+		if m.to > target {
+			return fmt.Errorf("the migration from schema %d goes past schema %d", version, target)
+		}
+
+		slog.Info("Migrating the database", "from", version, "to", m.to)
+		if err := m.fn(db); err != nil {
+			return fmt.Errorf("migration from schema %d to %d: %w", version, m.to, err)
+		}
+		if err := db.Update(func(txn StorageTxn) error {
+			return setSchemaVersion(txn, m.to)
+		}); err != nil {
+			return err
+		}
+		version = m.to
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// registerTestMigration registers a migration for the test and removes it again when the test ends
+func registerTestMigration(t *testing.T, from, to uint32, fn func(Storage) error) {
+	t.Helper()
+
+	RegisterMigration(from, to, fn)
+	t.Cleanup(func() {
+		migrationsMu.Lock()
+		delete(migrations, from)
+		migrationsMu.Unlock()
+	})
+}
+
+// deleteSchemaVersion turns a database into one from before the schema version was stored
+func deleteSchemaVersion(t *testing.T, db Storage) {
+	t.Helper()
+
+	if err := db.Update(func(txn StorageTxn) error {
+		return txn.Delete(schemaKey)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitStoresTheCurrentSchemaVersion(t *testing.T) {
+	chain, closeChain, err := NewTestChain(string(wallet.MakeWallet().Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	version, err := SchemaVersion(chain.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != CurrentSchemaVersion {
+		t.Errorf("schema version %d, want %d", version, CurrentSchemaVersion)
+	}
+
+	// a database of the current version opens without migrations
+	if _, err := ContinueWithStorage(chain.Database); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContinueMigratesFromSchemaVersion1(t *testing.T) {
+	chain, closeChain, err := NewTestChain(string(wallet.MakeWallet().Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+	deleteSchemaVersion(t, chain.Database)
+
+	if version, err := SchemaVersion(chain.Database); err != nil || version != 1 {
+		t.Fatalf("a database without a schema version has version %d, err %v, want 1", version, err)
+	}
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Init doesn't create the UTXO set
+	if _, ok, _ := (UTXOSet{Blockchain: chain}).FindOutput(genesis.Transactions[0].ID, 0); ok {
+		t.Fatal("the UTXO set exists before the migration")
+	}
+
+	continued, err := ContinueWithStorage(chain.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := SchemaVersion(chain.Database); err != nil || version != 2 {
+		t.Errorf("schema version %d after the migration, err %v, want 2", version, err)
+	}
+
+	// the migration to version 2 rebuilt the UTXO set with the output indexes
+	utxoSet := UTXOSet{Blockchain: continued}
+	if _, ok, err := utxoSet.FindOutput(genesis.Transactions[0].ID, 0); err != nil || !ok {
+		t.Errorf("the genesis coinbase is not in the UTXO set after the migration, ok %v err %v", ok, err)
+	}
+}
+
+func TestMigrateSchemaRunsRegisteredMigrations(t *testing.T) {
+	chain, closeChain, err := NewTestChain(string(wallet.MakeWallet().Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	failed := errors.New("failed")
+	fail := true
+	registerTestMigration(t, CurrentSchemaVersion, CurrentSchemaVersion+1, func(db Storage) error {
+		if fail {
+			return failed
+		}
+		return db.Update(func(txn StorageTxn) error {
+			return txn.Set([]byte("migrated"), []byte{1})
+		})
+	})
+
+	// a failed migration keeps the version, so it runs again on the next start
+	if err := migrateSchema(chain.Database, CurrentSchemaVersion+1); !errors.Is(err, failed) {
+		t.Fatalf("migrateSchema returned %v, want the error of the migration", err)
+	}
+	if version, _ := SchemaVersion(chain.Database); version != CurrentSchemaVersion {
+		t.Fatalf("schema version %d after a failed migration, want %d", version, CurrentSchemaVersion)
+	}
+
+	fail = false
+	if err := migrateSchema(chain.Database, CurrentSchemaVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := SchemaVersion(chain.Database); version != CurrentSchemaVersion+1 {
+		t.Errorf("schema version %d, want %d", version, CurrentSchemaVersion+1)
+	}
+	if err := chain.Database.View(func(txn StorageTxn) error {
+		_, err := txn.Get([]byte("migrated"))
+		return err
+	}); err != nil {
+		t.Errorf("the key of the migration was not stored: %v", err)
+	}
+}
+
+func TestContinueRejectsNewerSchemaVersions(t *testing.T) {
+	chain, closeChain, err := NewTestChain(string(wallet.MakeWallet().Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	if err := chain.Database.Update(func(txn StorageTxn) error {
+		return setSchemaVersion(txn, CurrentSchemaVersion+1)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ContinueWithStorage(chain.Database); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("ContinueWithStorage returned %v, want ErrSchemaTooNew", err)
+	}
+}
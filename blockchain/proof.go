@@ -2,12 +2,14 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
 	"math"
 	"math/big"
+	"runtime"
 )
 
 // take data from block
@@ -26,37 +28,86 @@ import (
 // a growing number of minors as well as the increase in computation power of computers in general
 //
 // the goal is to make the amount of time to mine a block to be about the same over time. So this number should increase slowly over time and depending on how many people are mining
+//
+// Difficulty is the starting difficulty of a chain, afterwards it is adjusted by RetargetDifficulty. Blocks stored without a difficulty use it as well
 const Difficulty = 12
 
+// how many nonces are tried between checks for cancellation
+const cancelCheckInterval = 1000
+
+// how many nonces are tried between progress reports
+const progressInterval = 10000
+
+// ErrNonceExhausted is returned when every nonce has been tried without finding a valid hash
+var ErrNonceExhausted = errors.New("nonce range exhausted")
+
 // ProofOfWork defines the conensus algorithm and requirement for signing a new block
 //
 // requirement of computational power so that the block on the block chain can be signed
 type ProofOfWork struct {
 	Block *Block
+	// the amount of leading zero bits the hash needs
+	Difficulty int
 	// number that repreents the difficulty
 	Target *big.Int
+	// Progress is called every progressInterval nonces with the latest hash. Optional
+	Progress func(nonce int, hash []byte)
+	// the merkle root of the block transactions, it is the same for every nonce
+	merkleRoot []byte
+}
+
+// MinerConfig the settings of the miner
+type MinerConfig struct {
+	// the amount of goroutines that run the PoW
+	NumWorkers int
+}
+
+// DefaultMinerConfig runs one worker for each CPU
+func DefaultMinerConfig() MinerConfig {
+	return MinerConfig{NumWorkers: runtime.NumCPU()}
+}
+
+// NewProof creates a new PoW by assigning the block and the target of the difficulty
+//
+// the transactions of the block are hashed once, they must not change while the PoW runs. Returns ErrNoTransactions for a
+// block without any
+func NewProof(b *Block, difficulty int) (*ProofOfWork, error) {
+	merkleRoot, err := b.HashTransactions()
+	if err != nil {
+		return nil, err
+	}
+
+	pow := &ProofOfWork{Block: b, Difficulty: difficulty, Target: target(difficulty), merkleRoot: merkleRoot}
+
+	return pow, nil
 }
 
-// NewProof creates a new PoW by assigning the block and the target
-func NewProof(b *Block) *ProofOfWork {
+// target creates the number a hash has to be below to meet the difficulty
+func target(difficulty int) *big.Int {
 	target := big.NewInt(1)
 	// 256 is the number of bytes inside of the hash
 	// left shift
-	target.Lsh(target, uint(256-Difficulty))
+	target.Lsh(target, uint(256-difficulty))
 
-	pow := &ProofOfWork{b, target}
-
-	return pow
+	return target
 }
 
-// InitData takes the previous hash and the hashed transaction, combines them together
+// InitData takes the previous hash, the hashed transactions and the timestamp, combines them together
+//
+// the timestamp is part of the data so a new range of nonces can be tried by moving the timestamp forward
 func (pow *ProofOfWork) InitData(nonce int) []byte {
+	return powData(pow.Block.PrevHash, pow.merkleRoot, pow.Block.Timestamp, nonce, pow.Difficulty)
+}
+
+// powData joins the fields that are hashed by the PoW
+func powData(prevHash, merkleRoot []byte, timestamp int64, nonce, difficulty int) []byte {
 	data := bytes.Join(
 		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
+			prevHash,
+			merkleRoot,
+			ToHex(timestamp),
 			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
+			ToHex(int64(difficulty)),
 		},
 		[]byte{},
 	)
@@ -64,35 +115,117 @@ func (pow *ProofOfWork) InitData(nonce int) []byte {
 	return data
 }
 
-// Run runs the PoW
-func (pow *ProofOfWork) Run() (int, []byte) {
+// Run runs the PoW. Returns ErrNonceExhausted when no valid nonce exists for the block
+func (pow *ProofOfWork) Run() (int, []byte, error) {
+	return pow.RunContext(context.Background())
+}
+
+// RunContext runs the PoW until a valid nonce is found or the context is cancelled. The context is checked every 1000 nonces
+//
+// ErrNonceExhausted is returned when every nonce has been tried, the block data has to change before running it again
+func (pow *ProofOfWork) RunContext(ctx context.Context) (int, []byte, error) {
+	nonce, hash, err := pow.runRange(ctx, 0, math.MaxInt64, true)
+	fmt.Println()
+
+	return nonce, hash, err
+}
+
+// RunWithContext runs the PoW like RunContext
+//
+// Deprecated: use RunContext, which checks the context every 1000 nonces instead of every 10000
+func (pow *ProofOfWork) RunWithContext(ctx context.Context) (int, []byte, error) {
+	return pow.RunContext(ctx)
+}
+
+// RunParallel runs the PoW on multiple goroutines. The nonces are split into equal ranges, one for each worker
+//
+// the first worker that finds a valid nonce cancels the others. Only the first worker reports the progress
+func (pow *ProofOfWork) RunParallel(ctx context.Context, workers int) (int, []byte, error) {
+	if workers < 2 {
+		return pow.RunContext(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		nonce int
+		hash  []byte
+		err   error
+	}
+	// buffered so the cancelled workers can always send their result and exit
+	results := make(chan result, workers)
+
+	size := math.MaxInt64 / workers
+	for i := 0; i < workers; i++ {
+		from, to := i*size, (i+1)*size
+		// the last range takes the remainder of the division
+		if i == workers-1 {
+			to = math.MaxInt64
+		}
+
+		go func(from, to int, report bool) {
+			nonce, hash, err := pow.runRange(ctx, from, to, report)
+			results <- result{nonce, hash, err}
+		}(from, to, i == 0)
+	}
+
+	// the nonces are only exhausted once every worker ran out of nonces
+	for i := 0; i < workers; i++ {
+		res := <-results
+		if res.err == ErrNonceExhausted {
+			continue
+		}
+
+		fmt.Println()
+		return res.nonce, res.hash, res.err
+	}
+
+	fmt.Println()
+	return 0, nil, ErrNonceExhausted
+}
+
+// runRange tries the nonces from the start of the range up to, but not including, the end
+func (pow *ProofOfWork) runRange(ctx context.Context, from, to int, report bool) (int, []byte, error) {
 	var intHash big.Int
 	var hash [32]byte
 
-	nonce := 0
+	for nonce := from; nonce < to; nonce++ {
+		// checking the context on every nonce would slow the loop down
+		if (nonce-from)%cancelCheckInterval == 0 {
+			select {
+			case <-ctx.Done():
+				return nonce, nil, ctx.Err()
+			default:
+			}
+		}
 
-	// run forever (virtually)
-	for nonce < math.MaxInt64 {
 		// joins the previous hash, the current hash, the nonce and the difficulty into a 2d slice of bytes
 		data := pow.InitData(nonce)
 		// hash the bytes
 		hash = sha256.Sum256(data)
 
-		fmt.Printf("\r%x", hash)
+		// report the progress to the caller instead of printing every hash
+		if report {
+			if pow.Progress != nil {
+				if (nonce-from)%progressInterval == 0 {
+					pow.Progress(nonce, hash[:])
+				}
+			} else {
+				fmt.Printf("\r%x", hash)
+			}
+		}
 
 		// set the result to the big integer
 		intHash.SetBytes(hash[:])
 
 		// less than the target we are looking for. Block is signed
 		if intHash.Cmp(pow.Target) == -1 {
-			break
+			return nonce, hash[:], nil
 		}
-		nonce++
-
 	}
 
-	fmt.Println()
-	return nonce, hash[:]
+	return 0, nil, ErrNonceExhausted
 }
 
 // Validate after running PoW we can quickly validate if it is valid.
@@ -109,13 +242,24 @@ func (pow *ProofOfWork) Validate() bool {
 	return intHash.Cmp(pow.Target) == -1
 }
 
-// ToHex creates a new bytes buffer from an int64
-func ToHex(num int64) []byte {
-	buff := new(bytes.Buffer)
-	err := binary.Write(buff, binary.BigEndian, num)
-	if err != nil {
-		log.Panic(err)
+// Validate checks the PoW of a header without needing the block transactions
+func (h *BlockHeader) Validate() bool {
+	var intHash big.Int
+
+	difficulty := effectiveDifficulty(h.Difficulty)
+	hash := sha256.Sum256(powData(h.PrevHash, h.MerkleRoot, h.Timestamp, h.Nonce, difficulty))
+	if !bytes.Equal(hash[:], h.Hash) {
+		return false
 	}
 
-	return buff.Bytes()
+	intHash.SetBytes(hash[:])
+	return intHash.Cmp(target(difficulty)) == -1
+}
+
+// ToHex encodes an int64 into 8 big endian bytes
+func ToHex(num int64) []byte {
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint64(buff, uint64(num))
+
+	return buff
 }
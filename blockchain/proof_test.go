@@ -0,0 +1,118 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// unsolvableProof a PoW whose target no hash can be below, it only ends when it is cancelled
+func unsolvableProof(t *testing.T) *ProofOfWork {
+	t.Helper()
+
+	block := &Block{Timestamp: time.Now().Unix(), Transactions: []*Transaction{{ID: []byte("tx")}}, PrevHash: []byte("previous")}
+	pow, err := NewProof(block, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pow.Progress = func(int, []byte) {}
+	return pow
+}
+
+func TestRunContextStopsWhenCancelled(t *testing.T) {
+	for name, run := range map[string]func(*ProofOfWork, context.Context) (int, []byte, error){
+		"RunContext":     (*ProofOfWork).RunContext,
+		"RunWithContext": (*ProofOfWork).RunWithContext,
+	} {
+		pow := unsolvableProof(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		// the progress is reported at the first nonce, the context is checked again after cancelCheckInterval nonces
+		pow.Progress = func(int, []byte) { cancel() }
+
+		nonce, hash, err := run(pow, ctx)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s returned %v, want context.Canceled", name, err)
+		}
+		if hash != nil {
+			t.Errorf("%s returned a hash for a cancelled run", name)
+		}
+		if nonce > cancelCheckInterval {
+			t.Errorf("%s stopped at nonce %d, more than %d nonces after it was cancelled", name, nonce, cancelCheckInterval)
+		}
+	}
+}
+
+func TestRunParallelStopsWhenCancelled(t *testing.T) {
+	pow := unsolvableProof(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := pow.RunParallel(ctx, 4)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("RunParallel returned %v, want context.DeadlineExceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunParallel kept running after the context was done")
+	}
+}
+
+// solvableProof a PoW of a block that differs for every seed, so each run searches for another nonce
+func solvableProof(tb testing.TB, seed, difficulty int) *ProofOfWork {
+	tb.Helper()
+
+	block := &Block{Timestamp: time.Now().Unix(), Transactions: []*Transaction{{ID: []byte("tx")}}, PrevHash: []byte(fmt.Sprint(seed))}
+	pow, err := NewProof(block, difficulty)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pow.Progress = func(int, []byte) {}
+	return pow
+}
+
+func TestRunParallelFindsAValidNonce(t *testing.T) {
+	for _, workers := range []int{1, 2, 4} {
+		pow := solvableProof(t, workers, 8)
+		nonce, hash, err := pow.RunParallel(context.Background(), workers)
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		pow.Block.Nonce = nonce
+		if !pow.Validate() || len(hash) == 0 {
+			t.Errorf("%d workers found the invalid nonce %d", workers, nonce)
+		}
+	}
+}
+
+// BenchmarkRunParallel compares a single worker with more workers on a high difficulty. The time per block should
+// drop almost linearly with the workers up to the amount of CPUs, and no further with twice as many workers
+func BenchmarkRunParallel(b *testing.B) {
+	var counts []int
+	for workers := 1; workers < runtime.NumCPU(); workers *= 2 {
+		counts = append(counts, workers)
+	}
+	counts = append(counts, runtime.NumCPU(), 2*runtime.NumCPU())
+
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				pow := solvableProof(b, i, 20)
+				b.StartTimer()
+
+				if _, _, err := pow.RunParallel(context.Background(), workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package blockchain
+
+// the race detector turns on checkptr, which the bloom filter Badger 1.6 depends on fails
+const raceEnabled = true
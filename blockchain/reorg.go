@@ -0,0 +1,286 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/qhenkart/blockchain/blockchain/metrics"
+)
+
+const (
+	// the amount of reorganization events that are kept until they are read, newer events are dropped when it is full
+	reorgBuffer = 10
+)
+
+var (
+	// ErrOrphanBlock is returned by AddBlock when the previous block of the block is unknown, it waits in the orphan pool
+	ErrOrphanBlock = errors.New("previous block is unknown, the block is kept as an orphan")
+	// ErrNoCommonAncestor is returned when a fork does not share any block with the chain, eg. it has another genesis block
+	ErrNoCommonAncestor = errors.New("fork has no common ancestor with the chain")
+)
+
+// ChainReorg describes a reorganization of the chain onto a longer fork
+type ChainReorg struct {
+	// the tips before and after the reorganization
+	OldTip []byte
+	NewTip []byte
+	// the last block both the old chain and the fork contain
+	CommonAncestor []byte
+	// the blocks that were removed from the chain, the newest first
+	Disconnected []*Block
+	// the blocks of the fork that were added to the chain, the oldest first
+	Connected []*Block
+}
+
+// Reorgs returns a channel that receives an event for every reorganization of the chain
+//
+// the channel is shared by all callers. Events are dropped while the channel is full, so the chain never waits for a reader
+func (chain *Blockchain) Reorgs() <-chan ChainReorg {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	if chain.reorgs == nil {
+		chain.reorgs = make(chan ChainReorg, reorgBuffer)
+	}
+	return chain.reorgs
+}
+
+// Reorganize moves the chain onto the fork that ends with newTip. The fork has to be stored already, eg. by AddBlock
+//
+// the chain is walked back to the block the fork shares with it. The transactions of the blocks after that block are rolled
+// back in the UTXO set, then the blocks of the fork are verified and applied in order, all in one transaction. A ChainReorg
+// event is sent once the chain moved. Unlike AddBlock it moves the chain even when the fork has less work.
+// Returns an error matching ErrInvalidBlock when a block of the fork breaks the consensus rules, the chain stays where it was
+func (chain *Blockchain) Reorganize(newTip *Block) error {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	fork, err := chain.forkTo(newTip)
+	if err != nil {
+		return err
+	}
+	return chain.reorganize(fork)
+}
+
+// forkTo walks back from the tip of the chain and newTip until they meet. The chain lock must be held
+//
+// the returned event holds the blocks that would be disconnected and connected to move the chain onto newTip
+func (chain *Blockchain) forkTo(newTip *Block) (ChainReorg, error) {
+	oldTip, err := chain.GetBlock(chain.lastHash)
+	if err != nil {
+		return ChainReorg{}, err
+	}
+
+	// step back on the higher branch, or on both at the same height, until they meet
+	var disconnected, connected []*Block
+	old, fork := &oldTip, newTip
+	for !bytes.Equal(old.Hash, fork.Hash) {
+		oldHeight, forkHeight := old.Height, fork.Height
+		if oldHeight >= forkHeight {
+			disconnected = append(disconnected, old)
+			if old, err = chain.parentOf(old); err != nil {
+				return ChainReorg{}, err
+			}
+		}
+		if forkHeight >= oldHeight {
+			connected = append([]*Block{fork}, connected...)
+			if fork, err = chain.parentOf(fork); err != nil {
+				return ChainReorg{}, err
+			}
+		}
+	}
+
+	return ChainReorg{oldTip.Hash, newTip.Hash, old.Hash, disconnected, connected}, nil
+}
+
+// reorganize moves the chain onto a fork found by forkTo. The chain lock must be held
+//
+// the rollback of the old blocks, the index rewrite and the update of the UTXO set with the new blocks are written in the
+// same transaction. If a block of the fork is invalid none of it is committed, and the block and the fork blocks after it
+// are deleted
+func (chain *Blockchain) reorganize(fork ChainReorg) error {
+	// the chain already ends with the tip
+	if len(fork.Connected) == 0 {
+		return nil
+	}
+
+	// the heights, timestamps and difficulties were checked when AddBlock stored the blocks, Reorganize accepts any stored fork
+	prev, err := chain.parentOf(fork.Connected[0])
+	if err != nil {
+		return err
+	}
+	for i, block := range fork.Connected {
+		if err := checkProof(block); err != nil {
+			return chain.dropFork(fork.Connected[i:], err)
+		}
+		if err := chain.checkParent(block, prev); err != nil {
+			return chain.dropFork(fork.Connected[i:], err)
+		}
+		prev = block
+	}
+
+	utxoSet, err := NewUTXOSet(chain)
+	if err != nil {
+		return err
+	}
+
+	// the change of the amount of transactions with unspent outputs, applied to the metric once the transaction is committed
+	var added int
+	invalid := -1
+	err = chain.Database.Update(func(txn StorageTxn) error {
+		added = 0
+
+		// the transaction index still points to the spent outputs of the old chain while its blocks are rolled back
+		for _, block := range fork.Disconnected {
+			n, err := utxoSet.rollback(txn, block)
+			if err != nil {
+				return err
+			}
+			added += n
+
+			if err := txn.Delete(heightKey(block.Height)); err != nil {
+				return err
+			}
+			for _, tx := range block.Transactions {
+				if err := txn.Delete(txKey(tx.ID)); err != nil {
+					return err
+				}
+			}
+		}
+
+		// every block spends the outputs of the blocks before it, so each is verified and indexed before the next one
+		for i, block := range fork.Connected {
+			if err := chain.verifyTransactions(txn, block); err != nil {
+				invalid = i
+				return err
+			}
+			n, err := utxoSet.update(txn, block)
+			if err != nil {
+				return err
+			}
+			added += n
+
+			if err := indexBlock(txn, block); err != nil {
+				return err
+			}
+		}
+
+		return txn.Set([]byte("lh"), fork.NewTip)
+	})
+	if invalid >= 0 {
+		return chain.dropFork(fork.Connected[invalid:], err)
+	}
+	if err != nil {
+		return err
+	}
+
+	chain.lastHash = fork.NewTip
+	metrics.ChainHeight.Set(float64(fork.Connected[len(fork.Connected)-1].Height))
+	metrics.UTXOCount.Add(float64(added))
+
+	chain.emitReorg(fork)
+	return nil
+}
+
+// dropFork deletes the invalid block, the first of blocks, and the blocks of the fork that build on it. The chain lock must be held
+//
+// returns the reason the block is invalid, it matches ErrInvalidBlock
+func (chain *Blockchain) dropFork(blocks []*Block, reason error) error {
+	err := chain.Database.Update(func(txn StorageTxn) error {
+		for _, block := range blocks {
+			if err := txn.Delete(block.Hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return invalidBlock{fmt.Errorf("block %x: %w", blocks[0].Hash, reason)}
+}
+
+// parentOf reads the previous block of a block. Returns ErrNoCommonAncestor for the genesis block
+func (chain *Blockchain) parentOf(block *Block) (*Block, error) {
+	if len(block.PrevHash) == 0 {
+		return nil, ErrNoCommonAncestor
+	}
+
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return nil, err
+	}
+	return &parent, nil
+}
+
+// emitReorg sends the event without waiting, nobody listens until Reorgs is called. The chain lock must be held
+func (chain *Blockchain) emitReorg(event ChainReorg) {
+	select {
+	case chain.reorgs <- event:
+	default:
+	}
+}
+
+// addOrphan keeps a block until its previous block arrives. The chain lock must be held
+//
+// when the pool holds Config.MaxOrphanBlocks blocks the oldest orphan is dropped, its previous block is the least likely to arrive
+func (chain *Blockchain) addOrphan(block *Block) {
+	if chain.OrphanPool == nil {
+		chain.OrphanPool = make(map[string]*Block)
+	}
+
+	key := hex.EncodeToString(block.Hash)
+	if _, ok := chain.OrphanPool[key]; ok {
+		return
+	}
+
+	limit := chain.Config.MaxOrphanBlocks
+	if limit <= 0 {
+		limit = DefaultChainConfig().MaxOrphanBlocks
+	}
+	for len(chain.OrphanPool) >= limit && len(chain.orphanOrder) > 0 {
+		chain.removeOrphan(chain.orphanOrder[0])
+	}
+
+	chain.OrphanPool[key] = block
+	chain.orphanOrder = append(chain.orphanOrder, key)
+}
+
+// removeOrphan deletes a block from the orphan pool. The chain lock must be held
+func (chain *Blockchain) removeOrphan(key string) {
+	delete(chain.OrphanPool, key)
+	for i, k := range chain.orphanOrder {
+		if k == key {
+			chain.orphanOrder = append(chain.orphanOrder[:i], chain.orphanOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// connectOrphans adds the orphans that build on the block with the hash, then the orphans that build on them. The chain lock must be held
+func (chain *Blockchain) connectOrphans(hash []byte) error {
+	parents := [][]byte{hash}
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+
+		for key, orphan := range chain.OrphanPool {
+			if !bytes.Equal(orphan.PrevHash, parent) {
+				continue
+			}
+			chain.removeOrphan(key)
+			// the orphan is dropped, and the blocks that build on it stay orphans until they are evicted
+			if err := chain.addBlock(orphan); errors.Is(err, ErrInvalidTimestamp) || errors.Is(err, ErrInvalidBlock) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			parents = append(parents, orphan.Hash)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,338 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// addBlocks adds a branch of n blocks on top of prev and returns them, the oldest first
+func addBlocks(t *testing.T, chain *Blockchain, prev *Block, address string, n int) []*Block {
+	t.Helper()
+
+	var blocks []*Block
+	for i := 0; i < n; i++ {
+		block := blockOn(t, prev, address)
+		if block == nil {
+			t.FailNow()
+		}
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+		prev = block
+	}
+	return blocks
+}
+
+// assertUnspent checks whether the coinbase of the block is in the UTXO set
+func assertUnspent(t *testing.T, utxoSet *UTXOSet, block *Block, want bool) {
+	t.Helper()
+
+	_, ok, err := utxoSet.FindOutput(block.Transactions[0].ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != want {
+		t.Errorf("coinbase of block %d unspent: %v, want %v", block.Height, ok, want)
+	}
+}
+
+func TestAddBlockReorganizesOntoTheForkWithMoreWork(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	utxoSet, closeChain := newIndexedUTXOSet(t, address)
+	defer closeChain()
+	chain := utxoSet.Blockchain
+	reorgs := chain.Reorgs()
+
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := addBlocks(t, chain, genesis, address, 1)
+	if err := utxoSet.Update(main[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first fork block has the same work as the chain, the first block seen stays the tip
+	fork := addBlocks(t, chain, genesis, address, 1)
+	if !bytes.Equal(chain.GetLastHash(), main[0].Hash) {
+		t.Fatal("the chain moved onto a fork with the same work")
+	}
+
+	fork = append(fork, addBlocks(t, chain, fork[0], address, 1)...)
+	if !bytes.Equal(chain.GetLastHash(), fork[1].Hash) {
+		t.Fatal("the chain did not move onto the fork with more work")
+	}
+
+	for height, block := range fork {
+		stored, err := chain.GetBlockByHeight(height + 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(stored.Hash, block.Hash) {
+			t.Errorf("height %d is indexed to %x, want the fork block %x", height+1, stored.Hash, block.Hash)
+		}
+	}
+	if _, err := chain.FindTransaction(main[0].Transactions[0].ID); err == nil {
+		t.Error("the transaction index still holds the coinbase of the disconnected block")
+	}
+	assertUnspent(t, utxoSet, main[0], false)
+	assertUnspent(t, utxoSet, fork[0], true)
+	assertUnspent(t, utxoSet, fork[1], true)
+
+	select {
+	case event := <-reorgs:
+		if !bytes.Equal(event.CommonAncestor, genesis.Hash) || len(event.Disconnected) != 1 || len(event.Connected) != 2 {
+			t.Errorf("reorg from ancestor %x disconnected %d and connected %d blocks, want the genesis block, 1 and 2",
+				event.CommonAncestor, len(event.Disconnected), len(event.Connected))
+		}
+	default:
+		t.Error("no reorganization event was sent")
+	}
+}
+
+func TestAddBlockRejectsInvalidBlocks(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := CoinbaseTx(address, "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]func() *Block{
+		"changed nonce": func() *Block {
+			block := blockOn(t, genesis, address)
+			block.Nonce++
+			return block
+		},
+		"below the difficulty": func() *Block {
+			block, err := CreateBlock([]*Transaction{coinbase}, genesis.Hash, 1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return block
+		},
+		// a fork can't claim a height to look longer than it is
+		"claimed height": func() *Block {
+			block, err := CreateBlock([]*Transaction{coinbase}, genesis.Hash, 5, Difficulty)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return block
+		},
+		"unsigned transaction": func() *Block {
+			spend := &Transaction{
+				Inputs:  []TxInput{{ID: genesis.Transactions[0].ID, Out: 0}},
+				Outputs: []TxOutput{{Value: genesis.Transactions[0].Outputs[0].Value, PubKeyHash: wallet.MakeWallet().PubKeyHash()}},
+			}
+			hashTx(t, spend)
+			block, err := CreateBlock([]*Transaction{coinbase, spend}, genesis.Hash, 1, Difficulty)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return block
+		},
+	}
+	for name, invalid := range tests {
+		t.Run(name, func(t *testing.T) {
+			block := invalid()
+			if err := chain.AddBlock(block); !errors.Is(err, ErrInvalidBlock) {
+				t.Fatalf("AddBlock returned %v, want ErrInvalidBlock", err)
+			}
+			if _, err := chain.GetBlock(block.Hash); err == nil {
+				t.Error("the invalid block was stored")
+			}
+			if !bytes.Equal(chain.GetLastHash(), genesis.Hash) {
+				t.Error("the invalid block became the tip")
+			}
+		})
+	}
+}
+
+func TestAddBlockLeavesTheChainWhenAForkBlockIsInvalid(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	utxoSet, closeChain := newIndexedUTXOSet(t, address)
+	defer closeChain()
+	chain := utxoSet.Blockchain
+
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := addBlocks(t, chain, genesis, address, 1)
+	if err := utxoSet.Update(main[0]); err != nil {
+		t.Fatal(err)
+	}
+	fork := addBlocks(t, chain, genesis, address, 1)
+
+	// the transactions of a fork block are only verified once the chain moves onto the fork
+	coinbase, err := CoinbaseTx(address, "", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend := &Transaction{
+		Inputs:  []TxInput{{ID: genesis.Transactions[0].ID, Out: 0}},
+		Outputs: []TxOutput{{Value: 1, PubKeyHash: wallet.MakeWallet().PubKeyHash()}},
+	}
+	hashTx(t, spend)
+	invalid, err := CreateBlock([]*Transaction{coinbase, spend}, fork[0].Hash, 2, Difficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chain.AddBlock(invalid); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("AddBlock returned %v, want ErrInvalidBlock", err)
+	}
+
+	// the rollback of the chain was part of the reorganization, so it was not committed either
+	if !bytes.Equal(chain.GetLastHash(), main[0].Hash) {
+		t.Error("the chain moved onto the invalid fork")
+	}
+	stored, err := chain.GetBlockByHeight(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.Hash, main[0].Hash) {
+		t.Error("the height index was rewritten")
+	}
+	assertUnspent(t, utxoSet, main[0], true)
+	assertUnspent(t, utxoSet, fork[0], false)
+	if _, err := chain.GetBlock(invalid.Hash); err == nil {
+		t.Error("the invalid fork block is still stored")
+	}
+}
+
+func TestWorkDoublesWithEveryDifficultyStep(t *testing.T) {
+	easy := []*Block{{Difficulty: 12}, {Difficulty: 12}, {Difficulty: 12}}
+	hard := []*Block{{Difficulty: 14}}
+
+	// three blocks are higher, the single block has more work
+	if chainWork(hard).Cmp(chainWork(easy)) <= 0 {
+		t.Errorf("work of difficulty 14 is %s, not more than three blocks of difficulty 12 with %s", chainWork(hard), chainWork(easy))
+	}
+	if (&Block{}).Work().Cmp((&Block{Difficulty: Difficulty}).Work()) != 0 {
+		t.Error("a block without a difficulty does not have the work of the Difficulty constant")
+	}
+}
+
+// chainOf creates n blocks on top of prev without adding them, the oldest first
+func chainOf(t *testing.T, prev *Block, address string, n int) []*Block {
+	t.Helper()
+
+	var blocks []*Block
+	for i := 0; i < n; i++ {
+		block := blockOn(t, prev, address)
+		if block == nil {
+			t.FailNow()
+		}
+		blocks = append(blocks, block)
+		prev = block
+	}
+	return blocks
+}
+
+// assertMainChain checks that the blocks are the main chain on top of the genesis block and that no orphans are left
+func assertMainChain(t *testing.T, chain *Blockchain, blocks []*Block) {
+	t.Helper()
+
+	stored, err := chain.GetBlocksByHeightRange(1, len(blocks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(blocks) {
+		t.Fatalf("%d blocks on the main chain, want %d", len(stored), len(blocks))
+	}
+	for i, block := range blocks {
+		if !bytes.Equal(stored[i].Hash, block.Hash) {
+			t.Errorf("block %d of the main chain is %x, want %x", i+1, stored[i].Hash, block.Hash)
+		}
+	}
+	if len(chain.OrphanPool) != 0 {
+		t.Errorf("%d orphans are left", len(chain.OrphanPool))
+	}
+}
+
+func TestAddBlockConnectsOrphansThatArriveOutOfOrder(t *testing.T) {
+	orders := map[string][]int{
+		"reversed": {4, 3, 2, 1, 0},
+		"shuffled": {2, 0, 4, 1, 3},
+	}
+	for name, order := range orders {
+		t.Run(name, func(t *testing.T) {
+			address := string(wallet.MakeWallet().Address())
+			chain, closeChain, err := NewTestChain(address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeChain()
+			genesis, err := chain.Genesis()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			blocks := chainOf(t, genesis, address, len(order))
+			for _, i := range order {
+				// only a block whose previous block is on the chain connects
+				err := chain.AddBlock(blocks[i])
+				if _, known := chain.OrphanPool[hex.EncodeToString(blocks[i].Hash)]; known != errors.Is(err, ErrOrphanBlock) {
+					t.Fatalf("block %d returned %v, in the orphan pool %v", i+1, err, known)
+				}
+				if err != nil && !errors.Is(err, ErrOrphanBlock) {
+					t.Fatal(err)
+				}
+			}
+			assertMainChain(t, chain, blocks)
+		})
+	}
+}
+
+func TestAddBlockEvictsTheOldestOrphan(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+	chain.Config.MaxOrphanBlocks = 2
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := chainOf(t, genesis, address, 5)
+	for _, block := range blocks[2:] {
+		if err := chain.AddBlock(block); !errors.Is(err, ErrOrphanBlock) {
+			t.Fatalf("block %d returned %v, want ErrOrphanBlock", block.Height, err)
+		}
+	}
+	if _, ok := chain.OrphanPool[hex.EncodeToString(blocks[2].Hash)]; ok || len(chain.OrphanPool) != 2 {
+		t.Fatalf("%d orphans with block 3 in the pool %v, want the 2 newest", len(chain.OrphanPool), ok)
+	}
+
+	// the orphans after the evicted block wait for it
+	for _, block := range blocks[:2] {
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if height, err := chain.GetBestHeight(); err != nil || height != 2 {
+		t.Fatalf("best height %d, %v, want 2", height, err)
+	}
+	if err := chain.AddBlock(blocks[2]); err != nil {
+		t.Fatal(err)
+	}
+	assertMainChain(t, chain, blocks)
+}
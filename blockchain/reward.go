@@ -0,0 +1,32 @@
+package blockchain
+
+// minBlockReward the reward never halves below this, miners are always paid something
+const minBlockReward = 1
+
+// BlockReward the amount of new tokens the coinbase of the block at the height may pay, with the default chain config
+//
+// starts at 50 and halves every 210000 blocks, like Bitcoin
+func BlockReward(height int) int {
+	return DefaultChainConfig().BlockReward(height)
+}
+
+// BlockReward the amount of new tokens the coinbase of the block at the height may pay
+//
+// the reward starts at InitialReward and halves every HalvingInterval blocks, down to a minimum of 1.
+// Without an interval the reward never halves
+func (c ChainConfig) BlockReward(height int) int {
+	if height < 0 {
+		height = 0
+	}
+
+	reward := c.InitialReward
+	if c.HalvingInterval > 0 {
+		// shifting past the width of an int gives 0, then the minimum applies
+		reward >>= uint(height / c.HalvingInterval)
+	}
+
+	if reward < minBlockReward {
+		return minBlockReward
+	}
+	return reward
+}
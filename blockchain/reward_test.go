@@ -0,0 +1,58 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+func TestBlockRewardHalves(t *testing.T) {
+	const maxInt = int(^uint(0) >> 1)
+	tests := []struct {
+		height, reward int
+	}{
+		{-1, 50},
+		{0, 50},
+		{209999, 50},
+		{210000, 25},
+		{419999, 25},
+		{420000, 12},
+		{630000, 6},
+		{840000, 3},
+		{1050000, 1},
+		// 50 halved 6 times is 0, the minimum applies from here on
+		{1260000, minBlockReward},
+		{maxInt, minBlockReward},
+	}
+	for _, test := range tests {
+		if reward := BlockReward(test.height); reward != test.reward {
+			t.Errorf("height %d: reward %d, want %d", test.height, reward, test.reward)
+		}
+	}
+
+	config := DefaultChainConfig()
+	config.InitialReward, config.HalvingInterval = 20, 10
+	for height, want := range map[int]int{9: 20, 10: 10, 20: 5, 30: 2, 40: 1, 50: 1} {
+		if reward := config.BlockReward(height); reward != want {
+			t.Errorf("every 10 blocks, height %d: reward %d, want %d", height, reward, want)
+		}
+	}
+	// without an interval the reward never halves
+	config.HalvingInterval = 0
+	if reward := config.BlockReward(maxInt); reward != 20 {
+		t.Errorf("reward %d without halvings, want 20", reward)
+	}
+}
+
+func TestCoinbasePaysTheRewardOfItsHeight(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	for _, height := range []int{0, 210000, 420000} {
+		coinbase, err := CoinbaseTx(address, "", height, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := BlockReward(height) + 3; coinbase.Outputs[0].Value != want {
+			t.Errorf("height %d: coinbase pays %d, want the reward and fees of %d", height, coinbase.Outputs[0].Value, want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/qhenkart/blockchain/blockchain/metrics"
+)
+
+const (
+	// the largest record we read from a snapshot, protects against allocating huge buffers for corrupted lengths
+	maxSnapshotRecord = 32 << 20
+	// the amount of entries written in one badger transaction when a snapshot is imported
+	snapshotBatchSize = 10000
+)
+
+// ErrSnapshotMismatch is returned when a snapshot was exported from a block that is not part of this chain
+var ErrSnapshotMismatch = errors.New("snapshot does not match the chain")
+
+// snapshotHeader the first record of a snapshot, identifies the block the UTXO set belongs to
+type snapshotHeader struct {
+	BestHash []byte
+	Height   int
+	// the amount of entries that follow, so a truncated snapshot is noticed
+	Entries int
+}
+
+// snapshotEntry the unspent outputs of a single transaction
+type snapshotEntry struct {
+	TxID    []byte
+	Outputs TxOutputs
+}
+
+// ExportSnapshot writes the UTXO set to the writer, so new nodes don't have to replay the entire chain to build it
+//
+// every record is a gob prefixed with its length as a 4 byte big endian value. The first record holds the best hash
+// and height at the time of the export, the others hold the unspent outputs of one transaction each
+func (u UTXOSet) ExportSnapshot(w io.Writer) error {
+	// one read transaction, so the last hash and the outputs belong together
+	return u.Blockchain.Database.View(func(txn StorageTxn) error {
+		lastBlock, err := lastBlockOf(txn)
+		if err != nil {
+			return err
+		}
+
+		var entries []snapshotEntry
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+			v, err := valueHash(it.Item())
+			if err != nil {
+				return err
+			}
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+
+			txID := bytes.TrimPrefix(it.Item().KeyCopy(nil), utxoPrefix)
+			entries = append(entries, snapshotEntry{txID, outs})
+		}
+
+		header := snapshotHeader{lastBlock.Hash, lastBlock.Height, len(entries)}
+		if err := writeSnapshotRecord(w, header); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := writeSnapshotRecord(w, entry); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ImportSnapshot replaces the UTXO set with a snapshot written by ExportSnapshot
+//
+// the block of the snapshot must be part of this chain. Blocks that are newer than the snapshot are applied afterwards,
+// so only they have to be replayed instead of the entire chain. The bloom filter is rebuilt from the snapshot
+func (u *UTXOSet) ImportSnapshot(r io.Reader) error {
+	var header snapshotHeader
+	if err := readSnapshotRecord(r, &header); err != nil {
+		return err
+	}
+
+	// the snapshot can only be grafted onto the chain when its block is on it
+	block, err := u.Blockchain.GetBlockByHeight(header.Height)
+	if err != nil || !bytes.Equal(block.Hash, header.BestHash) {
+		return ErrSnapshotMismatch
+	}
+	bestHeight, err := u.Blockchain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	// read the whole snapshot before the current set is removed, a broken file must not leave us without one
+	entries := make([]snapshotEntry, 0, header.Entries)
+	for i := 0; i < header.Entries; i++ {
+		var entry snapshotEntry
+		if err := readSnapshotRecord(r, &entry); err != nil {
+			return fmt.Errorf("snapshot entry %d: %s", i, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := u.DeleteByPrefix(utxoPrefix); err != nil {
+		return err
+	}
+
+	u.BloomFilter = NewBloomFilterWithConfig(u.BloomConfig)
+	for start := 0; start < len(entries); start += snapshotBatchSize {
+		end := start + snapshotBatchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		err := u.Blockchain.Database.Update(func(txn StorageTxn) error {
+			for _, entry := range entries[start:end] {
+				data, err := entry.Outputs.Serialize()
+				if err != nil {
+					return err
+				}
+				key := append(append([]byte{}, utxoPrefix...), entry.TxID...)
+				if err := txn.Set(key, data); err != nil {
+					return err
+				}
+
+				for _, out := range entry.Outputs.Outputs {
+					u.addToBloom(out)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := u.Blockchain.Database.Update(u.saveBloom); err != nil {
+		return err
+	}
+	metrics.UTXOCount.Set(float64(len(entries)))
+
+	// replay only the blocks that were added since the snapshot
+	for height := header.Height + 1; height <= bestHeight; height++ {
+		block, err := u.Blockchain.GetBlockByHeight(height)
+		if err != nil {
+			return err
+		}
+		if err := u.Update(&block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeSnapshotRecord writes a length prefixed gob record
+func writeSnapshotRecord(w io.Writer, record interface{}) error {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(record); err != nil {
+		return err
+	}
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(buffer.Len()))
+	if _, err := w.Write(length); err != nil {
+		return err
+	}
+
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+// readSnapshotRecord reads a record written by writeSnapshotRecord
+func readSnapshotRecord(r io.Reader, record interface{}) error {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(length)
+	if size > maxSnapshotRecord {
+		return fmt.Errorf("snapshot record of %d bytes is too large", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(record)
+}
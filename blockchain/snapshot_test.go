@@ -0,0 +1,124 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// snapshotChain creates a UTXO set of a chain of n blocks on top of the genesis block
+func snapshotChain(t *testing.T, n int) (*UTXOSet, []*Block, func()) {
+	t.Helper()
+
+	address := string(wallet.MakeWallet().Address())
+	utxoSet, closeChain := newIndexedUTXOSet(t, address)
+	// the blocks are mined without waiting, keep the difficulty where it is
+	utxoSet.Blockchain.Config.RetargetWindow = 0
+	genesis, err := utxoSet.Blockchain.Genesis()
+	if err != nil {
+		closeChain()
+		t.Fatal(err)
+	}
+	blocks := addBlocks(t, utxoSet.Blockchain, genesis, address, n)
+	// AddBlock doesn't update the UTXO set
+	if err := utxoSet.Reindex(); err != nil {
+		closeChain()
+		t.Fatal(err)
+	}
+	return utxoSet, append([]*Block{genesis}, blocks...), closeChain
+}
+
+func TestImportSnapshotRestoresTheUTXOSet(t *testing.T) {
+	utxoSet, blocks, closeChain := snapshotChain(t, 50)
+	defer closeChain()
+
+	count, err := utxoSet.CountTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(blocks) {
+		t.Fatalf("%d transactions with unspent outputs, want the %d coinbases", count, len(blocks))
+	}
+	var snapshot bytes.Buffer
+	if err := utxoSet.ExportSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := utxoSet.DeleteByPrefix(utxoPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if wiped, err := utxoSet.CountTransactions(); err != nil || wiped != 0 {
+		t.Fatalf("%d transactions after wiping the set, %v", wiped, err)
+	}
+
+	if err := utxoSet.ImportSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if imported, err := utxoSet.CountTransactions(); err != nil || imported != count {
+		t.Errorf("%d transactions after the import, %v, want %d", imported, err, count)
+	}
+	for _, block := range blocks {
+		coinbase := block.Transactions[0]
+		if out, ok, err := utxoSet.FindOutput(coinbase.ID, 0); err != nil || !ok || out.Value != coinbase.Outputs[0].Value {
+			t.Errorf("coinbase of block %d after the import: ok %v err %v", block.Height, ok, err)
+		}
+	}
+}
+
+func TestImportSnapshotReplaysNewerBlocks(t *testing.T) {
+	utxoSet, blocks, closeChain := snapshotChain(t, 10)
+	defer closeChain()
+
+	var snapshot bytes.Buffer
+	if err := utxoSet.ExportSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	newer := addBlocks(t, utxoSet.Blockchain, blocks[len(blocks)-1], string(wallet.MakeWallet().Address()), 5)
+
+	if err := utxoSet.DeleteByPrefix(utxoPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if err := utxoSet.ImportSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := utxoSet.CountTransactions(); err != nil || count != len(blocks)+len(newer) {
+		t.Errorf("%d transactions after the import, %v, want %d", count, err, len(blocks)+len(newer))
+	}
+	for _, block := range newer {
+		assertUnspent(t, utxoSet, block, true)
+	}
+}
+
+func TestImportSnapshotRejectsOtherChainsAndBrokenFiles(t *testing.T) {
+	utxoSet, _, closeChain := snapshotChain(t, 3)
+	defer closeChain()
+	other, _, closeOther := snapshotChain(t, 3)
+	defer closeOther()
+
+	var snapshot bytes.Buffer
+	if err := other.ExportSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := utxoSet.ImportSnapshot(bytes.NewReader(snapshot.Bytes())); !errors.Is(err, ErrSnapshotMismatch) {
+		t.Errorf("importing the snapshot of another chain returned %v, want ErrSnapshotMismatch", err)
+	}
+
+	snapshot.Reset()
+	if err := utxoSet.ExportSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	count, err := utxoSet.CountTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := snapshot.Bytes()[:snapshot.Len()-10]
+	if err := utxoSet.ImportSnapshot(bytes.NewReader(truncated)); err == nil {
+		t.Error("imported a truncated snapshot")
+	}
+	// the set is only replaced once the whole snapshot was read
+	if after, err := utxoSet.CountTransactions(); err != nil || after != count {
+		t.Errorf("%d transactions after a failed import, %v, want %d", after, err, count)
+	}
+}
@@ -0,0 +1,121 @@
+package blockchain
+
+import "github.com/dgraph-io/badger"
+
+// ErrKeyNotFound is returned by StorageTxn.Get when a key is not stored
+var ErrKeyNotFound = badger.ErrKeyNotFound
+
+// Storage the key value store the chain is kept in. The methods follow the transaction API of Badger
+//
+// a transaction ends when its function returns. The writes of an Update are only committed when the function returns nil
+type Storage interface {
+	View(fn func(txn StorageTxn) error) error
+	Update(fn func(txn StorageTxn) error) error
+	// Sync flushes the writes to disk
+	Sync() error
+	Close() error
+}
+
+// StorageTxn a transaction on a Storage
+type StorageTxn interface {
+	// Get returns ErrKeyNotFound when the key is not stored
+	Get(key []byte) (StorageItem, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	NewIterator(opts IteratorOptions) StorageIterator
+}
+
+// StorageItem a key and its value. Both are only valid until the transaction ends, copy them to keep them
+type StorageItem interface {
+	Key() []byte
+	KeyCopy(dst []byte) []byte
+	Value(fn func(val []byte) error) error
+	ValueCopy(dst []byte) ([]byte, error)
+}
+
+// StorageIterator walks over the keys of a transaction in sorted order
+type StorageIterator interface {
+	// Seek moves to the first key that is equal to or after the key
+	Seek(key []byte)
+	Rewind()
+	Valid() bool
+	ValidForPrefix(prefix []byte) bool
+	Next()
+	Item() StorageItem
+	Close()
+}
+
+// IteratorOptions the settings of a StorageIterator
+type IteratorOptions struct {
+	// only the keys with the prefix are iterated
+	Prefix []byte
+	// false when only the keys are read, Badger then skips reading the values
+	PrefetchValues bool
+}
+
+// DefaultIteratorOptions iterate over every key and read the values
+var DefaultIteratorOptions = IteratorOptions{PrefetchValues: true}
+
+// BadgerStorage stores the chain in a Badger database
+type BadgerStorage struct {
+	DB *badger.DB
+}
+
+// View runs a read only transaction
+func (s *BadgerStorage) View(fn func(txn StorageTxn) error) error {
+	return s.DB.View(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+// Update runs a read write transaction
+func (s *BadgerStorage) Update(fn func(txn StorageTxn) error) error {
+	return s.DB.Update(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+// Sync flushes the database to disk
+func (s *BadgerStorage) Sync() error {
+	return s.DB.Sync()
+}
+
+// Close closes the database
+func (s *BadgerStorage) Close() error {
+	return s.DB.Close()
+}
+
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+func (t badgerTxn) Get(key []byte) (StorageItem, error) {
+	item, err := t.txn.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (t badgerTxn) Set(key, value []byte) error {
+	return t.txn.Set(key, value)
+}
+
+func (t badgerTxn) Delete(key []byte) error {
+	return t.txn.Delete(key)
+}
+
+func (t badgerTxn) NewIterator(opts IteratorOptions) StorageIterator {
+	badgerOpts := badger.DefaultIteratorOptions
+	badgerOpts.Prefix = opts.Prefix
+	badgerOpts.PrefetchValues = opts.PrefetchValues
+	return badgerIterator{t.txn.NewIterator(badgerOpts)}
+}
+
+type badgerIterator struct {
+	*badger.Iterator
+}
+
+func (it badgerIterator) Item() StorageItem {
+	return it.Iterator.Item()
+}
@@ -0,0 +1,87 @@
+package blockchain
+
+import "time"
+
+// BlockSummary is an overview of a block, used to display the chain without going through every transaction
+type BlockSummary struct {
+	Height     int
+	TxCount    int
+	TotalValue int
+	Fees       int
+	Hash       []byte
+	PrevHash   []byte
+	Timestamp  time.Time
+	// the address the coinbase reward was sent to, empty when the reward is not locked to an address
+	MinerAddress string
+	// whether the hash of the block meets its difficulty
+	ValidPoW bool
+}
+
+// Summary creates a summary of each block between two heights, ordered by height
+func (chain *Blockchain) Summary(fromHeight, toHeight int) ([]BlockSummary, error) {
+	if fromHeight < 0 || toHeight < fromHeight {
+		return nil, ErrInvalidRange
+	}
+
+	var summaries []BlockSummary
+
+	iter := chain.Iterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if block.Height >= fromHeight && block.Height <= toHeight {
+			summaries = append(summaries, chain.summarize(block))
+		}
+
+		if len(block.PrevHash) == 0 || block.Height <= fromHeight {
+			break
+		}
+	}
+
+	// the iterator goes backwards, reverse the summaries so they are ordered by height
+	for i, j := 0, len(summaries)-1; i < j; i, j = i+1, j-1 {
+		summaries[i], summaries[j] = summaries[j], summaries[i]
+	}
+
+	return summaries, nil
+}
+
+// summarize creates the summary of a single block
+//
+// the fees are what the coinbase pays above the subsidy of the height in the consensus settings of the chain
+func (chain *Blockchain) summarize(block *Block) BlockSummary {
+	summary := BlockSummary{
+		Height:    block.Height,
+		TxCount:   len(block.Transactions),
+		Hash:      block.Hash,
+		PrevHash:  block.PrevHash,
+		Timestamp: time.Unix(block.Timestamp, 0),
+	}
+	// a block without transactions has no PoW data
+	if pow, err := NewProof(block, block.EffectiveDifficulty()); err == nil {
+		summary.ValidPoW = pow.Validate()
+	}
+
+	minerFound := false
+	for _, tx := range block.Transactions {
+		value := 0
+		for _, out := range tx.Outputs {
+			value += out.Value
+		}
+		summary.TotalValue += value
+
+		// the miner is paid by the first coinbase output. Anything above the reward are the collected fees
+		if tx.IsCoinbase() && !minerFound && len(tx.Outputs) > 0 {
+			minerFound = true
+			// the reward can go to a script hash as well
+			summary.MinerAddress, _ = tx.Outputs[0].Address()
+			if reward := chain.Config.BlockReward(block.Height); value > reward {
+				summary.Fees = value - reward
+			}
+		}
+	}
+
+	return summary
+}
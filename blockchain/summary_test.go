@@ -0,0 +1,76 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+func TestSummaryOfTheGenesisBlock(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	summaries, err := chain.Summary(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 {
+		t.Fatalf("%d summaries, want 1", len(summaries))
+	}
+
+	summary := summaries[0]
+	if summary.MinerAddress != address {
+		t.Errorf("miner %s, want %s", summary.MinerAddress, address)
+	}
+	if !summary.ValidPoW {
+		t.Error("the PoW of the genesis block is not valid")
+	}
+	if summary.Fees != 0 {
+		t.Errorf("the genesis block collected %d fees", summary.Fees)
+	}
+}
+
+func TestSummaryUsesTheSubsidyOfTheHeight(t *testing.T) {
+	chain, closeChain, err := NewTestChain(string(wallet.MakeWallet().Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	// the reward has halved twice at height 4
+	chain.Config.InitialReward = 40
+	chain.Config.HalvingInterval = 2
+	const height, fees = 4, 3
+
+	// the reward goes to a script hash address
+	minerAddress := string(wallet.AddressFromScriptHash(wallet.PublicKeyHash([]byte("redeem script"))))
+	coinbase, err := coinbaseTx(minerAddress, []byte("coinbase"), chain.Config.BlockReward(height)+fees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := CreateBlock([]*Transaction{coinbase}, []byte("previous"), height, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := chain.summarize(block)
+	if summary.Fees != fees {
+		t.Errorf("fees %d, want %d", summary.Fees, fees)
+	}
+	if summary.MinerAddress != minerAddress {
+		t.Errorf("miner %s, want the script hash address %s", summary.MinerAddress, minerAddress)
+	}
+	if !summary.ValidPoW {
+		t.Error("the PoW of the mined block is not valid")
+	}
+
+	// the block was mined for difficulty 1, no hash meets 200
+	block.Difficulty = 200
+	if chain.summarize(block).ValidPoW {
+		t.Error("the PoW is valid for a difficulty the block was not mined for")
+	}
+}
@@ -6,17 +6,38 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"math/big"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/qhenkart/blockchain/wallet"
 )
 
-const miningReward = 20
+// CoinbaseMaturity the amount of confirmations the outputs of a coinbase transaction need before they can be spent
+//
+// a block can still be replaced by a longer chain, its reward would disappear with it. The same value as Bitcoin
+const CoinbaseMaturity = 100
+
+// ErrImmatureCoinbase is returned for transactions that spend a coinbase output before it has CoinbaseMaturity confirmations
+var ErrImmatureCoinbase = errors.New("coinbase output is not mature")
+
+// isMature checks whether a transaction in the block at height can spend an output of the block at outHeight, the block of
+// a coinbase counts as its first confirmation
+func isMature(out TxOutput, outHeight, height int) bool {
+	return !out.FromCoinbase || height-outHeight >= CoinbaseMaturity
+}
+
+// ErrInsufficientFunds is returned when a wallet does not have enough tokens to send the amount
+var ErrInsufficientFunds = errors.New("not enough funds")
+
+// LockTimeThreshold lock times up to this value are block heights, larger values are unix timestamps. The same threshold as Bitcoin
+const LockTimeThreshold = 500000000
 
 // Transaction transactions do not have any identifiable information or secrets because they are public. They are just a collection
 // of inputs and outputs and we can derive everything we need from those elements
@@ -24,105 +45,315 @@ type Transaction struct {
 	ID      []byte
 	Inputs  []TxInput
 	Outputs []TxOutput
+	// the transaction can't be mined before this block height, or before this unix timestamp when it is above LockTimeThreshold. 0 means no lock
+	LockTime int64
+	// sealed transactions are final and can no longer be signed. Not serialized, received transactions are always sealed
+	sealed bool
+}
+
+// gob numbers the types in the order a process first uses them and writes the numbers into the encoding. The ID and the merkle
+// leaf of a transaction hash its encoding, so the types of a transaction are numbered before anything else runs. Otherwise
+// two nodes could encode the same transaction differently and reject each others blocks
+func init() {
+	if _, err := (Transaction{}).Serialize(); err != nil {
+		panic(err)
+	}
 }
 
 // Serialize serializes a transaction into bytes
-func (tx Transaction) Serialize() []byte {
+func (tx Transaction) Serialize() ([]byte, error) {
 	var res bytes.Buffer
 	encoder := gob.NewEncoder(&res)
 
 	if err := encoder.Encode(tx); err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	return res.Bytes()
+	return res.Bytes(), nil
 }
 
 // DeserializeTransaction decodes a transaction from bytes to transactions
-func DeserializeTransaction(data []byte) Transaction {
+func DeserializeTransaction(data []byte) (Transaction, error) {
 	var transaction Transaction
 
 	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&transaction)
-	handle(err)
-	return transaction
+	if err := decoder.Decode(&transaction); err != nil {
+		return transaction, err
+	}
+
+	// transactions coming from other peers are final
+	transaction.sealed = true
+	return transaction, nil
 }
 
 // Hash creates a hash from our transactions to use as the ID
-func (tx *Transaction) Hash() []byte {
-	var hash [32]byte
-
+func (tx *Transaction) Hash() ([]byte, error) {
 	txCopy := *tx
 	txCopy.ID = []byte{}
 
-	hash = sha256.Sum256(txCopy.Serialize())
+	data, err := txCopy.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
 
-	return hash[:]
+	return hash[:], nil
 }
 
 // CoinbaseTx creates the first genesis transaction
-func CoinbaseTx(to, data string) *Transaction {
+//
+// the miner is paid the reward of the block at the height plus the fees of the other transactions in the block
+func CoinbaseTx(to, data string, height, fees int) (*Transaction, error) {
 	// create something random to put in the coinbase data
 	if data == "" {
-		randData := make([]byte, 24)
-		_, err := rand.Read(randData)
-		handle(err)
+		randData, err := coinbaseRandData()
+		if err != nil {
+			return nil, err
+		}
+		data = fmt.Sprintf("%x", randData)
+	}
+
+	return coinbaseTx(to, []byte(data), BlockReward(height)+fees)
+}
+
+// CoinbaseTxWithHeight creates a coinbase transaction with the height of the block it goes into at the start of the data
+//
+// two coinbase transactions for different blocks can never have the same ID, even with the same data and address (see BIP34)
+func CoinbaseTxWithHeight(to, data string, height, fees int) (*Transaction, error) {
+	if data == "" {
+		randData, err := coinbaseRandData()
+		if err != nil {
+			return nil, err
+		}
 		data = fmt.Sprintf("%x", randData)
 	}
 
+	return coinbaseTx(to, append(ToHex(int64(height)), data...), BlockReward(height)+fees)
+}
+
+// coinbaseRandData creates random bytes for the coinbase data
+//
+// the current time is mixed into the random bytes so the data is unique even if the random generator repeats itself
+func coinbaseRandData() ([]byte, error) {
+	randData := make([]byte, 24)
+	if _, err := rand.Read(randData); err != nil {
+		return nil, err
+	}
+
+	now := make([]byte, 8)
+	binary.BigEndian.PutUint64(now, uint64(time.Now().UnixNano()))
+	for i := range now {
+		randData[i] ^= now[i]
+	}
+
+	return randData, nil
+}
+
+// coinbaseTx creates a coinbase transaction with the data in its input that pays the value to the address
+func coinbaseTx(to string, data []byte, value int) (*Transaction, error) {
 	// referencing no output so it is missing data
-	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(miningReward, to)
+	txin := TxInput{[]byte{}, -1, nil, data, wallet.KeyTypeP256, 0, nil}
+	txout, err := NewTXOutput(value, to)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := Transaction{ID: nil, Inputs: []TxInput{txin}, Outputs: []TxOutput{*txout}}
+	if tx.ID, err = tx.Hash(); err != nil {
+		return nil, err
+	}
+	if err := tx.Seal(); err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
 
-	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
-	tx.ID = tx.Hash()
+// PaymentOutput a single recipient of a transaction
+type PaymentOutput struct {
+	To     string
+	Amount int
+	// embeds the data in an unspendable data output instead of paying To, see NewDataTXOutput
+	Data []byte
+}
 
-	return &tx
+// TxOptions the optional settings of a transaction created by NewTransaction. The zero value pays no fee and can be mined right away
+type TxOptions struct {
+	Fee int
+	// a block height or a unix timestamp, see LockTimeThreshold
+	LockTime int64
+	// embedded in a data output when set
+	Data []byte
 }
 
-// NewTransaction create a new transaction by accumulating the total amount of tokens a user has, validating it is less than what they want to send
+// NewTransaction creates a transaction that sends the amount from an address in the wallet file of the node the chain belongs to
+//
+// returns wallet.ErrWalletNotFound when the address is not in the wallet file and ErrInsufficientFunds when the address can't
+// cover the amount and the fee. Encrypted wallet files have to be loaded by the caller, use NewWalletTransaction for them
+func NewTransaction(from, to string, amount int, UTXO *UTXOSet, options ...TxOptions) (*Transaction, error) {
+	return NewMultiOutputTransaction(from, []PaymentOutput{{To: to, Amount: amount}}, UTXO, options...)
+}
+
+// NewMultiOutputTransaction creates a single transaction that pays multiple recipients from an address in the wallet file of
+// the node, eg. for batch payments. Returns the same errors as NewTransaction
+func NewMultiOutputTransaction(from string, outputs []PaymentOutput, UTXO *UTXOSet, options ...TxOptions) (*Transaction, error) {
+	var opts TxOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
+
+	if UTXO.Blockchain.nodeID == "" {
+		return nil, errors.New("the chain does not belong to a node, it has no wallet file")
+	}
+	wallets, err := wallet.CreateWallets(UTXO.Blockchain.nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the wallets: %w", err)
+	}
+	w, err := wallets.GetWallet(from)
+	if err != nil {
+		return nil, err
+	}
+
+	// copy the outputs, the data output must not end up in the slice of the caller
+	payments := append([]PaymentOutput{}, outputs...)
+	if opts.Data != nil {
+		payments = append(payments, PaymentOutput{Data: opts.Data})
+	}
+	return NewWalletMultiOutputTransaction(&w, payments, opts.Fee, opts.LockTime, UTXO)
+}
+
+// NewWalletTransaction create a new transaction by accumulating the total amount of tokens a user has, validating it is less than what they want to send
 // then iterate through all of the unused outputs and create new inputs for them.
 //
-// creates 2 new outputs. One is the amount being sent, the other is the amount not being sent
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+// creates 2 new outputs. One is the amount being sent, the other is the amount not being sent minus the fee. The fee is collected by the miner.
+// Data is embedded in an additional data output, a transaction can only have one. A lock time of 0 lets the transaction be mined right away
+func NewWalletTransaction(w *wallet.Wallet, to string, amount, fee int, lockTime int64, UTXO *UTXOSet, data ...[]byte) (*Transaction, error) {
+	payments := []PaymentOutput{{To: to, Amount: amount}}
+	for _, d := range data {
+		payments = append(payments, PaymentOutput{Data: d})
+	}
+
+	return NewWalletMultiOutputTransaction(w, payments, fee, lockTime, UTXO)
+}
+
+// NewWalletMultiOutputTransaction creates a single transaction that pays multiple recipients from the wallet
+//
+// the inputs have to cover the sum of the amounts plus the fee. Creates one output per recipient and one for the change
+func NewWalletMultiOutputTransaction(w *wallet.Wallet, payments []PaymentOutput, fee int, lockTime int64, UTXO *UTXOSet) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 
+	if w.WatchOnly {
+		return nil, wallet.ErrWatchOnly
+	}
+	if len(payments) == 0 {
+		return nil, errors.New("transaction has no recipients")
+	}
+	if fee < 0 {
+		return nil, errors.New("fee can't be negative")
+	}
+	if lockTime < 0 {
+		return nil, errors.New("lock time can't be negative")
+	}
+
+	// validate every recipient before any outputs are collected. The address type decides how the output is locked
+	amount := fee
+	dataOutputs := 0
+	for _, payment := range payments {
+		if payment.Data != nil {
+			dataOutputs++
+			if dataOutputs > 1 {
+				return nil, errors.New("transaction can only have one data output")
+			}
+			if len(payment.Data) > MaxDataOutputSize {
+				return nil, fmt.Errorf("data output can hold at most %d bytes, not %d", MaxDataOutputSize, len(payment.Data))
+			}
+			if payment.To != "" || payment.Amount != 0 {
+				return nil, errors.New("data output can't pay a recipient")
+			}
+			continue
+		}
+
+		if _, err := wallet.ValidateAddress(payment.To); err != nil {
+			return nil, fmt.Errorf("invalid recipient %s: %s", payment.To, err)
+		}
+		if payment.Amount <= 0 {
+			return nil, fmt.Errorf("amount for %s must be positive", payment.To)
+		}
+		amount += payment.Amount
+	}
+
 	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
 	// collect the accumulated total of coins and the output locations
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	acc, validOutputs, err := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	if err != nil {
+		return nil, err
+	}
 
-	// if there is not enough funds, panic
+	// if there is not enough funds, the transaction can't be created
 	if acc < amount {
-		log.Panic("Error: not enough funds")
+		return nil, ErrInsufficientFunds
 	}
 
 	// iterate through each valid output
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
-		handle(err)
+		if err != nil {
+			return nil, err
+		}
 
 		// iterate through each of the outs and create a new input for each unspent output that will be part of the transaction
 		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
+			input := TxInput{txID, out, nil, w.PublicKey, w.KeyType, 0, nil}
 			inputs = append(inputs, input)
 		}
 	}
 
 	from := fmt.Sprintf("%s", w.Address())
-	// create an output with the amount we are going to send and the address we are sending it to
-	outputs = append(outputs, *NewTXOutput(amount, to))
+	// create an output for each recipient with the amount we are going to send them
+	var data *TxOutput
+	for _, payment := range payments {
+		if payment.Data != nil {
+			if data, err = NewDataTXOutput(payment.Data); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		out, err := NewTXOutput(payment.Amount, payment.To)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *out)
+	}
 
-	// create a second output for the left over tokens that are not part of the transaction
+	// create another output for the left over tokens that are not part of the transaction. The fee is left for the miner
 	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+		change, err := NewTXOutput(acc-amount, from)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *change)
+	}
+
+	// the data output goes last. It isn't stored in the UTXO set, so it must not shift the indexes of the spendable outputs
+	if data != nil {
+		outputs = append(outputs, *data)
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{ID: nil, Inputs: inputs, Outputs: outputs, LockTime: lockTime}
 	// the id is now equal to the hashed version of all transactions
-	tx.ID = tx.Hash()
-	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
+	if tx.ID, err = tx.Hash(); err != nil {
+		return nil, err
+	}
+	if err := UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey); err != nil {
+		return nil, err
+	}
+	// the transaction is signed, it must not change anymore
+	if err := tx.Seal(); err != nil {
+		return nil, err
+	}
 
-	return &tx
+	return &tx, nil
 }
 
 // IsCoinbase checks whether the transaction is a coinbase transaction
@@ -130,66 +361,187 @@ func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
+// Seal freezes the transaction once it has been hashed and signed. Only sealed transactions can be broadcasted
+//
+// returns an error for a transaction without an ID, it was never hashed
+func (tx *Transaction) Seal() error {
+	if len(tx.ID) == 0 {
+		return errors.New("cannot seal a transaction without an ID")
+	}
+	tx.sealed = true
+	return nil
+}
+
+// IsSealed checks whether the transaction has been sealed
+func (tx *Transaction) IsSealed() bool {
+	return tx.sealed
+}
+
 // Sign signs and verifies transactions
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
 	// coinbase does not need to be signed
 	if tx.IsCoinbase() {
-		return
+		return nil
+	}
+
+	if tx.sealed {
+		return errors.New("cannot sign a sealed transaction")
+	}
+
+	// the ID is the hash of the unsigned transaction, if they differ then the transaction was changed after it was hashed
+	hash, err := tx.unsignedHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(tx.ID, hash) {
+		return errors.New("transaction is corrupted, the ID does not match the hash")
 	}
 
 	// we sign our transactions by the input. We use the inputs to access the referenced outputs
 	// we need to iterate through all of the inputs to make sure they are valid
 	for _, in := range tx.Inputs {
 		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("the previous transaction does not exist")
+			return errors.New("the previous transaction does not exist")
 		}
 	}
 
-	// creates a copy of the transaction
-	txCopy := tx.TrimmedCopy()
+	for inID, in := range tx.Inputs {
+		prevOut := prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out]
+		// multi signature outputs are signed with SignMultiSig
+		if prevOut.IsMultiSig() {
+			continue
+		}
 
-	for inID, in := range txCopy.Inputs {
-		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		// set signature to nil to double check
-		txCopy.Inputs[inID].Signature = nil
-		// all of the transactions but the current one are empty, so these should be nil
-		// thus each transaction is signed separately
-		txCopy.Inputs[inID].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-
-		dataToSign := fmt.Sprintf("%x\n", txCopy)
-		// serializes the transaction and hashes it
-		// this is the data we want to sign
-		//txCopy.ID = txCopy.Hash()
-		//txCopy.Inputs[inID].PubKey = nil
-
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
-		handle(err)
-		signature := append(r.Bytes(), s.Bytes()...)
+		// the private key has to be on the curve of the input
+		if privKey.Curve.Params().Name != wallet.Curve(in.KeyType).Params().Name {
+			return errors.New("the private key does not match the input key type")
+		}
+
+		hash, err := tx.signatureHash(inID, prevOut)
+		if err != nil {
+			return err
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, &privKey, hash)
+		if err != nil {
+			return err
+		}
+		signature := signatureBytes(privKey.Curve, r, s)
 
 		tx.Inputs[inID].Signature = signature
-		txCopy.Inputs[inID].PubKey = nil
 	}
+
+	return nil
 }
 
-// TrimmedCopy creates a copy of a transaction without input signatures or keys
-func (tx *Transaction) TrimmedCopy() Transaction {
+// unsignedHash hashes the transaction without any signatures, it equals the ID until the transaction changes
+//
+// inputs can be signed one after another, eg. by SignMultiSig, without the earlier signatures changing the hash
+func (tx *Transaction) unsignedHash() ([]byte, error) {
+	txCopy := *tx
+	txCopy.Inputs = make([]TxInput, len(tx.Inputs))
+	for i, in := range tx.Inputs {
+		in.Signature = nil
+		in.MultiSig = nil
+		txCopy.Inputs[i] = in
+	}
+
+	return txCopy.Hash()
+}
+
+// signatureHash creates the hash a single key signs for an input, Sign and Verify must build it the same way
+//
+// all of the inputs but the current one are empty, so each input is signed separately. The signing data is hashed because
+// ecdsa only uses as many bytes of the data as the curve order has, which would only cover its constant prefix
+func (tx *Transaction) signatureHash(inID int, prevOut TxOutput) ([]byte, error) {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Inputs[inID].PubKey = prevOut.PubKeyHash
+	id, err := txCopy.Hash()
+	if err != nil {
+		return nil, err
+	}
+	txCopy.ID = id
+	txCopy.Inputs[inID].PubKey = nil
+
+	hash := sha256.Sum256([]byte(txCopy.signingData()))
+	return hash[:], nil
+}
+
+// multiSigData creates the data that every key signs for an input that spends a multi signature output
+//
+// the trimmed copy is hashed with the locking key hashes in place of the public key, so the signatures are bound to the output they spend
+func (tx *Transaction) multiSigData(inID int, prevOut TxOutput) ([]byte, error) {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Inputs[inID].PubKey = bytes.Join(prevOut.PubKeyHashes, nil)
+
+	return txCopy.Hash()
+}
+
+// IsMatured checks if the lock time of the transaction has passed, so it can be mined in a block of the height at the time
+func (tx *Transaction) IsMatured(currentHeight int, currentTime int64) bool {
+	if tx.LockTime <= 0 {
+		return true
+	}
+	if tx.LockTime <= LockTimeThreshold {
+		return tx.LockTime <= int64(currentHeight)
+	}
+	return tx.LockTime <= currentTime
+}
+
+// IsRBFSignaled checks if any input signals that the transaction can be replaced by one with a higher fee
+func (tx *Transaction) IsRBFSignaled() bool {
+	for _, in := range tx.Inputs {
+		if in.Sequence() < SequenceFinal-1 {
+			return true
+		}
+	}
+	return false
+}
+
+// TrimmedCopy creates a new transaction without input signatures or keys. The original transaction is never modified
+func (tx Transaction) TrimmedCopy() Transaction {
 	var inputs []TxInput
 	var outputs []TxOutput
 	for _, in := range tx.Inputs {
 		// copy each input sans the signature and key
-		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil})
+		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil, in.KeyType, in.InvertedSequence, nil})
 	}
 
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash, out.ScriptType, out.Required, out.PubKeyHashes, out.FromCoinbase})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{ID: append([]byte{}, tx.ID...), Inputs: inputs, Outputs: outputs, LockTime: tx.LockTime}
 
 	return txCopy
 }
 
-// Verify verifies if a transaction is valid
+// signingData formats the trimmed transaction into the data that is signed
+//
+// the data is the hex of the transaction printed the way String printed it before lock times, multi signatures and data
+// outputs were added. Signatures are stored in the chain, so this format must never change, even when String does. The
+// fields that are not printed are still covered, the ID is the hash of the whole transaction
+func (tx Transaction) signingData() string {
+	var lines []string
+
+	lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.ID))
+	for i, input := range tx.Inputs {
+		lines = append(lines, fmt.Sprintf("     Input %d:", i))
+		lines = append(lines, fmt.Sprintf("       TXID:     %x", input.ID))
+		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Out))
+		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
+		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+	}
+
+	for i, output := range tx.Outputs {
+		lines = append(lines, fmt.Sprintf("     Output %d:", i))
+		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
+		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+	}
+
+	return fmt.Sprintf("%x\n", strings.Join(lines, "\n"))
+}
+
+// Verify verifies if a transaction is valid. Transactions that spend unknown previous transactions are invalid
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
@@ -197,73 +549,147 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 
 	for _, in := range tx.Inputs {
 		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("Previous Transaction does not exist ")
+			return false
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-
 	for inID, in := range tx.Inputs {
 		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		// set signature to nil to double check
-		txCopy.Inputs[inID].Signature = nil
-		// all of the transactions but the current one are empty, so these should be nil
-		// thus each transaction is signed separately
-		txCopy.Inputs[inID].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-		// serializes the transaction and hashes it
-		// this is the data we want to sign
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inID].PubKey = nil
-
-		// since each signature is just a pair of numbers and pub keys are a pair coordinates, we can deconstruct them
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		// r takes the last half
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		// s takes the first half
-		s.SetBytes(in.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		// last half
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		// first half
-		y.SetBytes(in.PubKey[(keyLen / 2):])
-
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
-
-		// create new public key
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		// verify the public key with the ID and the signature
-
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
+		if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return false
+		}
+
+		prevOut := prevTX.Outputs[in.Out]
+		if prevOut.IsMultiSig() {
+			if !tx.verifyMultiSig(inID, prevOut) {
+				return false
+			}
+			continue
+		}
+
+		// only the key the output is locked to can spend it
+		if !in.UsesKey(prevOut.PubKeyHash) {
+			return false
+		}
+
+		// the curve depends on which kind of key signed the input
+		curve := wallet.Curve(in.KeyType)
+
+		// verify the public key with the hash and the signature
+		hash, err := tx.signatureHash(inID, prevOut)
+		if err != nil || !verifySignature(curve, in.PubKey, in.Signature, hash) {
 			return false
 		}
-		txCopy.Inputs[inID].PubKey = nil
 	}
 	return true
 }
 
+// verifyMultiSig checks that at least the required keys of a multi signature output signed the input
+//
+// every key is counted once, signatures of keys that are not part of the output are ignored
+func (tx *Transaction) verifyMultiSig(inID int, prevOut TxOutput) bool {
+	data, err := tx.multiSigData(inID, prevOut)
+	if err != nil {
+		return false
+	}
+
+	signed := make(map[int]bool)
+	for _, sig := range tx.Inputs[inID].MultiSig {
+		index := prevOut.keyIndex(wallet.PublicKeyHash(sig.PubKey))
+		if index == -1 || signed[index] {
+			continue
+		}
+
+		if verifySignature(wallet.Curve(sig.KeyType), sig.PubKey, sig.Signature, data) {
+			signed[index] = true
+		}
+	}
+
+	return len(signed) >= prevOut.Required
+}
+
+// signatureBytes encodes a signature as r followed by s, both padded to the size of the curve
+//
+// verifySignature splits the signature in half, so r and s need the same length even when one of them has leading zero bytes
+func signatureBytes(curve elliptic.Curve, r, s *big.Int) []byte {
+	size := (curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+	return signature
+}
+
+// verifySignature verifies an ecdsa signature of the data
+func verifySignature(curve elliptic.Curve, pubKey, signature, data []byte) bool {
+	if len(pubKey) == 0 || len(signature) == 0 {
+		return false
+	}
+
+	// since each signature is just a pair of numbers and pub keys are a pair coordinates, we can deconstruct them
+	r := big.Int{}
+	s := big.Int{}
+	sigLen := len(signature)
+	// r takes the last half
+	r.SetBytes(signature[:(sigLen / 2)])
+	// s takes the first half
+	s.SetBytes(signature[(sigLen / 2):])
+
+	x := big.Int{}
+	y := big.Int{}
+	keyLen := len(pubKey)
+	// last half
+	x.SetBytes(pubKey[:(keyLen / 2)])
+	// first half
+	y.SetBytes(pubKey[(keyLen / 2):])
+
+	// create new public key
+	rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
+
+	return ecdsa.Verify(&rawPubKey, data, &r, &s)
+}
+
 // String converts the transaction into a formatted string for cli usage
 func (tx Transaction) String() string {
 	var lines []string
 
 	lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.ID))
+	if tx.LockTime > LockTimeThreshold {
+		lines = append(lines, fmt.Sprintf("     Locked until: %s", time.Unix(tx.LockTime, 0)))
+	} else if tx.LockTime > 0 {
+		lines = append(lines, fmt.Sprintf("     Locked until height: %d", tx.LockTime))
+	}
 	for i, input := range tx.Inputs {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:     %x", input.ID))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Out))
 		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
 		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		for _, sig := range input.MultiSig {
+			lines = append(lines, fmt.Sprintf("       MultiSig:  %x %x", sig.PubKey, sig.Signature))
+		}
 	}
 
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
 		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+		if output.IsData() {
+			// show the data as text when it is readable
+			if data := output.Data(); utf8.Valid(data) {
+				lines = append(lines, fmt.Sprintf("       Data:   %s", data))
+			} else {
+				lines = append(lines, fmt.Sprintf("       Data:   %x", data))
+			}
+		} else if output.IsMultiSig() {
+			lines = append(lines, fmt.Sprintf("       MultiSig: %d of %d", output.Required, len(output.PubKeyHashes)))
+			for _, hash := range output.PubKeyHashes {
+				lines = append(lines, fmt.Sprintf("         Address: %s", wallet.AddressFromPubKeyHash(hash)))
+			}
+		} else if address, ok := output.Address(); ok {
+			lines = append(lines, fmt.Sprintf("       Address: %s", address))
+		} else {
+			lines = append(lines, "       (non-standard script)")
+		}
 	}
 
 	return strings.Join(lines, "\n")
@@ -0,0 +1,556 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// originalTransaction the transaction and its String method as they were when the first transactions were signed
+type originalTransaction struct {
+	ID      []byte
+	Inputs  []TxInput
+	Outputs []TxOutput
+}
+
+func (tx originalTransaction) String() string {
+	var lines []string
+
+	lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.ID))
+	for i, input := range tx.Inputs {
+		lines = append(lines, fmt.Sprintf("     Input %d:", i))
+		lines = append(lines, fmt.Sprintf("       TXID:     %x", input.ID))
+		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Out))
+		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
+		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+	}
+
+	for i, output := range tx.Outputs {
+		lines = append(lines, fmt.Sprintf("     Output %d:", i))
+		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
+		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func TestSigningDataKeepsTheOriginalFormat(t *testing.T) {
+	w := wallet.MakeWallet()
+	tx := Transaction{
+		ID:       []byte("transaction id"),
+		Inputs:   []TxInput{{ID: []byte("previous"), Out: 1, PubKey: w.PubKeyHash()}, {ID: []byte("other"), Out: 0}},
+		Outputs:  []TxOutput{{Value: 5, PubKeyHash: w.PubKeyHash()}, {Value: 2, PubKeyHash: []byte("script")}},
+		LockTime: 100,
+	}
+
+	// the original code signed fmt.Sprintf("%x\n", txCopy), which is the hex of String
+	original := fmt.Sprintf("%x\n", originalTransaction{tx.ID, tx.Inputs, tx.Outputs})
+	if got := tx.signingData(); got != original {
+		t.Errorf("signing data changed\ngot  %s\nwant %s", got, original)
+	}
+}
+
+func TestDeserializeSealsTransactions(t *testing.T) {
+	w := wallet.MakeWallet()
+	coinbase, err := CoinbaseTx(string(w.Address()), "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := CreateBlock([]*Transaction{coinbase}, []byte("previous"), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gobData bytes.Buffer
+	if err := gob.NewEncoder(&gobData).Encode((*gobBlock)(block)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"binary": block.Serialize(), "gob": gobData.Bytes()} {
+		decoded, err := Deserialize(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, tx := range decoded.Transactions {
+			if !tx.IsSealed() {
+				t.Errorf("%s: transaction %x of the block is not sealed", name, tx.ID)
+			}
+		}
+	}
+}
+
+func TestNewTransactionNeedsTheWalletsOfTheNode(t *testing.T) {
+	from := string(wallet.MakeWallet().Address())
+	to := string(wallet.MakeWallet().Address())
+	utxoSet, closeChain := newIndexedUTXOSet(t, from)
+	defer closeChain()
+
+	if _, err := NewTransaction(from, to, 1, utxoSet); err == nil {
+		t.Error("created a transaction for a chain without a node")
+	}
+
+	utxoSet.Blockchain.nodeID = "node without a wallet file"
+	if _, err := NewTransaction(from, to, 1, utxoSet); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("NewTransaction returned %v, want the missing wallet file", err)
+	}
+}
+
+func TestWatchOnlyWalletsHaveABalanceButCantSpend(t *testing.T) {
+	// the key of the cold wallet is kept elsewhere, the node only watches its address
+	cold := wallet.MakeWallet()
+	address := string(cold.Address())
+	utxoSet, closeChain := newIndexedUTXOSet(t, address)
+	defer closeChain()
+	matureGenesis(t, utxoSet.Blockchain, address)
+
+	// the wallet file is written relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "tmp"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	wallets, err := wallet.CreateWallets("3000")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	if err := wallets.AddWatchAddress(address); err != nil {
+		t.Fatal(err)
+	}
+	wallets.SaveFile("3000")
+	utxoSet.Blockchain.nodeID = "3000"
+
+	loaded, err := wallet.CreateWallets("3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	watched, err := loaded.GetWallet(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !watched.WatchOnly {
+		t.Fatal("the loaded wallet is not watch only")
+	}
+
+	balance, err := GetBalance(&watched, utxoSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := utxoSet.Blockchain.Config.BlockReward(0); balance != want {
+		t.Errorf("the watched address has a balance of %d, want the genesis reward %d", balance, want)
+	}
+
+	to := string(wallet.MakeWallet().Address())
+	if _, err := NewTransaction(address, to, 1, utxoSet); !errors.Is(err, wallet.ErrWatchOnly) {
+		t.Errorf("NewTransaction from a watched address returned %v, want ErrWatchOnly", err)
+	}
+	if _, err := NewWalletTransaction(&watched, to, 1, 1, 0, utxoSet); !errors.Is(err, wallet.ErrWatchOnly) {
+		t.Errorf("NewWalletTransaction of a watch only wallet returned %v, want ErrWatchOnly", err)
+	}
+	// the key can still spend the same outputs
+	if _, err := NewWalletTransaction(cold, to, 1, 1, 0, utxoSet); err != nil {
+		t.Errorf("the key of the watched address could not spend: %v", err)
+	}
+}
+
+func TestNewWalletTransactionReturnsInsufficientFunds(t *testing.T) {
+	w := wallet.MakeWallet()
+	utxoSet, closeChain := newIndexedUTXOSet(t, string(w.Address()))
+	defer closeChain()
+
+	to := string(wallet.MakeWallet().Address())
+	if _, err := NewWalletTransaction(w, to, 1<<40, 1, 0, utxoSet); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("sending more than the balance returned %v, want ErrInsufficientFunds", err)
+	}
+}
+
+func TestNewWalletMultiOutputTransactionPaysEveryRecipient(t *testing.T) {
+	w := wallet.MakeWallet()
+	utxoSet, closeChain := newIndexedUTXOSet(t, string(w.Address()))
+	defer closeChain()
+	matureGenesis(t, utxoSet.Blockchain, string(w.Address()))
+
+	recipients := []*wallet.Wallet{wallet.MakeWallet(), wallet.MakeWallet(), wallet.MakeWallet()}
+	var payments []PaymentOutput
+	for i, recipient := range recipients {
+		payments = append(payments, PaymentOutput{To: string(recipient.Address()), Amount: i + 1})
+	}
+	const fee = 2
+	tx, err := NewWalletMultiOutputTransaction(w, payments, fee, 0, utxoSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one output per recipient and the change, the fee is left for the miner
+	if len(tx.Outputs) != len(payments)+1 {
+		t.Fatalf("%d outputs, want %d", len(tx.Outputs), len(payments)+1)
+	}
+	in := 0
+	for i, recipient := range recipients {
+		if out := tx.Outputs[i]; out.Value != payments[i].Amount || !out.IsLockedWithKey(recipient.PubKeyHash()) {
+			t.Errorf("output %d pays %d to %x, want %d to recipient %d", i, out.Value, out.PubKeyHash, payments[i].Amount, i)
+		}
+		in += payments[i].Amount
+	}
+	change := tx.Outputs[len(payments)]
+	in += change.Value + fee
+	if !change.IsLockedWithKey(w.PubKeyHash()) || in != utxoSet.Blockchain.Config.BlockReward(0) {
+		t.Errorf("change of %d, want the genesis reward minus the payments and the fee back", change.Value)
+	}
+
+	payments[1].To = "invalid address"
+	if _, err := NewWalletMultiOutputTransaction(w, payments, fee, 0, utxoSet); err == nil {
+		t.Error("created a transaction with an invalid recipient")
+	}
+}
+
+// hashTx sets the ID of a transaction built by a test
+func hashTx(tb testing.TB, tx *Transaction) {
+	tb.Helper()
+
+	id, err := tx.Hash()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tx.ID = id
+}
+
+// signedSpend creates a transaction that spends output 0 of prev, which belongs to the wallet, and signs it
+func signedSpend(t *testing.T, w *wallet.Wallet, prev *Transaction) *Transaction {
+	t.Helper()
+
+	tx := &Transaction{
+		Inputs:  []TxInput{{ID: prev.ID, Out: 0, PubKey: w.PublicKey, KeyType: w.KeyType}},
+		Outputs: []TxOutput{{Value: prev.Outputs[0].Value, PubKeyHash: wallet.MakeWallet().PubKeyHash()}},
+	}
+	hashTx(t, tx)
+	if err := tx.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(prev.ID): *prev}); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestSignedTransactionsVerify(t *testing.T) {
+	w := wallet.MakeWallet()
+	prev, err := CoinbaseTx(string(w.Address()), "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevTXs := map[string]Transaction{hex.EncodeToString(prev.ID): *prev}
+
+	tx := signedSpend(t, w, prev)
+	if !tx.Verify(prevTXs) {
+		t.Fatal("the signed transaction does not verify")
+	}
+
+	changed := *tx
+	changed.Outputs = []TxOutput{{Value: tx.Outputs[0].Value + 1, PubKeyHash: tx.Outputs[0].PubKeyHash}}
+	if changed.Verify(prevTXs) {
+		t.Error("a transaction with a changed output verifies")
+	}
+
+	// the key has to be the one the spent output is locked to
+	other := wallet.MakeWallet()
+	stolen := *tx
+	stolen.Inputs = []TxInput{{ID: prev.ID, Out: 0, PubKey: other.PublicKey, KeyType: other.KeyType}}
+	hashTx(t, &stolen)
+	if err := stolen.Sign(other.PrivateKey, prevTXs); err != nil {
+		t.Fatal(err)
+	}
+	if stolen.Verify(prevTXs) {
+		t.Error("a transaction signed by another key verifies")
+	}
+}
+
+func TestSignaturesWithLeadingZeroBytesVerify(t *testing.T) {
+	// about one in 128 keys has a coordinate with a leading zero byte, and one in 128 signatures a number with one
+	var key *ecdsa.PrivateKey
+	for key == nil || (key.X.BitLen() > 248 && key.Y.BitLen() > 248) {
+		var err error
+		if key, err = ecdsa.GenerateKey(wallet.Curve(wallet.KeyTypeP256), rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pubKey := wallet.PublicKeyBytes(&key.PublicKey)
+	if len(pubKey) != 64 {
+		t.Fatalf("the public key has %d bytes, want 64", len(pubKey))
+	}
+
+	data := sha256.Sum256([]byte("data"))
+	for short := 0; short < 2; {
+		r, s, err := ecdsa.Sign(rand.Reader, key, data[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.BitLen() > 248 && s.BitLen() > 248 {
+			continue
+		}
+		short++
+
+		signature := signatureBytes(key.Curve, r, s)
+		if len(signature) != 64 || !verifySignature(key.Curve, pubKey, signature, data[:]) {
+			t.Errorf("the signature %x of the key %x does not verify", signature, pubKey)
+		}
+	}
+}
+
+func TestSealRequiresAnID(t *testing.T) {
+	var tx Transaction
+	if err := tx.Seal(); err == nil {
+		t.Fatal("a transaction without an ID was sealed")
+	}
+	if tx.IsSealed() {
+		t.Error("the transaction is sealed")
+	}
+}
+
+func TestCoinbaseOutputsCanOnlyBeSpentOnceMature(t *testing.T) {
+	w := wallet.MakeWallet()
+	address := string(w.Address())
+	utxoSet, closeChain := newIndexedUTXOSet(t, address)
+	defer closeChain()
+	chain := utxoSet.Blockchain
+	// the blocks are mined without waiting, keep the difficulty where it is
+	chain.Config.RetargetWindow = 0
+
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend := signedSpend(t, w, genesis.Transactions[0])
+	spendOn := func(prev *Block) *Block {
+		coinbase, err := CoinbaseTx(address, "", prev.Height+1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := CreateBlock([]*Transaction{coinbase, spend}, prev.Hash, prev.Height+1, Difficulty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return block
+	}
+
+	// the mempool checks against the next block, AddBlock against the height of the block
+	assertImmature := func(tip *Block) {
+		t.Helper()
+		if _, err := chain.VerifyTransaction(spend); !errors.Is(err, ErrImmatureCoinbase) {
+			t.Errorf("VerifyTransaction on height %d returned %v, want ErrImmatureCoinbase", tip.Height, err)
+		}
+		if err := chain.AddBlock(spendOn(tip)); !errors.Is(err, ErrImmatureCoinbase) {
+			t.Errorf("AddBlock on height %d returned %v, want ErrImmatureCoinbase", tip.Height, err)
+		}
+	}
+	assertImmature(genesis)
+
+	// the block of the spend would give the coinbase one confirmation too few
+	blocks := addBlocks(t, chain, genesis, address, CoinbaseMaturity-2)
+	tip := blocks[len(blocks)-1]
+	assertImmature(tip)
+
+	tip = addBlocks(t, chain, tip, address, 1)[0]
+	valid, err := chain.VerifyTransaction(spend)
+	if err != nil || !valid {
+		t.Fatalf("VerifyTransaction of the mature coinbase returned %v, %v", valid, err)
+	}
+	block := spendOn(tip)
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chain.GetLastHash(), block.Hash) {
+		t.Error("the block that spends the mature coinbase is not the tip")
+	}
+}
+
+func TestInputsStoredWithoutASequenceAreFinal(t *testing.T) {
+	// TxInput before the sequence numbers were added
+	type originalInput struct {
+		ID        []byte
+		Out       int
+		Signature []byte
+		PubKey    []byte
+	}
+	type originalTx struct {
+		ID     []byte
+		Inputs []originalInput
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(originalTx{ID: []byte("id"), Inputs: []originalInput{{ID: []byte("prev"), Out: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := DeserializeTransaction(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence := tx.Inputs[0].Sequence(); sequence != SequenceFinal {
+		t.Errorf("sequence %x, want SequenceFinal", sequence)
+	}
+	if tx.IsRBFSignaled() {
+		t.Error("a transaction stored before the sequence numbers signals RBF")
+	}
+
+	tx.Inputs[0].SetSequence(SequenceFinal - 2)
+	if sequence := tx.Inputs[0].Sequence(); sequence != SequenceFinal-2 || !tx.IsRBFSignaled() {
+		t.Errorf("sequence %x after SetSequence, want %x and RBF", sequence, SequenceFinal-2)
+	}
+}
+
+func TestMultiSigNeedsTheRequiredValidSignatures(t *testing.T) {
+	a, b, c := wallet.MakeWallet(), wallet.MakeWallet(), wallet.MakeWallet()
+	// not one of the keys of the output
+	outsider := wallet.MakeWallet()
+
+	out, err := NewMultiSigTXOutput(10, 2, []string{string(a.Address()), string(b.Address()), string(c.Address())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := &Transaction{Outputs: []TxOutput{*out}}
+	hashTx(t, prev)
+	prevTXs := map[string]Transaction{hex.EncodeToString(prev.ID): *prev}
+
+	// forged signs the input with the key of the signer, but claims the public key of another wallet
+	forged := func(tx *Transaction, signer, claimed *wallet.Wallet) MultiSigSignature {
+		data, err := tx.multiSigData(0, *out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, &signer.PrivateKey, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return MultiSigSignature{claimed.PublicKey, claimed.KeyType, append(r.Bytes(), s.Bytes()...)}
+	}
+
+	tests := []struct {
+		name  string
+		keys  []*wallet.Wallet
+		forge func(tx *Transaction)
+		valid bool
+	}{
+		{"one of three", []*wallet.Wallet{a}, nil, false},
+		{"one key and an outsider", []*wallet.Wallet{a, outsider}, nil, false},
+		{"two of three", []*wallet.Wallet{a, c}, nil, true},
+		{"two of three and an outsider", []*wallet.Wallet{outsider, b, c}, nil, true},
+		// a signature that claims to be from b, but is made with another key
+		{"one key and an invalid signature", []*wallet.Wallet{a}, func(tx *Transaction) {
+			tx.Inputs[0].MultiSig = append(tx.Inputs[0].MultiSig, forged(tx, outsider, b))
+		}, false},
+		// the same key only counts once
+		{"one key twice", []*wallet.Wallet{a}, func(tx *Transaction) {
+			tx.Inputs[0].MultiSig = append(tx.Inputs[0].MultiSig, tx.Inputs[0].MultiSig[0])
+		}, false},
+	}
+	for _, test := range tests {
+		tx := &Transaction{
+			Inputs:  []TxInput{{ID: prev.ID, Out: 0}},
+			Outputs: []TxOutput{{Value: 10, PubKeyHash: wallet.MakeWallet().PubKeyHash()}},
+		}
+		hashTx(t, tx)
+
+		var keys []ecdsa.PrivateKey
+		for _, w := range test.keys {
+			keys = append(keys, w.PrivateKey)
+		}
+		if err := SignMultiSig(tx, keys, prevTXs); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.forge != nil {
+			test.forge(tx)
+		}
+
+		if valid := tx.Verify(prevTXs); valid != test.valid {
+			t.Errorf("%s: Verify returned %v, want %v", test.name, valid, test.valid)
+		}
+	}
+}
+
+func TestHeightLockedTransactionsWaitForTheHeight(t *testing.T) {
+	w := wallet.MakeWallet()
+	address := string(w.Address())
+	utxoSet, closeChain := newIndexedUTXOSet(t, address)
+	defer closeChain()
+	chain := utxoSet.Blockchain
+	// the blocks are mined without waiting, keep the difficulty where it is
+	chain.Config.RetargetWindow = 0
+	matureGenesis(t, chain, address)
+
+	// the next block has the height CoinbaseMaturity, the one after it can include the transaction
+	lockHeight := int64(CoinbaseMaturity + 1)
+	payment := []PaymentOutput{{To: string(wallet.MakeWallet().Address()), Amount: 1}}
+	tx, err := NewWalletMultiOutputTransaction(w, payment, 0, lockHeight, utxoSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.LockTime != lockHeight {
+		t.Fatalf("lock time %d, want %d", tx.LockTime, lockHeight)
+	}
+
+	mine := func(txs ...*Transaction) (*Block, error) {
+		coinbase, err := CoinbaseTx(address, "", CoinbaseMaturity, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chain.MineBlock(append([]*Transaction{coinbase}, txs...))
+	}
+	if _, err := mine(tx); err == nil || !strings.Contains(err.Error(), "locked until") {
+		t.Fatalf("mining the transaction locked until %d at height %d returned %v", lockHeight, CoinbaseMaturity, err)
+	}
+	if _, err := mine(); err != nil {
+		t.Fatal(err)
+	}
+	block, err := mine(tx)
+	if err != nil {
+		t.Fatalf("the transaction was rejected at its lock height: %v", err)
+	}
+	if int64(block.Height) != lockHeight || !bytes.Equal(block.Transactions[1].ID, tx.ID) {
+		t.Errorf("block %d with %d transactions, want the transaction at height %d", block.Height, len(block.Transactions), lockHeight)
+	}
+
+	// lock times above the threshold are compared to the clock instead
+	now := time.Now().Unix()
+	locked := &Transaction{LockTime: now + 3600}
+	if locked.IsMatured(int(lockHeight), now) {
+		t.Error("a transaction locked for another hour is matured")
+	}
+	if locked.LockTime = now - 60; !locked.IsMatured(0, now) {
+		t.Error("a transaction whose lock time has passed is not matured")
+	}
+}
+
+func TestTransactionEncodingDoesNotDependOnEarlierEncodings(t *testing.T) {
+	// other types encoded first would be numbered before the types of a transaction, if the package didn't number them first
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(struct{ Fields map[string][]int }{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := Transaction{Inputs: []TxInput{{ID: []byte("a"), Out: 1}}, Outputs: []TxOutput{{Value: 3}}}
+	data, err := tx.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the hash of the encoding in a new process
+	const want = "7b30a90d71e8b26ace93148412734d35009919eea46d065018a176fd5ef9efe8"
+	if hash := sha256.Sum256(data); hex.EncodeToString(hash[:]) != want {
+		t.Errorf("the encoding hashes to %x, want %s", hash, want)
+	}
+}
@@ -3,10 +3,33 @@ package blockchain
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"fmt"
 
 	"github.com/qhenkart/blockchain/wallet"
 )
 
+// Script types define how an output is locked
+const (
+	// ScriptTypeP2PKH the output is locked to a public key hash
+	ScriptTypeP2PKH = byte(0)
+	// ScriptTypeP2SH the output is locked to the hash of a redeem script
+	ScriptTypeP2SH = byte(1)
+	// ScriptTypeMultiSig the output is locked to several public key hashes, a number of them have to sign to spend it
+	ScriptTypeMultiSig = byte(2)
+	// ScriptTypeData the output only carries data and can never be spent, like OP_RETURN in Bitcoin
+	ScriptTypeData = byte(3)
+)
+
+// MaxDataOutputSize the maximum amount of bytes a data output can carry
+const MaxDataOutputSize = 80
+
+// dataOutputMarker prefixes the data of a data output, so the PubKeyHash can never be mistaken for a key hash
+const dataOutputMarker = byte(0xFF)
+
+// the length of a RIPEMD160 public key hash
+const pubKeyHashLength = 20
+
 // TxOutput indivisible outputs, You cannot reference part of an output. eg. you can't take a $10 bill and split it in half to give change. You would have to make 2 new outputs with 5 each
 type TxOutput struct {
 	// value in tokens, assigned and locked in the output
@@ -15,11 +38,44 @@ type TxOutput struct {
 	//
 	// in BTC this is implemented in Script lang
 	PubKeyHash []byte
+	// how the output is locked, based on the type of address it was sent to
+	ScriptType byte
+	// the amount of signatures that are needed to spend a multi signature output
+	Required int
+	// the public key hashes of a multi signature output, PubKeyHash is empty for these outputs
+	PubKeyHashes [][]byte
+	// marks the outputs of coinbase transactions in the UTXO set, they can't be spent before CoinbaseMaturity.
+	// Never set on the outputs of a transaction, it would change the ID
+	FromCoinbase bool
 }
 
 // TxOutputs defines a collection of outputs
 type TxOutputs struct {
 	Outputs []TxOutput
+	// the height of the block the transaction is in, only set in the UTXO set
+	Height int
+	// the index of every output in its transaction, only set in the UTXO set. Spent outputs are removed from the set, so
+	// the position of an output in Outputs is not its index. Sets written before the indexes were stored have none
+	Indexes []int
+}
+
+// indexed checks if the index of every output is stored
+func (outs TxOutputs) indexed() bool {
+	return len(outs.Indexes) == len(outs.Outputs)
+}
+
+// index returns the index in the transaction of the output at a position. Without stored indexes the position is used
+func (outs TxOutputs) index(pos int) int {
+	if outs.indexed() {
+		return outs.Indexes[pos]
+	}
+	return pos
+}
+
+// add appends an output with its index in the transaction
+func (outs *TxOutputs) add(out TxOutput, index int) {
+	outs.Outputs = append(outs.Outputs, out)
+	outs.Indexes = append(outs.Indexes, index)
 }
 
 // TxInput refences to pevious outputs
@@ -32,15 +88,151 @@ type TxInput struct {
 	Signature []byte
 	// public key that has not been hashed
 	PubKey []byte
+	// the curve of the public key, see wallet.KeyTypeP256
+	KeyType byte
+	// the sequence number is stored as SequenceFinal - sequence, use Sequence and SetSequence to access it
+	//
+	// gob doesn't encode zero values, so inputs stored before the field existed decode with 0 here. Stored as is, every old
+	// input would have sequence 0 and signal RBF. Inverted, they decode as SequenceFinal, which is what they were created as.
+	// The JSON format exposes the plain sequence
+	InvertedSequence uint32
+	// the signatures of an input that spends a multi signature output, Signature and PubKey are empty for these inputs
+	MultiSig []MultiSigSignature
+}
+
+// MultiSigSignature one of the signatures of an input that spends a multi signature output
+type MultiSigSignature struct {
+	// public key that has not been hashed, its hash must be one of the output's PubKeyHashes
+	PubKey []byte
+	// the curve of the public key, see wallet.KeyTypeP256
+	KeyType   byte
+	Signature []byte
+}
+
+// SequenceFinal the sequence number of an input that can't be replaced
+const SequenceFinal = uint32(0xFFFFFFFF)
+
+// Sequence returns the sequence number of the input. Defaults to SequenceFinal
+//
+// like in Bitcoin, a sequence below SequenceFinal-1 signals that the transaction may be replaced by one with a higher fee (RBF)
+func (in *TxInput) Sequence() uint32 {
+	return SequenceFinal - in.InvertedSequence
+}
+
+// SetSequence sets the sequence number of the input. The transaction ID must be recalculated afterwards
+func (in *TxInput) SetSequence(sequence uint32) {
+	in.InvertedSequence = SequenceFinal - sequence
 }
 
 // NewTXOutput creates a new locked output
-func NewTXOutput(value int, address string) *TxOutput {
+func NewTXOutput(value int, address string) (*TxOutput, error) {
 	// create the output but ignore the key hash lock
-	txo := &TxOutput{value, nil}
+	txo := &TxOutput{value, nil, ScriptTypeP2PKH, 0, nil, false}
 	// populate the pub key hash field by converting it into base58 bytes and locking it
-	txo.Lock([]byte(address))
-	return txo
+	if err := txo.Lock([]byte(address)); err != nil {
+		return nil, err
+	}
+	return txo, nil
+}
+
+// NewMultiSigTXOutput creates an output that is locked to several addresses. Any required of them can spend it together (m-of-n)
+//
+// only P2PKH addresses can be used, the keys have to sign directly
+func NewMultiSigTXOutput(value, required int, addresses []string) (*TxOutput, error) {
+	if required < 1 || required > len(addresses) {
+		return nil, fmt.Errorf("required signatures must be between 1 and %d, not %d", len(addresses), required)
+	}
+
+	txo := &TxOutput{value, nil, ScriptTypeMultiSig, required, nil, false}
+	for _, address := range addresses {
+		addressType, err := wallet.ValidateAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		if addressType == wallet.AddressTypeP2SH {
+			return nil, fmt.Errorf("%s is a script address, multi signature outputs need key addresses", address)
+		}
+
+		_, pubKeyHash, _, err := wallet.AddressToComponents(address)
+		if err != nil {
+			return nil, err
+		}
+		// the same key twice would let one signature count twice
+		if txo.keyIndex(pubKeyHash) != -1 {
+			return nil, fmt.Errorf("%s is used more than once", address)
+		}
+		txo.PubKeyHashes = append(txo.PubKeyHashes, pubKeyHash)
+	}
+
+	return txo, nil
+}
+
+// NewDataTXOutput creates an unspendable output that embeds up to 80 bytes of data in the transaction
+//
+// the output has no value, the data is stored behind a 0xFF marker in the PubKeyHash
+func NewDataTXOutput(data []byte) (*TxOutput, error) {
+	if len(data) > MaxDataOutputSize {
+		return nil, fmt.Errorf("data output can hold at most %d bytes, not %d", MaxDataOutputSize, len(data))
+	}
+
+	script := append([]byte{dataOutputMarker}, data...)
+	return &TxOutput{0, script, ScriptTypeData, 0, nil, false}, nil
+}
+
+// IsData checks if the output is a data output. Data outputs can't be spent and are never part of the UTXO set
+func (out *TxOutput) IsData() bool {
+	return out.ScriptType == ScriptTypeData && len(out.PubKeyHash) > 0 && out.PubKeyHash[0] == dataOutputMarker
+}
+
+// Data returns the data embedded in a data output, or nil for other outputs
+func (out *TxOutput) Data() []byte {
+	if !out.IsData() {
+		return nil
+	}
+	return out.PubKeyHash[1:]
+}
+
+// checkDataOutputs checks that a transaction has at most one data output and that it holds at most MaxDataOutputSize bytes
+func checkDataOutputs(tx *Transaction) error {
+	dataOutputs := 0
+	for _, out := range tx.Outputs {
+		if !out.IsData() {
+			continue
+		}
+		dataOutputs++
+		if dataOutputs > 1 {
+			return errors.New("transaction can only have one data output")
+		}
+		if len(out.Data()) > MaxDataOutputSize {
+			return fmt.Errorf("data output can hold at most %d bytes, not %d", MaxDataOutputSize, len(out.Data()))
+		}
+	}
+	return nil
+}
+
+// IsMultiSig checks if the output is locked to several public key hashes
+func (out *TxOutput) IsMultiSig() bool {
+	return out.ScriptType == ScriptTypeMultiSig
+}
+
+// keyIndex returns the index of the public key hash in a multi signature output, or -1
+func (out *TxOutput) keyIndex(pubKeyHash []byte) int {
+	for i, hash := range out.PubKeyHashes {
+		if bytes.Equal(hash, pubKeyHash) {
+			return i
+		}
+	}
+	return -1
+}
+
+// signedBy checks if the public key already signed the multi signature input
+func (in *TxInput) signedBy(pubKey []byte) bool {
+	for _, sig := range in.MultiSig {
+		if bytes.Equal(sig.PubKey, pubKey) {
+			return true
+		}
+	}
+	return false
 }
 
 // UsesKey checks to see if the input belongs to a public key
@@ -50,38 +242,77 @@ func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
 
-// Lock locks the output with an address
-func (out *TxOutput) Lock(address []byte) {
+// Lock locks the output with an address. Returns an error when the address is not valid
+func (out *TxOutput) Lock(address []byte) error {
+	addressType, err := wallet.ValidateAddress(string(address))
+	if err != nil {
+		return err
+	}
+
+	// set the script type from the address type
+	switch addressType {
+	case wallet.AddressTypeP2SH:
+		out.ScriptType = ScriptTypeP2SH
+	default:
+		out.ScriptType = ScriptTypeP2PKH
+	}
+
 	// turn the address into the public key hash
-	pubKeyHash := wallet.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+	_, pubKeyHash, _, err := wallet.AddressToComponents(string(address))
+	if err != nil {
+		return err
+	}
 	// lock it. This gets deferred to UsesKey on the input of the next block
 	out.PubKeyHash = pubKeyHash
+	return nil
+}
+
+// Address returns the address the output is locked to. Returns false for non-standard outputs that aren't locked to a 20 byte hash
+func (out *TxOutput) Address() (string, bool) {
+	if len(out.PubKeyHash) != pubKeyHashLength {
+		return "", false
+	}
+
+	switch out.ScriptType {
+	case ScriptTypeP2PKH:
+		return string(wallet.AddressFromPubKeyHash(out.PubKeyHash)), true
+	case ScriptTypeP2SH:
+		return string(wallet.AddressFromScriptHash(out.PubKeyHash)), true
+	}
+
+	return "", false
 }
 
-// IsLockedWithKey checks if an output is locked with a provided key
+// IsLockedWithKey checks if an output is locked with a provided key. Multi signature outputs are locked with each of their keys
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
+	// nobody can unlock a data output
+	if out.IsData() {
+		return false
+	}
+	if out.IsMultiSig() {
+		return out.keyIndex(pubKeyHash) != -1
+	}
 	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
 }
 
 // Serialize serializes a transaction into bytes
-func (outs TxOutputs) Serialize() []byte {
+func (outs TxOutputs) Serialize() ([]byte, error) {
 	var buffer bytes.Buffer
 
 	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(outs)
-	handle(err)
+	if err := encode.Encode(outs); err != nil {
+		return nil, err
+	}
 
-	return buffer.Bytes()
+	return buffer.Bytes(), nil
 }
 
 // DeserializeOutputs turns bytes into txoutputs
-func DeserializeOutputs(data []byte) TxOutputs {
+func DeserializeOutputs(data []byte) (TxOutputs, error) {
 	var outputs TxOutputs
 
 	decode := gob.NewDecoder(bytes.NewReader(data))
 	err := decode.Decode(&outputs)
-	handle(err)
 
-	return outputs
+	return outputs, err
 }
@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"fmt"
+	"io"
+)
+
+// ExportTxGraph writes the transactions between two block heights as a Graphviz DOT graph
+//
+// each transaction is a node and each input is an edge from the transaction that holds the referenced output.
+// The graph can be rendered with `dot -Tsvg`
+func (chain *Blockchain) ExportTxGraph(w io.Writer, fromHeight, toHeight int) error {
+	if fromHeight < 0 || toHeight < fromHeight {
+		return ErrInvalidRange
+	}
+
+	// the iterator goes backwards, so collect the blocks first and write them in ascending order
+	var blocks []*Block
+	iter := chain.Iterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if block.Height >= fromHeight && block.Height <= toHeight {
+			blocks = append(blocks, block)
+		}
+
+		if len(block.PrevHash) == 0 || block.Height <= fromHeight {
+			break
+		}
+	}
+
+	if _, err := fmt.Fprintln(w, "digraph txgraph {"); err != nil {
+		return err
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		for _, tx := range blocks[i].Transactions {
+			if err := writeTxNode(w, tx); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// writeTxNode writes a transaction node and the edges of its inputs
+func writeTxNode(w io.Writer, tx *Transaction) error {
+	total := 0
+	for _, out := range tx.Outputs {
+		total += out.Value
+	}
+
+	// coinbase transactions create new coins, make them stand out
+	shape := "ellipse"
+	if tx.IsCoinbase() {
+		shape = "doubleoctagon"
+	}
+
+	id := fmt.Sprintf("%x", tx.ID)
+	if _, err := fmt.Fprintf(w, "  \"%s\" [label=\"%.8s\\n%d\", shape=%s];\n", id, id, total, shape); err != nil {
+		return err
+	}
+
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	for _, in := range tx.Inputs {
+		if _, err := fmt.Fprintf(w, "  \"%x\" -> \"%s\" [label=\"out %d\"];\n", in.ID, id, in.Out); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -3,15 +3,23 @@ package blockchain
 import (
 	"bytes"
 	"encoding/hex"
-	"log"
+	"errors"
 
-	"github.com/dgraph-io/badger"
+	"github.com/qhenkart/blockchain/blockchain/metrics"
+	"github.com/qhenkart/blockchain/wallet"
 )
 
 var (
 	// badger does not have any tables, so to get around that, we can create a key prefix to separate them from other items
 	utxoPrefix   = []byte("utxo-")
 	prefixLength = len(utxoPrefix)
+	// the bloom filter of the key hashes in the UTXO set. Outside of the utxo prefix, so it isn't counted as an unspent transaction
+	utxoBloomKey = []byte("bloom-utxo")
+
+	// ErrNilChain is returned when a UTXO set is created without a blockchain
+	ErrNilChain = errors.New("blockchain is nil")
+	// ErrUTXOSetNotIndexed is returned when the UTXO set was written without the indexes of the outputs, Reindex adds them
+	ErrUTXOSetNotIndexed = errors.New("the UTXO set has no output indexes, it needs a reindex")
 )
 
 // UTXOSet allows us to access the database connected to our blockchain
@@ -19,155 +27,512 @@ var (
 // we can create a new layer in our db that has only UTXOs (unspent transactions)
 type UTXOSet struct {
 	Blockchain *Blockchain
+	// the size of the bloom filter, only used when the filter is rebuilt by Reindex
+	BloomConfig BloomConfig
+	// the key hashes of the unspent outputs, lets FindUnspentTransactions skip addresses without outputs
+	//
+	// nil when the set was never reindexed with a filter, then every lookup scans the set
+	BloomFilter BloomFilter
+}
+
+// NewUTXOSet creates a new UTXO set connected to a blockchain. Returns ErrNilChain when there is no blockchain
+//
+// the bloom filter is loaded from the database, it only matches the default config after Reindex
+func NewUTXOSet(chain *Blockchain) (*UTXOSet, error) {
+	if chain == nil {
+		return nil, ErrNilChain
+	}
+
+	u := &UTXOSet{Blockchain: chain, BloomConfig: DefaultBloomConfig()}
+	if err := chain.Database.View(u.loadBloom); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// BloomFalsePositiveRate estimates the chance that a lookup of an address without outputs still scans the set
+//
+// the filter only grows until the next Reindex, spent outputs keep their bits. Returns 1 without a filter
+func (u UTXOSet) BloomFalsePositiveRate() float64 {
+	return u.BloomFilter.falsePositiveRate(u.BloomConfig.Hashes)
+}
+
+// addToBloom adds the key hashes that can unlock the output to the filter
+func (u *UTXOSet) addToBloom(out TxOutput) {
+	if out.IsData() {
+		return
+	}
+	if out.IsMultiSig() {
+		for _, hash := range out.PubKeyHashes {
+			u.BloomFilter.add(hash, u.BloomConfig.Hashes)
+		}
+		return
+	}
+	u.BloomFilter.add(out.PubKeyHash, u.BloomConfig.Hashes)
+}
+
+// ReloadBloom reads the filter from the database again
+//
+// Update and Reindex on other UTXO sets of the chain add outputs to the stored filter. A set that lives longer than a
+// block, eg. the one of the API, has to reload it or FindUnspentTransactions misses the new outputs
+func (u *UTXOSet) ReloadBloom() error {
+	return u.Blockchain.Database.View(u.loadBloom)
+}
+
+// loadBloom reads the stored filter. The filter stays nil when there is none or it was built with another config
+func (u *UTXOSet) loadBloom(txn StorageTxn) error {
+	u.BloomFilter = nil
+
+	item, err := txn.Get(utxoBloomKey)
+	if err == ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+
+	// the first byte is the amount of hash functions
+	if len(data) > 1 && int(data[0]) == u.BloomConfig.Hashes && len(data)-1 == len(NewBloomFilterWithConfig(u.BloomConfig)) {
+		u.BloomFilter = BloomFilter(data[1:])
+	}
+	return nil
 }
 
-// NewUTXOSet creates a new UTXO set connected to a blockchain
-func NewUTXOSet(chain *Blockchain) *UTXOSet {
-	return &UTXOSet{Blockchain: chain}
+// saveBloom stores the filter with the amount of hash functions in front of it
+func (u *UTXOSet) saveBloom(txn StorageTxn) error {
+	data := append([]byte{byte(u.BloomConfig.Hashes)}, u.BloomFilter...)
+	return txn.Set(utxoBloomKey, data)
 }
 
 // FindSpendableOutputs accumulates the total unspent outputs as well as their addresses to sent a specified amount
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+//
+// coinbase outputs are skipped until they have CoinbaseMaturity confirmations. Sets built before the outputs were marked
+// need a Reindex, until then their coinbase outputs are treated like any other output
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
 	unspentOuts := make(map[string][]int)
 	accumulated := 0
 
 	db := u.Blockchain.Database
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	err := db.View(func(txn StorageTxn) error {
+		lastBlock, err := lastBlockOf(txn)
+		if err != nil {
+			return err
+		}
+
+		opts := DefaultIteratorOptions
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
 		// iterate through each prefix key
+	UTXOs:
 		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
 			item := it.Item()
 			k := item.Key()
-			v := valueHash(item)
+			v, err := valueHash(item)
+			if err != nil {
+				return err
+			}
 
 			k = bytes.TrimPrefix(k, utxoPrefix)
 			txID := hex.EncodeToString(k)
 
 			// get the outputs of the id
-			outs := DeserializeOutputs(v)
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
 
 			// iterate through transaction outputs
-			for outIdx, out := range outs.Outputs {
-				// make sure a transaction cannot be made where a user does not have enough tokens
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
+			for pos, out := range outs.Outputs {
+				// once we have enough tokens there is no need to look at the remaining outputs
+				if accumulated >= amount {
+					break UTXOs
+				}
+
+				// the transaction goes into the block after the tip
+				if !isMature(out, outs.Height, lastBlock.Height+1) {
+					continue
+				}
+
+				// multi signature outputs need the other keys as well, a single wallet can't spend them
+				if out.IsLockedWithKey(pubKeyHash) && !out.IsMultiSig() {
 					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
+					unspentOuts[txID] = append(unspentOuts[txID], outs.index(pos))
 				}
 			}
 		}
 		return nil
 	})
 
-	handle(err)
-	return accumulated, unspentOuts
+	return accumulated, unspentOuts, err
+}
+
+// FindOutput looks up a single unspent output directly by its utxo prefixed transaction id
+//
+// returns false if the output is spent or unknown. Also returns false for sets without stored indexes, the position of an
+// output there doesn't tell its index, so the caller has to look the output up in the chain
+func (u UTXOSet) FindOutput(txID []byte, outIdx int) (TxOutput, bool, error) {
+	output, _, found, err := u.findOutput(txID, outIdx)
+	return output, found, err
+}
+
+// findOutput finds an unspent output like FindOutput, and the height of the block of its transaction
+func (u UTXOSet) findOutput(txID []byte, outIdx int) (TxOutput, int, bool, error) {
+	var output TxOutput
+	height := 0
+	found := false
+
+	db := u.Blockchain.Database
+
+	err := db.View(func(txn StorageTxn) error {
+		// create the prefixed key rather than iterating over the whole set
+		key := append(append([]byte{}, utxoPrefix...), txID...)
+		item, err := txn.Get(key)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		v, err := valueHash(item)
+		if err != nil {
+			return err
+		}
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+		if !outs.indexed() {
+			return nil
+		}
+		for pos, index := range outs.Indexes {
+			if index == outIdx {
+				output = outs.Outputs[pos]
+				height = outs.Height
+				found = true
+				break
+			}
+		}
+		return nil
+	})
+
+	return output, height, found, err
 }
 
 // Reindex clears out the database of utxos, and rebuild the set directly from the blockchain
-func (u UTXOSet) Reindex() {
+//
+// the bloom filter is rebuilt with the BloomConfig of the set
+func (u *UTXOSet) Reindex() error {
 	// alias the db
 	db := u.Blockchain.Database
 
 	// remove all items in the database with this prefix
-	u.DeleteByPrefix(utxoPrefix)
+	if err := u.DeleteByPrefix(utxoPrefix); err != nil {
+		return err
+	}
 
 	// collect all unspent outputs from the blockchain
-	UTXO := u.Blockchain.FindUTXO()
+	UTXO, err := u.Blockchain.FindUTXO()
+	if err != nil {
+		return err
+	}
+
+	// a fresh filter drops the key hashes of spent outputs
+	u.BloomFilter = NewBloomFilterWithConfig(u.BloomConfig)
 
-	err := db.Update(func(txn *badger.Txn) error {
+	err = db.Update(func(txn StorageTxn) error {
 		// iterate through all utxos
 		for txID, outs := range UTXO {
 			// decode the index into bytes
 			key, err := hex.DecodeString(txID)
 			if err != nil {
-				handle(err)
+				return err
 			}
 			// add prefix
 			key = append(utxoPrefix, key...)
 
+			data, err := outs.Serialize()
+			if err != nil {
+				return err
+			}
+
 			// add it to the database
-			err = txn.Set(key, outs.Serialize())
-			handle(err)
+			if err := txn.Set(key, data); err != nil {
+				return err
+			}
+
+			for _, out := range outs.Outputs {
+				u.addToBloom(out)
+			}
 		}
 
-		return nil
+		return u.saveBloom(txn)
 	})
-	handle(err)
+	if err != nil {
+		return err
+	}
+
+	metrics.UTXOCount.Set(float64(len(UTXO)))
+	return nil
 }
 
 // Update takes a block and uses it to update the utxo set
-func (u *UTXOSet) Update(block *Block) {
-	db := u.Blockchain.Database
+func (u *UTXOSet) Update(block *Block) error {
+	var added int
+	err := u.Blockchain.Database.Update(func(txn StorageTxn) error {
+		var err error
+		added, err = u.update(txn, block)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	metrics.UTXOCount.Add(float64(added))
+	return nil
+}
+
+// update applies a block to the set in the transaction. Returns the change of the amount of transactions with unspent outputs
+func (u *UTXOSet) update(txn StorageTxn, block *Block) (int, error) {
+	added := 0
+
+	// read the filter in the same transaction, so a filter saved since the set was created isn't overwritten
+	if err := u.loadBloom(txn); err != nil {
+		return 0, err
+	}
+
+	// iterate through each transaction
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			// iterate through each input
+			for _, in := range tx.Inputs {
+				// create an output for each input
+				updatedOuts := TxOutputs{}
+				// take the id of the input and add the prefix to it
+				inID := append(utxoPrefix, in.ID...)
+				// get the value of the input from the db
+				item, err := txn.Get(inID)
+				if err != nil {
+					return 0, err
+				}
+				v, err := valueHash(item)
+				if err != nil {
+					return 0, err
+				}
 
-	err := db.Update(func(txn *badger.Txn) error {
-		// iterate through each transaction
-		for _, tx := range block.Transactions {
-			if !tx.IsCoinbase() {
-				// iterate through each input
-				for _, in := range tx.Inputs {
-					// create an output for each input
-					updatedOuts := TxOutputs{}
-					// take the id of the input and add the prefix to it
-					inID := append(utxoPrefix, in.ID...)
-					// get the value of the input from the db
-					item, err := txn.Get(inID)
-					handle(err)
-					v := valueHash(item)
-
-					// deserialixe the output value
-					outs := DeserializeOutputs(v)
-
-					// iterate through each output
-					for outIdx, out := range outs.Outputs {
-						// if the output is not attached to the input then we know it is unspent.. add it to the updated outputs
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
+				// deserialixe the output value
+				outs, err := DeserializeOutputs(v)
+				if err != nil {
+					return 0, err
+				}
+
+				// the remaining outputs are still from the same block
+				updatedOuts.Height = outs.Height
+				// iterate through each output
+				for pos, out := range outs.Outputs {
+					// if the output is not attached to the input then we know it is unspent.. add it to the updated outputs
+					if index := outs.index(pos); index != in.Out {
+						updatedOuts.add(out, index)
 					}
+				}
 
-					if len(updatedOuts.Outputs) == 0 {
-						// if there are no unspent outputs, then get rid of the utxo transaction ids
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
-					} else {
-						// save the unspent outputs with the utxo prefixed transaction id
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							log.Panic(err)
-						}
+				if len(updatedOuts.Outputs) == 0 {
+					// if there are no unspent outputs, then get rid of the utxo transaction ids
+					if err := txn.Delete(inID); err != nil {
+						return 0, err
+					}
+					added--
+				} else {
+					// save the unspent outputs with the utxo prefixed transaction id
+					data, err := updatedOuts.Serialize()
+					if err != nil {
+						return 0, err
+					}
+					if err := txn.Set(inID, data); err != nil {
+						return 0, err
 					}
 				}
 			}
+		}
 
-			// account for coinbase transactions in the block, they will always be unspent
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+		// account for coinbase transactions in the block, they will always be unspent
+		newOutputs := TxOutputs{Height: block.Height}
+		for outIdx, out := range tx.Outputs {
+			// data outputs can never be spent, there is no reason to keep them
+			if out.IsData() {
+				continue
 			}
-
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
+			out.FromCoinbase = tx.IsCoinbase()
+			newOutputs.add(out, outIdx)
+			// without a filter there is nothing to update, a partial one would rule out addresses that have outputs
+			if u.BloomFilter != nil {
+				u.addToBloom(out)
 			}
 		}
+		if len(newOutputs.Outputs) == 0 {
+			continue
+		}
 
-		return nil
+		data, err := newOutputs.Serialize()
+		if err != nil {
+			return 0, err
+		}
+		txID := append(utxoPrefix, tx.ID...)
+		if err := txn.Set(txID, data); err != nil {
+			return 0, err
+		}
+		added++
+	}
+
+	if u.BloomFilter == nil {
+		return added, nil
+	}
+	return added, u.saveBloom(txn)
+}
+
+// Rollback undoes Update for a block that is removed from the chain, eg. during a reorganization
+//
+// the outputs of the block are removed and the outputs its transactions spent are unspent again. The blocks have to be
+// rolled back from the newest to the oldest, while the transaction index still knows the spent transactions
+func (u *UTXOSet) Rollback(block *Block) error {
+	var added int
+	err := u.Blockchain.Database.Update(func(txn StorageTxn) error {
+		var err error
+		added, err = u.rollback(txn, block)
+		return err
 	})
-	handle(err)
+	if err != nil {
+		return err
+	}
+
+	metrics.UTXOCount.Add(float64(added))
+	return nil
+}
+
+// rollback undoes update for a block in the transaction. Returns the change of the amount of transactions with unspent outputs
+func (u *UTXOSet) rollback(txn StorageTxn, block *Block) (int, error) {
+	added := 0
+
+	if err := u.loadBloom(txn); err != nil {
+		return 0, err
+	}
+
+	// later transactions can spend the outputs of earlier ones in the same block, so they are undone first
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+
+		txID := append(append([]byte{}, utxoPrefix...), tx.ID...)
+		if _, err := txn.Get(txID); err == nil {
+			if err := txn.Delete(txID); err != nil {
+				return 0, err
+			}
+			added--
+		} else if err != ErrKeyNotFound {
+			return 0, err
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, in := range tx.Inputs {
+			out, height, err := spentOutput(txn, in)
+			if err != nil {
+				return 0, err
+			}
+
+			// add the output back to the unspent outputs of its transaction
+			outs := TxOutputs{Height: height}
+			inID := append(append([]byte{}, utxoPrefix...), in.ID...)
+			item, err := txn.Get(inID)
+			if err == nil {
+				v, err := valueHash(item)
+				if err != nil {
+					return 0, err
+				}
+				if outs, err = DeserializeOutputs(v); err != nil {
+					return 0, err
+				}
+			} else if err == ErrKeyNotFound {
+				added++
+			} else {
+				return 0, err
+			}
+			// without stored indexes the positions would be wrong once the output is added at the end
+			if !outs.indexed() {
+				return 0, ErrUTXOSetNotIndexed
+			}
+			outs.add(out, in.Out)
+
+			data, err := outs.Serialize()
+			if err != nil {
+				return 0, err
+			}
+			if err := txn.Set(inID, data); err != nil {
+				return 0, err
+			}
+			if u.BloomFilter != nil {
+				u.addToBloom(out)
+			}
+		}
+	}
+
+	if u.BloomFilter == nil {
+		return added, nil
+	}
+	return added, u.saveBloom(txn)
+}
+
+// spentOutput reads the output an input spends from the block of its transaction, and the height of that block
+func spentOutput(txn StorageTxn, in TxInput) (TxOutput, int, error) {
+	item, err := txn.Get(txKey(in.ID))
+	if err != nil {
+		return TxOutput{}, 0, ErrInputNotFound(hex.EncodeToString(in.ID))
+	}
+	blockHash, err := valueHash(item)
+	if err != nil {
+		return TxOutput{}, 0, err
+	}
+	if item, err = txn.Get(blockHash); err != nil {
+		return TxOutput{}, 0, err
+	}
+	block, err := readBlock(item)
+	if err != nil {
+		return TxOutput{}, 0, err
+	}
+
+	for _, tx := range block.Transactions {
+		if bytes.Equal(tx.ID, in.ID) && in.Out >= 0 && in.Out < len(tx.Outputs) {
+			out := tx.Outputs[in.Out]
+			out.FromCoinbase = tx.IsCoinbase()
+			return out, block.Height, nil
+		}
+	}
+	return TxOutput{}, 0, ErrInputNotFound(hex.EncodeToString(in.ID))
 }
 
 // FindUnspentTransactions measuring outputs that have no input references then they are "unspent" tokens. By counting all of the
 // unspent outputs that are associated with a certain user, we can tell how many tokens a user owns
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
+//
+// the bloom filter is checked first, addresses that never had an output are answered without reading the set
+func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) ([]TxOutput, error) {
 	var UTXOs []TxOutput
 
+	if !u.BloomFilter.mayContain(pubKeyHash, u.BloomConfig.Hashes) {
+		return UTXOs, nil
+	}
+
 	db := u.Blockchain.Database
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	err := db.View(func(txn StorageTxn) error {
+		opts := DefaultIteratorOptions
 
 		it := txn.NewIterator(opts)
 		defer it.Close()
@@ -175,8 +540,14 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
 		// iterate through UTXOS prefixes
 		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
 			// get the value of each utxo prefixed item
-			v := valueHash(it.Item())
-			outs := DeserializeOutputs(v)
+			v, err := valueHash(it.Item())
+			if err != nil {
+				return err
+			}
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
 
 			// iterate through each output, check to see if it is locked by the provided hash address
 			for _, out := range outs.Outputs {
@@ -188,18 +559,31 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
 
 		return nil
 	})
-	handle(err)
 
-	return UTXOs
+	return UTXOs, err
+}
+
+// GetBalance adds up the unspent outputs of a wallet. Only the public key hash is needed, so watch only wallets work as well
+func GetBalance(w *wallet.Wallet, UTXO *UTXOSet) (int, error) {
+	UTXOs, err := UTXO.FindUnspentTransactions(w.PubKeyHash())
+	if err != nil {
+		return 0, err
+	}
+
+	balance := 0
+	for _, out := range UTXOs {
+		balance += out.Value
+	}
+	return balance, nil
 }
 
 // CountTransactions counts how many unspent transactions exist within the set
-func (u UTXOSet) CountTransactions() int {
+func (u UTXOSet) CountTransactions() (int, error) {
 	db := u.Blockchain.Database
 	counter := 0
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	err := db.View(func(txn StorageTxn) error {
+		opts := DefaultIteratorOptions
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
@@ -209,17 +593,19 @@ func (u UTXOSet) CountTransactions() int {
 		}
 		return nil
 	})
-	handle(err)
+	if err == nil {
+		metrics.UTXOCount.Set(float64(counter))
+	}
 
-	return counter
+	return counter, err
 }
 
 // DeleteByPrefix goes through the db and deletes the prefix keys by bulk
-func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
+func (u *UTXOSet) DeleteByPrefix(prefix []byte) error {
 	// create closure that has all of the deleted keys
 	deleteKeys := func(keysForDelete [][]byte) error {
 		// access db via the blockchain connection and expose the badger transaction
-		if err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		if err := u.Blockchain.Database.Update(func(txn StorageTxn) error {
 			// iterate through the 2d slice of bytes
 			for _, k := range keysForDelete {
 				// delete each key
@@ -239,8 +625,8 @@ func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
 	collectSize := 100000
 
 	// open read only transaction
-	u.Blockchain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	return u.Blockchain.Database.View(func(txn StorageTxn) error {
+		opts := DefaultIteratorOptions
 		// allows us to read the keys but without the values for optimization
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
@@ -259,7 +645,7 @@ func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
 			// if we hit the limit, then delete the first 100,000 keys set for deletion
 			if keysCollected == collectSize {
 				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
+					return err
 				}
 
 				// reset the array and the counter
@@ -271,7 +657,7 @@ func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
 		// if the keys are above 0 but below 100,000 at the end of the loop, delete the rest
 		if keysCollected > 0 {
 			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panic(err)
+				return err
 			}
 		}
 		return nil
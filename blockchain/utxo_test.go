@@ -0,0 +1,301 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// newIndexedUTXOSet creates a test chain and a UTXO set that holds the genesis coinbase
+func newIndexedUTXOSet(t *testing.T, address string) (*UTXOSet, func()) {
+	t.Helper()
+
+	chain, closeChain, err := NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxoSet, err := NewUTXOSet(chain)
+	if err != nil {
+		closeChain()
+		t.Fatal(err)
+	}
+	if err := utxoSet.Reindex(); err != nil {
+		closeChain()
+		t.Fatal(err)
+	}
+	return utxoSet, closeChain
+}
+
+// storeBlock writes a block and its index entries without validating it, so the transactions don't need signatures
+func storeBlock(t testing.TB, chain *Blockchain, block *Block) {
+	t.Helper()
+
+	err := chain.Database.Update(func(txn StorageTxn) error {
+		if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		return indexBlock(txn, block)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUTXOSetKeepsOutputIndexes(t *testing.T) {
+	owners := []*wallet.Wallet{wallet.MakeWallet(), wallet.MakeWallet(), wallet.MakeWallet()}
+	utxoSet, closeChain := newIndexedUTXOSet(t, string(owners[0].Address()))
+	defer closeChain()
+
+	genesis, err := utxoSet.Blockchain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a transaction with 3 outputs, each with its own owner and value
+	payments := &Transaction{Inputs: []TxInput{{ID: genesis.Transactions[0].ID, Out: 0}}}
+	for i, w := range owners {
+		out, err := NewTXOutput(i+1, string(w.Address()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		payments.Outputs = append(payments.Outputs, *out)
+	}
+	hashTx(t, payments)
+	paymentsBlock := &Block{Hash: []byte("payments"), Transactions: []*Transaction{payments}, PrevHash: genesis.Hash, Height: 1}
+	storeBlock(t, utxoSet.Blockchain, paymentsBlock)
+	if err := utxoSet.Update(paymentsBlock); err != nil {
+		t.Fatal(err)
+	}
+
+	// spending output 0 moves the other outputs to a lower position in the set
+	spend := &Transaction{Inputs: []TxInput{{ID: payments.ID, Out: 0}}, Outputs: []TxOutput{{Value: 1, PubKeyHash: owners[1].PubKeyHash()}}}
+	hashTx(t, spend)
+	spendBlock := &Block{Hash: []byte("spend"), Transactions: []*Transaction{spend}, PrevHash: paymentsBlock.Hash, Height: 2}
+	storeBlock(t, utxoSet.Blockchain, spendBlock)
+	if err := utxoSet.Update(spendBlock); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := utxoSet.FindOutput(payments.ID, 0); err != nil || ok {
+		t.Fatalf("spent output 0 was found, ok %v err %v", ok, err)
+	}
+	for outIdx := 1; outIdx <= 2; outIdx++ {
+		out, ok, err := utxoSet.FindOutput(payments.ID, outIdx)
+		if err != nil || !ok {
+			t.Fatalf("output %d was not found, ok %v err %v", outIdx, ok, err)
+		}
+		if out.Value != outIdx+1 || !out.IsLockedWithKey(owners[outIdx].PubKeyHash()) {
+			t.Errorf("output %d resolved to the output with value %d", outIdx, out.Value)
+		}
+	}
+
+	// the inputs a wallet creates have to reference the index in the transaction, not the position in the set
+	_, spendable, err := utxoSet.FindSpendableOutputs(owners[2].PubKeyHash(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := spendable[hex.EncodeToString(payments.ID)]; len(got) != 1 || got[0] != 2 {
+		t.Errorf("spendable outputs of the third owner are %v, want [2]", got)
+	}
+
+	// spending output 2 must leave output 1 untouched
+	spendLast := &Transaction{Inputs: []TxInput{{ID: payments.ID, Out: 2}}, Outputs: []TxOutput{{Value: 3, PubKeyHash: owners[0].PubKeyHash()}}}
+	hashTx(t, spendLast)
+	spendLastBlock := &Block{Hash: []byte("spend last"), Transactions: []*Transaction{spendLast}, PrevHash: spendBlock.Hash, Height: 3}
+	storeBlock(t, utxoSet.Blockchain, spendLastBlock)
+	if err := utxoSet.Update(spendLastBlock); err != nil {
+		t.Fatal(err)
+	}
+	if out, ok, _ := utxoSet.FindOutput(payments.ID, 1); !ok || out.Value != 2 {
+		t.Errorf("output 1 after spending output 2: ok %v value %d", ok, out.Value)
+	}
+	if _, ok, _ := utxoSet.FindOutput(payments.ID, 2); ok {
+		t.Error("spent output 2 was found")
+	}
+
+	// rolling back the spends restores the outputs under their own index
+	if err := utxoSet.Rollback(spendLastBlock); err != nil {
+		t.Fatal(err)
+	}
+	if err := utxoSet.Rollback(spendBlock); err != nil {
+		t.Fatal(err)
+	}
+	for outIdx := 0; outIdx <= 2; outIdx++ {
+		out, ok, err := utxoSet.FindOutput(payments.ID, outIdx)
+		if err != nil || !ok {
+			t.Fatalf("output %d was not restored, ok %v err %v", outIdx, ok, err)
+		}
+		if out.Value != outIdx+1 {
+			t.Errorf("restored output %d has value %d", outIdx, out.Value)
+		}
+	}
+}
+
+func TestFindOutputIgnoresSetsWithoutIndexes(t *testing.T) {
+	w := wallet.MakeWallet()
+	utxoSet, closeChain := newIndexedUTXOSet(t, string(w.Address()))
+	defer closeChain()
+
+	genesis, err := utxoSet.Blockchain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesis.Transactions[0]
+
+	// an entry written before the indexes were stored
+	legacy := TxOutputs{Outputs: coinbase.Outputs}
+	data, err := legacy.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = utxoSet.Blockchain.Database.Update(func(txn StorageTxn) error {
+		return txn.Set(append(append([]byte{}, utxoPrefix...), coinbase.ID...), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := utxoSet.FindOutput(coinbase.ID, 0); err != nil || ok {
+		t.Errorf("FindOutput used the position of a set without indexes, ok %v err %v", ok, err)
+	}
+
+	// VerifyTransaction and TxFee fall back to the chain
+	fee, err := utxoSet.Blockchain.TxFee(&Transaction{Inputs: []TxInput{{ID: coinbase.ID, Out: 0}}, Outputs: []TxOutput{{Value: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := coinbase.Outputs[0].Value - 1; fee != want {
+		t.Errorf("fee %d, want %d", fee, want)
+	}
+}
+
+func TestFindSpendableOutputsStopsAtTheAmount(t *testing.T) {
+	miner, owner := wallet.MakeWallet(), wallet.MakeWallet()
+	utxoSet, closeChain := newIndexedUTXOSet(t, string(miner.Address()))
+	defer closeChain()
+
+	genesis, err := utxoSet.Blockchain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 100 outputs with a value of 1 each
+	coins := &Transaction{Inputs: []TxInput{{ID: genesis.Transactions[0].ID, Out: 0}}}
+	for i := 0; i < 100; i++ {
+		coins.Outputs = append(coins.Outputs, TxOutput{Value: 1, PubKeyHash: owner.PubKeyHash()})
+	}
+	hashTx(t, coins)
+	block := &Block{Hash: []byte("coins"), Transactions: []*Transaction{coins}, PrevHash: genesis.Hash, Height: 1}
+	storeBlock(t, utxoSet.Blockchain, block)
+	if err := utxoSet.Update(block); err != nil {
+		t.Fatal(err)
+	}
+
+	accumulated, spendable, err := utxoSet.FindSpendableOutputs(owner.PubKeyHash(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accumulated != 10 {
+		t.Errorf("accumulated %d, want 10", accumulated)
+	}
+	if got := len(spendable[hex.EncodeToString(coins.ID)]); got != 10 {
+		t.Errorf("selected %d outputs, want 10", got)
+	}
+}
+
+func TestDataOutputsAreNeverSpendable(t *testing.T) {
+	owner := wallet.MakeWallet()
+	utxoSet, closeChain := newIndexedUTXOSet(t, string(wallet.MakeWallet().Address()))
+	defer closeChain()
+
+	genesis, err := utxoSet.Blockchain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := NewDataTXOutput([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a value sent to a data output is burned
+	burned := *data
+	burned.Value = 5
+	tx := &Transaction{
+		Inputs:  []TxInput{{ID: genesis.Transactions[0].ID, Out: 0}},
+		Outputs: []TxOutput{{Value: 1, PubKeyHash: owner.PubKeyHash()}, *data, burned},
+	}
+	hashTx(t, tx)
+	block := &Block{Hash: []byte("data"), Transactions: []*Transaction{tx}, PrevHash: genesis.Hash, Height: 1}
+	storeBlock(t, utxoSet.Blockchain, block)
+	if err := utxoSet.Update(block); err != nil {
+		t.Fatal(err)
+	}
+
+	for outIdx := 1; outIdx <= 2; outIdx++ {
+		if tx.Outputs[outIdx].IsLockedWithKey(owner.PubKeyHash()) {
+			t.Errorf("data output %d can be unlocked", outIdx)
+		}
+		if _, ok, err := utxoSet.FindOutput(tx.ID, outIdx); err != nil || ok {
+			t.Errorf("data output %d is in the UTXO set, ok %v err %v", outIdx, ok, err)
+		}
+	}
+	accumulated, spendable, err := utxoSet.FindSpendableOutputs(owner.PubKeyHash(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := spendable[hex.EncodeToString(tx.ID)]; accumulated != 1 || len(got) != 1 || got[0] != 0 {
+		t.Errorf("spendable outputs %v worth %d, want only output 0 worth 1", got, accumulated)
+	}
+}
+
+func TestDataOutputsHoldAtMost80Bytes(t *testing.T) {
+	out, err := NewDataTXOutput(make([]byte, MaxDataOutputSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.IsData() || len(out.Data()) != MaxDataOutputSize || out.Value != 0 {
+		t.Errorf("data output of %d bytes with value %d, want %d bytes and no value", len(out.Data()), out.Value, MaxDataOutputSize)
+	}
+	if _, err := NewDataTXOutput(make([]byte, MaxDataOutputSize+1)); err == nil {
+		t.Errorf("created a data output of %d bytes", MaxDataOutputSize+1)
+	}
+
+	w := wallet.MakeWallet()
+	utxoSet, closeChain := newIndexedUTXOSet(t, string(w.Address()))
+	defer closeChain()
+	matureGenesis(t, utxoSet.Blockchain, string(w.Address()))
+
+	to := string(wallet.MakeWallet().Address())
+	tests := []struct {
+		name     string
+		payments []PaymentOutput
+		valid    bool
+	}{
+		{"80 bytes", []PaymentOutput{{To: to, Amount: 1}, {Data: make([]byte, MaxDataOutputSize)}}, true},
+		{"81 bytes", []PaymentOutput{{To: to, Amount: 1}, {Data: make([]byte, MaxDataOutputSize+1)}}, false},
+		{"two data outputs", []PaymentOutput{{Data: []byte("a")}, {Data: []byte("b")}}, false},
+		{"data output with a recipient", []PaymentOutput{{To: to, Amount: 1, Data: []byte("a")}}, false},
+	}
+	for _, test := range tests {
+		tx, err := NewWalletMultiOutputTransaction(w, test.payments, 0, 0, utxoSet)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: created %x", test.name, tx.ID)
+		}
+	}
+
+	// transactions of other nodes are checked as well
+	genesis, err := utxoSet.Blockchain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oversized := TxOutput{PubKeyHash: append([]byte{dataOutputMarker}, make([]byte, MaxDataOutputSize+1)...), ScriptType: ScriptTypeData}
+	tx := &Transaction{Inputs: []TxInput{{ID: genesis.Transactions[0].ID, Out: 0}}, Outputs: []TxOutput{oversized}}
+	hashTx(t, tx)
+	if ok, err := utxoSet.Blockchain.VerifyTransaction(tx); ok || err == nil {
+		t.Errorf("verified a data output of %d bytes, ok %v err %v", MaxDataOutputSize+1, ok, err)
+	}
+}
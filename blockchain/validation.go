@@ -0,0 +1,146 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidBlock is matched by the errors AddBlock and Reorganize return for blocks that break the consensus rules,
+// use errors.Is. The peer that sent such a block can be punished for it
+var ErrInvalidBlock = errors.New("invalid block")
+
+// invalidBlock wraps the reason a block was refused, it matches ErrInvalidBlock
+type invalidBlock struct {
+	err error
+}
+
+func (b invalidBlock) Error() string {
+	return fmt.Sprintf("invalid block: %s", b.err)
+}
+
+func (b invalidBlock) Unwrap() error {
+	return b.err
+}
+
+func (b invalidBlock) Is(target error) bool {
+	return target == ErrInvalidBlock
+}
+
+// checkProof checks that the block has transactions, its hash matches its data and meets the difficulty the block claims
+//
+// the merkle root isn't stored, the block hash commits to it. A changed transaction changes the root and so the hash
+func checkProof(block *Block) error {
+	pow, err := NewProof(block, block.EffectiveDifficulty())
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(pow.InitData(block.Nonce))
+	if !bytes.Equal(hash[:], block.Hash) {
+		return errors.New("block hash does not match its data")
+	}
+	if !pow.Validate() {
+		return errors.New("block hash does not meet the difficulty target")
+	}
+
+	return nil
+}
+
+// checkParent checks a block against its previous block: the height follows it, the timestamp isn't before it and the
+// difficulty is the one the chain up to the previous block asks for
+func (chain *Blockchain) checkParent(block, prev *Block) error {
+	if block.Height != prev.Height+1 {
+		return fmt.Errorf("block height %d does not follow the previous block height %d", block.Height, prev.Height)
+	}
+	if err := checkTimestamp(block, prev); err != nil {
+		return err
+	}
+
+	expected, err := chain.difficultyAfter(prev.Hash, chain.Config.RetargetWindow)
+	if err != nil {
+		return err
+	}
+	if block.EffectiveDifficulty() != expected {
+		return fmt.Errorf("block difficulty %d does not match the expected difficulty %d", block.EffectiveDifficulty(), expected)
+	}
+
+	return nil
+}
+
+// verifyTransactions checks the signatures of the transactions of a block, that coinbase outputs are only spent once they
+// are mature and that the coinbase doesn't pay more than the reward plus the fees
+//
+// the spent outputs are read through the transaction index in txn, so the blocks of a fork can be checked while the chain is
+// moved onto it. Transactions can spend the outputs of earlier transactions in the same block
+func (chain *Blockchain) verifyTransactions(txn StorageTxn, block *Block) error {
+	earlier := make(map[string]*Transaction)
+	fees, paid := 0, 0
+	for _, tx := range block.Transactions {
+		if err := checkDataOutputs(tx); err != nil {
+			return fmt.Errorf("transaction %x: %w", tx.ID, err)
+		}
+		if tx.IsCoinbase() {
+			for _, out := range tx.Outputs {
+				paid += out.Value
+			}
+			earlier[hex.EncodeToString(tx.ID)] = tx
+			continue
+		}
+
+		// only the referenced outputs are needed to verify, so rebuild partial previous transactions
+		prevTXs := make(map[string]Transaction)
+		in := 0
+		for _, input := range tx.Inputs {
+			txID := hex.EncodeToString(input.ID)
+			if input.Out < 0 {
+				return fmt.Errorf("transaction %x spends output %d", tx.ID, input.Out)
+			}
+
+			var spent TxOutput
+			height := block.Height
+			if prev, ok := earlier[txID]; ok && input.Out < len(prev.Outputs) {
+				spent = prev.Outputs[input.Out]
+				spent.FromCoinbase = prev.IsCoinbase()
+			} else {
+				var err error
+				if spent, height, err = spentOutput(txn, input); err != nil {
+					return fmt.Errorf("transaction %x: %w", tx.ID, err)
+				}
+			}
+			if !isMature(spent, height, block.Height) {
+				return fmt.Errorf("transaction %x: %w: output %d of transaction %x", tx.ID, ErrImmatureCoinbase, input.Out, input.ID)
+			}
+
+			prevTX := prevTXs[txID]
+			prevTX.ID = input.ID
+			for len(prevTX.Outputs) <= input.Out {
+				prevTX.Outputs = append(prevTX.Outputs, TxOutput{})
+			}
+			prevTX.Outputs[input.Out] = spent
+			prevTXs[txID] = prevTX
+			in += spent.Value
+		}
+		if !tx.Verify(prevTXs) {
+			return fmt.Errorf("transaction %x is invalid", tx.ID)
+		}
+
+		out := 0
+		for _, output := range tx.Outputs {
+			out += output.Value
+		}
+		if out > in {
+			return fmt.Errorf("transaction %x spends more than its inputs", tx.ID)
+		}
+		fees += in - out
+		earlier[hex.EncodeToString(tx.ID)] = tx
+	}
+
+	// the coinbase can't pay the miner more than the reward plus the fees
+	if reward := chain.Config.BlockReward(block.Height); paid > reward+fees {
+		return fmt.Errorf("coinbase pays %d, more than the reward and fees of %d", paid, reward+fees)
+	}
+
+	return nil
+}
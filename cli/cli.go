@@ -1,31 +1,56 @@
 package cli
 
 import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"runtime"
-	"strconv"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/qhenkart/blockchain/blockchain"
 	"github.com/qhenkart/blockchain/network"
+	"github.com/qhenkart/blockchain/network/api"
 	"github.com/qhenkart/blockchain/wallet"
 )
 
+// how long mining a block may take before it is abandoned
+const defaultMineTimeout = 10 * time.Minute
+
 // CommandLine creates the cli interface
 type CommandLine struct{}
 
 func (cli *CommandLine) printUsage() {
 	fmt.Println("Usage:")
+	fmt.Println(" --version - Prints the version and build information")
 	fmt.Println(" getbalance -address ADDRESS - get the balance for the provided address")
 	fmt.Println(" createblockchain -address ADDRESS - creates a blockchain. Mines the genesis block")
 	fmt.Println(" printchain - Prints the blocks in the chain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT -mine - Send amount of coins. Then -mine flag is set, mine off of this node")
-	fmt.Println(" createwallet - Creates a new Wallet")
-	fmt.Println(" listaddresses - Lists the addresses in our wallet file")
+	fmt.Println(" listblocks -from N -to N - Lists the blocks between two heights, -to defaults to the last block")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT -fee FEE -locktime N -mine -yes -dry-run -encrypted - Send amount of coins. Then -mine flag is set, mine off of this node")
+	fmt.Println(" -from and -to take an address, or @NAME for a name in the address book")
+	fmt.Println(" -locktime is the block height, or unix time when it is above 500000000, before which the transaction can't be mined")
+	fmt.Println(" createwallet -curve p256|secp256k1 -encrypted - Creates a new Wallet")
+	fmt.Println(" listaddresses -encrypted -watch-only - Lists the addresses in our wallet file, -watch-only only lists the watched addresses")
+	fmt.Println(" watchaddress -address ADDRESS -encrypted - Adds an address without its private key, to monitor its balance")
+	fmt.Println(" addressbook add NAME ADDRESS | remove NAME | list - Manages the names of addresses, send uses them as @NAME")
 	fmt.Println(" reindexutxo - Rebuilds the UTXO set")
-	fmt.Println(" startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println(" verifychain - Checks the links, PoW and transaction signatures of every block in the chain")
+	fmt.Println(" startnode -miner ADDRESS -listen-addr HOST:PORT -tls -headers-first -api-addr HOST:PORT -metrics -metrics-addr HOST:PORT -log-level LEVEL -log-format text|json -max-peers N -max-tx-per-block N -dns-seeds HOST,HOST - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println(" -tls encrypts the connections with a self signed certificate, for development. Every node has to use it")
+	fmt.Println(" dumpprivkey -address ADDRESS -encrypted - Prints the private key of the address in Wallet Import Format")
+	fmt.Println(" importblock -hex HEX - Verifies and adds a hex encoded serialized block to the chain")
+	fmt.Println(" tx history ADDRESS - Lists the transactions that spend from or pay to the address, the oldest first")
+	fmt.Println(" txgraph -from N -to N -output FILE - Writes the transaction graph between two heights as a DOT file")
+	fmt.Println(" getbans - Lists the peers that are banned by the node")
+	fmt.Println(" getpeers - Lists the peers of the node and their services, full, miner or spv")
+	fmt.Println(" -encrypted uses the wallet file encrypted with a passphrase, read from WALLET_PASSPHRASE or asked for")
 
 }
 
@@ -36,68 +61,197 @@ func (cli *CommandLine) validateArgs() {
 	}
 }
 
+// loadWallets loads the wallet file of the node, or the encrypted wallet file when encrypted is set
+//
+// the passphrase is returned so the encrypted file can be saved again
+func loadWallets(nodeID string, encrypted bool) (*wallet.Wallets, string, error) {
+	if !encrypted {
+		wallets, err := wallet.CreateWallets(nodeID)
+		return wallets, "", err
+	}
+
+	passphrase := readPassphrase()
+	wallets, err := wallet.CreateWalletsEncrypted(nodeID, passphrase)
+	return wallets, passphrase, err
+}
+
+// saveWallets saves the wallets to the wallet file that loadWallets loaded them from
+func saveWallets(wallets *wallet.Wallets, nodeID, passphrase string, encrypted bool) error {
+	if !encrypted {
+		wallets.SaveFile(nodeID)
+		return nil
+	}
+
+	return wallets.SaveFileEncrypted(nodeID, passphrase)
+}
+
+// readPassphrase reads the wallet passphrase from the WALLET_PASSPHRASE env, or asks for it on stdin
+func readPassphrase() string {
+	if passphrase := os.Getenv("WALLET_PASSPHRASE"); passphrase != "" {
+		return passphrase
+	}
+
+	// the prompt goes to stderr so it does not end up in the output of the command
+	fmt.Fprint(os.Stderr, "Wallet passphrase: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimRight(answer, "\r\n")
+}
+
+// continueChain opens the blockchain of the node, exits when it does not exist
+func continueChain(nodeID string) *blockchain.Blockchain {
+	chain, err := blockchain.Continue(nodeID)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+
+	return chain
+}
+
 func (cli *CommandLine) printChain(nodeID string) {
-	chain := blockchain.Continue(nodeID)
+	chain := continueChain(nodeID)
 	defer chain.Database.Close()
 
-	iter := chain.Iterator()
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		log.Panic(err)
+	}
 
-	for {
-		block := iter.Next()
-		fmt.Printf("Previous Hash: %x\n", block.PrevHash)
-		fmt.Printf("Hash : %x\n", block.Hash)
+	summaries, err := chain.Summary(0, height)
+	if err != nil {
+		log.Panic(err)
+	}
 
-		pow := blockchain.NewProof(block)
-		fmt.Printf("PoW %s\n ", strconv.FormatBool(pow.Validate()))
+	// print the newest block first
+	for i := len(summaries) - 1; i >= 0; i-- {
+		summary := summaries[i]
+		fmt.Printf("Height: %d\n", summary.Height)
+		fmt.Printf("Previous Hash: %x\n", summary.PrevHash)
+		fmt.Printf("Hash : %x\n", summary.Hash)
+		fmt.Printf("Time: %s\n", summary.Timestamp.Format(time.RFC3339))
+		fmt.Printf("Transactions: %d\n", summary.TxCount)
+		fmt.Printf("Total Value: %d\n", summary.TotalValue)
+		fmt.Printf("Fees: %d\n", summary.Fees)
+		fmt.Printf("Miner: %s\n", summary.MinerAddress)
+		fmt.Printf("PoW %t\n", summary.ValidPoW)
+
+		block, err := chain.GetBlock(summary.Hash)
+		if err != nil {
+			log.Panic(err)
+		}
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
 		}
 		fmt.Println()
+	}
+}
 
-		if len(block.PrevHash) == 0 {
-			break
+func (cli *CommandLine) listBlocks(from, to int, nodeID string) {
+	chain := continueChain(nodeID)
+	defer chain.Database.Close()
+
+	if to == -1 {
+		height, err := chain.GetBestHeight()
+		if err != nil {
+			log.Panic(err)
 		}
+		to = height
+	}
+
+	blocks, err := chain.GetBlocksByHeightRange(from, to)
+	if err == blockchain.ErrRangeTooLarge {
+		fmt.Printf("Can't list more than %d blocks at once\n", blockchain.MaxRangeSize)
+		return
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for _, block := range blocks {
+		fmt.Printf("%d %x %s %d transactions\n", block.Height, block.Hash, time.Unix(block.Timestamp, 0).Format(time.RFC3339), len(block.Transactions))
 	}
 }
 
-func (cli *CommandLine) startNode(nodeID, minerAddress string) {
+func (cli *CommandLine) startNode(nodeID, minerAddress, listenAddr, apiAddr string, useTLS bool, config network.NodeConfig) {
 	fmt.Printf("Starting Node %s\n", nodeID)
 
+	network.ListenAddr = listenAddr
+
+	if useTLS {
+		cert, err := network.GenerateSelfSignedCert(nodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		// self signed certificates can't be verified, the peer address is checked against the common name instead
+		config.TLSConfig = &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS12,
+		}
+	}
+
 	if len(minerAddress) > 0 {
-		if wallet.ValidateAddress(minerAddress) {
+		if _, err := wallet.ValidateAddress(minerAddress); err == nil {
 			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
 		} else {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	network.StartServer(nodeID, minerAddress)
+
+	// the API shares the chain of the server, it starts serving once the server opened it
+	if apiAddr != "" {
+		go func() {
+			if err := api.StartAPIServer(nodeID, apiAddr); err != nil {
+				log.Panic(err)
+			}
+		}()
+	}
+
+	network.StartServer(nodeID, minerAddress, config)
 }
 
 func (cli *CommandLine) createBlockchain(address, nodeID string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Address is not Valid")
+	if _, err := wallet.ValidateAddress(address); err != nil {
+		log.Panic("Address is not Valid: ", err)
+	}
+	chain, err := blockchain.Init(address, nodeID)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
 	}
-	chain := blockchain.Init(address, nodeID)
 	defer chain.Database.Close()
 
-	UTXOSet := blockchain.NewUTXOSet(chain)
-	UTXOSet.Reindex()
+	UTXOSet, err := blockchain.NewUTXOSet(chain)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := UTXOSet.Reindex(); err != nil {
+		log.Panic(err)
+	}
 
 	fmt.Println("block chain created")
 }
 
 func (cli *CommandLine) getBalance(address, nodeID string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Address is not Valid")
+	if _, err := wallet.ValidateAddress(address); err != nil {
+		log.Panic("Address is not Valid: ", err)
+	}
+	chain := continueChain(nodeID)
+	UTXOSet, err := blockchain.NewUTXOSet(chain)
+	if err != nil {
+		log.Panic(err)
 	}
-	chain := blockchain.Continue(nodeID)
-	UTXOSet := blockchain.NewUTXOSet(chain)
 	defer chain.Database.Close()
 
 	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
+	_, pubKeyHash, _, err := wallet.AddressToComponents(address)
+	if err != nil {
+		log.Panic(err)
+	}
+	UTXOs, err := UTXOSet.FindUnspentTransactions(pubKeyHash)
+	if err != nil {
+		log.Panic(err)
+	}
 
 	for _, out := range UTXOs {
 		balance += out.Value
@@ -107,76 +261,411 @@ func (cli *CommandLine) getBalance(address, nodeID string) {
 }
 
 func (cli *CommandLine) reindexUTXO(nodeID string) {
-	chain := blockchain.Continue(nodeID)
+	chain := continueChain(nodeID)
 	defer chain.Database.Close()
-	UTXOSet := blockchain.NewUTXOSet(chain)
-	UTXOSet.Reindex()
+	UTXOSet, err := blockchain.NewUTXOSet(chain)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := UTXOSet.Reindex(); err != nil {
+		log.Panic(err)
+	}
 
-	count := UTXOSet.CountTransactions()
+	count, err := UTXOSet.CountTransactions()
+	if err != nil {
+		log.Panic(err)
+	}
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
-func (cli *CommandLine) listAddresses(nodeID string) {
-	wallets, _ := wallet.CreateWallets(nodeID)
+func (cli *CommandLine) verifyChain(nodeID string) {
+	chain := continueChain(nodeID)
+	defer chain.Database.Close()
+
+	verified := 0
+	err := chain.VerifyWithProgress(func(height int) {
+		verified++
+		if verified%100 == 0 {
+			fmt.Printf("Verified %d blocks, at height %d\n", verified, height)
+		}
+	})
+	if err != nil {
+		fmt.Println("The chain is invalid:", err)
+		return
+	}
+
+	fmt.Printf("Done! All %d blocks are valid.\n", verified)
+}
+
+func (cli *CommandLine) importBlock(blockHex, nodeID string) {
+	data, err := hex.DecodeString(blockHex)
+	if err != nil {
+		fmt.Println("Block is not valid hex:", err)
+		return
+	}
+
+	block, err := blockchain.Deserialize(data)
+	if err != nil {
+		fmt.Println("Could not decode block:", err)
+		return
+	}
+
+	chain := continueChain(nodeID)
+	defer chain.Database.Close()
+
+	// a duplicate block is not an error, there is just nothing to do
+	if _, err := chain.GetBlock(block.Hash); err == nil {
+		fmt.Printf("Already have block %x\n", block.Hash)
+		return
+	}
+
+	if err := chain.VerifyBlock(block); err != nil {
+		fmt.Printf("Rejected block %x: %s\n", block.Hash, err)
+		return
+	}
+
+	if err := chain.AddBlock(block); err != nil {
+		log.Panic(err)
+	}
+
+	UTXOSet, err := blockchain.NewUTXOSet(chain)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := UTXOSet.Reindex(); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Accepted block %x at height %d\n", block.Hash, block.Height)
+}
+
+func (cli *CommandLine) dumpPrivKey(address, nodeID string, encrypted bool) {
+	// the prompt goes to stderr so only the key ends up in stdout
+	fmt.Fprint(os.Stderr, "ARE YOU SURE? This will display your private key. Type yes to continue: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(answer) != "yes" {
+		fmt.Fprintln(os.Stderr, "Aborted")
+		return
+	}
+
+	wallets, _, err := loadWallets(nodeID, encrypted)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not load wallets:", err)
+		return
+	}
+
+	wif, err := wallets.DumpPrivKey(address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not export the private key:", err)
+		return
+	}
+
+	fmt.Println(wif)
+}
+
+func (cli *CommandLine) listAddresses(nodeID string, encrypted, watchOnly bool) {
+	wallets, _, err := loadWallets(nodeID, encrypted)
+	// a node without a wallet file has no addresses
+	if err != nil && !os.IsNotExist(err) {
+		log.Panic(err)
+	}
 	addresses := wallets.GetAllAddresses()
+	if watchOnly {
+		addresses = wallets.GetAllAddresses(true)
+	}
 
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
 }
 
-func (cli *CommandLine) createWallet(nodeID string) {
-	wallets, _ := wallet.CreateWallets(nodeID)
-	address := wallets.AddWallet()
-	wallets.SaveFile(nodeID)
+func (cli *CommandLine) createWallet(curve, nodeID string, encrypted bool) {
+	var keyType byte
+	switch curve {
+	case "p256":
+		keyType = wallet.KeyTypeP256
+	case "secp256k1":
+		keyType = wallet.KeyTypeSecp256k1
+	default:
+		log.Panic("Unknown curve, use p256 or secp256k1")
+	}
+
+	// the first wallet creates the wallet file. Any other error must stop us, saving would overwrite the existing wallets
+	wallets, passphrase, err := loadWallets(nodeID, encrypted)
+	if err != nil && !os.IsNotExist(err) {
+		log.Panic(err)
+	}
+	address, err := wallets.AddWalletWithKeyType(keyType)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := saveWallets(wallets, nodeID, passphrase, encrypted); err != nil {
+		log.Panic(err)
+	}
 
 	fmt.Printf("New address is: %s\n", address)
 }
 
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow bool) {
-	if !wallet.ValidateAddress(to) {
-		log.Panic("Address is not Valid")
+func (cli *CommandLine) watchAddress(address, nodeID string, encrypted bool) {
+	wallets, passphrase, err := loadWallets(nodeID, encrypted)
+	if err != nil && !os.IsNotExist(err) {
+		log.Panic(err)
 	}
-	if !wallet.ValidateAddress(from) {
-		log.Panic("Address is not Valid")
+	if err := wallets.AddWatchAddress(address); err != nil {
+		fmt.Println("Could not watch the address:", err)
+		return
+	}
+	if err := saveWallets(wallets, nodeID, passphrase, encrypted); err != nil {
+		log.Panic(err)
 	}
-	chain := blockchain.Continue(nodeID)
-	UTXOSet := blockchain.NewUTXOSet(chain)
-	defer chain.Database.Close()
 
-	wallets, err := wallet.CreateWallets(nodeID)
+	fmt.Printf("Watching %s\n", address)
+}
+
+// newTransaction creates a transaction from an address of the wallet file. Encrypted wallet files are unlocked with the passphrase first
+func newTransaction(from, to string, amount, fee int, lockTime int64, UTXOSet *blockchain.UTXOSet, nodeID string, encrypted bool) (*blockchain.Transaction, error) {
+	if !encrypted {
+		return blockchain.NewTransaction(from, to, amount, UTXOSet, blockchain.TxOptions{Fee: fee, LockTime: lockTime})
+	}
+
+	wallets, _, err := loadWallets(nodeID, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the wallets: %w", err)
+	}
+	w, err := wallets.GetWallet(from)
+	if err != nil {
+		return nil, err
+	}
+
+	return blockchain.NewWalletTransaction(&w, to, amount, fee, lockTime, UTXOSet)
+}
+
+func (cli *CommandLine) send(from, to string, amount, fee int, lockTime int64, nodeID string, mineNow, skipConfirm, dryRun, encrypted bool) {
+	from, to = resolveAddress(from, nodeID), resolveAddress(to, nodeID)
+	if _, err := wallet.ValidateAddress(to); err != nil {
+		log.Panic("Address is not Valid: ", err)
+	}
+	if _, err := wallet.ValidateAddress(from); err != nil {
+		log.Panic("Address is not Valid: ", err)
+	}
+	chain := continueChain(nodeID)
+	UTXOSet, err := blockchain.NewUTXOSet(chain)
 	if err != nil {
 		log.Panic(err)
 	}
+	defer chain.Database.Close()
 
-	wallet := wallets.GetWallet(from)
+	tx, err := newTransaction(from, to, amount, fee, lockTime, UTXOSet, nodeID, encrypted)
+	if err == wallet.ErrWalletNotFound {
+		fmt.Printf("There is no wallet for %s on this node, check the address for typos\n", from)
+		return
+	}
+	if err != nil {
+		fmt.Println("Could not create transaction:", err)
+		return
+	}
+
+	// a dry run only checks that the transaction is valid, nothing is sent or mined
+	if dryRun {
+		valid, err := chain.VerifyTransaction(tx)
+		if err != nil {
+			fmt.Println("Could not verify transaction:", err)
+			return
+		}
+		if !valid {
+			fmt.Println("Transaction is not valid")
+			return
+		}
+		fmt.Printf("Dry run, transaction %x is valid and was not sent\n", tx.ID)
+		return
+	}
 
-	tx := blockchain.NewTransaction(&wallet, to, amount, UTXOSet)
+	if !skipConfirm && !confirm(fmt.Sprintf("Send %d to %s? Fee: %d tokens (y/N): ", amount, to, fee)) {
+		fmt.Println("Aborted")
+		return
+	}
 
 	// if mine is true, then a coinbase transaction is required
 	if mineNow {
 		// create a coinbase tx
-		cbTx := blockchain.CoinbaseTx(from, "")
+		// we mine the block ourselves, so the fee comes back to us
+		height, err := chain.GetBestHeight()
+		if err != nil {
+			log.Panic(err)
+		}
+		cbTx, err := blockchain.CoinbaseTxWithHeight(from, "", height+1, fee)
+		if err != nil {
+			log.Panic(err)
+		}
 		// add it to the transactions
 		txs := []*blockchain.Transaction{cbTx, tx}
 		// mine the block
-		block := chain.MineBlock(txs)
+		block, err := chain.MineBlockWithTimeout(txs, defaultMineTimeout)
+		if err != nil {
+			log.Panic(err)
+		}
 		// update the UTXO set
-		UTXOSet.Update(block)
+		if err := UTXOSet.Update(block); err != nil {
+			log.Panic(err)
+		}
 
 		//otherwise send the transaction to the other node
 	} else {
-		network.SendTx(network.KnownNodes[0], tx)
+		network.SendTx(network.CentralNode, tx)
 		fmt.Println("send tx")
 	}
 
 	fmt.Println("Success!")
 }
 
+// confirm asks a yes or no question on stdin. Anything but y is a no
+func confirm(prompt string) bool {
+	fmt.Print(prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(answer)) == "y"
+}
+
+func (cli *CommandLine) txHistory(address, nodeID string) {
+	if _, err := wallet.ValidateAddress(address); err != nil {
+		log.Panic("Address is not Valid: ", err)
+	}
+	chain := continueChain(nodeID)
+	defer chain.Database.Close()
+
+	txs, err := chain.GetAddressTransactions(address)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for _, tx := range txs {
+		fmt.Println(tx)
+	}
+	fmt.Printf("%d transactions\n", len(txs))
+}
+
+// resolveAddress looks up names prefixed with @ in the address book of the node, other addresses are returned as they are
+func resolveAddress(address, nodeID string) string {
+	if !strings.HasPrefix(address, "@") {
+		return address
+	}
+
+	var book wallet.AddressBook
+	if err := book.Load(nodeID); err != nil {
+		log.Panic(err)
+	}
+	resolved, err := book.Lookup(strings.TrimPrefix(address, "@"))
+	if err != nil {
+		log.Panic(address, ": ", err)
+	}
+	return resolved
+}
+
+func (cli *CommandLine) addressBook(args []string, nodeID string) {
+	var book wallet.AddressBook
+	if err := book.Load(nodeID); err != nil {
+		log.Panic(err)
+	}
+
+	switch args[0] {
+	case "add":
+		if err := book.Add(args[1], args[2]); err != nil {
+			fmt.Println("Could not add the address:", err)
+			return
+		}
+		fmt.Printf("Added %s as @%s\n", args[2], args[1])
+	case "remove":
+		book.Remove(args[1])
+		fmt.Printf("Removed @%s\n", args[1])
+	case "list":
+		for _, entry := range book.List() {
+			fmt.Printf("@%s %s\n", entry.Name, entry.Address)
+		}
+		return
+	}
+
+	if err := book.Save(nodeID); err != nil {
+		log.Panic(err)
+	}
+}
+
+func (cli *CommandLine) txGraph(from, to int, output, nodeID string) {
+	chain := continueChain(nodeID)
+	defer chain.Database.Close()
+
+	// write to stdout when no file is provided
+	w := os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if err := chain.ExportTxGraph(w, from, to); err != nil {
+		log.Panic(err)
+	}
+
+	if output != "" {
+		fmt.Printf("Transaction graph written to %s\n", output)
+	}
+}
+
+func (cli *CommandLine) getBans(nodeID string) {
+	bans, err := network.LoadBans(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if len(bans) == 0 {
+		fmt.Println("No peers are banned")
+		return
+	}
+
+	// list the bans that expire first at the top
+	hosts := make([]string, 0, len(bans))
+	for host := range bans {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return bans[hosts[i]].Before(bans[hosts[j]])
+	})
+
+	for _, host := range hosts {
+		fmt.Printf("%s banned until %s\n", host, bans[host].Format(time.RFC3339))
+	}
+}
+
+func (cli *CommandLine) getPeers(nodeID string) {
+	peers, err := network.LoadPeerInfo(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if len(peers) == 0 {
+		fmt.Println("No peers are known")
+		return
+	}
+
+	for _, peer := range peers {
+		services := strings.Join(network.ServiceNames(peer.Services), ",")
+		if services == "" {
+			services = "unknown"
+		}
+		fmt.Printf("%s services: %s height: %d\n", peer.Addr, services, peer.BestHeight)
+	}
+}
+
 // Run runs the cli tool
 func (cli *CommandLine) Run() {
 	cli.validateArgs()
 
+	if os.Args[1] == "--version" || os.Args[1] == "-version" {
+		fmt.Println(GetBuildInfo())
+		return
+	}
+
 	nodeID := os.Getenv("NODE_ID")
 	if nodeID == "" {
 		fmt.Println("NODE_ID env is not set!")
@@ -187,10 +676,20 @@ func (cli *CommandLine) Run() {
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	listBlocksCmd := flag.NewFlagSet("listblocks", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	watchAddressCmd := flag.NewFlagSet("watchaddress", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	txGraphCmd := flag.NewFlagSet("txgraph", flag.ExitOnError)
+	txCmd := flag.NewFlagSet("tx", flag.ExitOnError)
+	addressBookCmd := flag.NewFlagSet("addressbook", flag.ExitOnError)
+	importBlockCmd := flag.NewFlagSet("importblock", flag.ExitOnError)
+	dumpPrivKeyCmd := flag.NewFlagSet("dumpprivkey", flag.ExitOnError)
+	getBansCmd := flag.NewFlagSet("getbans", flag.ExitOnError)
+	getPeersCmd := flag.NewFlagSet("getpeers", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
@@ -198,7 +697,37 @@ func (cli *CommandLine) Run() {
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendLockTime := sendCmd.Int64("locktime", 0, "Block height or unix time before which the transaction can't be mined")
+	sendYes := sendCmd.Bool("yes", false, "Send without asking for confirmation")
+	sendDryRun := sendCmd.Bool("dry-run", false, "Create and validate the transaction without sending it")
+	sendEncrypted := sendCmd.Bool("encrypted", false, "Use the encrypted wallet file")
+	createWalletCurve := createWalletCmd.String("curve", "p256", "Elliptic curve of the wallet keys, p256 or secp256k1")
+	createWalletEncrypted := createWalletCmd.Bool("encrypted", false, "Use the encrypted wallet file")
+	listAddressesEncrypted := listAddressesCmd.Bool("encrypted", false, "Use the encrypted wallet file")
+	listAddressesWatchOnly := listAddressesCmd.Bool("watch-only", false, "Only list the watched addresses")
+	watchAddressAddress := watchAddressCmd.String("address", "", "The address to watch")
+	watchAddressEncrypted := watchAddressCmd.Bool("encrypted", false, "Use the encrypted wallet file")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeListenAddr := startNodeCmd.String("listen-addr", "", "host:port to listen on, eg. [::1]:3001 or 0.0.0.0:3001. Defaults to localhost:NODE_ID")
+	startNodeTLS := startNodeCmd.Bool("tls", false, "Encrypt connections with a self signed certificate")
+	startNodeAPIAddr := startNodeCmd.String("api-addr", "", "host:port of the JSON API, eg. localhost:8080. The API is off when it is empty")
+	startNodeMetrics := startNodeCmd.Bool("metrics", false, "Serve Prometheus metrics on /metrics of the API and of -metrics-addr")
+	startNodeMetricsAddr := startNodeCmd.String("metrics-addr", "", "host:port of a separate metrics server, eg. localhost:9100")
+	startNodeHeadersFirst := startNodeCmd.Bool("headers-first", false, "Validate the headers of a longer chain before downloading its blocks")
+	startNodeLogLevel := startNodeCmd.String("log-level", "info", "Lowest level that is logged, debug, info, warn or error")
+	startNodeLogFormat := startNodeCmd.String("log-format", "text", "Log format, text or json")
+	startNodeMaxPeers := startNodeCmd.Int("max-peers", 125, "The maximum amount of peers the node keeps")
+	startNodeMaxTxPerBlock := startNodeCmd.Int("max-tx-per-block", 2, "The maximum amount of transactions a miner puts in a block, it mines once the memory pool holds that many")
+	startNodeDNSSeeds := startNodeCmd.String("dns-seeds", "", "Comma separated host names that resolve to the addresses of nodes")
+	listBlocksFrom := listBlocksCmd.Int("from", 0, "First block height")
+	listBlocksTo := listBlocksCmd.Int("to", -1, "Last block height, -1 for the last block")
+	txGraphFrom := txGraphCmd.Int("from", 0, "First block height of the graph")
+	txGraphTo := txGraphCmd.Int("to", 0, "Last block height of the graph")
+	txGraphOutput := txGraphCmd.String("output", "", "File to write the DOT graph to")
+	importBlockHex := importBlockCmd.String("hex", "", "Hex encoded serialized block")
+	dumpPrivKeyAddress := dumpPrivKeyCmd.String("address", "", "The address to export the private key of")
+	dumpPrivKeyEncrypted := dumpPrivKeyCmd.Bool("encrypted", false, "Use the encrypted wallet file")
 
 	switch os.Args[1] {
 	case "getbalance":
@@ -211,6 +740,11 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "verifychain":
+		err := verifyChainCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createblockchain":
 		err := createBlockchainCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -226,6 +760,11 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "watchaddress":
+		err := watchAddressCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createwallet":
 		err := createWalletCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -236,11 +775,51 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "listblocks":
+		err := listBlocksCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "send":
 		err := sendCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "tx":
+		err := txCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "addressbook":
+		err := addressBookCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "txgraph":
+		err := txGraphCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "importblock":
+		err := importBlockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "dumpprivkey":
+		err := dumpPrivKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getbans":
+		err := getBansCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpeers":
+		err := getPeersCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		runtime.Goexit()
@@ -266,28 +845,121 @@ func (cli *CommandLine) Run() {
 		cli.printChain(nodeID)
 	}
 
+	if listBlocksCmd.Parsed() {
+		if *listBlocksFrom < 0 || *listBlocksTo < -1 {
+			listBlocksCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.listBlocks(*listBlocksFrom, *listBlocksTo, nodeID)
+	}
+
 	if createWalletCmd.Parsed() {
-		cli.createWallet(nodeID)
+		cli.createWallet(*createWalletCurve, nodeID, *createWalletEncrypted)
 	}
 
 	if listAddressesCmd.Parsed() {
-		cli.listAddresses(nodeID)
+		cli.listAddresses(nodeID, *listAddressesEncrypted, *listAddressesWatchOnly)
+	}
+
+	if watchAddressCmd.Parsed() {
+		if *watchAddressAddress == "" {
+			watchAddressCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.watchAddress(*watchAddressAddress, nodeID, *watchAddressEncrypted)
 	}
 
 	if reindexUTXOCmd.Parsed() {
 		cli.reindexUTXO(nodeID)
 	}
 
+	if verifyChainCmd.Parsed() {
+		cli.verifyChain(nodeID)
+	}
+
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendLockTime < 0 {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendLockTime, nodeID, *sendMine, *sendYes, *sendDryRun, *sendEncrypted)
 	}
 
 	if startNodeCmd.Parsed() {
-		cli.startNode(nodeID, *startNodeMiner)
+		var logLevel slog.Level
+		if err := logLevel.UnmarshalText([]byte(*startNodeLogLevel)); err != nil {
+			startNodeCmd.Usage()
+			runtime.Goexit()
+		}
+		if *startNodeLogFormat != "text" && *startNodeLogFormat != "json" {
+			startNodeCmd.Usage()
+			runtime.Goexit()
+		}
+
+		config := network.NodeConfig{
+			HeadersFirst:  *startNodeHeadersFirst,
+			Metrics:       network.MetricsConfig{Enabled: *startNodeMetrics, ListenAddr: *startNodeMetricsAddr},
+			LogLevel:      logLevel,
+			LogFormat:     *startNodeLogFormat,
+			MaxPeers:      *startNodeMaxPeers,
+			MaxTxPerBlock: *startNodeMaxTxPerBlock,
+		}
+		if *startNodeDNSSeeds != "" {
+			config.DNSSeeds = strings.Split(*startNodeDNSSeeds, ",")
+		}
+		cli.startNode(nodeID, *startNodeMiner, *startNodeListenAddr, *startNodeAPIAddr, *startNodeTLS, config)
+	}
+
+	if txCmd.Parsed() {
+		// tx only has the history subcommand so far
+		args := txCmd.Args()
+		if len(args) != 2 || args[0] != "history" {
+			cli.printUsage()
+			runtime.Goexit()
+		}
+		cli.txHistory(args[1], nodeID)
+	}
+
+	if addressBookCmd.Parsed() {
+		args := addressBookCmd.Args()
+		argCount := map[string]int{"add": 3, "remove": 2, "list": 1}
+		if len(args) == 0 || argCount[args[0]] != len(args) {
+			cli.printUsage()
+			runtime.Goexit()
+		}
+		cli.addressBook(args, nodeID)
+	}
+
+	if txGraphCmd.Parsed() {
+		if *txGraphTo < *txGraphFrom {
+			txGraphCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.txGraph(*txGraphFrom, *txGraphTo, *txGraphOutput, nodeID)
+	}
+
+	if importBlockCmd.Parsed() {
+		if *importBlockHex == "" {
+			importBlockCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.importBlock(*importBlockHex, nodeID)
+	}
+
+	if dumpPrivKeyCmd.Parsed() {
+		if *dumpPrivKeyAddress == "" {
+			dumpPrivKeyCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.dumpPrivKey(*dumpPrivKeyAddress, nodeID, *dumpPrivKeyEncrypted)
+	}
+
+	if getBansCmd.Parsed() {
+		cli.getBans(nodeID)
+	}
+
+	if getPeersCmd.Parsed() {
+		cli.getPeers(nodeID)
 	}
 }
@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// build information, set with the linker. See the build target in the Makefile
+var (
+	Version   = "v0.1.0"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// BuildInfo describes the build of the running binary
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	BuildDate string
+	GoVersion string
+}
+
+// GetBuildInfo returns the build information. When the linker flags are not set, the values are read from the build info embedded by the go tool
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{Version, Commit, BuildDate, runtime.Version()}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			}
+		}
+	}
+
+	// only keep the short hash
+	if len(info.Commit) > 7 {
+		info.Commit = info.Commit[:7]
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+
+	return info
+}
+
+// String formats the build information for the --version flag
+func (info BuildInfo) String() string {
+	return fmt.Sprintf("questcoin %s (commit: %s, built: %s, go: %s)", info.Version, info.Commit, info.BuildDate, info.GoVersion)
+}
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/qhenkart/blockchain/blockchain"
+	"github.com/qhenkart/blockchain/blockchain/metrics"
+	"github.com/qhenkart/blockchain/network"
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+const (
+	// the amount of blocks on a page of /blocks when no limit is given
+	defaultPageLimit = 10
+	// the maximum amount of blocks on a page of /blocks, every block is read from the database
+	maxPageLimit = 100
+)
+
+// APIServer serves read only JSON endpoints for the blockchain, the wallets and the memory pool
+//
+// /metrics is served as well when the metrics of the node are enabled
+type APIServer struct {
+	*http.ServeMux
+	Chain   *blockchain.Blockchain
+	UTXOSet *blockchain.UTXOSet
+	// guards the bloom filter of UTXOSet, it is reloaded before every balance lookup
+	utxoMu sync.Mutex
+}
+
+// Balance the response of /balance/{address}
+type Balance struct {
+	Address string `json:"address"`
+	Balance int    `json:"balance"`
+}
+
+// BlockPage the response of /blocks, the blocks are ordered from the newest to the oldest
+type BlockPage struct {
+	Page  int `json:"page"`
+	Limit int `json:"limit"`
+	// the amount of blocks in the chain
+	Total  int                `json:"total"`
+	Blocks []blockchain.Block `json:"blocks"`
+}
+
+// Error the response of a failed request
+type Error struct {
+	Error string `json:"error"`
+}
+
+// NewAPIServer creates an API server for the chain and registers the endpoints
+func NewAPIServer(chain *blockchain.Blockchain) (*APIServer, error) {
+	utxoSet, err := blockchain.NewUTXOSet(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &APIServer{ServeMux: http.NewServeMux(), Chain: chain, UTXOSet: utxoSet}
+	s.HandleFunc("/block/", s.get(s.handleBlock))
+	s.HandleFunc("/tx/", s.get(s.handleTx))
+	s.HandleFunc("/balance/", s.get(s.handleBalance))
+	s.HandleFunc("/blocks", s.get(s.handleBlocks))
+	s.HandleFunc("/mempool", s.get(s.handleMempool))
+	if network.Config.Metrics.Enabled {
+		s.Handle("/metrics", metrics.Handler())
+	}
+
+	return s, nil
+}
+
+// StartAPIServer serves the API on the listen address, with the chain of the node server
+//
+// the API shares the chain of the server, so it waits until the server of the node started. Blocks until the API stops
+func StartAPIServer(nodeID string, listenAddr string) error {
+	chain, err := network.ServerChain(context.Background())
+	if err != nil {
+		return err
+	}
+
+	s, err := NewAPIServer(chain)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("API listening", "nodeID", nodeID, "address", listenAddr)
+	return http.ListenAndServe(listenAddr, s)
+}
+
+// get only lets GET requests through to the handler
+func (s *APIServer) get(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// handleBlock serves /block/{hash} and /block/height/{n}
+func (s *APIServer) handleBlock(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/block/")
+
+	if strings.HasPrefix(path, "height/") {
+		height, err := strconv.Atoi(strings.TrimPrefix(path, "height/"))
+		if err != nil || height < 0 {
+			writeError(w, http.StatusBadRequest, "height must be a positive number")
+			return
+		}
+		block, err := s.Chain.GetBlockByHeight(height)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, block)
+		return
+	}
+
+	hash, err := hex.DecodeString(path)
+	if err != nil || len(hash) == 0 {
+		writeError(w, http.StatusBadRequest, "block hash must be hex encoded")
+		return
+	}
+	block, err := s.Chain.GetBlock(hash)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, block)
+}
+
+// handleTx serves /tx/{txid}, transactions that are not mined yet are looked up in the memory pool
+func (s *APIServer) handleTx(w http.ResponseWriter, r *http.Request) {
+	id, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, "/tx/"))
+	if err != nil || len(id) == 0 {
+		writeError(w, http.StatusBadRequest, "transaction id must be hex encoded")
+		return
+	}
+
+	tx, err := s.Chain.FindTransaction(id)
+	if err == nil {
+		writeJSON(w, http.StatusOK, tx)
+		return
+	}
+
+	for _, pending := range network.MempoolTransactions() {
+		if bytes.Equal(pending.ID, id) {
+			writeJSON(w, http.StatusOK, pending)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, err.Error())
+}
+
+// handleBalance serves /balance/{address}
+func (s *APIServer) handleBalance(w http.ResponseWriter, r *http.Request) {
+	address := strings.TrimPrefix(r.URL.Path, "/balance/")
+	if _, err := wallet.ValidateAddress(address); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	_, pubKeyHash, _, err := wallet.AddressToComponents(address)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.utxoMu.Lock()
+	// the node adds outputs to the stored filter with every block
+	err = s.UTXOSet.ReloadBloom()
+	var UTXOs []blockchain.TxOutput
+	if err == nil {
+		UTXOs, err = s.UTXOSet.FindUnspentTransactions(pubKeyHash)
+	}
+	s.utxoMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	balance := 0
+	for _, out := range UTXOs {
+		balance += out.Value
+	}
+	writeJSON(w, http.StatusOK, Balance{address, balance})
+}
+
+// handleBlocks serves /blocks?page=N&limit=M. Page 1 holds the newest blocks
+func (s *APIServer) handleBlocks(w http.ResponseWriter, r *http.Request) {
+	page, ok := queryInt(r, "page", 1)
+	if !ok || page < 1 {
+		writeError(w, http.StatusBadRequest, "page must be a number above 0")
+		return
+	}
+	limit, ok := queryInt(r, "limit", defaultPageLimit)
+	if !ok || limit < 1 || limit > maxPageLimit {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be a number between 1 and %d", maxPageLimit))
+		return
+	}
+
+	bestHeight, err := s.Chain.GetBestHeight()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	result := BlockPage{Page: page, Limit: limit, Total: bestHeight + 1, Blocks: []blockchain.Block{}}
+
+	// pages count down from the tip of the chain. Pages after the genesis block are empty, the check comes before the
+	// multiplication because (page-1)*limit overflows for large pages
+	if page-1 <= bestHeight/limit {
+		toHeight := bestHeight - (page-1)*limit
+		fromHeight := toHeight - limit + 1
+		if fromHeight < 0 {
+			fromHeight = 0
+		}
+
+		blocks, err := s.Chain.GetBlocksByHeightRange(fromHeight, toHeight)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for i := len(blocks) - 1; i >= 0; i-- {
+			result.Blocks = append(result.Blocks, *blocks[i])
+		}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleMempool serves /mempool, the transactions that wait to be mined
+func (s *APIServer) handleMempool(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, network.MempoolTransactions())
+}
+
+// queryInt reads a number from the query string, returns the fallback when it is missing
+func queryInt(r *http.Request, key string, fallback int) (int, bool) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return fallback, true
+	}
+	n, err := strconv.Atoi(value)
+	return n, err == nil
+}
+
+// writeJSON writes the value as the JSON response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Error("Could not write the response", "err", err)
+	}
+}
+
+// writeError writes the message as a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, Error{message})
+}
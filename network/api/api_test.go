@@ -0,0 +1,199 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qhenkart/blockchain/blockchain"
+	"github.com/qhenkart/blockchain/network"
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// newTestServer creates an API server for a test chain, the genesis coinbase pays the returned address
+func newTestServer(t *testing.T) (*APIServer, string, func()) {
+	t.Helper()
+
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := blockchain.NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewAPIServer(chain)
+	if err != nil {
+		closeChain()
+		t.Fatal(err)
+	}
+	if err := s.UTXOSet.Reindex(); err != nil {
+		closeChain()
+		t.Fatal(err)
+	}
+	return s, address, closeChain
+}
+
+// get requests the path from the server and decodes the JSON response into value, value can be nil
+func get(t *testing.T, s *APIServer, path string, value interface{}) int {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if value != nil && rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(value); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestHandleBlock(t *testing.T) {
+	s, _, closeChain := newTestServer(t)
+	defer closeChain()
+
+	genesis, err := s.Chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]int{
+		"/block/" + hex.EncodeToString(genesis.Hash): http.StatusOK,
+		"/block/height/0":  http.StatusOK,
+		"/block/not-hex":   http.StatusBadRequest,
+		"/block/00ff":      http.StatusNotFound,
+		"/block/height/-1": http.StatusBadRequest,
+		"/block/height/1":  http.StatusNotFound,
+	}
+	for path, want := range tests {
+		var block blockchain.Block
+		if code := get(t, s, path, &block); code != want {
+			t.Errorf("%s: status %d, want %d", path, code, want)
+		} else if code == http.StatusOK && block.Height != 0 {
+			t.Errorf("%s: block %d, want the genesis block", path, block.Height)
+		}
+	}
+}
+
+func TestHandleTx(t *testing.T) {
+	s, _, closeChain := newTestServer(t)
+	defer closeChain()
+
+	genesis, err := s.Chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := hex.EncodeToString(genesis.Transactions[0].ID)
+
+	tests := map[string]int{
+		"/tx/" + coinbase: http.StatusOK,
+		"/tx/not-hex":     http.StatusBadRequest,
+		"/tx/00ff":        http.StatusNotFound,
+	}
+	for path, want := range tests {
+		if code := get(t, s, path, nil); code != want {
+			t.Errorf("%s: status %d, want %d", path, code, want)
+		}
+	}
+}
+
+func TestHandleBalance(t *testing.T) {
+	s, address, closeChain := newTestServer(t)
+	defer closeChain()
+
+	var balance Balance
+	if code := get(t, s, "/balance/"+address, &balance); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if want := s.Chain.Config.BlockReward(0); balance.Address != address || balance.Balance != want {
+		t.Errorf("balance %+v, want %d for %s", balance, want, address)
+	}
+
+	var empty Balance
+	if code := get(t, s, "/balance/"+string(wallet.MakeWallet().Address()), &empty); code != http.StatusOK || empty.Balance != 0 {
+		t.Errorf("status %d and balance %d for a new address, want 200 and 0", code, empty.Balance)
+	}
+	if code := get(t, s, "/balance/invalid", nil); code != http.StatusBadRequest {
+		t.Errorf("status %d for an invalid address, want 400", code)
+	}
+}
+
+func TestHandleBlocks(t *testing.T) {
+	s, _, closeChain := newTestServer(t)
+	defer closeChain()
+
+	const maxInt = int(^uint(0) >> 1)
+	tests := []struct {
+		query  string
+		code   int
+		blocks int
+	}{
+		{"", http.StatusOK, 1},
+		{"?page=1&limit=1", http.StatusOK, 1},
+		// pages after the genesis block are empty
+		{"?page=2&limit=1", http.StatusOK, 0},
+		// (page-1)*limit overflows
+		{fmt.Sprintf("?page=%d&limit=%d", maxInt, maxPageLimit), http.StatusOK, 0},
+		{"?page=0", http.StatusBadRequest, 0},
+		{"?page=first", http.StatusBadRequest, 0},
+		{"?limit=0", http.StatusBadRequest, 0},
+		{fmt.Sprintf("?limit=%d", maxPageLimit+1), http.StatusBadRequest, 0},
+	}
+	for _, test := range tests {
+		var page BlockPage
+		if code := get(t, s, "/blocks"+test.query, &page); code != test.code {
+			t.Errorf("%s: status %d, want %d", test.query, code, test.code)
+			continue
+		}
+		if test.code == http.StatusOK && (len(page.Blocks) != test.blocks || page.Total != 1) {
+			t.Errorf("%s: %d blocks of %d, want %d of 1", test.query, len(page.Blocks), page.Total, test.blocks)
+		}
+	}
+}
+
+func TestHandleMempool(t *testing.T) {
+	s, _, closeChain := newTestServer(t)
+	defer closeChain()
+
+	var txs []blockchain.Transaction
+	if code := get(t, s, "/mempool", &txs); code != http.StatusOK {
+		t.Errorf("status %d, want 200", code)
+	}
+	if len(txs) != len(network.MempoolTransactions()) {
+		t.Errorf("%d transactions, want the %d of the memory pool", len(txs), len(network.MempoolTransactions()))
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	enabled := network.Config.Metrics.Enabled
+	defer func() { network.Config.Metrics.Enabled = enabled }()
+
+	for _, metrics := range []bool{false, true} {
+		network.Config.Metrics.Enabled = metrics
+		s, _, closeChain := newTestServer(t)
+
+		// without metrics the path falls through to the not found handler of the mux
+		want := http.StatusNotFound
+		if metrics {
+			want = http.StatusOK
+		}
+		if code := get(t, s, "/metrics", nil); code != want {
+			t.Errorf("metrics enabled %v: status %d, want %d", metrics, code, want)
+		}
+		closeChain()
+	}
+}
+
+func TestEndpointsOnlyAllowGet(t *testing.T) {
+	s, _, closeChain := newTestServer(t)
+	defer closeChain()
+
+	for _, path := range []string{"/block/height/0", "/tx/00", "/balance/x", "/blocks", "/mempool"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}")))
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodGet {
+			t.Errorf("POST %s: status %d, want 405 with Allow: GET", path, rec.Code)
+		}
+	}
+}
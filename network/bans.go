@@ -0,0 +1,149 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// the ban list is stored for the getbans command, which runs in another process than the node
+	banFile = "./tmp/bans_%s.data"
+	// the score a peer gets for a message that can't be decoded
+	malformedMessageScore = 20
+)
+
+// bansMu guards BanList and BanScore, peers are handled on their own goroutines
+var bansMu sync.Mutex
+
+// malformedMessage is returned by the handlers for messages that can't be decoded, HandleConnection scores the peer for it
+type malformedMessage struct {
+	err error
+}
+
+func (m malformedMessage) Error() string {
+	return fmt.Sprintf("malformed message: %s", m.err)
+}
+
+// banKey returns the host of an address, bans apply to the machine and not to a single port
+//
+// localhost, 127.0.0.1 and ::1 are the same host
+func banKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if isLoopback(host) {
+		return "localhost"
+	}
+	return host
+}
+
+// BanPeer bans the host of the address for the duration. Banned peers are not contacted and their connections are dropped
+func BanPeer(addr string, duration time.Duration) {
+	bansMu.Lock()
+	defer bansMu.Unlock()
+
+	banLocked(banKey(addr), duration)
+}
+
+// UnbanPeer lifts the ban of the host of the address and resets its score
+func UnbanPeer(addr string) {
+	bansMu.Lock()
+	defer bansMu.Unlock()
+
+	key := banKey(addr)
+	delete(BanList, key)
+	delete(BanScore, key)
+	saveBans()
+}
+
+// IsBanned checks if the host of the address is banned. Expired bans are removed
+func IsBanned(addr string) bool {
+	bansMu.Lock()
+	defer bansMu.Unlock()
+
+	key := banKey(addr)
+	until, ok := BanList[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(BanList, key)
+		saveBans()
+		return false
+	}
+	return true
+}
+
+// Misbehaving adds to the ban score of the peer. The peer is banned for BanDuration once the score reaches BanThreshold
+func Misbehaving(addr string, score int) {
+	bansMu.Lock()
+	defer bansMu.Unlock()
+
+	key := banKey(addr)
+	BanScore[key] += score
+	slog.Info("Peer misbehaved", "peer", key, "banScore", BanScore[key])
+
+	if BanScore[key] >= BanThreshold {
+		banLocked(key, BanDuration)
+	}
+}
+
+// banLocked bans a host, bansMu must be held
+func banLocked(key string, duration time.Duration) {
+	BanList[key] = time.Now().Add(duration)
+	// the score starts over once the ban expires
+	delete(BanScore, key)
+	slog.Info("Banned a peer", "peer", key, "until", BanList[key].Format(time.RFC3339))
+
+	saveBans()
+}
+
+// saveBans writes the ban list to the ban file of the node, bansMu must be held. Nothing is written before the server started
+func saveBans() {
+	if localNodeID == "" {
+		return
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(BanList); err != nil {
+		slog.Error("Could not encode the bans", "err", err)
+		return
+	}
+	// only the owner can change who is banned
+	if err := ioutil.WriteFile(fmt.Sprintf(banFile, localNodeID), buffer.Bytes(), 0600); err != nil {
+		slog.Error("Could not save the bans", "err", err)
+	}
+}
+
+// LoadBans reads the bans of a node from its ban file. Expired bans are left out and a missing file means there are no bans
+func LoadBans(nodeID string) (map[string]time.Time, error) {
+	bans := make(map[string]time.Time)
+
+	data, err := ioutil.ReadFile(fmt.Sprintf(banFile, nodeID))
+	if os.IsNotExist(err) {
+		return bans, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&bans); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for key, until := range bans {
+		if now.After(until) {
+			delete(bans, key)
+		}
+	}
+	return bans, nil
+}
@@ -0,0 +1,121 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/qhenkart/blockchain/blockchain"
+)
+
+// the maximum amount of compact blocks that wait for their missing transactions
+const maxPendingCompactBlocks = 100
+
+// compactBlocks the compact blocks that wait for their missing transactions
+var compactBlocks = &compactBlockPool{pending: make(map[string]*compactState)}
+
+// compactState a compact block that is being rebuilt
+type compactState struct {
+	from   string
+	header blockchain.BlockHeader
+	ids    [][]byte
+	// the transactions in block order, nil while a transaction is missing
+	txs      []*blockchain.Transaction
+	received time.Time
+}
+
+// newCompactState collects the transactions of a compact block from the prefilled transactions and the memory pool
+func newCompactState(compact CompactBlock) (*compactState, error) {
+	if len(compact.TxIDs) == 0 {
+		return nil, errors.New("compact block has no transactions")
+	}
+
+	state := &compactState{
+		from:     compact.AddrFrom,
+		header:   compact.Header,
+		ids:      compact.TxIDs,
+		txs:      make([]*blockchain.Transaction, len(compact.TxIDs)),
+		received: time.Now(),
+	}
+
+	for _, prefilled := range compact.Prefilled {
+		if prefilled.Index < 0 || prefilled.Index >= len(state.txs) {
+			return nil, errors.New("prefilled transaction is out of range")
+		}
+		tx, err := blockchain.DeserializeTransaction(prefilled.Transaction)
+		if err != nil {
+			return nil, err
+		}
+		state.txs[prefilled.Index] = &tx
+	}
+
+	mempoolMu.RLock()
+	for i, id := range state.ids {
+		if state.txs[i] != nil {
+			continue
+		}
+		if tx, ok := memoryPool[hex.EncodeToString(id)]; ok {
+			state.txs[i] = &tx
+		}
+	}
+	mempoolMu.RUnlock()
+
+	return state, nil
+}
+
+// missing returns the ids of the transactions that are still missing
+func (s *compactState) missing() [][]byte {
+	var ids [][]byte
+	for i, tx := range s.txs {
+		if tx == nil {
+			ids = append(ids, s.ids[i])
+		}
+	}
+	return ids
+}
+
+// fill puts a received transaction at its place in the block
+func (s *compactState) fill(tx *blockchain.Transaction) {
+	for i, id := range s.ids {
+		if s.txs[i] == nil && bytes.Equal(id, tx.ID) {
+			s.txs[i] = tx
+		}
+	}
+}
+
+// compactBlockPool keeps the compact blocks until their missing transactions arrive
+type compactBlockPool struct {
+	mu      sync.Mutex
+	pending map[string]*compactState
+}
+
+// Add stores a compact block. When the pool is full the oldest block is dropped, it can still be downloaded in full
+func (p *compactBlockPool) Add(state *compactState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.pending) >= maxPendingCompactBlocks {
+		var oldest string
+		for key, s := range p.pending {
+			if oldest == "" || s.received.Before(p.pending[oldest].received) {
+				oldest = key
+			}
+		}
+		delete(p.pending, oldest)
+	}
+
+	p.pending[hex.EncodeToString(state.header.Hash)] = state
+}
+
+// Take removes the compact block of the hash from the pool and returns it
+func (p *compactBlockPool) Take(hash []byte) (*compactState, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := hex.EncodeToString(hash)
+	state, ok := p.pending[key]
+	delete(p.pending, key)
+	return state, ok
+}
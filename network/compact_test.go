@@ -0,0 +1,121 @@
+package network
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/qhenkart/blockchain/blockchain"
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// blockOfSize creates a block with a coinbase and n payments from one wallet to another. Only the size of the transactions
+// matters, so the inputs spend made up outputs and the signatures are random bytes of the size of a real signature
+func blockOfSize(tb testing.TB, n int) *blockchain.Block {
+	tb.Helper()
+
+	from, to := wallet.MakeWallet(), string(wallet.MakeWallet().Address())
+	coinbase, err := blockchain.CoinbaseTx(to, "", 1, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	txs := []*blockchain.Transaction{coinbase}
+	for i := 0; i < n; i++ {
+		prevID, signature := make([]byte, 32), make([]byte, 64)
+		if _, err := rand.Read(prevID); err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := rand.Read(signature); err != nil {
+			tb.Fatal(err)
+		}
+		payment, err := blockchain.NewTXOutput(10, to)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		change, err := blockchain.NewTXOutput(89, string(from.Address()))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tx := &blockchain.Transaction{
+			Inputs:  []blockchain.TxInput{{ID: prevID, Out: i % 2, Signature: signature, PubKey: from.PublicKey, KeyType: from.KeyType}},
+			Outputs: []blockchain.TxOutput{*payment, *change},
+		}
+		if tx.ID, err = tx.Hash(); err != nil {
+			tb.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+
+	block, err := blockchain.CreateBlock(txs, make([]byte, 32), 1, 1)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return block
+}
+
+// relayedBytes returns the bytes of the block message and the bytes of the compact block messages when the receiver misses
+// the given number of transactions. The missing transactions are requested with getmissing and sent with missingtxs
+func relayedBytes(tb testing.TB, block *blockchain.Block, missing int) (full, compact int) {
+	tb.Helper()
+
+	full = len(CmdToBytes("block")) + len(EncodeMessage(messageVersion, Block{nodeAddress, block.Serialize()}))
+
+	announcement, err := newCompactBlock(block)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	compact = len(CmdToBytes("cmpctblock")) + len(EncodeMessage(messageVersion, announcement))
+	if missing == 0 {
+		return full, compact
+	}
+
+	request := GetMissingTxs{AddrFrom: nodeAddress, BlockHash: block.Hash}
+	response := MissingTxs{AddrFrom: nodeAddress, BlockHash: block.Hash}
+	// the coinbase is prefilled, the receiver misses the transactions after it
+	for _, tx := range block.Transactions[1 : missing+1] {
+		data, err := tx.Serialize()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		request.TxIDs = append(request.TxIDs, tx.ID)
+		response.Transactions = append(response.Transactions, data)
+	}
+	compact += len(CmdToBytes("getmissing")) + len(EncodeMessage(messageVersion, request))
+	compact += len(CmdToBytes("missingtxs")) + len(EncodeMessage(messageVersion, response))
+	return full, compact
+}
+
+func TestCompactBlocksSaveBytesOnA100TransactionBlock(t *testing.T) {
+	block := blockOfSize(t, 100)
+
+	// the receiver has every transaction in its memory pool, or misses some of them
+	for _, missing := range []int{0, 10} {
+		full, compact := relayedBytes(t, block, missing)
+		if reduction := 1 - float64(compact)/float64(full); reduction < 0.6 {
+			t.Errorf("%d missing transactions: %d bytes instead of %d, a reduction of %.0f%%, want at least 60%%", missing, compact, full, reduction*100)
+		}
+	}
+}
+
+// BenchmarkBlockRelay measures the bytes a 100 transaction block takes to relay, as a full block and as a compact block
+// with all, or all but 10, transactions in the memory pool of the receiver
+func BenchmarkBlockRelay(b *testing.B) {
+	block := blockOfSize(b, 100)
+
+	for _, test := range []struct {
+		name    string
+		missing int
+	}{
+		{"compact", 0},
+		{"compact 10 missing", 10},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			var full, compact int
+			for i := 0; i < b.N; i++ {
+				full, compact = relayedBytes(b, block, test.missing)
+			}
+			b.ReportMetric(float64(full), "full-bytes")
+			b.ReportMetric(float64(compact), "compact-bytes")
+			b.ReportMetric(100*(1-float64(compact)/float64(full)), "%saved")
+		})
+	}
+}
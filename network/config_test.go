@@ -0,0 +1,189 @@
+package network
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/qhenkart/blockchain/blockchain"
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+func TestEmptyNodeConfigUsesTheDefaults(t *testing.T) {
+	config := Config
+	Config = NodeConfig{}
+	defer func() { Config = config }()
+
+	defaults := DefaultNodeConfig()
+	if got := maxTxPerBlock(); got != defaults.MaxTxPerBlock || got != 2 {
+		t.Errorf("max transactions per block %d, want 2", got)
+	}
+	if got := protocol(); got != defaults.Protocol || got != "tcp" {
+		t.Errorf("protocol %q, want tcp", got)
+	}
+	if got := protocolVersion(); got != defaults.Version || got != 1 {
+		t.Errorf("protocol version %d, want 1", got)
+	}
+	if got := maxMessageSize(); got != defaults.MaxMessageSize {
+		t.Errorf("max message size %d, want %d", got, defaults.MaxMessageSize)
+	}
+	if got := readTimeout(); got != defaults.ReadTimeout {
+		t.Errorf("read timeout %s, want %s", got, defaults.ReadTimeout)
+	}
+	if got := dialTimeout(); got != defaults.DialTimeout {
+		t.Errorf("dial timeout %s, want %s", got, defaults.DialTimeout)
+	}
+	if got := writeTimeout(); got != defaults.WriteTimeout {
+		t.Errorf("write timeout %s, want %s", got, defaults.WriteTimeout)
+	}
+	if got := retryPolicy(); got != defaults.Retry {
+		t.Errorf("retry policy %+v, want %+v", got, defaults.Retry)
+	}
+}
+
+func TestNodeConfigOverridesTheDefaults(t *testing.T) {
+	config := Config
+	Config = NodeConfig{
+		MaxTxPerBlock:  5,
+		Protocol:       "tcp4",
+		Version:        3,
+		MaxMessageSize: 1024,
+		ReadTimeout:    time.Minute,
+		DialTimeout:    time.Second,
+		WriteTimeout:   2 * time.Second,
+		Retry:          RetryPolicy{MaxRetries: 1, InitialBackoff: time.Millisecond, MaxBackoff: time.Second},
+	}
+	defer func() { Config = config }()
+
+	if got := maxTxPerBlock(); got != 5 {
+		t.Errorf("max transactions per block %d, want 5", got)
+	}
+	if got := protocol(); got != "tcp4" {
+		t.Errorf("protocol %q, want tcp4", got)
+	}
+	if got := protocolVersion(); got != 3 {
+		t.Errorf("protocol version %d, want 3", got)
+	}
+	if got := maxMessageSize(); got != 1024 {
+		t.Errorf("max message size %d, want 1024", got)
+	}
+	if got := readTimeout(); got != time.Minute {
+		t.Errorf("read timeout %s, want 1m", got)
+	}
+	if got := dialTimeout(); got != time.Second {
+		t.Errorf("dial timeout %s, want 1s", got)
+	}
+	if got := writeTimeout(); got != 2*time.Second {
+		t.Errorf("write timeout %s, want 2s", got)
+	}
+	if got := retryPolicy(); got != Config.Retry {
+		t.Errorf("retry policy %+v, want %+v", got, Config.Retry)
+	}
+}
+
+// minerNode turns the package into a miner without peers, the returned function restores the node
+func minerNode(t *testing.T, config NodeConfig, miner string) func() {
+	t.Helper()
+
+	oldConfig, oldNodeAddress, oldMineAddress, oldKnownNodes := Config, nodeAddress, mineAddress, KnownNodes
+	Config, nodeAddress, mineAddress, KnownNodes = config, "localhost:3002", miner, NewPeerSet(defaultMaxPeers)
+
+	return func() {
+		Config, nodeAddress, mineAddress, KnownNodes = oldConfig, oldNodeAddress, oldMineAddress, oldKnownNodes
+		removeFromMempool(mempoolPointers())
+	}
+}
+
+// mempoolPointers returns the transactions of the memory pool, so they can be removed
+func mempoolPointers() []*blockchain.Transaction {
+	var txs []*blockchain.Transaction
+	for _, tx := range MempoolTransactions() {
+		tx := tx
+		txs = append(txs, &tx)
+	}
+	return txs
+}
+
+// matureGenesis mines CoinbaseMaturity-1 blocks on the chain, the next block can spend the genesis coinbase
+func matureGenesis(t *testing.T, chain *blockchain.Blockchain, address string) {
+	t.Helper()
+
+	// the blocks are mined without waiting, keep the difficulty where it is
+	chain.Config.RetargetWindow = 0
+	for height := 1; height < blockchain.CoinbaseMaturity; height++ {
+		coinbase, err := blockchain.CoinbaseTx(address, "", height, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := chain.MineBlock([]*blockchain.Transaction{coinbase}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// spendGenesis creates a transaction message that spends the genesis coinbase of the chain, which belongs to the wallet
+func spendGenesis(t *testing.T, chain *blockchain.Blockchain, w *wallet.Wallet) []byte {
+	t.Helper()
+
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesis.Transactions[0]
+
+	tx := &blockchain.Transaction{
+		Inputs:  []blockchain.TxInput{{ID: coinbase.ID, Out: 0, PubKey: w.PublicKey, KeyType: w.KeyType}},
+		Outputs: []blockchain.TxOutput{{Value: coinbase.Outputs[0].Value - 1, PubKeyHash: wallet.MakeWallet().PubKeyHash()}},
+	}
+	if tx.ID, err = tx.Hash(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Sign(w.PrivateKey, map[string]blockchain.Transaction{hex.EncodeToString(coinbase.ID): *coinbase}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := tx.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(CmdToBytes("tx"), EncodeMessage(messageVersion, Tx{"localhost:3003", data})...)
+}
+
+func TestHandleTxMinesOnceMaxTxPerBlockIsReached(t *testing.T) {
+	tests := []struct {
+		maxTxPerBlock int
+		height        int
+	}{
+		// the default waits for a second transaction
+		{0, 0},
+		{1, 1},
+	}
+
+	for _, test := range tests {
+		w := wallet.MakeWallet()
+		chain, closeChain, err := blockchain.NewTestChain(string(w.Address()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		restore := minerNode(t, NodeConfig{MaxTxPerBlock: test.maxTxPerBlock}, string(w.Address()))
+		matureGenesis(t, chain, string(w.Address()))
+
+		if err := HandleTx(spendGenesis(t, chain, w), chain); err != nil {
+			t.Fatal(err)
+		}
+		height, err := chain.GetBestHeight()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := blockchain.CoinbaseMaturity - 1 + test.height; height != want {
+			t.Errorf("MaxTxPerBlock %d: height %d after a single transaction, want %d", test.maxTxPerBlock, height, want)
+		}
+		// a mined transaction leaves the memory pool
+		if pending := len(MempoolTransactions()); pending != 1-test.height {
+			t.Errorf("MaxTxPerBlock %d: %d transactions in the memory pool", test.maxTxPerBlock, pending)
+		}
+
+		restore()
+		closeChain()
+	}
+}
@@ -0,0 +1,84 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// lookupHosts replaces the DNS lookup with the hosts of each seed, seeds that are not in the map fail to resolve. The
+// returned function restores the lookup
+func lookupHosts(hosts map[string][]string) func() {
+	old := LookupFn
+	LookupFn = func(seed string) ([]string, error) {
+		addrs, ok := hosts[seed]
+		if !ok {
+			return nil, fmt.Errorf("lookup %s: no such host", seed)
+		}
+		return addrs, nil
+	}
+	return func() { LookupFn = old }
+}
+
+func TestDNSSeedBootstrap(t *testing.T) {
+	defer lookupHosts(map[string][]string{
+		"seed1.example.com": {"10.0.0.1", "10.0.0.2", "10.0.0.1", "2001:db8::1"},
+		// both seeds know 10.0.0.2, the IPv6 address is written another way
+		"seed2.example.com": {"10.0.0.2", "2001:0db8::0001", "10.0.0.3"},
+		// entries that are no node addresses
+		"broken.example.com": {"not an ip", "0.0.0.0", "::", "10.0.0.4"},
+	})()
+
+	addrs, err := DNSSeedBootstrap([]string{"seed1.example.com", "unknown.example.com", "seed2.example.com", "broken.example.com"}, "3001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.1:3001", "10.0.0.2:3001", "[2001:db8::1]:3001", "10.0.0.3:3001", "10.0.0.4:3001"}
+	if fmt.Sprint(addrs) != fmt.Sprint(want) {
+		t.Errorf("addresses %v, want %v", addrs, want)
+	}
+
+	// an error is only returned when no seed resolves
+	if addrs, err := DNSSeedBootstrap([]string{"unknown.example.com"}, "3001"); err == nil {
+		t.Errorf("returned %v for a seed that doesn't resolve", addrs)
+	}
+	if addrs, err := DNSSeedBootstrap(nil, "3001"); err != nil || len(addrs) != 0 {
+		t.Errorf("returned %v, %v without seeds", addrs, err)
+	}
+	for _, port := range []string{"", "port", "70000", "-1"} {
+		if _, err := DNSSeedBootstrap([]string{"seed1.example.com"}, port); err == nil {
+			t.Errorf("accepted the port %q", port)
+		}
+	}
+}
+
+func TestBootstrapFromDNSSkipsThisNodeAndBannedHosts(t *testing.T) {
+	defer minerNode(t, NodeConfig{DNSSeeds: []string{"seed.example.com"}, DNSSeedPort: "3002"}, "")()
+	defer lookupHosts(map[string][]string{
+		// this node listens on localhost:3002, which is also 127.0.0.1:3002
+		"seed.example.com": {"10.0.0.1", "10.0.0.2", "127.0.0.1", "10.0.0.1"},
+	})()
+
+	// the ban is not saved, the node has no ban file
+	banned := "10.0.0.2:3002"
+	bansMu.Lock()
+	BanList[banKey(banned)] = time.Now().Add(time.Hour)
+	bansMu.Unlock()
+	defer func() {
+		bansMu.Lock()
+		delete(BanList, banKey(banned))
+		bansMu.Unlock()
+	}()
+
+	bootstrapFromDNS()
+	if nodes, want := KnownNodes.All(), []string{"10.0.0.1:3002"}; fmt.Sprint(nodes) != fmt.Sprint(want) {
+		t.Errorf("known nodes %v, want %v", nodes, want)
+	}
+
+	// seeds that can't be resolved leave the known nodes alone
+	defer lookupHosts(nil)()
+	bootstrapFromDNS()
+	if n := KnownNodes.Len(); n != 1 {
+		t.Errorf("%d known nodes after a failed lookup, want 1", n)
+	}
+}
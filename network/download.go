@@ -0,0 +1,172 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	// the maximum amount of blocks that can be requested from a peer at the same time
+	maxBlocksInFlight = 16
+	// how long we wait for a requested block before asking for it again
+	blockRequestTimeout = 30 * time.Second
+	// how often the blocks in flight are checked for a timeout
+	downloadSweepInterval = 10 * time.Second
+)
+
+// DownloadManager keeps track of the blocks that need to be downloaded from other peers
+//
+// blocks wait in the queue until they are dispatched. Once dispatched they are in flight until the block is received
+// if a peer does not respond in time, the block goes back into the queue so it can be requested again
+type DownloadManager struct {
+	queue    [][]byte
+	inFlight map[string]time.Time
+	mu       sync.Mutex
+}
+
+// NewDownloadManager creates an empty download manager
+func NewDownloadManager() *DownloadManager {
+	return &DownloadManager{inFlight: make(map[string]time.Time)}
+}
+
+// Enqueue adds block hashes to the download queue. Hashes that are already queued or in flight are skipped
+func (dm *DownloadManager) Enqueue(hashes [][]byte) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	for _, hash := range hashes {
+		if dm.isKnown(hash) {
+			continue
+		}
+		dm.queue = append(dm.queue, hash)
+	}
+}
+
+// Dispatch requests queued blocks from a peer until the in flight limit is reached
+func (dm *DownloadManager) Dispatch(peer string) {
+	var hashes [][]byte
+
+	dm.mu.Lock()
+	dm.requeueStale()
+
+	for len(dm.queue) > 0 && len(dm.inFlight) < maxBlocksInFlight {
+		hash := dm.queue[0]
+		dm.queue = dm.queue[1:]
+
+		dm.inFlight[hex.EncodeToString(hash)] = time.Now()
+		hashes = append(hashes, hash)
+	}
+	dm.mu.Unlock()
+
+	// send the requests without holding the lock, the peer may take a while to accept the connection
+	for _, hash := range hashes {
+		SendGetData(peer, "block", hash)
+	}
+}
+
+// Confirm marks a block as received. A block can arrive while it is still queued, eg. from another peer, so it is removed
+// from the queue as well
+func (dm *DownloadManager) Confirm(hash []byte) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	delete(dm.inFlight, hex.EncodeToString(hash))
+	dm.removeQueued(hash)
+}
+
+// Cancel removes a block from the queue and from the blocks in flight
+func (dm *DownloadManager) Cancel(hash []byte) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	delete(dm.inFlight, hex.EncodeToString(hash))
+	dm.removeQueued(hash)
+}
+
+// Run requeues the blocks that have been in flight for too long every sweep interval until the context is done
+//
+// Dispatch only requeues them when the next block arrives, which never happens when the peer stopped answering. The
+// requeued blocks are requested from a random peer
+func (dm *DownloadManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(downloadSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !dm.sweep() {
+				continue
+			}
+			for _, peer := range KnownNodes.GetRandomPeers(KnownNodes.Len()) {
+				if peer != nodeAddress {
+					dm.Dispatch(peer)
+					break
+				}
+			}
+		}
+	}
+}
+
+// sweep requeues the blocks that have been in flight for too long. Returns true when blocks are waiting in the queue
+func (dm *DownloadManager) sweep() bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.requeueStale()
+	return len(dm.queue) > 0
+}
+
+// Pending returns the amount of blocks that are either queued or in flight
+func (dm *DownloadManager) Pending() int {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	return len(dm.queue) + len(dm.inFlight)
+}
+
+// requeueStale puts the blocks that have been in flight for too long back into the queue. The lock must be held
+func (dm *DownloadManager) requeueStale() {
+	for id, requested := range dm.inFlight {
+		if time.Since(requested) < blockRequestTimeout {
+			continue
+		}
+
+		hash, err := hex.DecodeString(id)
+		if err != nil {
+			continue
+		}
+		delete(dm.inFlight, id)
+		dm.queue = append(dm.queue, hash)
+	}
+}
+
+// removeQueued removes a hash from the queue. The lock must be held
+func (dm *DownloadManager) removeQueued(hash []byte) {
+	queue := [][]byte{}
+	for _, queued := range dm.queue {
+		if !bytes.Equal(queued, hash) {
+			queue = append(queue, queued)
+		}
+	}
+	dm.queue = queue
+}
+
+// isKnown checks whether a hash is already queued or in flight. The lock must be held
+func (dm *DownloadManager) isKnown(hash []byte) bool {
+	if _, ok := dm.inFlight[hex.EncodeToString(hash)]; ok {
+		return true
+	}
+
+	for _, queued := range dm.queue {
+		if bytes.Equal(queued, hash) {
+			return true
+		}
+	}
+
+	return false
+}
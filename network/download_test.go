@@ -0,0 +1,42 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfirmRemovesQueuedBlocks(t *testing.T) {
+	dm := NewDownloadManager()
+	dm.Enqueue([][]byte{[]byte("first"), []byte("second")})
+
+	// the block arrived from another peer before it was requested
+	dm.Confirm([]byte("first"))
+
+	if pending := dm.Pending(); pending != 1 {
+		t.Fatalf("%d blocks pending, want 1", pending)
+	}
+	if dm.isKnown([]byte("first")) {
+		t.Error("the confirmed block is still queued")
+	}
+}
+
+func TestSweepRequeuesStaleBlocks(t *testing.T) {
+	dm := NewDownloadManager()
+	dm.inFlight["7374616c65"] = time.Now().Add(-blockRequestTimeout - time.Second)
+	dm.inFlight["6e6577"] = time.Now()
+
+	if !dm.sweep() {
+		t.Fatal("sweep did not requeue the stale block")
+	}
+	if len(dm.queue) != 1 || string(dm.queue[0]) != "stale" {
+		t.Errorf("queue %q, want the stale block", dm.queue)
+	}
+	if _, ok := dm.inFlight["6e6577"]; !ok {
+		t.Error("the block that was just requested was requeued")
+	}
+
+	dm.Confirm([]byte("stale"))
+	if dm.sweep() {
+		t.Error("sweep reports queued blocks after the stale block arrived")
+	}
+}
@@ -2,230 +2,796 @@ package network
 
 import (
 	"bytes"
-	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"time"
 
 	"github.com/qhenkart/blockchain/blockchain"
 )
 
-// HandleConnection reads a connection,
+// HandleConnection reads messages from a connection until the peer closes it or it has been idle for too long
 func HandleConnection(conn net.Conn, chain *blockchain.Blockchain) {
-	req, err := ioutil.ReadAll(conn)
+	handleConnection(conn, chain, nil)
+}
+
+// handleConnection reads messages like HandleConnection. Pongs are passed to the keep alive of the connection
+func handleConnection(conn net.Conn, chain *blockchain.Blockchain, alive *keepAlive) {
 	defer conn.Close()
 
-	if err != nil {
-		log.Panic(err)
+	// drop banned peers before reading anything from them
+	peer := conn.RemoteAddr().String()
+	if IsBanned(peer) {
+		return
+	}
+
+	resyncIfOffline(chain)
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(readTimeout())); err != nil {
+			return
+		}
+
+		req, err := readFrame(conn)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// idle timeouts and closed connections end the loop
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return
+			}
+			// the rest of the message is never read, so the connection can't be used anymore
+			if errors.Is(err, ErrMessageTooLarge) {
+				slog.Error("Received a message that is too large, closing the connection", "peer", peer, "err", err)
+				Misbehaving(peer, malformedMessageScore)
+				return
+			}
+			slog.Error("Could not read a message", "peer", peer, "err", err)
+			return
+		}
+
+		if !handleMessageFrom(peer, req, chain, conn, alive) {
+			return
+		}
+	}
+}
+
+// handleMessageFrom handles a message and scores the peer when the message is malformed
+//
+// returns false when the peer got banned and the connection should be closed
+func handleMessageFrom(peer string, req []byte, chain *blockchain.Blockchain, conn net.Conn, alive *keepAlive) bool {
+	var err error
+	// pings are answered on the connection they came from
+	handled := false
+	if len(req) >= commandLength {
+		handled, err = handleKeepAlive(conn, alive, req)
+	}
+	if !handled {
+		err = HandleMessage(req, chain)
+	}
+
+	var malformed malformedMessage
+	if errors.As(err, &malformed) {
+		slog.Error("Received a malformed message", "peer", peer, "err", malformed.err)
+		Misbehaving(peer, malformedMessageScore)
+		return !IsBanned(peer)
+	}
+
+	return true
+}
+
+// HandleMessage handles a single message based on its command
+//
+// returns a malformedMessage error when the message can't be decoded, the message is dropped
+func HandleMessage(req []byte, chain *blockchain.Blockchain) error {
+	if len(req) < commandLength {
+		return malformedMessage{fmt.Errorf("message is too short: %d bytes", len(req))}
 	}
 
 	// pull out the command and convert it to a string
 	command := BytesToCmd(req[:commandLength])
-	fmt.Printf("Received %s command\n", command)
+	slog.Debug("Received a command", "command", command)
 
 	// handle the connection based on the command
 	switch command {
 	case "addr":
-		HandleAddr(req)
+		return HandleAddr(req)
 	case "block":
-		HandleBlock(req, chain)
+		return HandleBlock(req, chain)
+	case "cmpctblock":
+		return HandleCompactBlock(req, chain)
+	case "getmissing":
+		return HandleGetMissingTxs(req, chain)
+	case "missingtxs":
+		return HandleMissingTxs(req, chain)
 	case "inv":
-		HandleInv(req, chain)
+		return HandleInv(req, chain)
 	case "getblocks":
-		HandleGetBlocks(req, chain)
+		return HandleGetBlocks(req, chain)
+	case "getheaders":
+		return HandleGetHeaders(req, chain)
+	case "header":
+		return HandleHeader(req, chain)
+	case "headers":
+		return HandleHeaders(req, chain)
 	case "getdata":
-		HandleGetData(req, chain)
+		return HandleGetData(req, chain)
+	case "notfound":
+		return HandleNotFound(req)
 	case "tx":
-		HandleTx(req, chain)
+		return HandleTx(req, chain)
 	case "version":
-		HandleVersion(req, chain)
+		return HandleVersion(req, chain)
 	default:
-		fmt.Println("Unknown command")
+		slog.Error("Unknown command", "command", command)
 	}
+
+	return nil
 }
 
 // HandleInv receives inventory payloads from other peers
-func HandleInv(request []byte, chain *blockchain.Blockchain) {
+func HandleInv(request []byte, chain *blockchain.Blockchain) error {
 	var payload Inv
-	decodeData(request, &payload)
-
-	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
-
-	// if the payload type is a block. then add them to the blocks in transit
-	if payload.Type == "block" {
-		blocksInTransit = payload.Items
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
 
-		// take the first items block hash
-		blockHash := payload.Items[0]
+	// nodes never announce an empty inventory
+	if len(payload.Items) == 0 {
+		return malformedMessage{errors.New("inventory has no items")}
+	}
 
-		// request the block from other peers
-		SendGetData(payload.AddrFrom, "block", blockHash)
+	slog.Debug("Received inventory", "peer", payload.AddrFrom, "type", payload.Type, "items", len(payload.Items))
 
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			// add new blocks in transit
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
-			}
+	// if the payload type is a block. then add them to the download queue and request them from the peer
+	if payload.Type == "block" {
+		// the inventory lists the newest block first. Requesting the oldest first lets the blocks arrive after their previous block,
+		// instead of waiting in the orphan pool
+		hashes := make([][]byte, 0, len(payload.Items))
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			hashes = append(hashes, payload.Items[i])
 		}
-		blocksInTransit = newInTransit
+		downloads.Enqueue(hashes)
+		downloads.Dispatch(payload.AddrFrom)
 	}
 
-	// if the payload is a transaction. then see if we have the transaction in our memory pool, otherwise request to get the transaction
+	// if the payload is a transaction. then see if we have the transactions in our memory pool, otherwise request to get them
 	if payload.Type == "tx" {
-		txID := payload.Items[0]
+		for _, txID := range payload.Items {
+			mempoolMu.RLock()
+			_, ok := memoryPool[hex.EncodeToString(txID)]
+			mempoolMu.RUnlock()
 
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
-			SendGetData(payload.AddrFrom, "tx", txID)
+			if !ok {
+				SendGetData(payload.AddrFrom, "tx", txID)
+			}
 		}
 	}
+
+	return nil
 }
 
 // HandleGetBlocks receives a request to send blocks back to a peer
-func HandleGetBlocks(request []byte, chain *blockchain.Blockchain) {
+func HandleGetBlocks(request []byte, chain *blockchain.Blockchain) error {
 	var payload GetBlocks
 
-	decodeData(request, &payload)
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
 	// get all of the hashes from the blockchain
-	blocks := chain.GetBlockHashes()
+	blocks, err := chain.GetBlockHashes()
+	if err != nil {
+		slog.Error("Could not read the block hashes", "peer", payload.AddrFrom, "err", err)
+		return nil
+	}
 	// send the inventory with all of the block hashes
 	//
 	// if one of the blockchains doesn't have the same hashes, then they know they need to update it
 	SendInv(payload.AddrFrom, "block", blocks)
+
+	return nil
+}
+
+// HandleGetHeaders receives a request to send block headers back to a peer
+func HandleGetHeaders(request []byte, chain *blockchain.Blockchain) error {
+	var payload GetHeaders
+
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
+
+	// without hashes the peer is syncing headers first and wants our chain from a height on
+	if len(payload.Hashes) == 0 {
+		if payload.FromHeight < 0 {
+			return malformedMessage{fmt.Errorf("headers requested from height %d", payload.FromHeight)}
+		}
+		// a message holds more headers than a range can read at once, so read them in chunks until the tip
+		var headers []blockchain.BlockHeader
+		for from := payload.FromHeight; len(headers) < maxHeadersPerMsg; {
+			size := maxHeadersPerMsg - len(headers)
+			if size > blockchain.MaxRangeSize {
+				size = blockchain.MaxRangeSize
+			}
+			blocks, err := chain.GetBlocksByHeightRange(from, from+size-1)
+			if err != nil {
+				slog.Error("Could not read the headers", "peer", payload.AddrFrom, "fromHeight", payload.FromHeight, "err", err)
+				return nil
+			}
+
+			for _, block := range blocks {
+				header, err := block.Header()
+				if err != nil {
+					slog.Error("Could not read the headers", "peer", payload.AddrFrom, "fromHeight", payload.FromHeight, "err", err)
+					return nil
+				}
+				headers = append(headers, header)
+			}
+			if len(blocks) < size {
+				break
+			}
+			from += size
+		}
+		SendHeaders(payload.AddrFrom, headers)
+		return nil
+	}
+
+	// cap the amount of headers per message, the peer can request the rest afterwards
+	hashes := payload.Hashes
+	if len(hashes) > maxHeadersPerMsg {
+		hashes = hashes[:maxHeadersPerMsg]
+	}
+
+	headers, err := chain.GetBlockHeaders(hashes)
+	if err != nil {
+		slog.Error("Could not read the headers", "peer", payload.AddrFrom, "err", err)
+		return nil
+	}
+
+	if len(headers) > 0 {
+		SendHeaders(payload.AddrFrom, headers)
+	}
+
+	// let the peer know which blocks we don't have so it can ask someone else
+	if missing := missingHeaders(hashes, headers); len(missing) > 0 {
+		SendNotFound(payload.AddrFrom, "header", missing)
+	}
+
+	return nil
+}
+
+// missingHeaders returns the hashes that none of the headers has
+func missingHeaders(hashes [][]byte, headers []blockchain.BlockHeader) [][]byte {
+	found := make(map[string]bool, len(headers))
+	for _, header := range headers {
+		found[hex.EncodeToString(header.Hash)] = true
+	}
+
+	var missing [][]byte
+	for _, hash := range hashes {
+		if !found[hex.EncodeToString(hash)] {
+			missing = append(missing, hash)
+		}
+	}
+	return missing
+}
+
+// HandleHeaders receives block headers from other peers and requests the blocks that are missing from our blockchain
+//
+// in headers first mode the blocks are only requested once the PoW of every header in the message is valid and the
+// headers link to our chain. A full message means the peer has more, so the next headers are requested as well
+func HandleHeaders(request []byte, chain *blockchain.Blockchain) error {
+	var payload Headers
+
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
+
+	slog.Info("Received headers", "peer", payload.AddrFrom, "headers", len(payload.Headers))
+
+	if Config.HeadersFirst {
+		if err := validateHeaders(chain, payload.Headers); err != nil {
+			slog.Error("Rejected headers", "peer", payload.AddrFrom, "err", err)
+			Misbehaving(payload.AddrFrom, invalidHeadersScore)
+			return nil
+		}
+		for _, header := range payload.Headers {
+			headerChain.Add(header)
+		}
+	}
+
+	var missing [][]byte
+	for _, header := range payload.Headers {
+		// skip the blocks we already have
+		if _, err := chain.GetBlock(header.Hash); err == nil {
+			continue
+		}
+		missing = append(missing, header.Hash)
+	}
+
+	downloads.Enqueue(missing)
+	downloads.Dispatch(payload.AddrFrom)
+
+	if Config.HeadersFirst && len(payload.Headers) == maxHeadersPerMsg {
+		SendGetHeadersFrom(payload.AddrFrom, payload.Headers[len(payload.Headers)-1].Height+1)
+	}
+
+	return nil
+}
+
+// validateHeaders checks the PoW of the headers and that each of them builds on the one before it
+//
+// the first header has to build on a block of our chain or on a header we validated before
+func validateHeaders(chain *blockchain.Blockchain, headers []blockchain.BlockHeader) error {
+	for i, header := range headers {
+		if !header.Validate() {
+			return fmt.Errorf("header %x has an invalid PoW", header.Hash)
+		}
+
+		var prevHash []byte
+		prevHeight := -1
+		if i > 0 {
+			prevHash, prevHeight = headers[i-1].Hash, headers[i-1].Height
+		} else if prev, ok := headerChain.Get(header.PrevHash); ok {
+			prevHash, prevHeight = prev.Hash, prev.Height
+		} else if block, err := chain.GetBlock(header.PrevHash); err == nil {
+			prevHash, prevHeight = block.Hash, block.Height
+		} else if header.Height != 0 {
+			return fmt.Errorf("header %x does not build on a known block", header.Hash)
+		}
+
+		if !bytes.Equal(header.PrevHash, prevHash) || header.Height != prevHeight+1 {
+			return fmt.Errorf("header %x does not build on the header before it", header.Hash)
+		}
+	}
+
+	return nil
+}
+
+// HandleHeader receives a single block header and stores it in the header chain
+func HandleHeader(request []byte, chain *blockchain.Blockchain) error {
+	var payload Header
+
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
+
+	// the full block is already stored, there is nothing to do
+	if _, err := chain.GetBlock(payload.Header.Hash); err == nil {
+		return nil
+	}
+
+	if !headerChain.Add(payload.Header) {
+		slog.Error("Received an invalid header", "peer", payload.AddrFrom, "blockHash", hex.EncodeToString(payload.Header.Hash))
+		return nil
+	}
+
+	slog.Info("Received a header", "peer", payload.AddrFrom, "blockHash", hex.EncodeToString(payload.Header.Hash), "height", payload.Header.Height)
+
+	return nil
 }
 
 // HandleGetData receives a request to send data back to a peer
-func HandleGetData(request []byte, chain *blockchain.Blockchain) {
+func HandleGetData(request []byte, chain *blockchain.Blockchain) error {
 	var payload GetData
 
-	decodeData(request, &payload)
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
 	// if the payload type is a block, retrieve the block from the blockchain based on the payload id
 	if payload.Type == "block" {
 		block, err := chain.GetBlock([]byte(payload.ID))
 		if err != nil {
-			return
+			// let the peer know so it can ask someone else
+			SendNotFound(payload.AddrFrom, "block", [][]byte{payload.ID})
+			return nil
 		}
 		// send the block to the other peers so they can download it
 		SendBlock(payload.AddrFrom, &block)
 	}
 
+	// if the payload type is a header, send only the header of the block
+	if payload.Type == "header" {
+		block, err := chain.GetBlock([]byte(payload.ID))
+		if err != nil {
+			SendNotFound(payload.AddrFrom, "header", [][]byte{payload.ID})
+			return nil
+		}
+
+		header, err := block.Header()
+		if err != nil {
+			slog.Error("Could not create the block header", "peer", payload.AddrFrom, "blockHash", hex.EncodeToString(payload.ID), "err", err)
+			return nil
+		}
+		SendHeader(payload.AddrFrom, &header)
+	}
+
 	//if the payload type is a transaction, add it to the memory pool and send the transaction to the other peers so they can keep track of it
 	if payload.Type == "tx" {
 		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
+		mempoolMu.RLock()
+		tx, ok := memoryPool[txID]
+		mempoolMu.RUnlock()
+		if !ok {
+			SendNotFound(payload.AddrFrom, "tx", [][]byte{payload.ID})
+			return nil
+		}
 
 		SendTx(payload.AddrFrom, &tx)
 	}
+
+	return nil
+}
+
+// HandleNotFound receives a list of items a peer does not have and requests them from a different peer
+//
+// an item is not requested again from a peer that did not have it, and is given up on after maxNotFoundAttempts peers
+func HandleNotFound(request []byte) error {
+	var payload NotFound
+
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
+
+	slog.Info("Peer could not find the items", "peer", payload.AddrFrom, "type", payload.Type, "items", len(payload.Items))
+
+	if payload.Type == "block" {
+		// remove the blocks from the transit queue, they will never arrive from this peer
+		for _, hash := range payload.Items {
+			downloads.Cancel(hash)
+		}
+	}
+
+	if payload.Type != "block" && payload.Type != "tx" && payload.Type != "header" {
+		return nil
+	}
+
+	// every item goes to a peer that has not told us it doesn't have it, until the item was tried too often
+	peers := KnownNodes.GetRandomPeers(KnownNodes.Len())
+	for _, id := range payload.Items {
+		peer, ok := notFound.next(payload.Type, id, payload.AddrFrom, peers)
+		if !ok {
+			slog.Info("Giving up on an item no peer could find", "type", payload.Type, "id", hex.EncodeToString(id))
+			continue
+		}
+
+		if payload.Type == "block" {
+			downloads.Enqueue([][]byte{id})
+			downloads.Dispatch(peer)
+			continue
+		}
+		SendGetData(peer, payload.Type, id)
+	}
+
+	return nil
 }
 
 // HandleTx receives requests for transactions. Our wallet will be sending transactions to our miner and central node
-func HandleTx(request []byte, chain *blockchain.Blockchain) {
+func HandleTx(request []byte, chain *blockchain.Blockchain) error {
 	var payload Tx
 
-	decodeData(request, &payload)
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
+	tx, err := blockchain.DeserializeTransaction(txData)
+	if err != nil {
+		slog.Error("Rejected a transaction", "peer", payload.AddrFrom, "err", err)
+		return nil
+	}
+
+	// transactions that spend more than their inputs or pay too little fee are dropped
+	fee, err := chain.TxFee(&tx)
+	if err != nil {
+		slog.Error("Rejected a transaction", "peer", payload.AddrFrom, "txID", hex.EncodeToString(tx.ID), "err", err)
+		return nil
+	}
+	if !Policy.Accepts(&tx, fee) {
+		slog.Info("Rejected a transaction with a low fee", "peer", payload.AddrFrom, "txID", hex.EncodeToString(tx.ID), "fee", fee, "minFeePerByte", Policy.MinFee)
+		return nil
+	}
+
+	// the pool only holds transactions the next block can take, so invalid signatures and immature coinbase spends are dropped
+	valid, err := chain.VerifyTransaction(&tx)
+	if err == nil && !valid {
+		err = errors.New("invalid signature")
+	}
+	if err != nil {
+		slog.Error("Rejected a transaction", "peer", payload.AddrFrom, "txID", hex.EncodeToString(tx.ID), "err", err)
+		return nil
+	}
 
 	// add the transaction or our memory pool
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	pending := addToMempool(tx)
 
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+	slog.Info("Added a transaction to the memory pool", "peer", payload.AddrFrom, "txID", hex.EncodeToString(tx.ID), "mempoolSize", pending)
 
 	// check to see if the node address is the central node. If it is the central node
 	// it has the responsibility to update the other nodes
-	if nodeAddress == KnownNodes[0] {
-		// then iterate through each known node address and send the transaction to all of the nodes (except for the current node and the sender's node)
-		for _, node := range KnownNodes {
+	if isCentralNode(nodeAddress) {
+		// then gossip the transaction to a random sample of known nodes (except for the current node and the sender's node)
+		for _, node := range KnownNodes.GetRandomPeers(gossipFanout) {
 			if node != nodeAddress && node != payload.AddrFrom {
 				// for all the non central nodes and non miner nodes
 				SendInv(node, "tx", [][]byte{tx.ID})
 			}
 		}
-		// for miner nodes. Check the memory pool length. If we have more transactions than 2, then we want to mine a new transaction
+		// for miner nodes. Check the memory pool length. Once it holds a block worth of transactions (MaxTxPerBlock), mine a new block
 	} else {
-		if len(memoryPool) >= maxTxLimit && len(mineAddress) > 0 {
+		if pending >= maxTxPerBlock() && len(mineAddress) > 0 {
 			// verify the transactions and mine a new block
 			MineTx(chain)
 		}
 	}
+
+	return nil
 }
 
 // HandleVersion decodes the version, calculates the best height, and compares it with the payload's best height.
 // If ours is higher, then we need to send our version so they know to download our blockchain
 // otherwise if their's is longer then we need to request for their blocks to update our blockchain
-func HandleVersion(request []byte, chain *blockchain.Blockchain) {
+func HandleVersion(request []byte, chain *blockchain.Blockchain) error {
 	var payload Version
 
-	decodeData(request, &payload)
+	version, err := decodeData(request, &payload)
+	if err != nil {
+		return err
+	}
+	// nodes from before the envelope can't decode our messages, answer them the way they talk
+	setLegacyPeer(payload.AddrFrom, version == legacyMessageVersion)
+
 	// calculate best height
-	bestHeight := chain.GetBestHeight()
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		slog.Error("Could not read the best height", "peer", payload.AddrFrom, "err", err)
+		return nil
+	}
 	otherHeight := payload.BestHeight
 
 	// if theirs is larger, then we need to request their blocks to update our blockchain
 	if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
+		if Config.HeadersFirst {
+			SendGetHeadersFrom(payload.AddrFrom, bestHeight+1)
+		} else {
+			SendGetBlocks(payload.AddrFrom)
+		}
 
 		// if ours is larger then send our version so they know to update their blockchain with our blocks
 	} else if bestHeight > otherHeight {
 		SendVersion(payload.AddrFrom, chain)
 	}
 
-	// add the incoming address to the known nodes if it isn't already there
-	if !NodeIsKnown(payload.AddrFrom) {
-		KnownNodes = append(KnownNodes, payload.AddrFrom)
+	// add the incoming address to the known nodes, or refresh it if it is already there
+	if !IsBanned(payload.AddrFrom) {
+		info := PeerInfo{Addr: payload.AddrFrom, Services: payload.Services, BestHeight: payload.BestHeight}
+		if KnownNodes.AddPeer(info) {
+			savePeers()
+		}
+		countPeers()
 	}
+
+	return nil
 }
 
 // HandleBlock receives blocks from other peers and adds them to the blockchain
-func HandleBlock(request []byte, chain *blockchain.Blockchain) {
+func HandleBlock(request []byte, chain *blockchain.Blockchain) error {
 	var payload Block
 
-	decodeData(request, &payload)
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
 
 	blockData := payload.Block
-	block := blockchain.Deserialize(blockData)
+	block, err := blockchain.Deserialize(blockData)
+	if err != nil {
+		slog.Error("Rejected a block", "peer", payload.AddrFrom, "err", err)
+		return nil
+	}
+
+	slog.Debug("Received a block", "peer", payload.AddrFrom, "blockHash", hex.EncodeToString(block.Hash))
+	processBlock(chain, block, payload.AddrFrom)
 
-	fmt.Println("Recevied a new block!")
-	chain.AddBlock(block)
+	return nil
+}
+
+// processBlock adds a block received from a peer to the chain
+func processBlock(chain *blockchain.Blockchain, block *blockchain.Block, addrFrom string) {
+	err := chain.AddBlock(block)
+	if err == blockchain.ErrOrphanBlock {
+		// the chain adds the block once its previous block arrives, so ask the peer for it unless it is already requested
+		slog.Info("Received an orphan block", "peer", addrFrom, "blockHash", hex.EncodeToString(block.Hash), "prevHash", hex.EncodeToString(block.PrevHash))
+		downloads.Confirm(block.Hash)
+		downloads.Enqueue([][]byte{block.PrevHash})
+		downloads.Dispatch(addrFrom)
+		return
+	}
+	if errors.Is(err, blockchain.ErrInvalidTimestamp) {
+		// clocks drift, so the peer is not scored. The block is dropped and not downloaded again
+		slog.Error("Dropped a block with an invalid timestamp", "peer", addrFrom, "blockHash", hex.EncodeToString(block.Hash), "timestamp", block.Timestamp, "err", err)
+		downloads.Confirm(block.Hash)
+		return
+	}
+	if errors.Is(err, blockchain.ErrInvalidBlock) {
+		// the chain didn't store the block, so it is not downloaded again either
+		slog.Error("Rejected an invalid block", "peer", addrFrom, "blockHash", hex.EncodeToString(block.Hash), "err", err)
+		Misbehaving(addrFrom, invalidBlockScore)
+		downloads.Confirm(block.Hash)
+		return
+	}
+	if err != nil {
+		slog.Error("Could not add a block", "peer", addrFrom, "blockHash", hex.EncodeToString(block.Hash), "err", err)
+		return
+	}
 
-	fmt.Printf("Added block %x\n", block.Hash)
+	// the block we are mining at this height would be stale
+	mining.CancelAt(block.Height)
 
-	// check to see how many blocks are in transit. If there are more, then request the next blocks from other peers if there are any
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
+	slog.Info("Added a block", "peer", addrFrom, "blockHash", hex.EncodeToString(block.Hash), "height", block.Height)
+	downloads.Confirm(block.Hash)
 
-		// skips the zeroth index since we just read the first one
-		blocksInTransit = blocksInTransit[1:]
+	// check to see how many blocks are still being downloaded. If there are more, then request the next blocks from the peer
+	if downloads.Pending() > 0 {
+		downloads.Dispatch(addrFrom)
 	} else {
 		// otherwise reindex the UTXO set
-		UTXOSet := blockchain.NewUTXOSet(chain)
-		UTXOSet.Reindex()
+		UTXOSet, err := blockchain.NewUTXOSet(chain)
+		if err != nil {
+			slog.Error("Could not open the UTXO set", "err", err)
+			return
+		}
+		if err := UTXOSet.Reindex(); err != nil {
+			slog.Error("Could not reindex the UTXO set", "err", err)
+		}
+	}
+}
+
+// HandleCompactBlock receives a block announced with its transaction ids and rebuilds it from the memory pool
+//
+// the transactions that are not in the memory pool are requested from the peer
+func HandleCompactBlock(request []byte, chain *blockchain.Blockchain) error {
+	var payload CompactBlock
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
+
+	// the block is already stored
+	if _, err := chain.GetBlock(payload.Header.Hash); err == nil {
+		return nil
+	}
+
+	pending, err := newCompactState(payload)
+	if err != nil {
+		slog.Error("Rejected a compact block", "peer", payload.AddrFrom, "blockHash", hex.EncodeToString(payload.Header.Hash), "err", err)
+		return nil
+	}
+
+	missing := pending.missing()
+	if len(missing) == 0 {
+		completeCompactBlock(chain, pending)
+		return nil
 	}
+
+	slog.Info("Received a compact block", "peer", payload.AddrFrom, "blockHash", hex.EncodeToString(payload.Header.Hash), "missing", len(missing), "transactions", len(payload.TxIDs))
+	compactBlocks.Add(pending)
+	SendGetMissingTxs(payload.AddrFrom, payload.Header.Hash, missing)
+
+	return nil
+}
+
+// HandleGetMissingTxs sends the requested transactions of a block back to the peer
+func HandleGetMissingTxs(request []byte, chain *blockchain.Blockchain) error {
+	var payload GetMissingTxs
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
+
+	block, err := chain.GetBlock(payload.BlockHash)
+	if err != nil {
+		SendNotFound(payload.AddrFrom, "block", [][]byte{payload.BlockHash})
+		return nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, id := range payload.TxIDs {
+		wanted[hex.EncodeToString(id)] = true
+	}
+
+	var txs []*blockchain.Transaction
+	for _, tx := range block.Transactions {
+		if wanted[hex.EncodeToString(tx.ID)] {
+			txs = append(txs, tx)
+		}
+	}
+
+	SendMissingTxs(payload.AddrFrom, payload.BlockHash, txs)
+
+	return nil
+}
+
+// HandleMissingTxs receives the transactions a compact block was missing and adds the block
+//
+// when the block still can't be rebuilt, the full block is requested instead
+func HandleMissingTxs(request []byte, chain *blockchain.Blockchain) error {
+	var payload MissingTxs
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
+
+	pending, ok := compactBlocks.Take(payload.BlockHash)
+	if !ok {
+		return nil
+	}
+
+	for _, data := range payload.Transactions {
+		tx, err := blockchain.DeserializeTransaction(data)
+		if err != nil {
+			slog.Error("Rejected a transaction", "peer", payload.AddrFrom, "blockHash", hex.EncodeToString(payload.BlockHash), "err", err)
+			continue
+		}
+		pending.fill(&tx)
+	}
+
+	if len(pending.missing()) > 0 {
+		slog.Info("Peer did not send every transaction, requesting the full block", "peer", payload.AddrFrom, "blockHash", hex.EncodeToString(payload.BlockHash))
+		SendGetData(payload.AddrFrom, "block", payload.BlockHash)
+		return nil
+	}
+
+	completeCompactBlock(chain, pending)
+
+	return nil
+}
+
+// completeCompactBlock rebuilds the block of a compact block once every transaction is known and adds it
+func completeCompactBlock(chain *blockchain.Blockchain, pending *compactState) {
+	block, err := blockchain.BlockFromHeader(pending.header, pending.txs)
+	if err != nil {
+		// a transaction in our memory pool had the same id but other contents, fall back to the full block
+		slog.Error("Could not rebuild a compact block", "peer", pending.from, "blockHash", hex.EncodeToString(pending.header.Hash), "err", err)
+		SendGetData(pending.from, "block", pending.header.Hash)
+		return
+	}
+
+	slog.Debug("Rebuilt a block from a compact block", "peer", pending.from, "blockHash", hex.EncodeToString(block.Hash))
+	processBlock(chain, block, pending.from)
 }
 
 // HandleAddr recieves an address list from other peers and adds them to the known nodes
-func HandleAddr(request []byte) {
+func HandleAddr(request []byte) error {
 	var payload Addr
-	decodeData(request, &payload)
-	// add the payloads address list to the known knowns
-	KnownNodes = append(KnownNodes, payload.AddrList...)
-	fmt.Printf("there are %d known nodes\n", len(KnownNodes))
+	if _, err := decodeData(request, &payload); err != nil {
+		return err
+	}
+	// add the payloads address list to the known knowns. Duplicates only update when the node was last seen
+	for _, addr := range payload.AddrList {
+		if IsBanned(addr) {
+			continue
+		}
+		if !KnownNodes.Add(addr) {
+			slog.Debug("Peer limit reached, ignoring the remaining addresses", "peer", addr)
+			break
+		}
+	}
+	countPeers()
+	slog.Info("Received addresses", "addresses", len(payload.AddrList), "knownNodes", KnownNodes.Len())
 	RequestBlocks()
-}
 
-func decodeData(in []byte, out interface{}) {
-	var buff bytes.Buffer
+	return nil
+}
 
+// decodeData strips the command and decodes the message into out. Returns the message version
+//
+// returns a malformedMessage when the message can't be decoded, the connection handler scores the peer for it
+func decodeData(in []byte, out interface{}) (byte, error) {
 	// extract the command
-	buff.Write(in[commandLength:])
-
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&out)
+	version, err := DecodeMessage(in[commandLength:], out)
 	if err != nil {
-		log.Panic(err)
+		return 0, malformedMessage{err}
 	}
+
+	return version, nil
 }
@@ -0,0 +1,296 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qhenkart/blockchain/blockchain"
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+func TestMissingHeaders(t *testing.T) {
+	hashes := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	headers := []blockchain.BlockHeader{{Hash: []byte("third")}, {Hash: []byte("first")}}
+
+	missing := missingHeaders(hashes, headers)
+	if len(missing) != 1 || string(missing[0]) != "second" {
+		t.Errorf("missing %q, want the second hash", missing)
+	}
+}
+
+// run with go test -race, new peers announce themselves while the known nodes are read for relaying
+func TestHandleVersionConcurrently(t *testing.T) {
+	chain, closeChain, err := blockchain.NewTestChain(string(wallet.MakeWallet().Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	known := KnownNodes
+	KnownNodes = NewPeerSet(defaultMaxPeers, CentralNode)
+	defer func() { KnownNodes = known }()
+
+	const peers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < peers; i++ {
+		wg.Add(2)
+		addr := fmt.Sprintf("localhost:%d", 4000+i)
+		go func() {
+			defer wg.Done()
+			// the same height as ours, so the handler doesn't contact the peer
+			message := append(CmdToBytes("version"), EncodeMessage(messageVersion, Version{Version: 1, AddrFrom: addr, Services: ServiceFullNode})...)
+			if err := HandleVersion(message, chain); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			KnownNodes.GetRandomPeers(gossipFanout)
+			KnownNodes.All()
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < peers; i++ {
+		if addr := fmt.Sprintf("localhost:%d", 4000+i); !KnownNodes.Contains(addr) {
+			t.Errorf("%s is not a known node", addr)
+		}
+	}
+}
+
+func TestMinerNodeAdvertisesTheMinerBit(t *testing.T) {
+	for _, node := range []struct {
+		miner     string
+		fullChain bool
+		want      uint64
+	}{
+		{"1miner", true, ServiceFullNode | ServiceMiner},
+		{"", true, ServiceFullNode},
+		{"1miner", false, ServiceSPV | ServiceMiner},
+		{"", false, ServiceSPV},
+	} {
+		if services := nodeServices(node.miner, node.fullChain); services != node.want {
+			t.Errorf("miner %q, full chain %v: services %b, want %b", node.miner, node.fullChain, services, node.want)
+		}
+	}
+
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := blockchain.NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+	defer minerNode(t, NodeConfig{}, address)()
+	defer pool.CloseAll()
+
+	// the services StartServer advertises for a miner with the whole chain
+	oldServices := localServices
+	localServices = nodeServices(mineAddress, true)
+	defer func() { localServices = oldServices }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := readFrame(conn)
+		received <- data
+	}()
+
+	if err := sendVersion(ln.Addr().String(), chain); err != nil {
+		t.Fatal(err)
+	}
+	var message []byte
+	select {
+	case message = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the version was not received")
+	}
+
+	var version Version
+	if _, err := decodeData(message, &version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Services&ServiceMiner == 0 || version.Services&ServiceFullNode == 0 {
+		t.Errorf("the miner advertised %v, want full and miner", ServiceNames(version.Services))
+	}
+
+	// the peer that receives the version keeps the services of the miner
+	KnownNodes = NewPeerSet(defaultMaxPeers)
+	if err := HandleVersion(message, chain); err != nil {
+		t.Fatal(err)
+	}
+	peers := KnownNodes.Peers()
+	if len(peers) != 1 || peers[0].Addr != nodeAddress || peers[0].Services&ServiceMiner == 0 {
+		t.Errorf("known peers %+v, want %s as a miner", peers, nodeAddress)
+	}
+}
+
+func TestProcessBlockScoresInvalidBlocks(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := blockchain.NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := blockchain.CoinbaseTx(address, "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := blockchain.CreateBlock([]*blockchain.Transaction{coinbase}, genesis.Hash, 1, blockchain.Difficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the hash no longer matches the data
+	block.Nonce++
+
+	const peer = "10.0.0.1:3000"
+	defer func() {
+		bansMu.Lock()
+		delete(BanScore, banKey(peer))
+		bansMu.Unlock()
+	}()
+	processBlock(chain, block, peer)
+
+	bansMu.Lock()
+	score := BanScore[banKey(peer)]
+	bansMu.Unlock()
+	if score != invalidBlockScore {
+		t.Errorf("ban score %d, want %d", score, invalidBlockScore)
+	}
+	if _, err := chain.GetBlock(block.Hash); err == nil {
+		t.Error("the invalid block was stored")
+	}
+}
+
+func TestHandleTxRejectsImmatureCoinbaseSpends(t *testing.T) {
+	w := wallet.MakeWallet()
+	chain, closeChain, err := blockchain.NewTestChain(string(w.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+	// the pool never fills up, so nothing is mined
+	restore := minerNode(t, NodeConfig{MaxTxPerBlock: 10}, string(w.Address()))
+	defer restore()
+
+	if err := HandleTx(spendGenesis(t, chain, w), chain); err != nil {
+		t.Fatal(err)
+	}
+	if pending := len(MempoolTransactions()); pending != 0 {
+		t.Fatalf("%d transactions in the memory pool, the genesis coinbase is not mature yet", pending)
+	}
+
+	matureGenesis(t, chain, string(w.Address()))
+	if err := HandleTx(spendGenesis(t, chain, w), chain); err != nil {
+		t.Fatal(err)
+	}
+	if pending := len(MempoolTransactions()); pending != 1 {
+		t.Errorf("%d transactions in the memory pool, want the spend of the mature coinbase", pending)
+	}
+}
+
+func TestProcessBlockDoesNotScoreInvalidTimestamps(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	chain, closeChain, err := blockchain.NewTestChain(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+
+	genesis, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := blockchain.CoinbaseTx(address, "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := blockchain.CreateBlock([]*blockchain.Transaction{coinbase}, genesis.Hash, 1, blockchain.Difficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the block comes before the genesis block, the PoW is redone so only the timestamp is wrong
+	block.Timestamp = genesis.Timestamp - 1
+	pow, err := blockchain.NewProof(block, block.Difficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Nonce, block.Hash, err = pow.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	const peer = "10.0.0.2:3000"
+	processBlock(chain, block, peer)
+
+	bansMu.Lock()
+	score, scored := BanScore[banKey(peer)]
+	bansMu.Unlock()
+	if scored {
+		t.Errorf("the peer was scored %d for a clock drift", score)
+	}
+	if _, err := chain.GetBlock(block.Hash); err == nil {
+		t.Error("the block with the invalid timestamp was stored")
+	}
+}
+
+func TestHandleConnectionClosesOversizedMessages(t *testing.T) {
+	defer minerNode(t, NodeConfig{MaxMessageSize: 1024}, "")()
+
+	tests := map[string]func(conn net.Conn) error{
+		"framed": func(conn net.Conn) error {
+			return writeFrame(conn, make([]byte, 1025))
+		},
+		// nodes from before the framing send the command first and no length
+		"unframed": func(conn net.Conn) error {
+			_, err := conn.Write(append(CmdToBytes("tx"), make([]byte, 2048)...))
+			return err
+		},
+	}
+	for name, send := range tests {
+		server, client := net.Pipe()
+		peer := server.RemoteAddr().String()
+
+		handled := make(chan struct{})
+		go func() {
+			defer close(handled)
+			HandleConnection(server, nil)
+		}()
+		// the write never finishes, the rest of the message is not read
+		go send(client)
+
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the connection is still open after an oversized message", name)
+		}
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%s: reading from the closed connection returned %v, want EOF", name, err)
+		}
+		client.Close()
+
+		bansMu.Lock()
+		score := BanScore[banKey(peer)]
+		delete(BanScore, banKey(peer))
+		bansMu.Unlock()
+		if score != malformedMessageScore {
+			t.Errorf("%s: the peer has a ban score of %d, want %d", name, score, malformedMessageScore)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package network
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/qhenkart/blockchain/blockchain"
+)
+
+// HeaderChain stores block headers received from peers, without the block bodies
+//
+// the header download runs separately from the block download, so headers can be synced before or while the full blocks arrive
+type HeaderChain struct {
+	// hex hash -> header
+	headers map[string]blockchain.BlockHeader
+	mu      sync.RWMutex
+}
+
+// NewHeaderChain creates an empty header chain
+func NewHeaderChain() *HeaderChain {
+	return &HeaderChain{headers: make(map[string]blockchain.BlockHeader)}
+}
+
+// Add stores a header after checking its PoW. Returns false when the header is invalid
+func (hc *HeaderChain) Add(header blockchain.BlockHeader) bool {
+	if !header.Validate() {
+		return false
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	hc.headers[hex.EncodeToString(header.Hash)] = header
+	return true
+}
+
+// Get returns the header with the given hash
+func (hc *HeaderChain) Get(hash []byte) (blockchain.BlockHeader, bool) {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	header, ok := hc.headers[hex.EncodeToString(hash)]
+	return header, ok
+}
+
+// Len returns the amount of stored headers
+func (hc *HeaderChain) Len() int {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	return len(hc.headers)
+}
@@ -0,0 +1,182 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Ping is sent over an idle connection to check that the peer is still there
+type Ping struct {
+	AddrFrom string
+	// random, so a pong can't be sent before the ping was received
+	Nonce uint64
+}
+
+// Pong the answer to a ping, it carries the nonce of the ping
+type Pong struct {
+	AddrFrom string
+	Nonce    uint64
+}
+
+// keepAlive pings the peer of an accepted connection and closes the connection when the peer stops answering
+type keepAlive struct {
+	conn  net.Conn
+	pongs chan Pong
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newKeepAlive(conn net.Conn) *keepAlive {
+	return &keepAlive{conn: conn, pongs: make(chan Pong, 1), done: make(chan struct{})}
+}
+
+// run sends a ping every PingInterval until the connection is done. A peer that doesn't answer within PongTimeout is removed
+func (k *keepAlive) run(ctx context.Context) {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+
+	// the listen address of the peer, learned from its pongs. The remote address of the connection uses a random port
+	var peer string
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-k.done:
+			return
+		case <-ticker.C:
+		}
+
+		nonce, err := randomNonce()
+		if err != nil {
+			slog.Error("Could not create a ping nonce", "err", err)
+			continue
+		}
+		request := append(CmdToBytes("ping"), EncodeMessage(messageVersion, Ping{nodeAddress, nonce})...)
+		// a peer that stops reading would block the write forever
+		if err := writeFrameTimeout(k.conn, request); err != nil {
+			k.conn.Close()
+			return
+		}
+
+		if !k.waitForPong(ctx, nonce, &peer) {
+			return
+		}
+	}
+}
+
+// waitForPong waits for the pong of the nonce. Returns false when the connection is done or the peer timed out
+func (k *keepAlive) waitForPong(ctx context.Context, nonce uint64, peer *string) bool {
+	timeout := time.NewTimer(PongTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-k.done:
+			return false
+		case pong := <-k.pongs:
+			// pongs of earlier pings are ignored
+			if pong.Nonce != nonce {
+				continue
+			}
+			if pong.AddrFrom != "" {
+				*peer = pong.AddrFrom
+			}
+			return true
+		case <-timeout.C:
+			slog.Info("Peer did not answer the ping, closing the connection", "peer", k.conn.RemoteAddr().String())
+			k.conn.Close()
+			if *peer != "" {
+				KnownNodes.Remove(*peer)
+				countPeers()
+			}
+			return false
+		}
+	}
+}
+
+// received passes a pong to the ping loop. Pongs that arrive while no ping is waiting are dropped
+func (k *keepAlive) received(pong Pong) {
+	select {
+	case k.pongs <- pong:
+	default:
+	}
+}
+
+// stop ends the ping loop once the connection is closed
+func (k *keepAlive) stop() {
+	k.once.Do(func() { close(k.done) })
+}
+
+// handleKeepAlive answers pings and passes pongs to the keep alive of the connection. Returns false for other commands
+func handleKeepAlive(conn net.Conn, alive *keepAlive, req []byte) (bool, error) {
+	switch BytesToCmd(req[:commandLength]) {
+	case "ping":
+		var ping Ping
+		if _, err := decodeData(req, &ping); err != nil {
+			return true, err
+		}
+
+		response := append(CmdToBytes("pong"), EncodeMessage(messageVersion, Pong{nodeAddress, ping.Nonce})...)
+		if err := writeFrameTimeout(conn, response); err != nil {
+			slog.Error("Could not answer a ping", "peer", ping.AddrFrom, "err", err)
+		}
+		return true, nil
+	case "pong":
+		var pong Pong
+		if _, err := decodeData(req, &pong); err != nil {
+			return true, err
+		}
+
+		if alive != nil {
+			alive.received(pong)
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// answerPings reads a connection we dialed and answers the pings of the peer. Other messages are never sent this way
+//
+// the connection is closed when the peer closes it, so the next send dials a new one
+func answerPings(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		req, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		if len(req) < commandLength || BytesToCmd(req[:commandLength]) != "ping" {
+			continue
+		}
+
+		var ping Ping
+		if _, err := DecodeMessage(req[commandLength:], &ping); err != nil {
+			slog.Error("Received a malformed ping", "peer", conn.RemoteAddr().String(), "err", err)
+			continue
+		}
+
+		response := append(CmdToBytes("pong"), EncodeMessage(messageVersion, Pong{nodeAddress, ping.Nonce})...)
+		if err := writeFrameTimeout(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// randomNonce creates a random ping nonce
+func randomNonce() (uint64, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
@@ -0,0 +1,165 @@
+package network
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fastKeepAlive shortens the ping interval, the pong timeout and the write timeout for the test
+func fastKeepAlive(t *testing.T) {
+	t.Helper()
+
+	interval, timeout, writeTimeout := PingInterval, PongTimeout, Config.WriteTimeout
+	PingInterval, PongTimeout, Config.WriteTimeout = 10*time.Millisecond, 50*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() { PingInterval, PongTimeout, Config.WriteTimeout = interval, timeout, writeTimeout })
+}
+
+// runKeepAlive pings the server end of the pipe, the returned channel is closed once the ping loop ends
+func runKeepAlive(t *testing.T, server net.Conn) (*keepAlive, <-chan struct{}) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	alive := newKeepAlive(server)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		alive.run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return alive, stopped
+}
+
+// readPing reads the next ping from the client end of the pipe
+func readPing(t *testing.T, client net.Conn) (Ping, error) {
+	t.Helper()
+
+	req, err := readFrame(client)
+	if err != nil {
+		return Ping{}, err
+	}
+	if cmd := BytesToCmd(req[:commandLength]); cmd != "ping" {
+		t.Fatalf("received %s, want a ping", cmd)
+	}
+	var ping Ping
+	if _, err := DecodeMessage(req[commandLength:], &ping); err != nil {
+		t.Fatal(err)
+	}
+	return ping, nil
+}
+
+func TestKeepAliveDisconnectsAnUnresponsivePeer(t *testing.T) {
+	fastKeepAlive(t)
+	server, client := net.Pipe()
+	defer client.Close()
+
+	const peer = "10.0.0.3:3000"
+	KnownNodes.Add(peer)
+	defer KnownNodes.Remove(peer)
+
+	alive, stopped := runKeepAlive(t, server)
+
+	// a peer that answers stays connected, every ping has a new nonce
+	nonces := make(map[uint64]bool)
+	for i := 0; i < 3; i++ {
+		ping, err := readPing(t, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nonces[ping.Nonce] {
+			t.Errorf("ping %d reused the nonce %d", i, ping.Nonce)
+		}
+		nonces[ping.Nonce] = true
+		// handleConnection passes the pongs of the peer to the keep alive
+		alive.received(Pong{peer, ping.Nonce})
+	}
+
+	// the peer keeps reading, but stops answering
+	if _, err := readPing(t, client); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection of the unresponsive peer is still open")
+	}
+	if _, err := readPing(t, client); err != io.EOF {
+		t.Errorf("reading after the timeout returned %v, want EOF", err)
+	}
+	if KnownNodes.Contains(peer) {
+		t.Error("the unresponsive peer is still known")
+	}
+}
+
+func TestKeepAliveIgnoresPongsWithTheWrongNonce(t *testing.T) {
+	fastKeepAlive(t)
+	server, client := net.Pipe()
+	defer client.Close()
+
+	alive, stopped := runKeepAlive(t, server)
+
+	ping, err := readPing(t, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a spoofed pong doesn't know the nonce
+	alive.received(Pong{"10.0.0.4:3000", ping.Nonce + 1})
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection is still open after a pong with the wrong nonce")
+	}
+}
+
+func TestKeepAliveDisconnectsAPeerThatStopsReading(t *testing.T) {
+	fastKeepAlive(t)
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// nothing reads the client end, so the ping can't be written
+	_, stopped := runKeepAlive(t, server)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the ping loop is blocked on a peer that doesn't read")
+	}
+}
+
+func TestHandleKeepAliveAnswersPings(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	ping := append(CmdToBytes("ping"), EncodeMessage(messageVersion, Ping{"10.0.0.5:3000", 42})...)
+	answered := make(chan error, 1)
+	go func() {
+		handled, err := handleKeepAlive(server, nil, ping)
+		if err == nil && !handled {
+			err = io.ErrUnexpectedEOF
+		}
+		answered <- err
+	}()
+
+	req, err := readFrame(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-answered; err != nil {
+		t.Fatal(err)
+	}
+	var pong Pong
+	if cmd := BytesToCmd(req[:commandLength]); cmd != "pong" {
+		t.Fatalf("answered with %s, want a pong", cmd)
+	}
+	if _, err := DecodeMessage(req[commandLength:], &pong); err != nil {
+		t.Fatal(err)
+	}
+	if pong.Nonce != 42 {
+		t.Errorf("pong with the nonce %d, want 42", pong.Nonce)
+	}
+}
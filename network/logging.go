@@ -0,0 +1,29 @@
+package network
+
+import (
+	"log/slog"
+	"os"
+)
+
+// the level of the node logger, shared by the handler so it can change while the node runs
+var logLevel = new(slog.LevelVar)
+
+// SetLogLevel changes the lowest level the node logs
+func SetLogLevel(level slog.Level) {
+	logLevel.Set(level)
+}
+
+// setupLogging makes the node logger the default slog logger, every record carries the id of the node
+func setupLogging(nodeID string) {
+	logLevel.Set(Config.LogLevel)
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	if Config.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+
+	slog.SetDefault(slog.New(handler).With("nodeID", nodeID))
+}
@@ -0,0 +1,193 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/qhenkart/blockchain/blockchain"
+	"github.com/qhenkart/blockchain/blockchain/metrics"
+)
+
+// the memory pool is stored on shutdown, so unconfirmed transactions survive a restart
+const mempoolFile = "./tmp/mempool_%s.dat"
+
+// MempoolTransactions returns a copy of the transactions in the memory pool, ordered by id
+func MempoolTransactions() []blockchain.Transaction {
+	mempoolMu.RLock()
+	defer mempoolMu.RUnlock()
+
+	txs := make([]blockchain.Transaction, 0, len(memoryPool))
+	for _, tx := range memoryPool {
+		txs = append(txs, tx)
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		return bytes.Compare(txs[i].ID, txs[j].ID) < 0
+	})
+	return txs
+}
+
+// addToMempool adds a transaction to the memory pool and returns the size of the pool. A transaction that is already
+// in the pool keeps its place in the arrival order
+func addToMempool(tx blockchain.Transaction) int {
+	mempoolMu.Lock()
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := memoryPool[txID]; !ok {
+		mempoolSeq++
+		mempoolArrival[txID] = mempoolSeq
+	}
+	memoryPool[txID] = tx
+	size := len(memoryPool)
+	mempoolMu.Unlock()
+
+	metrics.MempoolSize.Set(float64(size))
+	return size
+}
+
+// removeFromMempool deletes the transactions from the memory pool and returns the size of the pool
+func removeFromMempool(txs []*blockchain.Transaction) int {
+	mempoolMu.Lock()
+	for _, tx := range txs {
+		txID := hex.EncodeToString(tx.ID)
+		delete(memoryPool, txID)
+		delete(mempoolArrival, txID)
+	}
+	size := len(memoryPool)
+	mempoolMu.Unlock()
+
+	metrics.MempoolSize.Set(float64(size))
+	return size
+}
+
+// arrivalOf returns when a transaction was added to the memory pool, transactions that are not in the pool come last
+func arrivalOf(id []byte) uint64 {
+	mempoolMu.RLock()
+	defer mempoolMu.RUnlock()
+
+	seq, ok := mempoolArrival[hex.EncodeToString(id)]
+	if !ok {
+		return math.MaxUint64
+	}
+	return seq
+}
+
+// order sorts the transactions in the order they should be mined. Transactions with the same fee rate are mined in the
+// order they arrived. A transaction whose fee can't be calculated is mined last
+func (p MempoolPolicy) order(chain *blockchain.Blockchain, txs []*blockchain.Transaction) []*blockchain.Transaction {
+	arrival := make(map[*blockchain.Transaction]uint64, len(txs))
+	rate := make(map[*blockchain.Transaction]float64, len(txs))
+	for _, tx := range txs {
+		arrival[tx] = arrivalOf(tx.ID)
+		if p.SortPolicy == SortFIFO {
+			continue
+		}
+		feeRate, err := chain.FeeRate(tx)
+		if err != nil {
+			feeRate = -1
+		}
+		rate[tx] = feeRate
+	}
+
+	sorted := append([]*blockchain.Transaction{}, txs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if rate[a] != rate[b] {
+			return rate[a] > rate[b]
+		}
+		return arrival[a] < arrival[b]
+	})
+	return sorted
+}
+
+// SaveMempool writes the memory pool to the mempool file of the node
+//
+// the transactions are stored in their binary encoding and in the order they arrived, so the file can still be read
+// after the transaction format changes and the fifo order survives a restart
+func SaveMempool(nodeID string) error {
+	txs := MempoolTransactions()
+	sort.SliceStable(txs, func(i, j int) bool {
+		return arrivalOf(txs[i].ID) < arrivalOf(txs[j].ID)
+	})
+
+	var data [][]byte
+	for _, tx := range txs {
+		txData, err := tx.Serialize()
+		if err != nil {
+			return err
+		}
+		data = append(data, txData)
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(data); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fmt.Sprintf(mempoolFile, nodeID), buffer.Bytes(), 0600)
+}
+
+// LoadMempool adds the transactions of the mempool file of the node back to the memory pool. A missing file means the pool was empty
+//
+// the chain may have changed since the pool was saved, so every transaction is verified again. Transactions that are invalid
+// or spend outputs that are no longer unspent are dropped. The server chain has to be open
+func LoadMempool(nodeID string) error {
+	serverChainMu.Lock()
+	chain := serverChain
+	serverChainMu.Unlock()
+	if chain == nil {
+		return errors.New("the server chain is not open")
+	}
+
+	file, err := ioutil.ReadFile(fmt.Sprintf(mempoolFile, nodeID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var data [][]byte
+	if err := gob.NewDecoder(bytes.NewReader(file)).Decode(&data); err != nil {
+		return err
+	}
+
+	loaded := 0
+	for _, txData := range data {
+		tx, err := blockchain.DeserializeTransaction(txData)
+		if err != nil {
+			continue
+		}
+		if !verifyPending(chain, &tx) {
+			continue
+		}
+
+		addToMempool(tx)
+		loaded++
+	}
+
+	slog.Info("Loaded the memory pool", "transactions", loaded, "dropped", len(data)-loaded)
+	return nil
+}
+
+// verifyPending checks that a transaction can still be mined, its signatures are valid and its inputs are unspent
+func verifyPending(chain *blockchain.Blockchain, tx *blockchain.Transaction) bool {
+	if tx.IsCoinbase() {
+		return false
+	}
+
+	valid, err := chain.VerifyTransaction(tx)
+	if err != nil || !valid {
+		return false
+	}
+
+	// spent inputs mean the transaction was mined, or another one spent the outputs first
+	_, err = chain.FindUTXOForInputs(tx.Inputs)
+	return err == nil
+}
@@ -0,0 +1,156 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/qhenkart/blockchain/blockchain"
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// asServerChain makes the chain the one the server opened, the returned function restores the old one
+func asServerChain(chain *blockchain.Blockchain) func() {
+	serverChainMu.Lock()
+	old := serverChain
+	serverChain = chain
+	serverChainMu.Unlock()
+
+	return func() {
+		serverChainMu.Lock()
+		serverChain = old
+		serverChainMu.Unlock()
+	}
+}
+
+func TestMempoolSurvivesARestart(t *testing.T) {
+	inNodeDir(t)
+
+	w := wallet.MakeWallet()
+	chain, closeChain, err := blockchain.NewTestChain(string(w.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeChain()
+	defer minerNode(t, NodeConfig{}, "")()
+	defer asServerChain(chain)()
+	matureGenesis(t, chain, string(w.Address()))
+
+	if err := HandleTx(spendGenesis(t, chain, w), chain); err != nil {
+		t.Fatal(err)
+	}
+	pending := MempoolTransactions()
+	if len(pending) != 1 {
+		t.Fatalf("%d transactions in the memory pool, want 1", len(pending))
+	}
+	tx := pending[0]
+
+	// a transaction whose signature no longer matches is dropped on the way back
+	tampered := tx
+	tampered.Outputs = []blockchain.TxOutput{{Value: tx.Outputs[0].Value, PubKeyHash: wallet.MakeWallet().PubKeyHash()}}
+	if tampered.ID, err = tampered.Hash(); err != nil {
+		t.Fatal(err)
+	}
+	addToMempool(tampered)
+
+	if err := SaveMempool("3002"); err != nil {
+		t.Fatal(err)
+	}
+	// the node stops, the memory pool is gone
+	removeFromMempool(mempoolPointers())
+
+	if err := LoadMempool("3002"); err != nil {
+		t.Fatal(err)
+	}
+	loaded := MempoolTransactions()
+	if len(loaded) != 1 || !bytes.Equal(loaded[0].ID, tx.ID) {
+		t.Fatalf("%d transactions after the restart, want the one saved before it", len(loaded))
+	}
+
+	// once the transaction is mined it is dropped as well
+	if err := SaveMempool("3002"); err != nil {
+		t.Fatal(err)
+	}
+	removeFromMempool(mempoolPointers())
+	coinbase, err := blockchain.CoinbaseTx(string(w.Address()), "", blockchain.CoinbaseMaturity, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.MineBlock([]*blockchain.Transaction{coinbase, &loaded[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadMempool("3002"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(MempoolTransactions()); n != 0 {
+		t.Errorf("%d transactions after the restart, the mined one should be dropped", n)
+	}
+
+	// a node that never saved its memory pool starts with an empty one
+	if err := LoadMempool("3003"); err != nil || len(MempoolTransactions()) != 0 {
+		t.Errorf("loaded %d transactions without a file, %v", len(MempoolTransactions()), err)
+	}
+}
+
+func TestFullBlocksMineTheHighestFeeRateFirst(t *testing.T) {
+	for _, sortPolicy := range []string{SortByFeeRate, SortFIFO} {
+		// the genesis coinbase pays the first wallet, the blocks that mature it pay the second one
+		low, high := wallet.MakeWallet(), wallet.MakeWallet()
+		chain, closeChain, err := blockchain.NewTestChain(string(low.Address()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		restore := minerNode(t, NodeConfig{MaxTxPerBlock: 1}, string(wallet.MakeWallet().Address()))
+		oldPolicy := Policy
+		Policy.SortPolicy = sortPolicy
+		matureGenesis(t, chain, string(high.Address()))
+		// one more block matures the first coinbase of the second wallet
+		coinbase, err := blockchain.CoinbaseTx(string(high.Address()), "", blockchain.CoinbaseMaturity, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := chain.MineBlock([]*blockchain.Transaction{coinbase}); err != nil {
+			t.Fatal(err)
+		}
+		utxoSet, err := blockchain.NewUTXOSet(chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := utxoSet.Reindex(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the low fee transaction arrives first
+		to := string(wallet.MakeWallet().Address())
+		lowTx, err := blockchain.NewWalletTransaction(low, to, 1, 1, 0, utxoSet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		highTx, err := blockchain.NewWalletTransaction(high, to, 1, 20, 0, utxoSet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addToMempool(*lowTx)
+		addToMempool(*highTx)
+
+		// the block only has room for one of them, the other one is mined in the block after it
+		MineTx(chain)
+		want := [][]byte{highTx.ID, lowTx.ID}
+		if sortPolicy == SortFIFO {
+			want = [][]byte{lowTx.ID, highTx.ID}
+		}
+		for i, id := range want {
+			height := blockchain.CoinbaseMaturity + 1 + i
+			blocks, err := chain.GetBlocksByHeightRange(height, height)
+			if err != nil || len(blocks) != 1 {
+				t.Fatalf("%s: block %d: %v", sortPolicy, height, err)
+			}
+			if txs := blocks[0].Transactions; len(txs) != 2 || !bytes.Equal(txs[0].ID, id) {
+				t.Errorf("%s: block %d holds %d transactions, want the coinbase and %x", sortPolicy, height, len(txs)-1, id)
+			}
+		}
+
+		Policy = oldPolicy
+		restore()
+		closeChain()
+	}
+}
@@ -0,0 +1,69 @@
+package network
+
+import (
+	"context"
+	"sync"
+)
+
+// MiningJob keeps track of the block the node is mining, so the work can be abandoned when it becomes stale
+//
+// once a peer sends a block for the same height, the block being mined can no longer extend the chain
+type MiningJob struct {
+	height int
+	ctx    context.Context
+	// cancels the context of the running job, nil while no block is mined
+	cancel context.CancelFunc
+	mu     sync.Mutex
+}
+
+// Start creates the context of a new block at the given height. Only one block is mined at a time, returns false while
+// another block is mined
+func (j *MiningJob) Start(height int) (context.Context, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.cancel != nil {
+		return nil, false
+	}
+
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	j.height = height
+
+	return j.ctx, true
+}
+
+// Done releases the context once the block is mined or abandoned, the next block can be mined after it
+func (j *MiningJob) Done() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.cancel != nil {
+		j.cancel()
+		j.cancel = nil
+	}
+}
+
+// Cancel stops the block being mined, eg. on shutdown. Like a cancelled job it runs until its miner calls Done
+func (j *MiningJob) Cancel() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.cancel != nil {
+		j.cancel()
+	}
+}
+
+// CancelAt stops the mining when the block being mined is at or below the height of a received block. Returns true if it was cancelled
+//
+// the job runs until its miner calls Done, so no other block is mined while it stops
+func (j *MiningJob) CancelAt(height int) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.cancel == nil || j.ctx.Err() != nil || j.height > height {
+		return false
+	}
+
+	j.cancel()
+	return true
+}
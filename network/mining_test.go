@@ -0,0 +1,46 @@
+package network
+
+import "testing"
+
+func TestMiningJobRunsOneBlockAtATime(t *testing.T) {
+	var job MiningJob
+
+	ctx, ok := job.Start(1)
+	if !ok {
+		t.Fatal("the first job did not start")
+	}
+	if _, ok := job.Start(1); ok {
+		t.Fatal("a second job started while the first one runs")
+	}
+
+	// a cancelled job still runs until its miner is done with it
+	if !job.CancelAt(1) {
+		t.Fatal("the job was not cancelled by a block at its height")
+	}
+	if ctx.Err() == nil {
+		t.Error("the context of the cancelled job is not done")
+	}
+	if _, ok := job.Start(2); ok {
+		t.Fatal("a job started before the cancelled one was done")
+	}
+
+	job.Done()
+	if _, ok := job.Start(2); !ok {
+		t.Error("no job started after the first one was done")
+	}
+	job.Done()
+}
+
+func TestMiningJobIgnoresLowerBlocks(t *testing.T) {
+	var job MiningJob
+
+	ctx, _ := job.Start(5)
+	defer job.Done()
+
+	if job.CancelAt(4) {
+		t.Error("a block below the mined height cancelled the job")
+	}
+	if ctx.Err() != nil {
+		t.Error("the context is done")
+	}
+}
@@ -2,16 +2,24 @@ package network
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
-	"runtime"
+	"strconv"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/qhenkart/blockchain/blockchain"
+	"github.com/qhenkart/blockchain/blockchain/metrics"
+	"github.com/qhenkart/blockchain/wallet"
 	"gopkg.in/vrecan/death.v3"
 )
 
@@ -34,24 +42,82 @@ import (
 // Nodes interact with each other using RPCs (Remote Procedure Calls) -> see version struct
 //
 const (
-	protocol      = "tcp"
-	version       = 1
+	// the defaults of NodeConfig.Protocol and NodeConfig.Version
+	defaultProtocol        = "tcp"
+	defaultProtocolVersion = 1
+	// the commands are padded to this length at the start of every message. It is part of the message format, so every node has to use the same
 	commandLength = 12
-	// the maximum amount of transactions that can exist in a block
-	maxTxLimit = 2
+	// version of the message envelope, bump it when a message struct changes
+	messageVersion = byte(1)
+	// the version DecodeMessage returns for messages of nodes from before the envelope, their payload is plain gob
+	legacyMessageVersion = byte(0)
+	// the default maximum amount of transactions the node mines into a block, the coinbase not included
+	defaultMaxTxPerBlock = 2
+	// the amount of random peers a transaction is gossiped to
+	gossipFanout = 8
+	// the maximum amount of headers sent back in a single headers message
+	maxHeadersPerMsg = 2000
+	// the score a peer gets for sending headers with an invalid PoW or that don't link together
+	invalidHeadersScore = 50
+	// the score a peer gets for a block that breaks the consensus rules, eg. an invalid PoW or transaction
+	invalidBlockScore = 50
 )
 
 var (
 	// unique port for each instance
 	nodeAddress string
+	// the id of the node the server runs for, names the files of the node
+	localNodeID string
+	// the services the node advertises in its version
+	localServices uint64
 	// unique port for the miner
 	mineAddress string
+	// ListenAddr the host:port the node listens on and advertises to peers, eg. [::1]:3001. Defaults to localhost with the node id as port
+	ListenAddr string
+	// CentralNode the address of the node that all other nodes connect to
+	CentralNode = "localhost:3001"
 	// KnownNodes contains all of the strings for the localhost addresses connected to this network
-	KnownNodes = []string{"localhost:3001"}
+	KnownNodes = NewPeerSet(defaultMaxPeers, CentralNode)
 	// blocks being sent from 1 client to another
-	blocksInTransit = [][]byte{}
+	downloads = NewDownloadManager()
+	// the peers that did not have the items we requested
+	notFound = newNotFoundTracker()
+	// headers downloaded without their block bodies
+	headerChain = NewHeaderChain()
+	// the block this node is currently mining
+	mining = &MiningJob{}
 	// keep record of blockchain transactions
 	memoryPool = make(map[string]blockchain.Transaction)
+	// the order in which the transactions arrived in memoryPool, used by the fifo sort policy
+	mempoolArrival = make(map[string]uint64)
+	mempoolSeq     uint64
+	// guards memoryPool and its arrival order, peers are handled on their own goroutines and the API reads the pool as well
+	mempoolMu sync.RWMutex
+	// the chain of the running server, see ServerChain
+	serverChain       *blockchain.Blockchain
+	serverChainMu     sync.Mutex
+	serverChainOpened = make(chan struct{})
+	serverChainOnce   sync.Once
+	// idle connections to other peers
+	pool = &ConnectionPool{}
+	// the goroutines that use the chain outside of a connection, the server waits for them before closing the database
+	chainTasks sync.WaitGroup
+	// Policy decides which transactions are accepted into the memory pool
+	Policy = MempoolPolicy{MinFee: 0, SortPolicy: SortByFeeRate}
+	// DrainTimeout how long the server waits for active connections to finish when shutting down
+	DrainTimeout = 30 * time.Second
+	// PingInterval how often the peers of accepted connections are pinged
+	PingInterval = 30 * time.Second
+	// PongTimeout how long a peer has to answer a ping before its connection is closed
+	PongTimeout = 10 * time.Second
+	// BanList the hosts that are banned and when their ban expires
+	BanList = make(map[string]time.Time)
+	// BanScore how much each host misbehaved. A host is banned once its score reaches BanThreshold
+	BanScore = make(map[string]int)
+	// BanThreshold the ban score at which a peer is banned
+	BanThreshold = 100
+	// BanDuration how long a peer is banned once it reaches the threshold
+	BanDuration = 24 * time.Hour
 )
 
 // Addr list of addresses that are connected to each of the nodes
@@ -69,6 +135,39 @@ type Block struct {
 	Block    []byte
 }
 
+// CompactBlock announces a new block with only the ids of its transactions
+//
+// the receiver already has most of the transactions in its memory pool, so it only requests the ones it is missing
+type CompactBlock struct {
+	AddrFrom string
+	Header   blockchain.BlockHeader
+	// the ids of every transaction, in the order of the block
+	TxIDs [][]byte
+	// transactions the receiver can't have, like the coinbase. Serialized
+	Prefilled []PrefilledTx
+}
+
+// PrefilledTx a transaction that is sent along with a compact block
+type PrefilledTx struct {
+	// index of the transaction in the block
+	Index       int
+	Transaction []byte
+}
+
+// GetMissingTxs requests the transactions of a compact block that are not in the memory pool
+type GetMissingTxs struct {
+	AddrFrom  string
+	BlockHash []byte
+	TxIDs     [][]byte
+}
+
+// MissingTxs the response to GetMissingTxs, the serialized transactions
+type MissingTxs struct {
+	AddrFrom     string
+	BlockHash    []byte
+	Transactions [][]byte
+}
+
 // GetBlocks get the blocks from one node and send them to another
 //
 // calling this will fetch the block chain from one node and copy it to another node
@@ -84,6 +183,26 @@ type GetData struct {
 	ID   []byte
 }
 
+// GetHeaders requests the headers of a list of block hashes
+type GetHeaders struct {
+	AddrFrom string
+	Hashes   [][]byte
+	// when no hashes are given, the headers from this height on are sent. Used by the headers first sync
+	FromHeight int
+}
+
+// Headers the response to GetHeaders
+type Headers struct {
+	AddrFrom string
+	Headers  []blockchain.BlockHeader
+}
+
+// Header a single block header, the response to GetData with the "header" type
+type Header struct {
+	AddrFrom string
+	Header   blockchain.BlockHeader
+}
+
 // Inv represents transactions or blocks
 type Inv struct {
 	AddrFrom string
@@ -92,6 +211,14 @@ type Inv struct {
 	Items [][]byte
 }
 
+// NotFound tells a peer that the requested blocks or transactions do not exist on this node
+type NotFound struct {
+	AddrFrom string
+	// transaction or block
+	Type  string
+	Items [][]byte
+}
+
 // Tx represents a transaction
 type Tx struct {
 	AddrFrom    string
@@ -111,36 +238,398 @@ type Version struct {
 	// the length of the actual chain (eg, chain is 4 blocks long)
 	BestHeight int
 	AddrFrom   string
+	// what the node can do for its peers, a combination of the Service bits
+	Services uint64
+}
+
+// the Service bits a node advertises in its version
+const (
+	// ServiceFullNode the node stores the whole chain and can send any block
+	ServiceFullNode uint64 = 1 << iota
+	// ServiceMiner the node mines the transactions it receives
+	ServiceMiner
+	// ServiceSPV the node only keeps headers and verifies transactions with merkle proofs
+	ServiceSPV
+)
+
+// ServiceNames returns readable names of the Service bits that are set, eg. [full miner]
+func ServiceNames(services uint64) []string {
+	var names []string
+	for _, service := range []struct {
+		bit  uint64
+		name string
+	}{{ServiceFullNode, "full"}, {ServiceMiner, "miner"}, {ServiceSPV, "spv"}} {
+		if services&service.bit != 0 {
+			names = append(names, service.name)
+		}
+	}
+	return names
+}
+
+// nodeServices returns the services a node advertises. Nodes with the whole chain are full nodes, the others are SPV nodes
+func nodeServices(minerAddress string, fullChain bool) uint64 {
+	services := ServiceSPV
+	if fullChain {
+		services = ServiceFullNode
+	}
+	if minerAddress != "" {
+		services |= ServiceMiner
+	}
+	return services
+}
+
+// NodeConfig settings of the node
+type NodeConfig struct {
+	// encrypts every connection to and from the node when set. All nodes of a network have to use TLS, or none of them
+	//
+	// when the config skips certificate verification, eg. for self signed certificates, the common name of the
+	// peer certificate still has to be the address that was dialed
+	TLSConfig *tls.Config
+	// downloads and validates the headers of a longer chain before any of its blocks, so a peer can't make us
+	// download blocks of a chain with an invalid PoW
+	HeadersFirst bool
+	// serves the node metrics for Prometheus
+	Metrics MetricsConfig
+	// the lowest level that is logged, change it on a running node with SetLogLevel
+	LogLevel slog.Level
+	// "json" logs every record as a JSON object, anything else logs text
+	LogFormat string
+	// the largest message in bytes a peer may send, larger messages close the connection. Defaults to 32MB
+	MaxMessageSize int
+	// how long an accepted connection may wait for the next message before it is closed. Defaults to 90 seconds, it has
+	// to stay above the idle timeout of the connection pool and PingInterval or idle connections are closed too early
+	ReadTimeout time.Duration
+	// how long connecting to a peer and writing a message to it may take. Default to 10 and 30 seconds
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
+	// how often sending a message to a peer is retried before the peer is removed. Defaults to DefaultRetryPolicy
+	Retry RetryPolicy
+	// the maximum amount of peers the node keeps, the central node included. Defaults to 125
+	MaxPeers int
+	// host names that resolve to the addresses of nodes, they are asked for peers when only the central node is known
+	DNSSeeds []string
+	// the port of the nodes behind DNSSeeds. Defaults to the port of the central node
+	DNSSeedPort string
+	// the maximum amount of transactions the node mines into a block, the coinbase not included. A miner mines once the
+	// memory pool holds this many transactions. Defaults to 2
+	MaxTxPerBlock int
+	// the network the node listens and dials on, eg. "tcp4" to only use IPv4. Defaults to "tcp"
+	Protocol string
+	// the protocol version the node sends in its version message. Defaults to 1
+	Version int
+}
+
+// DefaultNodeConfig returns the settings a node uses for the fields that are left empty
+func DefaultNodeConfig() NodeConfig {
+	return NodeConfig{
+		LogLevel:       slog.LevelInfo,
+		LogFormat:      "text",
+		MaxMessageSize: defaultMaxMessageSize,
+		ReadTimeout:    connReadTimeout,
+		DialTimeout:    defaultDialTimeout,
+		WriteTimeout:   defaultWriteTimeout,
+		Retry:          DefaultRetryPolicy,
+		MaxPeers:       defaultMaxPeers,
+		MaxTxPerBlock:  defaultMaxTxPerBlock,
+		Protocol:       defaultProtocol,
+		Version:        defaultProtocolVersion,
+	}
+}
+
+// maxTxPerBlock returns the maximum amount of transactions the node mines into a block
+func maxTxPerBlock() int {
+	if Config.MaxTxPerBlock > 0 {
+		return Config.MaxTxPerBlock
+	}
+	return defaultMaxTxPerBlock
+}
+
+// protocol returns the network the node listens and dials on
+func protocol() string {
+	if Config.Protocol != "" {
+		return Config.Protocol
+	}
+	return defaultProtocol
+}
+
+// protocolVersion returns the version the node sends to its peers
+func protocolVersion() int {
+	if Config.Version > 0 {
+		return Config.Version
+	}
+	return defaultProtocolVersion
+}
+
+// MetricsConfig settings of the metrics endpoint
+type MetricsConfig struct {
+	// serves /metrics on the API server, and on ListenAddr when it is set. The metrics are collected either way
+	Enabled bool
+	// the host:port of a separate metrics server, eg. localhost:9100
+	ListenAddr string
+}
+
+// Config the settings of the node, set them before the server starts
+var Config NodeConfig
+
+// the orders in which the transactions of the memory pool are mined
+const (
+	// SortByFeeRate mines the transactions with the highest fee per byte first
+	SortByFeeRate = "fee_rate"
+	// SortFIFO mines the transactions in the order they were added to the memory pool
+	SortFIFO = "fifo"
+)
+
+// MempoolPolicy the rules a transaction has to follow before it is added to the memory pool
+type MempoolPolicy struct {
+	// the minimum fee per byte of the serialized transaction. Zero accepts transactions without a fee
+	MinFee int
+	// the order in which transactions are mined, SortByFeeRate or SortFIFO. Empty sorts by fee rate
+	SortPolicy string
+}
+
+// Accepts checks if the fee of a transaction is high enough for the policy. A transaction that can't be serialized is never accepted
+func (p MempoolPolicy) Accepts(tx *blockchain.Transaction, fee int) bool {
+	data, err := tx.Serialize()
+	if err != nil {
+		return false
+	}
+	return fee >= p.MinFee*len(data)
 }
 
 // StartServer initializes the network. If there is no mineraddress then pass in an empty string
-func StartServer(nodeID, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+//
+// the optional config replaces Config, without it the server uses Config. The server shuts down gracefully on SIGINT or SIGTERM
+func StartServer(nodeID, minerAddress string, config ...NodeConfig) {
+	if len(config) > 0 {
+		Config = config[0]
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+		d.WaitForDeathWithFunc(cancel)
+	}()
+
+	StartServerWithContext(ctx, nodeID, minerAddress)
+}
+
+// StartServerWithContext initializes the network and serves until the context is cancelled
+//
+// on shutdown it stops accepting connections, waits up to DrainTimeout for the active connections and then closes the database
+func StartServerWithContext(ctx context.Context, nodeID, minerAddress string) {
+	setupLogging(nodeID)
+
+	// refuse to start a miner that would send its rewards to an invalid address
+	if minerAddress != "" {
+		if _, err := wallet.ValidateAddress(minerAddress); err != nil {
+			slog.Error("Invalid miner address", "address", minerAddress, "err", err)
+			panic(err)
+		}
+	}
+
+	nodeAddress = advertisedAddress(nodeID)
+	// catch typos in the listen address before the database is opened
+	if _, err := net.ResolveTCPAddr(protocol(), nodeAddress); err != nil {
+		slog.Error("Invalid listen address", "address", nodeAddress, "err", err)
+		panic(err)
+	}
 	mineAddress = minerAddress
+	localNodeID = nodeID
 
-	ln, err := net.Listen(protocol, nodeAddress)
+	// bans survive restarts
+	bans, err := LoadBans(nodeID)
 	if err != nil {
-		log.Panic(err)
+		slog.Error("Could not load the bans", "err", err)
+		panic(err)
+	}
+	bansMu.Lock()
+	for host, until := range bans {
+		BanList[host] = until
+	}
+	bansMu.Unlock()
+
+	// peers survive restarts as well. Peers that went away are removed the first time a message to them fails
+	peers, err := LoadPeers(nodeID)
+	if err != nil {
+		slog.Error("Could not load the peers", "err", err)
+	}
+	KnownNodes.SetMax(Config.MaxPeers)
+	var newPeers []string
+	for _, addr := range peers {
+		if !sameAddress(addr, nodeAddress) && !IsBanned(addr) && !KnownNodes.Contains(addr) {
+			newPeers = append(newPeers, addr)
+		}
+	}
+	// when there are more peers than the node accepts, the least recently seen are left out
+	if remaining := KnownNodes.Remaining(); len(newPeers) > remaining {
+		newPeers = newPeers[:remaining]
+	}
+	// the file starts with the most recently seen peer, add it last so it is in front again
+	for i := len(newPeers) - 1; i >= 0; i-- {
+		KnownNodes.Add(newPeers[i])
 	}
-	defer ln.Close()
 
 	// the nodeID helps us identify which blockchain belongs to which client
-	chain := blockchain.Continue(nodeID)
-	defer chain.Database.Close()
-	go CloseDB(chain)
+	chain, err := blockchain.Continue(nodeID)
+	if err != nil {
+		slog.Error("Could not open the blockchain", "err", err)
+		panic(err)
+	}
+	serverChainMu.Lock()
+	serverChain = chain
+	serverChainMu.Unlock()
+	serverChainOnce.Do(func() { close(serverChainOpened) })
+	// the server opened the whole chain, so it can serve every block
+	localServices = nodeServices(minerAddress, true)
+
+	// unconfirmed transactions survive restarts
+	if err := LoadMempool(nodeID); err != nil {
+		slog.Error("Could not load the memory pool", "err", err)
+	}
+
+	initMetrics(chain)
+	go logReorgs(ctx, chain)
+	go downloads.Run(ctx)
+
+	ln, err := listen(nodeAddress)
+	if err != nil {
+		chain.Database.Close()
+		slog.Error("Could not listen", "address", nodeAddress, "err", err)
+		panic(err)
+	}
+	slog.Info("Node started", "address", nodeAddress, "miner", minerAddress)
+
+	// a new node only knows the central node, the DNS seeds find it more peers
+	if KnownNodes.Len() == 1 && KnownNodes.Contains(CentralNode) && len(Config.DNSSeeds) > 0 {
+		bootstrapFromDNS()
+	}
 
 	// if the node is not the central node. Then we want to request to get the most up to date information from the central node
-	if nodeAddress != KnownNodes[0] {
-		SendVersion(KnownNodes[0], chain)
+	// the seeds are contacted in the background so the node can accept connections while it retries
+	if !isCentralNode(nodeAddress) {
+		chainTasks.Add(1)
+		go func() {
+			defer chainTasks.Done()
+			startupSync(ctx, chain)
+		}()
 	}
 
+	// closing the listener unblocks Accept
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	conns := newConnTracker()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Panic(err)
+			if ctx.Err() != nil {
+				break
+			}
+			slog.Error("Could not accept a connection", "err", err)
+			panic(err)
 		}
-		go HandleConnection(conn, chain)
 
+		conns.Add(conn)
+		// ping the peer so a peer that went away silently doesn't keep the connection open
+		alive := newKeepAlive(conn)
+		go alive.run(ctx)
+		go func() {
+			defer conns.Done(conn)
+			defer alive.stop()
+			handleConnection(conn, chain, alive)
+		}()
+	}
+
+	slog.Info("Shutting down, waiting for active connections")
+	drain(conns, DrainTimeout)
+	// the syncs with the seed nodes use the chain as well
+	chainTasks.Wait()
+
+	pool.CloseAll()
+
+	if err := SaveMempool(nodeID); err != nil {
+		slog.Error("Could not save the memory pool", "err", err)
+	}
+	if err := SavePeers(nodeID); err != nil {
+		slog.Error("Could not save the peers", "err", err)
+	}
+
+	// flush everything to disk before the database is closed
+	if err := chain.Database.Sync(); err != nil {
+		slog.Error("Could not sync the database", "err", err)
+	}
+	chain.Database.Close()
+}
+
+// drain waits up to the timeout for the active connections to finish, then closes the remaining ones
+//
+// returns once every connection handler returned, a handler that is still adding a block needs the database
+func drain(conns *connTracker, timeout time.Duration) {
+	if conns.Wait(timeout) {
+		return
+	}
+
+	slog.Info("Drain timeout reached, closing remaining connections", "timeout", timeout)
+	// a block being mined would keep its connection busy
+	mining.Cancel()
+	conns.CloseAll()
+	conns.wg.Wait()
+}
+
+// connTracker keeps track of the active connections so the server can wait for them on shutdown
+type connTracker struct {
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]struct{})}
+}
+
+// Add starts tracking a connection
+func (t *connTracker) Add(conn net.Conn) {
+	t.wg.Add(1)
+	t.mu.Lock()
+	t.conns[conn] = struct{}{}
+	t.mu.Unlock()
+}
+
+// Done stops tracking a connection once it has been handled
+func (t *connTracker) Done(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// Wait waits for the active connections to finish. Returns false if the timeout was reached first
+func (t *connTracker) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// CloseAll force closes the remaining connections
+func (t *connTracker) CloseAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for conn := range t.conns {
+		conn.Close()
 	}
 }
 
@@ -149,58 +638,185 @@ func StartServer(nodeID, minerAddress string) {
 func MineTx(chain *blockchain.Blockchain) {
 	var txs []*blockchain.Transaction
 
+	// without a miner address the coinbase reward would be lost
+	if mineAddress == "" {
+		slog.Error("Cannot mine without a miner address")
+		return
+	}
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		slog.Error("Could not read the best height", "err", err)
+		return
+	}
+	now := time.Now().Unix()
+
 	// take each tx from the memory pool and verify them
-	for id := range memoryPool {
-		fmt.Printf("tx: %s\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
+	for _, tx := range MempoolTransactions() {
+		tx := tx
+		valid, err := chain.VerifyTransaction(&tx)
+		if err != nil {
+			slog.Error("Could not verify the transaction", "txID", hex.EncodeToString(tx.ID), "err", err)
+			continue
+		}
+		// locked transactions stay in the pool until they can be mined
+		if !tx.IsMatured(height+1, now) {
+			continue
+		}
+		if valid {
 			txs = append(txs, &tx)
+		} else {
+			slog.Info("Skipped an invalid transaction", "txID", hex.EncodeToString(tx.ID))
 		}
 	}
 
 	// if no txs were successfully verified then we know they are all invalid and should be ignored
 	if len(txs) == 0 {
-		fmt.Println("All Transactions are invalid")
+		slog.Info("All transactions are invalid")
+		return
+	}
+
+	// the block only has room for maxTxPerBlock transactions, the others wait for the next block
+	txs = Policy.order(chain, txs)
+	if limit := maxTxPerBlock(); len(txs) > limit {
+		txs = txs[:limit]
+	}
+
+	// the miner collects the fees of every transaction in the block
+	fees, err := chain.TotalFees(txs)
+	if err != nil {
+		slog.Error("Could not calculate the fees", "err", err)
 		return
 	}
 
 	// create a new coinbase transaction with the miner address
-	cbTx := blockchain.CoinbaseTx(mineAddress, "")
+	cbTx, err := blockchain.CoinbaseTxWithHeight(mineAddress, "", height+1, fees)
+	if err != nil {
+		slog.Error("Could not create the coinbase transaction", "err", err)
+		return
+	}
 	// add the coinbase tx to the tx slice
 	txs = append(txs, cbTx)
 
 	// create a new block, add it to the UTXO and reindex
-	newBlock := chain.MineBlock(txs)
+	//
+	// the mining is cancelled when a peer sends a block for the same height first
+	ctx, ok := mining.Start(height + 1)
+	if !ok {
+		// the transactions stay in the pool for the next block
+		slog.Info("Already mining a block, the transactions wait for the next one", "height", height+1)
+		return
+	}
+	newBlock, err := chain.MineBlockWithProgress(ctx, txs, func(nonce int, hash []byte) {
+		slog.Debug("Mining", "height", height+1, "nonce", nonce, "hash", hex.EncodeToString(hash))
+	})
+	mining.Done()
+	if err == context.Canceled {
+		slog.Info("Received the block from a peer, stopped mining", "height", height+1)
+		return
+	}
+	if errors.Is(err, blockchain.ErrStaleTip) {
+		slog.Info("The chain moved on while mining, dropped the block", "height", height+1)
+		return
+	}
+	if err != nil {
+		slog.Error("Could not mine the block", "height", height+1, "err", err)
+		return
+	}
 
-	UTXOSet := blockchain.NewUTXOSet(chain)
-	UTXOSet.Reindex()
+	UTXOSet, err := blockchain.NewUTXOSet(chain)
+	if err != nil {
+		slog.Error("Could not open the UTXO set", "err", err)
+		return
+	}
+	// the block is already stored, so it is still announced when the reindex fails
+	if err := UTXOSet.Reindex(); err != nil {
+		slog.Error("Could not reindex the UTXO set", "err", err)
+	}
 
-	fmt.Println("New Block mined")
+	slog.Info("Mined a new block", "blockHash", hex.EncodeToString(newBlock.Hash), "height", newBlock.Height, "transactions", len(newBlock.Transactions))
 
 	// Delete all of the transactions from the memory pool now that they are part of the blockchain
-	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
-	}
+	remaining := removeFromMempool(txs)
 
-	// send the new block to all of the known nodes
-	for _, node := range KnownNodes {
+	// send the new block to all of the known nodes. They have most transactions already, so only the ids are sent
+	for _, node := range KnownNodes.All() {
 		if node != nodeAddress {
-			SendInv(node, "block", [][]byte{newBlock.Hash})
+			SendCompactBlock(node, newBlock)
 		}
 	}
 
 	//  if the memory pool still has items in it, we can recursively call MineTx
-	if len(memoryPool) > 0 {
+	if remaining > 0 {
 		MineTx(chain)
 	}
 }
 
+// logReorgs logs the reorganizations of the chain until the context is cancelled
+func logReorgs(ctx context.Context, chain *blockchain.Blockchain) {
+	reorgs := chain.Reorgs()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case reorg := <-reorgs:
+			slog.Warn("Reorganized the chain", "oldTip", hex.EncodeToString(reorg.OldTip), "newTip", hex.EncodeToString(reorg.NewTip),
+				"commonAncestor", hex.EncodeToString(reorg.CommonAncestor), "disconnected", len(reorg.Disconnected), "connected", len(reorg.Connected))
+		}
+	}
+}
+
+// initMetrics sets the metrics that describe the chain and starts the metrics server when it is configured
+func initMetrics(chain *blockchain.Blockchain) {
+	if height, err := chain.GetBestHeight(); err == nil {
+		metrics.ChainHeight.Set(float64(height))
+	}
+	if UTXOSet, err := blockchain.NewUTXOSet(chain); err == nil {
+		// sets the metric of the UTXO set
+		if _, err := UTXOSet.CountTransactions(); err != nil {
+			slog.Error("Could not count the UTXO set", "err", err)
+		}
+	}
+	countPeers()
+
+	if !Config.Metrics.Enabled || Config.Metrics.ListenAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	go func() {
+		if err := http.ListenAndServe(Config.Metrics.ListenAddr, mux); err != nil {
+			slog.Error("Metrics server stopped", "address", Config.Metrics.ListenAddr, "err", err)
+		}
+	}()
+}
+
+// countPeers updates the peer metric, call it after KnownNodes changed
+func countPeers() {
+	metrics.PeerCount.Set(float64(KnownNodes.Len()))
+}
+
+// ServerChain waits until the server opened the chain of the node and returns it
+//
+// badger allows a single writable handle, so services that run next to the server, like the API, have to share its chain
+func ServerChain(ctx context.Context) (*blockchain.Blockchain, error) {
+	select {
+	case <-serverChainOpened:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	serverChainMu.Lock()
+	defer serverChainMu.Unlock()
+	return serverChain, nil
+}
+
 // RequestBlocks iterates through the known nodes and requests blocks from each node
 //
 // it makes sure all of the blockchains are synced with one another
 func RequestBlocks() {
-	for _, node := range KnownNodes {
+	for _, node := range KnownNodes.All() {
 		SendGetBlocks(node)
 	}
 }
@@ -237,30 +853,192 @@ func GobEncode(data interface{}) []byte {
 	enc := gob.NewEncoder(&buff)
 	err := enc.Encode(data)
 	if err != nil {
-		log.Panic(err)
+		slog.Error("Could not encode a message", "err", err)
+		panic(err)
 	}
 
 	return buff.Bytes()
 }
 
-// NodeIsKnown checks to see if we have a  node recorded or not
-func NodeIsKnown(addr string) bool {
-	for _, node := range KnownNodes {
-		if node == addr {
-			return true
+// Envelope wraps every message payload with the version it was encoded with
+//
+// when a message struct gains new fields, handlers can check the version to know if the fields are present
+type Envelope struct {
+	Version byte
+	Payload []byte
+}
+
+// EncodeMessage encodes the payload and wraps it in a versioned envelope
+func EncodeMessage(version byte, payload interface{}) []byte {
+	return GobEncode(Envelope{version, GobEncode(payload)})
+}
+
+// DecodeMessage unwraps the envelope and decodes the payload into out. Returns the version of the message
+//
+// messages without an envelope are decoded as plain gob, the way nodes from before the envelope send them, and have the
+// legacyMessageVersion
+func DecodeMessage(data []byte, out interface{}) (byte, error) {
+	var envelope Envelope
+
+	// none of the message structs has a Payload field, so a plain gob message never decodes into an envelope
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&envelope)
+	if err != nil || envelope.Version == legacyMessageVersion {
+		if legacyErr := gob.NewDecoder(bytes.NewReader(data)).Decode(out); legacyErr != nil {
+			if err == nil {
+				err = legacyErr
+			}
+			return 0, err
 		}
+		return legacyMessageVersion, nil
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(envelope.Payload)).Decode(out); err != nil {
+		return envelope.Version, err
 	}
 
-	return false
+	return envelope.Version, nil
 }
 
-// CloseDB shuts down the database and quits the application in the event of a shutdown
-func CloseDB(chain *blockchain.Blockchain) {
-	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+// legacyPeers the addresses of the peers that sent their version without an envelope. Those nodes are also from before the
+// framing, so they get every message without an envelope and without a length prefix
+var legacyPeers sync.Map
 
-	d.WaitForDeathWithFunc(func() {
-		defer os.Exit(1)
-		defer runtime.Goexit()
-		chain.Database.Close()
-	})
+// setLegacyPeer records whether a peer only understands messages without an envelope
+func setLegacyPeer(addr string, legacy bool) {
+	if legacy {
+		legacyPeers.Store(addr, true)
+	} else {
+		legacyPeers.Delete(addr)
+	}
+}
+
+// isLegacyPeer checks if a peer only understands messages without an envelope
+func isLegacyPeer(addr string) bool {
+	_, ok := legacyPeers.Load(addr)
+	return ok
+}
+
+// legacyMessage strips the envelope of a message, leaving the command and the plain gob payload
+func legacyMessage(data []byte) ([]byte, error) {
+	if len(data) < commandLength {
+		return nil, fmt.Errorf("message is too short: %d bytes", len(data))
+	}
+
+	var envelope Envelope
+	if err := gob.NewDecoder(bytes.NewReader(data[commandLength:])).Decode(&envelope); err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, data[:commandLength]...), envelope.Payload...), nil
+}
+
+// LookupFn resolves the host names of the DNS seeds, replace it to resolve them another way
+var LookupFn = net.LookupHost
+
+// DNSSeedBootstrap resolves the seed host names and returns the addresses of the nodes behind them with the port appended
+//
+// the addresses are deduplicated, and invalid or unspecified IPs are dropped. A seed that can't be resolved is skipped, an error
+// is only returned when none of the seeds could be resolved
+func DNSSeedBootstrap(seeds []string, port string) ([]string, error) {
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+
+	var addrs []string
+	var lastErr error
+	resolved := false
+	seen := make(map[string]bool)
+	for _, seed := range seeds {
+		hosts, err := LookupFn(seed)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resolved = true
+
+		for _, host := range hosts {
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsUnspecified() {
+				continue
+			}
+			addr := net.JoinHostPort(ip.String(), port)
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	if !resolved && lastErr != nil {
+		return nil, lastErr
+	}
+	return addrs, nil
+}
+
+// bootstrapFromDNS adds the nodes of the configured DNS seeds to the known nodes, leaving out this node and banned hosts
+func bootstrapFromDNS() {
+	port := Config.DNSSeedPort
+	if port == "" {
+		_, port, _ = net.SplitHostPort(CentralNode)
+	}
+
+	addrs, err := DNSSeedBootstrap(Config.DNSSeeds, port)
+	if err != nil {
+		slog.Error("Could not resolve the DNS seeds", "seeds", Config.DNSSeeds, "err", err)
+		return
+	}
+
+	added := 0
+	for _, addr := range addrs {
+		if sameAddress(addr, nodeAddress) || IsBanned(addr) {
+			continue
+		}
+		if !KnownNodes.Add(addr) {
+			slog.Info("Peer limit reached, ignoring the remaining DNS seed addresses")
+			break
+		}
+		added++
+	}
+	countPeers()
+	slog.Info("Resolved the DNS seeds", "seeds", len(Config.DNSSeeds), "addresses", added)
+}
+
+// isCentralNode checks if the address belongs to the central node
+//
+// the central node can be reached over IPv4 and IPv6 loopback, so localhost:3001, 127.0.0.1:3001 and [::1]:3001 are the same node
+func isCentralNode(addr string) bool {
+	return sameAddress(addr, CentralNode)
+}
+
+// sameAddress checks if 2 addresses belong to the same node. Loopback hosts with the same port are the same node
+func sameAddress(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	hostA, portA, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	hostB, portB, err := net.SplitHostPort(b)
+	if err != nil {
+		return false
+	}
+
+	return portA == portB && isLoopback(hostA) && isLoopback(hostB)
+}
+
+// isLoopback checks if the host is the local machine
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// NodeIsKnown checks to see if we have a  node recorded or not
+func NodeIsKnown(addr string) bool {
+	return KnownNodes.Contains(addr)
 }
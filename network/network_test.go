@@ -0,0 +1,82 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeMessageReadsEnvelopes(t *testing.T) {
+	sent := Version{Version: 1, BestHeight: 5, AddrFrom: "localhost:3000", Services: ServiceFullNode}
+
+	var received Version
+	version, err := DecodeMessage(EncodeMessage(messageVersion, sent), &received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != messageVersion {
+		t.Errorf("version %d, want %d", version, messageVersion)
+	}
+	if received != sent {
+		t.Errorf("received %+v, want %+v", received, sent)
+	}
+}
+
+func TestDecodeMessageReadsLegacyMessages(t *testing.T) {
+	// nodes from before the envelope sent the payload as plain gob
+	payloads := []struct {
+		sent     interface{}
+		received interface{}
+	}{
+		{Version{Version: 1, BestHeight: 5, AddrFrom: "localhost:3000"}, &Version{}},
+		{Addr{[]string{"localhost:3000", "localhost:3001"}}, &Addr{}},
+		{Inv{"localhost:3000", "block", [][]byte{[]byte("hash")}}, &Inv{}},
+		{GetData{"localhost:3000", "tx", []byte("id")}, &GetData{}},
+	}
+
+	for _, p := range payloads {
+		version, err := DecodeMessage(GobEncode(p.sent), p.received)
+		if err != nil {
+			t.Fatalf("%T: %v", p.sent, err)
+		}
+		if version != legacyMessageVersion {
+			t.Errorf("%T: version %d, want the legacy version", p.sent, version)
+		}
+		if got := reflect.ValueOf(p.received).Elem().Interface(); !reflect.DeepEqual(got, p.sent) {
+			t.Errorf("received %+v, want %+v", got, p.sent)
+		}
+	}
+}
+
+func TestLegacyMessageStripsTheEnvelope(t *testing.T) {
+	payload := Addr{[]string{"localhost:3000"}}
+
+	legacy, err := legacyMessage(append(CmdToBytes("addr"), EncodeMessage(messageVersion, payload)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(CmdToBytes("addr"), GobEncode(payload)...); !bytes.Equal(legacy, want) {
+		t.Errorf("legacy message %x, want %x", legacy, want)
+	}
+}
+
+func TestHandleMessageRejectsMalformedMessages(t *testing.T) {
+	messages := [][]byte{
+		[]byte("inv"),
+		append(CmdToBytes("inv"), []byte("not a gob message")...),
+		append(CmdToBytes("version"), EncodeMessage(messageVersion, Addr{[]string{"localhost:3000"}})[:10]...),
+		append(CmdToBytes("getdata"), 0xff, 0xff, 0xff),
+		// decodable, but a node never sends them
+		append(CmdToBytes("inv"), EncodeMessage(messageVersion, Inv{AddrFrom: "localhost:3000", Type: "tx"})...),
+		append(CmdToBytes("inv"), EncodeMessage(messageVersion, Inv{AddrFrom: "localhost:3000", Type: "block"})...),
+		append(CmdToBytes("getheaders"), EncodeMessage(messageVersion, GetHeaders{AddrFrom: "localhost:3000", FromHeight: -1})...),
+	}
+
+	for _, message := range messages {
+		var malformed malformedMessage
+		if err := HandleMessage(message, nil); !errors.As(err, &malformed) {
+			t.Errorf("HandleMessage(%x) returned %v, want a malformed message", message, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package network
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	// the amount of peers an item is requested from before we give up on it
+	maxNotFoundAttempts = 3
+	// how long the peers that did not have an item are remembered
+	notFoundExpiry = 10 * time.Minute
+)
+
+// notFoundTracker remembers the peers that answered notfound for an item, so the item is not requested from them again
+type notFoundTracker struct {
+	mu sync.Mutex
+	// type and hex id of the item -> the peers that did not have it
+	items map[string]*notFoundItem
+}
+
+type notFoundItem struct {
+	tried map[string]bool
+	since time.Time
+}
+
+// newNotFoundTracker creates an empty tracker
+func newNotFoundTracker() *notFoundTracker {
+	return &notFoundTracker{items: make(map[string]*notFoundItem)}
+}
+
+// next records that the peer did not have the item and picks the next peer to request it from out of the candidates
+//
+// returns false once the item was requested from maxNotFoundAttempts peers or every candidate was tried. The item is
+// forgotten then, so a later request for it starts over
+func (t *notFoundTracker) next(kind string, id []byte, from string, candidates []string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire()
+
+	key := kind + ":" + hex.EncodeToString(id)
+	item, ok := t.items[key]
+	if !ok {
+		item = &notFoundItem{tried: make(map[string]bool), since: time.Now()}
+		t.items[key] = item
+	}
+	item.tried[from] = true
+
+	if len(item.tried) < maxNotFoundAttempts {
+		for _, peer := range candidates {
+			if peer != nodeAddress && !item.tried[peer] {
+				return peer, true
+			}
+		}
+	}
+
+	delete(t.items, key)
+	return "", false
+}
+
+// expire forgets the items that were first not found a while ago. The lock must be held
+func (t *notFoundTracker) expire() {
+	for key, item := range t.items {
+		if time.Since(item.since) > notFoundExpiry {
+			delete(t.items, key)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package network
+
+import "testing"
+
+func TestNotFoundTrackerSkipsTriedPeers(t *testing.T) {
+	tracker := newNotFoundTracker()
+	id := []byte("block hash")
+	peers := []string{"localhost:3001", "localhost:3002", "localhost:3003", "localhost:3004"}
+
+	peer, ok := tracker.next("block", id, "localhost:3001", peers)
+	if !ok || peer != "localhost:3002" {
+		t.Fatalf("next peer %q %v, want localhost:3002", peer, ok)
+	}
+	peer, ok = tracker.next("block", id, peer, peers)
+	if !ok || peer != "localhost:3003" {
+		t.Fatalf("next peer %q %v, want localhost:3003", peer, ok)
+	}
+
+	// the third peer without the block is the last attempt, even though a fourth peer is known
+	if peer, ok := tracker.next("block", id, peer, peers); ok {
+		t.Errorf("the block was requested from %s after %d attempts", peer, maxNotFoundAttempts)
+	}
+
+	// giving up forgets the block, so a new request starts over
+	if peer, ok := tracker.next("block", id, "localhost:3001", peers); !ok || peer != "localhost:3002" {
+		t.Errorf("next peer after giving up %q %v, want localhost:3002", peer, ok)
+	}
+}
+
+func TestNotFoundTrackerGivesUpWhenEveryPeerWasTried(t *testing.T) {
+	tracker := newNotFoundTracker()
+	id := []byte("tx id")
+	peers := []string{"localhost:3001", "localhost:3002"}
+
+	peer, ok := tracker.next("tx", id, "localhost:3001", peers)
+	if !ok || peer != "localhost:3002" {
+		t.Fatalf("next peer %q %v, want localhost:3002", peer, ok)
+	}
+	if peer, ok := tracker.next("tx", id, peer, peers); ok {
+		t.Errorf("the tx was requested from %s after every peer was tried", peer)
+	}
+}
+
+func TestNotFoundTrackerKeepsItemTypesApart(t *testing.T) {
+	tracker := newNotFoundTracker()
+	id := []byte("hash")
+	peers := []string{"localhost:3001", "localhost:3002"}
+
+	tracker.next("block", id, "localhost:3001", peers)
+	if peer, ok := tracker.next("header", id, "localhost:3002", peers); !ok || peer != "localhost:3001" {
+		t.Errorf("next peer for the header %q %v, want localhost:3001", peer, ok)
+	}
+}
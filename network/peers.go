@@ -0,0 +1,353 @@
+package network
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxKnownNodes the maximum amount of peers a node will keep track of. Protects long running nodes from running out of memory
+	maxKnownNodes = 1000
+	// defaultMaxPeers the amount of peers a node accepts when NodeConfig.MaxPeers is not set
+	defaultMaxPeers = 125
+	// the known nodes are stored on shutdown, so a node doesn't have to discover its peers again after a restart
+	peersFile = "./tmp/peers_%s.json"
+)
+
+// peer an entry in the known nodes list
+type peer struct {
+	Addr     string
+	LastSeen time.Time
+}
+
+// NodeList a fixed capacity list of peer addresses
+//
+// the list is ordered by when the peer was last seen. When the list is full, the least recently seen peer is evicted
+// a doubly linked list keeps the order and a map allows us to find an entry without walking the list
+type NodeList struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+// NewNodeList creates an empty node list that holds up to capacity addresses
+func NewNodeList(capacity int, addrs ...string) *NodeList {
+	nodes := &NodeList{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	for _, addr := range addrs {
+		nodes.Add(addr)
+	}
+
+	return nodes
+}
+
+// Add adds an address to the list. If the address is already known, its last seen time is updated instead
+func (nodes *NodeList) Add(addr string) {
+	nodes.mu.Lock()
+	defer nodes.mu.Unlock()
+
+	// the peer is already known, move it to the front
+	if el, ok := nodes.entries[addr]; ok {
+		el.Value.(*peer).LastSeen = time.Now()
+		nodes.order.MoveToFront(el)
+		return
+	}
+
+	// make room by evicting the least recently seen peer. The central node is never evicted
+	if nodes.order.Len() >= nodes.capacity {
+		oldest := nodes.order.Back()
+		if oldest != nil && isCentralNode(oldest.Value.(*peer).Addr) {
+			oldest = oldest.Prev()
+		}
+		if oldest != nil {
+			nodes.order.Remove(oldest)
+			delete(nodes.entries, oldest.Value.(*peer).Addr)
+		}
+	}
+
+	nodes.entries[addr] = nodes.order.PushFront(&peer{addr, time.Now()})
+}
+
+// Remove removes an address from the list
+func (nodes *NodeList) Remove(addr string) {
+	nodes.mu.Lock()
+	defer nodes.mu.Unlock()
+
+	if el, ok := nodes.entries[addr]; ok {
+		nodes.order.Remove(el)
+		delete(nodes.entries, addr)
+	}
+}
+
+// Contains checks whether the address is in the list
+func (nodes *NodeList) Contains(addr string) bool {
+	nodes.mu.Lock()
+	defer nodes.mu.Unlock()
+
+	_, ok := nodes.entries[addr]
+	return ok
+}
+
+// Len returns the amount of known addresses
+func (nodes *NodeList) Len() int {
+	nodes.mu.Lock()
+	defer nodes.mu.Unlock()
+
+	return nodes.order.Len()
+}
+
+// All returns a copy of every known address, starting with the most recently seen
+func (nodes *NodeList) All() []string {
+	nodes.mu.Lock()
+	defer nodes.mu.Unlock()
+
+	addrs := make([]string, 0, nodes.order.Len())
+	for el := nodes.order.Front(); el != nil; el = el.Next() {
+		addrs = append(addrs, el.Value.(*peer).Addr)
+	}
+
+	return addrs
+}
+
+// GetRandomPeers returns a random sample of up to n known addresses. Used for gossiping and broadcasting transactions
+func (nodes *NodeList) GetRandomPeers(n int) []string {
+	addrs := nodes.All()
+	if n < 0 {
+		n = 0
+	}
+
+	rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+
+	if n < len(addrs) {
+		addrs = addrs[:n]
+	}
+
+	return addrs
+}
+
+// PeerInfo a peer and what it told us about itself in its version
+type PeerInfo struct {
+	Addr string `json:"addr"`
+	// the Service bits of the peer, zero until the peer sent its version
+	Services   uint64 `json:"services"`
+	BestHeight int    `json:"bestHeight"`
+}
+
+// UnmarshalJSON also reads a plain address, the peers file used to only hold the addresses
+func (info *PeerInfo) UnmarshalJSON(data []byte) error {
+	var addr string
+	if err := json.Unmarshal(data, &addr); err == nil {
+		*info = PeerInfo{Addr: addr}
+		return nil
+	}
+
+	type plain PeerInfo
+	return json.Unmarshal(data, (*plain)(info))
+}
+
+// PeerSet the peers of the node, it refuses new peers once it holds max of them
+//
+// unlike the NodeList it wraps, a full set doesn't evict anyone. Peers make room by failing and being removed
+type PeerSet struct {
+	// makes checking the capacity and adding a peer one step
+	mu    sync.RWMutex
+	nodes *NodeList
+	max   int
+	// what the peers told us in their version, keyed by address
+	info map[string]PeerInfo
+}
+
+// NewPeerSet creates a peer set that holds up to max addresses
+func NewPeerSet(max int, addrs ...string) *PeerSet {
+	peers := &PeerSet{nodes: NewNodeList(maxKnownNodes), max: max, info: make(map[string]PeerInfo)}
+	for _, addr := range addrs {
+		peers.Add(addr)
+	}
+
+	return peers
+}
+
+// Add adds an address to the set, or updates when it was last seen if it is already there
+//
+// returns false when the address is new and the set is full
+func (peers *PeerSet) Add(addr string) bool {
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+
+	if !peers.nodes.Contains(addr) && peers.nodes.Len() >= peers.max {
+		return false
+	}
+	peers.nodes.Add(addr)
+	return true
+}
+
+// AddPeer adds a peer like Add and stores its services and best height. Returns false when the set is full
+func (peers *PeerSet) AddPeer(info PeerInfo) bool {
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+
+	if !peers.nodes.Contains(info.Addr) && peers.nodes.Len() >= peers.max {
+		return false
+	}
+	peers.nodes.Add(info.Addr)
+	peers.info[info.Addr] = info
+	return true
+}
+
+// Remove removes an address from the set
+func (peers *PeerSet) Remove(addr string) {
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+
+	peers.nodes.Remove(addr)
+	delete(peers.info, addr)
+}
+
+// Contains checks whether the address is in the set
+func (peers *PeerSet) Contains(addr string) bool {
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+
+	return peers.nodes.Contains(addr)
+}
+
+// Len returns the amount of peers in the set
+func (peers *PeerSet) Len() int {
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+
+	return peers.nodes.Len()
+}
+
+// Remaining returns how many new peers the set still accepts
+func (peers *PeerSet) Remaining() int {
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+
+	if remaining := peers.max - peers.nodes.Len(); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// SetMax changes how many peers the set holds, values below 1 are ignored. Peers above a lowered limit are kept until they are removed
+func (peers *PeerSet) SetMax(max int) {
+	if max < 1 {
+		return
+	}
+	if max > maxKnownNodes {
+		max = maxKnownNodes
+	}
+
+	peers.mu.Lock()
+	peers.max = max
+	peers.mu.Unlock()
+}
+
+// All returns a copy of every address in the set, starting with the most recently seen
+func (peers *PeerSet) All() []string {
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+
+	return peers.nodes.All()
+}
+
+// Peers returns every peer in the set with what it told us about itself, starting with the most recently seen
+func (peers *PeerSet) Peers() []PeerInfo {
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+
+	addrs := peers.nodes.All()
+	infos := make([]PeerInfo, 0, len(addrs))
+	for _, addr := range addrs {
+		info, ok := peers.info[addr]
+		if !ok {
+			info = PeerInfo{Addr: addr}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// GetRandomPeers returns a random sample of up to n addresses in the set
+func (peers *PeerSet) GetRandomPeers(n int) []string {
+	peers.mu.RLock()
+	defer peers.mu.RUnlock()
+
+	return peers.nodes.GetRandomPeers(n)
+}
+
+// SavePeers writes the known nodes and their services to the peers file of the node as a JSON array, the most recently seen first
+func SavePeers(nodeID string) error {
+	data, err := json.Marshal(KnownNodes.Peers())
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fmt.Sprintf(peersFile, nodeID), data, 0644)
+}
+
+// savePeers writes the peers file while the server runs, so getpeers sees the services of new peers. Nothing is written before the server started
+func savePeers() {
+	if localNodeID == "" {
+		return
+	}
+	if err := SavePeers(localNodeID); err != nil {
+		slog.Error("Could not save the peers", "err", err)
+	}
+}
+
+// LoadPeers reads the addresses in the peers file of the node. Duplicates are left out and a missing file means no peers were saved
+func LoadPeers(nodeID string) ([]string, error) {
+	infos, err := LoadPeerInfo(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]string, 0, len(infos))
+	for _, info := range infos {
+		peers = append(peers, info.Addr)
+	}
+	return peers, nil
+}
+
+// LoadPeerInfo reads the peers file of the node with the services the peers advertised when they were saved
+func LoadPeerInfo(nodeID string) ([]PeerInfo, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf(peersFile, nodeID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved []PeerInfo
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+
+	peers := make([]PeerInfo, 0, len(saved))
+	seen := make(map[string]bool, len(saved))
+	for _, info := range saved {
+		if info.Addr == "" || seen[info.Addr] {
+			continue
+		}
+		seen[info.Addr] = true
+		peers = append(peers, info)
+	}
+	return peers, nil
+}
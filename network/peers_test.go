@@ -0,0 +1,104 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestPeersFileRoundTrips(t *testing.T) {
+	inNodeDir(t)
+	defer minerNode(t, NodeConfig{}, "")()
+
+	KnownNodes = NewPeerSet(defaultMaxPeers, "localhost:3001", "10.0.0.1:3000")
+	KnownNodes.AddPeer(PeerInfo{Addr: "10.0.0.2:3000", Services: ServiceFullNode | ServiceMiner, BestHeight: 7})
+	if err := SavePeers("3002"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the most recently seen peer comes first
+	peers, err := LoadPeers("3002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.2:3000", "10.0.0.1:3000", "localhost:3001"}; fmt.Sprint(peers) != fmt.Sprint(want) {
+		t.Errorf("loaded %v, want %v", peers, want)
+	}
+	infos, err := LoadPeerInfo("3002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (PeerInfo{Addr: "10.0.0.2:3000", Services: ServiceFullNode | ServiceMiner, BestHeight: 7}); len(infos) != 3 || infos[0] != want {
+		t.Errorf("loaded %+v, want the services of %+v", infos, want)
+	}
+
+	// a node that never saved its peers has none
+	if peers, err := LoadPeers("3003"); err != nil || len(peers) != 0 {
+		t.Errorf("loaded %v, %v without a peers file", peers, err)
+	}
+}
+
+func TestLoadPeersDropsDuplicates(t *testing.T) {
+	inNodeDir(t)
+
+	// eg. a file that was edited by hand. Plain addresses are the format of older nodes
+	data := `[{"addr":"10.0.0.1:3000"},"10.0.0.2:3000",{"addr":""},{"addr":"10.0.0.1:3000","services":1},{"addr":"10.0.0.2:3000"}]`
+	if err := os.WriteFile(fmt.Sprintf(peersFile, "3002"), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := LoadPeers("3002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1:3000", "10.0.0.2:3000"}; fmt.Sprint(peers) != fmt.Sprint(want) {
+		t.Errorf("loaded %v, want %v", peers, want)
+	}
+
+	if err := os.WriteFile(fmt.Sprintf(peersFile, "3002"), []byte("10.0.0.1:3000"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPeers("3002"); err == nil {
+		t.Error("loaded a peers file that is not JSON")
+	}
+}
+
+func TestPeerSetAddStopsAtTheCap(t *testing.T) {
+	peers := NewPeerSet(2, "10.0.0.1:3000")
+	if !peers.Add("10.0.0.2:3000") {
+		t.Fatal("could not add a peer below the cap")
+	}
+	if peers.Add("10.0.0.3:3000") {
+		t.Error("added a peer above the cap")
+	}
+	if peers.AddPeer(PeerInfo{Addr: "10.0.0.3:3000"}) {
+		t.Error("added a peer with its services above the cap")
+	}
+	if peers.Contains("10.0.0.3:3000") || peers.Len() != 2 || peers.Remaining() != 0 {
+		t.Errorf("the full set holds %v", peers.All())
+	}
+
+	// a peer that is already known is only seen again
+	if !peers.Add("10.0.0.1:3000") {
+		t.Error("a known peer was rejected by the full set")
+	}
+	if all := peers.All(); all[0] != "10.0.0.1:3000" {
+		t.Errorf("the peer seen last is not first: %v", all)
+	}
+
+	// removing a peer or raising the cap makes room again
+	peers.Remove("10.0.0.2:3000")
+	if !peers.Add("10.0.0.3:3000") {
+		t.Error("could not add a peer after one was removed")
+	}
+	peers.SetMax(3)
+	if !peers.Add("10.0.0.4:3000") || peers.Add("10.0.0.5:3000") {
+		t.Errorf("the raised cap of 3 holds %v", peers.All())
+	}
+
+	// the cap can't be raised above maxKnownNodes
+	peers.SetMax(maxKnownNodes + 1)
+	if remaining := peers.Remaining(); remaining != maxKnownNodes-3 {
+		t.Errorf("%d remaining peers, want %d", remaining, maxKnownNodes-3)
+	}
+}
@@ -0,0 +1,265 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// idle connections are closed after this long
+	idleConnTimeout = 60 * time.Second
+	// the receiving side waits a bit longer than the sender so a pooled connection is never closed underneath the sender
+	connReadTimeout = 90 * time.Second
+	// every message is prefixed with its length so multiple messages can be sent over the same connection
+	frameHeaderLength = 4
+	// frames are read into a buffer that starts at most this large and grows as the data arrives
+	frameReadChunk = 64 << 10
+	// the largest message a peer may send when NodeConfig.MaxMessageSize is not set
+	defaultMaxMessageSize = 32 << 20
+	// how long connecting to a peer and writing a message may take when NodeConfig does not set it
+	defaultDialTimeout  = 10 * time.Second
+	defaultWriteTimeout = 30 * time.Second
+)
+
+// DefaultRetryPolicy the retry policy used when NodeConfig.Retry is not set
+var DefaultRetryPolicy = RetryPolicy{MaxRetries: 3, InitialBackoff: 500 * time.Millisecond, MaxBackoff: 30 * time.Second}
+
+// RetryPolicy decides how often sending a message to a peer is retried before the peer is given up on
+type RetryPolicy struct {
+	// the amount of attempts after the first one
+	MaxRetries int
+	// the wait before the first retry, it doubles with every retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Backoff returns how long to wait before the retry that follows the failed attempt, counting from 0
+func (r RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := r.InitialBackoff
+	for i := 0; i < attempt && backoff < r.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.MaxBackoff {
+		return r.MaxBackoff
+	}
+	return backoff
+}
+
+// ErrMessageTooLarge is returned when the length prefix of a message is above the message size limit
+var ErrMessageTooLarge = errors.New("message is too large")
+
+// ConnectionPool keeps idle TCP connections to peers so they can be reused instead of dialing for every message
+type ConnectionPool struct {
+	// peer address -> *idleConns
+	conns sync.Map
+}
+
+// idleConns the idle connections of a single peer
+type idleConns struct {
+	mu    sync.Mutex
+	conns []idleConn
+}
+
+type idleConn struct {
+	conn      net.Conn
+	idleSince time.Time
+}
+
+// Get checks out a connection to the peer. A new connection is dialed when there are no idle ones
+func (p *ConnectionPool) Get(addr string) (net.Conn, error) {
+	value, _ := p.conns.LoadOrStore(addr, &idleConns{})
+	idle := value.(*idleConns)
+
+	idle.mu.Lock()
+	idle.evict()
+	if n := len(idle.conns); n > 0 {
+		// take the most recently used connection
+		conn := idle.conns[n-1].conn
+		idle.conns = idle.conns[:n-1]
+		idle.mu.Unlock()
+		return conn, nil
+	}
+	idle.mu.Unlock()
+
+	return dial(addr)
+}
+
+// dial connects to a peer. The peer pings the connection to check that we are still there, so it is read in the background
+func dial(addr string) (net.Conn, error) {
+	conn, err := dialTransport(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go answerPings(conn)
+	return conn, nil
+}
+
+// Put returns a connection to the pool once the message has been sent
+func (p *ConnectionPool) Put(addr string, conn net.Conn) {
+	value, _ := p.conns.LoadOrStore(addr, &idleConns{})
+	idle := value.(*idleConns)
+
+	idle.mu.Lock()
+	defer idle.mu.Unlock()
+
+	idle.evict()
+	idle.conns = append(idle.conns, idleConn{conn, time.Now()})
+}
+
+// CloseAll closes every idle connection in the pool
+func (p *ConnectionPool) CloseAll() {
+	p.conns.Range(func(key, value interface{}) bool {
+		idle := value.(*idleConns)
+
+		idle.mu.Lock()
+		for _, c := range idle.conns {
+			c.conn.Close()
+		}
+		idle.conns = nil
+		idle.mu.Unlock()
+
+		return true
+	})
+}
+
+// evict closes the connections that have been idle for too long. The lock must be held
+func (idle *idleConns) evict() {
+	var alive []idleConn
+	for _, c := range idle.conns {
+		if time.Since(c.idleSince) > idleConnTimeout {
+			c.conn.Close()
+			continue
+		}
+		alive = append(alive, c)
+	}
+	idle.conns = alive
+}
+
+// writeFrame writes a message prefixed with its length
+func writeFrame(w io.Writer, data []byte) error {
+	header := make([]byte, frameHeaderLength)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+
+	if _, err := w.Write(append(header, data...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// readFrame reads a single length prefixed message
+//
+// the length is checked before the message is read, otherwise a peer could make us allocate 4GB with a single header. The
+// buffer only grows with the bytes that arrive, so a header below the limit can't make us allocate the limit either
+//
+// nodes from before the framing send a single message without a length and close the connection. Their messages start
+// with a command, which read as a length is far above the limit, so they are read until the connection is closed
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, frameHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	limit := maxMessageSize()
+	length := binary.BigEndian.Uint32(header)
+	if uint64(length) > uint64(limit) {
+		if isUnframed(header) {
+			return readUnframed(r, header, limit)
+		}
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrMessageTooLarge, length, limit)
+	}
+
+	var data bytes.Buffer
+	if length < frameReadChunk {
+		data.Grow(int(length))
+	}
+	if _, err := io.CopyN(&data, r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return data.Bytes(), nil
+}
+
+// isUnframed checks if the header is the start of a command instead of a length. Commands start with a lowercase letter
+func isUnframed(header []byte) bool {
+	return header[0] >= 'a' && header[0] <= 'z'
+}
+
+// readUnframed reads the rest of a message without a length prefix until the peer closes the connection
+func readUnframed(r io.Reader, start []byte, limit int) ([]byte, error) {
+	data := bytes.NewBuffer(append([]byte{}, start...))
+	// one byte past the limit tells a message at the limit apart from a larger one
+	if _, err := io.Copy(data, io.LimitReader(r, int64(limit-len(start)+1))); err != nil {
+		return nil, err
+	}
+	if data.Len() > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes without a length prefix", ErrMessageTooLarge, limit)
+	}
+
+	return data.Bytes(), nil
+}
+
+// writeUnframed sends a message the way nodes from before the framing expect it, on its own connection without a length
+func writeUnframed(addr string, data []byte) error {
+	conn, err := dialTransport(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout())); err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// maxMessageSize returns the message size limit of the node
+func maxMessageSize() int {
+	if Config.MaxMessageSize > 0 {
+		return Config.MaxMessageSize
+	}
+	return defaultMaxMessageSize
+}
+
+// dialTimeout returns how long connecting to a peer may take
+func dialTimeout() time.Duration {
+	if Config.DialTimeout > 0 {
+		return Config.DialTimeout
+	}
+	return defaultDialTimeout
+}
+
+// writeTimeout returns how long writing a message to a peer may take
+func writeTimeout() time.Duration {
+	if Config.WriteTimeout > 0 {
+		return Config.WriteTimeout
+	}
+	return defaultWriteTimeout
+}
+
+// retryPolicy returns the retry policy of the node
+func retryPolicy() RetryPolicy {
+	if Config.Retry == (RetryPolicy{}) {
+		return DefaultRetryPolicy
+	}
+	return Config.Retry
+}
+
+// readTimeout returns how long a connection may be idle before it is closed
+func readTimeout() time.Duration {
+	if Config.ReadTimeout > 0 {
+		return Config.ReadTimeout
+	}
+	return connReadTimeout
+}
@@ -0,0 +1,270 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadFrame(t *testing.T) {
+	var buf bytes.Buffer
+	first, second := []byte("first message"), []byte("second")
+	if err := writeFrame(&buf, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(&buf, second); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range [][]byte{first, second} {
+		got, err := readFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("read %q, want %q", got, want)
+		}
+	}
+	if _, err := readFrame(&buf); err != io.EOF {
+		t.Errorf("reading past the last frame returned %v, want EOF", err)
+	}
+}
+
+func TestReadFrameRejectsLargeMessages(t *testing.T) {
+	header := []byte{0xff, 0xff, 0xff, 0xff}
+	if _, err := readFrame(bytes.NewReader(header)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("readFrame returned %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestReadFrameStopsAtTheEndOfTheData(t *testing.T) {
+	// the header promises the whole limit, but only a few bytes follow
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, make([]byte, defaultMaxMessageSize)); err != nil {
+		t.Fatal(err)
+	}
+	truncated := buf.Bytes()[:frameHeaderLength+10]
+
+	if _, err := readFrame(bytes.NewReader(truncated)); err != io.ErrUnexpectedEOF {
+		t.Errorf("readFrame returned %v, want an unexpected EOF", err)
+	}
+}
+
+func TestReadFrameReadsUnframedMessages(t *testing.T) {
+	// nodes from before the framing send the command and the payload and close the connection
+	message := append(CmdToBytes("version"), GobEncode(Version{Version: 1, BestHeight: 3, AddrFrom: "localhost:3000"})...)
+
+	r := bytes.NewReader(message)
+	got, err := readFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, message) {
+		t.Errorf("read %x, want %x", got, message)
+	}
+	if _, err := readFrame(r); err != io.EOF {
+		t.Errorf("reading past the message returned %v, want EOF", err)
+	}
+
+	var payload Version
+	version, err := DecodeMessage(got[commandLength:], &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != legacyMessageVersion || payload.BestHeight != 3 {
+		t.Errorf("decoded version %d with best height %d", version, payload.BestHeight)
+	}
+}
+
+func TestReadFrameRejectsLargeUnframedMessages(t *testing.T) {
+	Config.MaxMessageSize = 64
+	defer func() { Config.MaxMessageSize = 0 }()
+
+	message := append(CmdToBytes("addr"), make([]byte, 64)...)
+	if _, err := readFrame(bytes.NewReader(message)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("readFrame returned %v, want ErrMessageTooLarge", err)
+	}
+}
+
+// frameServer accepts connections and reads frames from them, every frame is reported on received. When echo is set,
+// the frames are written back
+func frameServer(tb testing.TB, echo bool) (string, <-chan struct{}) {
+	tb.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+
+	received := make(chan struct{}, 1024)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					data, err := readFrame(conn)
+					if err != nil {
+						return
+					}
+					if echo {
+						if err := writeFrame(conn, data); err != nil {
+							return
+						}
+						continue
+					}
+					received <- struct{}{}
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), received
+}
+
+// relayMessage a transaction message as it is relayed to a peer
+func relayMessage() []byte {
+	return append(CmdToBytes("tx"), EncodeMessage(messageVersion, Tx{"localhost:3000", make([]byte, 250)})...)
+}
+
+// BenchmarkRelay measures how many transactions can be relayed to a peer, with pooled connections and with a new
+// connection for every message
+func BenchmarkRelay(b *testing.B) {
+	message := relayMessage()
+
+	b.Run("pooled", func(b *testing.B) {
+		addr, received := frameServer(b, false)
+		defer pool.CloseAll()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := sendOnce(addr, message); err != nil {
+				b.Fatal(err)
+			}
+			<-received
+		}
+	})
+
+	b.Run("dial", func(b *testing.B) {
+		addr, received := frameServer(b, false)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			conn, err := dialTransport(addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := writeFrame(conn, message); err != nil {
+				b.Fatal(err)
+			}
+			<-received
+			conn.Close()
+		}
+	})
+}
+
+// BenchmarkRoundTrip measures the latency of a message and its answer, over a reused connection and over a new one
+func BenchmarkRoundTrip(b *testing.B) {
+	message := relayMessage()
+
+	roundTrip := func(b *testing.B, conn net.Conn) {
+		if err := writeFrame(conn, message); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := readFrame(conn); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("reused", func(b *testing.B) {
+		addr, _ := frameServer(b, true)
+		conn, err := dialTransport(addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			roundTrip(b, conn)
+		}
+	})
+
+	b.Run("dial", func(b *testing.B) {
+		addr, _ := frameServer(b, true)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			conn, err := dialTransport(addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			roundTrip(b, conn)
+			conn.Close()
+		}
+	})
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	retry := RetryPolicy{MaxRetries: 10, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second} {
+		if backoff := retry.Backoff(attempt); backoff != want {
+			t.Errorf("attempt %d: backoff %v, want %v", attempt, backoff, want)
+		}
+	}
+}
+
+func TestPeerIsRemovedAfterTheRetries(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	// the peer resets every connection as soon as it is accepted
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+
+	retry := RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+	defer minerNode(t, NodeConfig{Retry: retry}, "")()
+	defer pool.CloseAll()
+	KnownNodes.Add(addr)
+
+	// the message is too large for the socket buffers, so writing it fails once the connection is reset
+	data := append(CmdToBytes("block"), make([]byte, 16<<20)...)
+	if err := sendData(addr, data); err == nil {
+		t.Fatal("sent the message to a peer that drops every connection")
+	}
+	if KnownNodes.Contains(addr) {
+		t.Error("the peer is still known after the retries failed")
+	}
+	// every attempt dials a connection, and a second one when writing to the first one failed. A reset that arrives
+	// before the dial finished fails the attempt right away
+	if n, attempts := int(accepted.Load()), retry.MaxRetries+1; n < attempts || n > 2*attempts {
+		t.Errorf("%d connections for %d attempts", n, attempts)
+	}
+
+	// a peer that was given up on can be sent to again
+	if err := sendData(addr, data); err == nil {
+		t.Error("sent the message to a peer that drops every connection")
+	}
+}
@@ -1,50 +1,110 @@
 package network
 
 import (
-	"bytes"
+	"encoding/hex"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net"
+	"time"
 
 	"github.com/qhenkart/blockchain/blockchain"
 )
 
 // SendData sends data from one node to another
+//
+// connections are taken from the connection pool and put back after the data is written
 func SendData(addr string, data []byte) {
-	// connect to the interent via tcp
-	conn, err := net.Dial(protocol, addr)
-	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
+	sendData(addr, data)
+}
 
-		// if the node is unavailable, we need to update the available nodes
-		for _, node := range KnownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
+// sendData sends data like SendData and returns an error when the peer could not be reached
+//
+// failed attempts are retried with the retry policy of the node. The peer is removed from the known nodes once every attempt failed
+func sendData(addr string, data []byte) error {
+	// banned peers are not contacted
+	if IsBanned(addr) {
+		return fmt.Errorf("%s is banned", addr)
+	}
+
+	if isLegacyPeer(addr) {
+		legacy, err := legacyMessage(data)
+		if err != nil {
+			return err
 		}
+		data = legacy
+	}
 
-		KnownNodes = updatedNodes
+	retry := retryPolicy()
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = sendOnce(addr, data); err == nil {
+			return nil
+		}
+		if attempt >= retry.MaxRetries {
+			break
+		}
 
-		return
+		backoff := retry.Backoff(attempt)
+		slog.Debug("Could not send data, retrying", "peer", addr, "attempt", attempt+1, "retries", retry.MaxRetries, "backoff", backoff, "err", err)
+		time.Sleep(backoff)
 	}
 
-	defer conn.Close()
+	slog.Info("Peer is not available", "peer", addr, "err", err)
 
-	// call the connection and copy the data into the connection
-	_, err = io.Copy(conn, bytes.NewReader(data))
+	// if the node is unavailable, we need to update the available nodes
+	KnownNodes.Remove(addr)
+	countPeers()
+
+	return err
+}
+
+// sendOnce makes a single attempt to send data to a peer
+func sendOnce(addr string, data []byte) error {
+	// nodes from before the framing read a single message until the connection is closed
+	if isLegacyPeer(addr) {
+		return writeUnframed(addr, data)
+	}
+
+	// connect to the interent via tcp, or reuse an idle connection
+	conn, err := pool.Get(addr)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+
+	// write the data into the connection. A pooled connection may have been closed by the peer, so retry once with a new one
+	if err := writeFrameTimeout(conn, data); err != nil {
+		conn.Close()
+
+		conn, err = dial(addr)
+		if err != nil {
+			return err
+		}
+
+		if err := writeFrameTimeout(conn, data); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	pool.Put(addr, conn)
+	return nil
+}
+
+// writeFrameTimeout writes a message and gives up when the peer doesn't read it within the write timeout of the node
+func writeFrameTimeout(conn net.Conn, data []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout())); err != nil {
+		return err
 	}
+
+	return writeFrame(conn, data)
 }
 
 // SendAddr send an address from one peer to another
 func SendAddr(address string) {
-	nodes := Addr{KnownNodes}
+	nodes := Addr{KnownNodes.All()}
 	// nodeAddress is the node address of the client that is connecting
 	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := GobEncode(nodes)
+	payload := EncodeMessage(messageVersion, nodes)
 	// prepend the command to the payload
 	request := append(CmdToBytes("addr"), payload...)
 
@@ -57,7 +117,7 @@ func SendBlock(addr string, b *blockchain.Block) {
 	data := Block{nodeAddress, b.Serialize()}
 
 	// convert it to bytes
-	payload := GobEncode(data)
+	payload := EncodeMessage(messageVersion, data)
 
 	//prepend the command in bytes
 	request := append(CmdToBytes("block"), payload...)
@@ -65,22 +125,101 @@ func SendBlock(addr string, b *blockchain.Block) {
 	SendData(addr, request)
 }
 
+// SendCompactBlock announces a block with the ids of its transactions. The coinbase is sent along, no peer can have it
+func SendCompactBlock(addr string, b *blockchain.Block) {
+	compact, err := newCompactBlock(b)
+	if err != nil {
+		slog.Error("Could not create the compact block", "peer", addr, "blockHash", hex.EncodeToString(b.Hash), "err", err)
+		return
+	}
+
+	request := append(CmdToBytes("cmpctblock"), EncodeMessage(messageVersion, compact)...)
+
+	SendData(addr, request)
+}
+
+// newCompactBlock creates the compact announcement of a block, with the coinbase prefilled
+func newCompactBlock(b *blockchain.Block) (CompactBlock, error) {
+	header, err := b.Header()
+	if err != nil {
+		return CompactBlock{}, err
+	}
+
+	compact := CompactBlock{AddrFrom: nodeAddress, Header: header}
+	for i, tx := range b.Transactions {
+		compact.TxIDs = append(compact.TxIDs, tx.ID)
+		if tx.IsCoinbase() {
+			data, err := tx.Serialize()
+			if err != nil {
+				return CompactBlock{}, fmt.Errorf("coinbase %x: %w", tx.ID, err)
+			}
+			compact.Prefilled = append(compact.Prefilled, PrefilledTx{i, data})
+		}
+	}
+	return compact, nil
+}
+
+// SendGetMissingTxs requests the transactions of a compact block that we don't have
+func SendGetMissingTxs(addr string, blockHash []byte, txIDs [][]byte) {
+	payload := EncodeMessage(messageVersion, GetMissingTxs{nodeAddress, blockHash, txIDs})
+	request := append(CmdToBytes("getmissing"), payload...)
+
+	SendData(addr, request)
+}
+
+// SendMissingTxs sends the requested transactions of a compact block
+func SendMissingTxs(addr string, blockHash []byte, txs []*blockchain.Transaction) {
+	data := MissingTxs{AddrFrom: nodeAddress, BlockHash: blockHash}
+	for _, tx := range txs {
+		txData, err := tx.Serialize()
+		if err != nil {
+			slog.Error("Could not serialize a transaction", "peer", addr, "txID", hex.EncodeToString(tx.ID), "err", err)
+			return
+		}
+		data.Transactions = append(data.Transactions, txData)
+	}
+
+	request := append(CmdToBytes("missingtxs"), EncodeMessage(messageVersion, data)...)
+
+	SendData(addr, request)
+}
+
 // SendInv sends inventory from one peer to another
 func SendInv(address, kind string, items [][]byte) {
 	// create structure
 	inventory := Inv{nodeAddress, kind, items}
 	// convert it to bytes
-	payload := GobEncode(inventory)
+	payload := EncodeMessage(messageVersion, inventory)
 	// prepend the command
 	request := append(CmdToBytes("inv"), payload...)
 
 	SendData(address, request)
 }
 
+// SendNotFound tells a peer that the requested items could not be found
+func SendNotFound(address, kind string, items [][]byte) {
+	payload := EncodeMessage(messageVersion, NotFound{nodeAddress, kind, items})
+	request := append(CmdToBytes("notfound"), payload...)
+
+	SendData(address, request)
+}
+
 // SendTx sends a transaction from one peer to another
 func SendTx(addr string, tnx *blockchain.Transaction) {
-	data := Tx{nodeAddress, tnx.Serialize()}
-	payload := GobEncode(data)
+	// only final transactions can be broadcasted
+	if !tnx.IsSealed() {
+		slog.Error("Transaction is not sealed", "peer", addr, "txID", hex.EncodeToString(tnx.ID))
+		return
+	}
+
+	txData, err := tnx.Serialize()
+	if err != nil {
+		slog.Error("Could not serialize the transaction", "peer", addr, "txID", hex.EncodeToString(tnx.ID), "err", err)
+		return
+	}
+
+	data := Tx{nodeAddress, txData}
+	payload := EncodeMessage(messageVersion, data)
 	request := append(CmdToBytes("tx"), payload...)
 
 	SendData(addr, request)
@@ -88,26 +227,66 @@ func SendTx(addr string, tnx *blockchain.Transaction) {
 
 // SendVersion calculates the best height and sends the version from one peer to another
 func SendVersion(addr string, chain *blockchain.Blockchain) {
+	sendVersion(addr, chain)
+}
+
+// sendVersion sends the version like SendVersion and returns an error when the peer could not be reached
+func sendVersion(addr string, chain *blockchain.Blockchain) error {
 	// Checks to see what the length of the blockchain actually is
-	bestHeight := chain.GetBestHeight()
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	payload := EncodeMessage(messageVersion, Version{protocolVersion(), bestHeight, nodeAddress, localServices})
 
 	request := append(CmdToBytes("version"), payload...)
 
-	SendData(addr, request)
+	return sendData(addr, request)
 }
 
 // SendGetBlocks requests blocks from another peer
 func SendGetBlocks(address string) {
-	payload := GobEncode(GetBlocks{nodeAddress})
+	payload := EncodeMessage(messageVersion, GetBlocks{nodeAddress})
 	request := append(CmdToBytes("getblocks"), payload...)
 
 	SendData(address, request)
 }
 
+// SendGetHeaders requests the headers of a list of blocks from another peer
+func SendGetHeaders(address string, hashes [][]byte) {
+	payload := EncodeMessage(messageVersion, GetHeaders{AddrFrom: nodeAddress, Hashes: hashes})
+	request := append(CmdToBytes("getheaders"), payload...)
+
+	SendData(address, request)
+}
+
+// SendGetHeadersFrom requests the headers of the blocks from the height on from another peer
+func SendGetHeadersFrom(address string, height int) {
+	payload := EncodeMessage(messageVersion, GetHeaders{AddrFrom: nodeAddress, FromHeight: height})
+	request := append(CmdToBytes("getheaders"), payload...)
+
+	SendData(address, request)
+}
+
+// SendHeaders sends a list of block headers from one peer to another
+func SendHeaders(address string, headers []blockchain.BlockHeader) {
+	payload := EncodeMessage(messageVersion, Headers{nodeAddress, headers})
+	request := append(CmdToBytes("headers"), payload...)
+
+	SendData(address, request)
+}
+
+// SendHeader sends a single block header to a peer
+func SendHeader(address string, header *blockchain.BlockHeader) {
+	payload := EncodeMessage(messageVersion, Header{nodeAddress, *header})
+	request := append(CmdToBytes("header"), payload...)
+
+	SendData(address, request)
+}
+
 // SendGetData requests a set of data from another peer
 func SendGetData(address, kind string, id []byte) {
-	payload := GobEncode(GetData{nodeAddress, kind, id})
+	payload := EncodeMessage(messageVersion, GetData{nodeAddress, kind, id})
 	request := append(CmdToBytes("getdata"), payload...)
 
 	SendData(address, request)
@@ -0,0 +1,52 @@
+package network
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForClosedConnections(t *testing.T) {
+	conns := newConnTracker()
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// the handler is busy for a while after its connection is closed, like a handler that is still adding a block
+	var finished int32
+	conns.Add(server)
+	go func() {
+		defer conns.Done(server)
+		buf := make([]byte, 1)
+		server.Read(buf)
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+	}()
+
+	start := time.Now()
+	drain(conns, 10*time.Millisecond)
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Fatal("drain returned before the connection handler finished")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %s, the connection should have been closed after the timeout", elapsed)
+	}
+}
+
+func TestDrainReturnsOnceConnectionsFinish(t *testing.T) {
+	conns := newConnTracker()
+	server, client := net.Pipe()
+	defer client.Close()
+
+	conns.Add(server)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conns.Done(server)
+	}()
+
+	start := time.Now()
+	drain(conns, time.Minute)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("drain waited %s for a finished connection", elapsed)
+	}
+}
@@ -0,0 +1,96 @@
+package network
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/qhenkart/blockchain/blockchain"
+)
+
+const (
+	// how many times the seed nodes are tried at startup before the node goes offline
+	seedAttempts = 5
+	// how long to wait between the attempts
+	seedRetryDelay = 5 * time.Second
+)
+
+// offline is set to 1 when no seed node could be reached. The node syncs again once a peer connects to it
+var offline int32
+
+// seedNodes returns the nodes that can be used for the initial sync
+//
+// the central node is always a seed, even if it was removed from the known nodes after a failed send
+func seedNodes() []string {
+	seeds := []string{CentralNode}
+	for _, node := range KnownNodes.All() {
+		if node != CentralNode {
+			seeds = append(seeds, node)
+		}
+	}
+
+	var others []string
+	for _, seed := range seeds {
+		if seed != nodeAddress && !IsBanned(seed) {
+			others = append(others, seed)
+		}
+	}
+	return others
+}
+
+// syncWithSeeds sends our version to the seed nodes until one of them can be reached. The version exchange starts the sync
+//
+// every seed is tried once per attempt, with seedRetryDelay between attempts. Returns false when no seed could be reached
+func syncWithSeeds(ctx context.Context, chain *blockchain.Blockchain, attempts int) bool {
+	for attempt := 1; attempt <= attempts; attempt++ {
+		for _, seed := range seedNodes() {
+			if ctx.Err() != nil {
+				return false
+			}
+			if err := sendVersion(seed, chain); err == nil {
+				return true
+			}
+		}
+
+		slog.Info("Could not reach any seed node", "attempt", attempt, "attempts", attempts)
+		if attempt == attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(seedRetryDelay):
+		}
+	}
+
+	return false
+}
+
+// startupSync contacts the seed nodes when the node starts. Without any seeds the node runs in offline mode
+func startupSync(ctx context.Context, chain *blockchain.Blockchain) {
+	if syncWithSeeds(ctx, chain, seedAttempts) || ctx.Err() != nil {
+		return
+	}
+
+	atomic.StoreInt32(&offline, 1)
+	slog.Info("No seed nodes are reachable, running in OFFLINE mode. The chain syncs once a peer connects")
+}
+
+// resyncIfOffline starts a new sync when the node is offline. Called when a peer connects, which means the network is reachable again
+func resyncIfOffline(chain *blockchain.Blockchain) {
+	if !atomic.CompareAndSwapInt32(&offline, 1, 0) {
+		return
+	}
+
+	slog.Info("A peer connected, leaving offline mode")
+	chainTasks.Add(1)
+	go func() {
+		defer chainTasks.Done()
+		if !syncWithSeeds(context.Background(), chain, 1) {
+			atomic.StoreInt32(&offline, 1)
+			slog.Info("Seed nodes are still unreachable, staying in offline mode")
+		}
+	}()
+}
@@ -0,0 +1,263 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qhenkart/blockchain/blockchain"
+	"github.com/qhenkart/blockchain/wallet"
+)
+
+// the environment of a node started by startNode, see TestNodeProcess
+const (
+	nodeIDEnv           = "NODE_TEST_ID"
+	nodeCentralEnv      = "NODE_TEST_CENTRAL_NODE"
+	nodeSyncHeightEnv   = "NODE_TEST_SYNC_HEIGHT"
+	nodeTLSEnv          = "NODE_TEST_TLS"
+	nodeHeadersFirstEnv = "NODE_TEST_HEADERS_FIRST"
+)
+
+// TestNodeProcess is not a test on its own. startNode runs the test binary with it to start each node in its own process,
+// the globals of the package only hold one node
+//
+// the central node serves until it is killed, the other node stops once its chain reached the sync height
+func TestNodeProcess(t *testing.T) {
+	nodeID := os.Getenv(nodeIDEnv)
+	if nodeID == "" {
+		return
+	}
+	CentralNode = os.Getenv(nodeCentralEnv)
+	KnownNodes = NewPeerSet(defaultMaxPeers, CentralNode)
+	// the connection of the other node stays open in its pool, don't wait for it once the sync is done
+	DrainTimeout = 100 * time.Millisecond
+	Config.HeadersFirst = os.Getenv(nodeHeadersFirstEnv) != ""
+
+	if os.Getenv(nodeTLSEnv) != "" {
+		cert, err := GenerateSelfSignedCert(nodeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the certificates are self signed, the common name is checked instead
+		Config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		StartServerWithContext(ctx, nodeID, "")
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	height, err := strconv.Atoi(os.Getenv(nodeSyncHeightEnv))
+	if err != nil {
+		<-stopped
+		return
+	}
+	<-serverChainOpened
+	serverChainMu.Lock()
+	chain := serverChain
+	serverChainMu.Unlock()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		best, err := chain.GetBestHeight()
+		if err == nil && best >= height {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("synced to height %d, %v, want %d", best, err, height)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// freePort returns a port nothing listens on
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+// copyDir copies the files of a closed database
+func copyDir(t *testing.T, from, to string) {
+	t.Helper()
+
+	if err := os.MkdirAll(to, 0700); err != nil {
+		t.Fatal(err)
+	}
+	files, err := os.ReadDir(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(from, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(to, file.Name()), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// inNodeDir runs the test in a new directory and returns it. The databases are opened relative to the working directory,
+// the nodes run in it as well
+func inNodeDir(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "tmp"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return dir
+}
+
+// syncChains creates the databases of two nodes with the same genesis block, the central node has n blocks on top of it
+//
+// the blocks are one target block time apart, so the difficulty stays the same however fast they are mined
+func syncChains(t *testing.T, central, other string, n int) {
+	t.Helper()
+
+	address := string(wallet.MakeWallet().Address())
+	chain, err := blockchain.Init(address, central)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Database.Close()
+	copyDir(t, filepath.Join("tmp", "blocks_"+central), filepath.Join("tmp", "blocks_"+other))
+
+	if chain, err = blockchain.Continue(central); err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Database.Close()
+	prev, err := chain.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	interval := int64(chain.Config.TargetBlockTime.Seconds())
+	for height := 1; height <= n; height++ {
+		coinbase, err := blockchain.CoinbaseTx(address, "", height, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := blockchain.CreateBlock([]*blockchain.Transaction{coinbase}, prev.Hash, height, prev.Difficulty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.Timestamp = prev.Timestamp + interval
+		pow, err := blockchain.NewProof(block, block.Difficulty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Nonce, block.Hash, err = pow.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		prev = block
+	}
+}
+
+// startNode starts the test binary as a node in the directory, the output of the node is written to out. env holds the
+// options of the node, eg. nodeTLSEnv
+func startNode(t *testing.T, dir, nodeID, central string, syncHeight int, out io.Writer, env ...string) *exec.Cmd {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestNodeProcess$")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), nodeIDEnv+"="+nodeID, nodeCentralEnv+"="+central)
+	if syncHeight > 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", nodeSyncHeightEnv, syncHeight))
+	}
+	for _, option := range env {
+		cmd.Env = append(cmd.Env, option+"=1")
+	}
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+// stopNode kills a node that serves until it is killed, its output is logged when the test failed
+func stopNode(t *testing.T, name string, cmd *exec.Cmd, out fmt.Stringer) {
+	cmd.Process.Kill()
+	cmd.Wait()
+	if t.Failed() {
+		t.Logf("%s:\n%s", name, out.String())
+	}
+}
+
+func TestHeadersFirstSync(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts two nodes")
+	}
+	if raceEnabled {
+		t.Skip("the nodes keep their chains in Badger, which fails with the race detector")
+	}
+
+	dir := inNodeDir(t)
+	central, other := freePort(t), freePort(t)
+	const blocks = 20
+	syncChains(t, central, other, blocks)
+
+	var centralOut, otherOut bytes.Buffer
+	centralAddr := "localhost:" + central
+	centralNode := startNode(t, dir, central, centralAddr, 0, &centralOut, nodeHeadersFirstEnv)
+	defer stopNode(t, "central node", centralNode, &centralOut)
+
+	otherNode := startNode(t, dir, other, centralAddr, blocks, &otherOut, nodeHeadersFirstEnv)
+	if err := otherNode.Wait(); err != nil {
+		t.Fatalf("the node did not sync the %d blocks of the central node: %v\n%s", blocks, err, otherOut.String())
+	}
+
+	// the node reached the best height of the central node, check that it got there with the headers of every block
+	if !strings.Contains(otherOut.String(), fmt.Sprintf("headers=%d", blocks)) {
+		t.Errorf("the node did not receive the %d headers before the blocks:\n%s", blocks, otherOut.String())
+	}
+	chain, err := blockchain.Continue(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Database.Close()
+	if best, err := chain.GetBestHeight(); err != nil || best != blocks {
+		t.Errorf("best height %d, %v, want %d", best, err, blocks)
+	}
+}
@@ -0,0 +1,111 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// how long a generated development certificate is valid
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// GenerateSelfSignedCert creates a self signed certificate for development setups
+//
+// the common name is the address the node advertises, localhost:NODE_ID unless ListenAddr is set
+func GenerateSelfSignedCert(nodeID string) (tls.Certificate, error) {
+	address := advertisedAddress(nodeID)
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: address},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		// nodes are servers and clients at the same time
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// advertisedAddress the address the node tells its peers about
+func advertisedAddress(nodeID string) string {
+	if ListenAddr != "" {
+		return ListenAddr
+	}
+	return fmt.Sprintf("localhost:%s", nodeID)
+}
+
+// listen opens the listener of the server, with TLS when it is configured
+func listen(addr string) (net.Listener, error) {
+	if Config.TLSConfig != nil {
+		return tls.Listen(protocol(), addr, Config.TLSConfig)
+	}
+	return net.Listen(protocol(), addr)
+}
+
+// dialTransport connects to a peer, with TLS when it is configured
+func dialTransport(addr string) (net.Conn, error) {
+	if Config.TLSConfig == nil {
+		return net.DialTimeout(protocol(), addr, dialTimeout())
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout()}, protocol(), addr, Config.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// without a verified chain the certificate could belong to anyone, at least make sure it was issued for this peer
+	if Config.TLSConfig.InsecureSkipVerify {
+		if err := checkPeerAddress(conn, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// checkPeerAddress checks that the common name of the peer certificate is the address we dialed
+func checkPeerAddress(conn *tls.Conn, addr string) error {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("%s did not send a certificate", addr)
+	}
+
+	if name := certs[0].Subject.CommonName; !sameAddress(name, addr) {
+		return fmt.Errorf("certificate of %s was issued for %s", addr, name)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package network
+
+import (
+	"bytes"
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestTLSNodesSync(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts two nodes")
+	}
+	if raceEnabled {
+		t.Skip("the nodes keep their chains in Badger, which fails with the race detector")
+	}
+
+	dir := inNodeDir(t)
+	central, other := freePort(t), freePort(t)
+	const blocks = 3
+	syncChains(t, central, other, blocks)
+
+	var centralOut, otherOut bytes.Buffer
+	centralAddr := "localhost:" + central
+	centralNode := startNode(t, dir, central, centralAddr, 0, &centralOut, nodeTLSEnv)
+	defer stopNode(t, "central node", centralNode, &centralOut)
+
+	// the central node only accepts TLS, and its certificate was issued for its address
+	var conn *tls.Conn
+	var err error
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		if conn, err = tls.Dial("tcp", centralAddr, &tls.Config{InsecureSkipVerify: true}); err == nil || time.Since(start) > 10*time.Second {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("could not connect to the central node with TLS: %v", err)
+	}
+	if err := checkPeerAddress(conn, centralAddr); err != nil {
+		t.Error(err)
+	}
+	conn.Close()
+
+	otherNode := startNode(t, dir, other, centralAddr, blocks, &otherOut, nodeTLSEnv)
+	if err := otherNode.Wait(); err != nil {
+		t.Fatalf("the node did not sync the %d blocks of the central node: %v\n%s", blocks, err, otherOut.String())
+	}
+}
@@ -0,0 +1,109 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+const addressBookFile = "./tmp/addressbook_%s.json"
+
+var (
+	// ErrNameTaken is returned when a name is added to the address book twice
+	ErrNameTaken = errors.New("name is already in the address book")
+	// ErrNameNotFound is returned when a name is not in the address book
+	ErrNameNotFound = errors.New("name is not in the address book")
+)
+
+// AddressBook gives addresses human readable names. It is stored as JSON, so it can be edited by hand
+type AddressBook struct {
+	// the addresses keyed by their name
+	Entries map[string]string `json:"entries"`
+}
+
+// AddressBookEntry a name and the address it stands for
+type AddressBookEntry struct {
+	Name    string
+	Address string
+}
+
+// Add stores an address under a name. The address has to be valid and the name unused, remove the name first to change it
+func (ab *AddressBook) Add(name, address string) error {
+	if name == "" {
+		return errors.New("name can't be empty")
+	}
+	if _, err := ValidateAddress(address); err != nil {
+		return err
+	}
+	if _, ok := ab.Entries[name]; ok {
+		return ErrNameTaken
+	}
+
+	if ab.Entries == nil {
+		ab.Entries = make(map[string]string)
+	}
+	ab.Entries[name] = address
+	return nil
+}
+
+// Remove deletes a name from the address book, unknown names are ignored
+func (ab *AddressBook) Remove(name string) {
+	delete(ab.Entries, name)
+}
+
+// Lookup returns the address of a name
+func (ab *AddressBook) Lookup(name string) (string, error) {
+	address, ok := ab.Entries[name]
+	if !ok {
+		return "", ErrNameNotFound
+	}
+	return address, nil
+}
+
+// List returns the entries of the address book ordered by name
+func (ab *AddressBook) List() []AddressBookEntry {
+	entries := make([]AddressBookEntry, 0, len(ab.Entries))
+	for name, address := range ab.Entries {
+		entries = append(entries, AddressBookEntry{name, address})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// Save writes the address book to the address book file of the node
+func (ab *AddressBook) Save(nodeID string) error {
+	content, err := json.MarshalIndent(ab, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fmt.Sprintf(addressBookFile, nodeID), content, 0644)
+}
+
+// Load reads the address book file of the node. A missing file leaves the address book empty
+func (ab *AddressBook) Load(nodeID string) error {
+	content, err := ioutil.ReadFile(fmt.Sprintf(addressBookFile, nodeID))
+	if os.IsNotExist(err) {
+		ab.Entries = make(map[string]string)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var book AddressBook
+	if err := json.Unmarshal(content, &book); err != nil {
+		return err
+	}
+	if book.Entries == nil {
+		book.Entries = make(map[string]string)
+	}
+
+	*ab = book
+	return nil
+}
@@ -0,0 +1,115 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestAddressBookRoundTrips(t *testing.T) {
+	inTempDir(t)
+
+	alice, bob := string(MakeWallet().Address()), string(MakeWallet().Address())
+	var book AddressBook
+	for name, address := range map[string]string{"alice": alice, "bob": bob} {
+		if err := book.Add(name, address); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := book.Save("3000"); err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded AddressBook
+	if err := loaded.Load("3000"); err != nil {
+		t.Fatal(err)
+	}
+	want := []AddressBookEntry{{"alice", alice}, {"bob", bob}}
+	if got := loaded.List(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("loaded %v, want %v", got, want)
+	}
+	if address, err := loaded.Lookup("bob"); err != nil || address != bob {
+		t.Errorf("bob is %q, %v, want %s", address, err, bob)
+	}
+
+	// a removed name is gone after the next save
+	loaded.Remove("alice")
+	if _, err := loaded.Lookup("alice"); !errors.Is(err, ErrNameNotFound) {
+		t.Errorf("looking up a removed name returned %v, want ErrNameNotFound", err)
+	}
+	if err := loaded.Save("3000"); err != nil {
+		t.Fatal(err)
+	}
+	var reloaded AddressBook
+	if err := reloaded.Load("3000"); err != nil {
+		t.Fatal(err)
+	}
+	if entries := reloaded.List(); len(entries) != 1 || entries[0].Name != "bob" {
+		t.Errorf("reloaded %v, want only bob", entries)
+	}
+
+	// a node without an address book file starts with an empty one
+	var empty AddressBook
+	if err := empty.Load("3001"); err != nil || len(empty.List()) != 0 {
+		t.Errorf("loaded %v, %v without a file", empty.List(), err)
+	}
+	if err := empty.Add("carol", alice); err != nil {
+		t.Errorf("could not add to a loaded empty address book: %v", err)
+	}
+}
+
+func TestAddressBookRejectsTakenNames(t *testing.T) {
+	alice := string(MakeWallet().Address())
+	var book AddressBook
+	if err := book.Add("alice", alice); err != nil {
+		t.Fatal(err)
+	}
+
+	// the name keeps its address, to change it the name has to be removed first
+	other := string(MakeWallet().Address())
+	if err := book.Add("alice", other); !errors.Is(err, ErrNameTaken) {
+		t.Errorf("adding a taken name returned %v, want ErrNameTaken", err)
+	}
+	if address, _ := book.Lookup("alice"); address != alice {
+		t.Errorf("alice was changed to %s", address)
+	}
+
+	book.Remove("alice")
+	if err := book.Add("alice", other); err != nil {
+		t.Errorf("could not add a removed name again: %v", err)
+	}
+}
+
+func TestAddressBookRejectsInvalidAddresses(t *testing.T) {
+	address := string(MakeWallet().Address())
+	// another last character breaks the checksum
+	changed := []byte(address)
+	if changed[len(changed)-1] == '2' {
+		changed[len(changed)-1] = '3'
+	} else {
+		changed[len(changed)-1] = '2'
+	}
+
+	var book AddressBook
+	for _, invalid := range []string{"", "not an address", string(changed)} {
+		if err := book.Add("name", invalid); err == nil {
+			t.Errorf("added the invalid address %q", invalid)
+		}
+	}
+	if err := book.Add("", address); err == nil {
+		t.Error("added an address without a name")
+	}
+	if len(book.List()) != 0 {
+		t.Errorf("the address book holds %v after only invalid entries", book.List())
+	}
+
+	// a file edited by hand can't be loaded when it isn't JSON
+	inTempDir(t)
+	if err := os.WriteFile(fmt.Sprintf(addressBookFile, "3000"), []byte("alice: 1abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := book.Load("3000"); err == nil {
+		t.Error("loaded an address book file that is not JSON")
+	}
+}
@@ -0,0 +1,127 @@
+package wallet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	encryptedWalletFile = "./tmp/wallets_%s.enc"
+	saltLength          = 16
+	// the argon2id key is split into the AES key and a value that checks the passphrase
+	aesKeyLength   = 32
+	verifierLength = 32
+	// argon2id settings, 64 MB of memory
+	argonTime    = 1
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+)
+
+var (
+	// ErrBadPassphrase is returned when an encrypted wallet file is opened with the wrong passphrase
+	ErrBadPassphrase = errors.New("wrong passphrase")
+	// ErrWalletTampered is returned when the encrypted wallets fail authentication, the file was changed or is corrupted
+	ErrWalletTampered = errors.New("encrypted wallet file failed authentication")
+)
+
+// SaveFileEncrypted saves the wallets to disc encrypted with AES-256-GCM
+//
+// the key is derived from the passphrase with argon2id. The file holds the salt, the passphrase verifier, the nonce and the ciphertext
+func (ws *Wallets) SaveFileEncrypted(nodeID, passphrase string) error {
+	content, err := ws.encode()
+	if err != nil {
+		return err
+	}
+
+	// a new salt and nonce on every save, the same key and nonce must never encrypt twice
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	key, verifier := deriveWalletKey(passphrase, salt)
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	data := append(append(append([]byte{}, salt...), verifier...), nonce...)
+	data = gcm.Seal(data, nonce, content, nil)
+
+	// the file holds private keys, only the owner can read it
+	return ioutil.WriteFile(fmt.Sprintf(encryptedWalletFile, nodeID), data, 0600)
+}
+
+// LoadFileEncrypted loads the wallets from an encrypted wallet file. Returns ErrBadPassphrase when the passphrase is wrong
+func (ws *Wallets) LoadFileEncrypted(nodeID, passphrase string) error {
+	data, err := ioutil.ReadFile(fmt.Sprintf(encryptedWalletFile, nodeID))
+	if err != nil {
+		return err
+	}
+
+	if len(data) < saltLength+verifierLength {
+		return ErrWalletTampered
+	}
+	salt := data[:saltLength]
+	key, verifier := deriveWalletKey(passphrase, salt)
+
+	// check the passphrase first, otherwise a wrong passphrase looks the same as a tampered file
+	if subtle.ConstantTimeCompare(verifier, data[saltLength:saltLength+verifierLength]) != 1 {
+		return ErrBadPassphrase
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	data = data[saltLength+verifierLength:]
+	if len(data) < gcm.NonceSize() {
+		return ErrWalletTampered
+	}
+
+	content, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return ErrWalletTampered
+	}
+
+	return ws.decode(content)
+}
+
+// CreateWalletsEncrypted reads an encrypted wallet file from disc like CreateWallets
+func CreateWalletsEncrypted(nodeID, passphrase string) (*Wallets, error) {
+	wallets := Wallets{}
+
+	wallets.Wallets = make(map[string]*Wallet)
+	wallets.RedeemScripts = make(map[string][]byte)
+
+	err := wallets.LoadFileEncrypted(nodeID, passphrase)
+	return &wallets, err
+}
+
+// deriveWalletKey derives the AES key and the passphrase verifier from the passphrase
+func deriveWalletKey(passphrase string, salt []byte) ([]byte, []byte) {
+	key := argon2.IDKey([]byte(passphrase), salt, argonTime, argonMemory, argonThreads, aesKeyLength+verifierLength)
+
+	return key[:aesKeyLength], key[aesKeyLength:]
+}
+
+// newGCM creates the AES-256-GCM cipher of a key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,127 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// inTempDir runs the test in a new directory with a tmp directory for the wallet files, they are written relative to the
+// working directory
+func inTempDir(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "tmp"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func newWallets() *Wallets {
+	return &Wallets{Wallets: make(map[string]*Wallet), RedeemScripts: make(map[string][]byte)}
+}
+
+func TestEncryptedWalletsRoundTrip(t *testing.T) {
+	inTempDir(t)
+
+	wallets := newWallets()
+	address := wallets.AddWallet()
+	secp, err := wallets.AddWalletWithKeyType(KeyTypeSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watched := string(MakeWallet().Address())
+	if err := wallets.AddWatchAddress(watched); err != nil {
+		t.Fatal(err)
+	}
+	if err := wallets.SaveFileEncrypted("3000", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(fmt.Sprintf(encryptedWalletFile, "3000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("the wallet file has mode %o, want 0600", mode)
+	}
+
+	loaded, err := CreateWalletsEncrypted("3000", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range []string{address, secp} {
+		w, err := loaded.GetWallet(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the curve is restored, so the loaded key can sign
+		saved := wallets.Wallets[address].PrivateKey
+		if w.PrivateKey.D.Cmp(saved.D) != 0 || w.PrivateKey.Curve != saved.Curve || string(w.Address()) != address {
+			t.Errorf("the loaded wallet %s has a different key than the saved one", address)
+		}
+	}
+	if w := loaded.Wallets[watched]; w == nil || !w.WatchOnly || string(w.Address()) != watched {
+		t.Error("the watch only wallet was not loaded")
+	}
+
+	if _, err := CreateWalletsEncrypted("3000", "wrong horse"); !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("loading with the wrong passphrase returned %v, want ErrBadPassphrase", err)
+	}
+}
+
+func TestEncryptedWalletsDetectTampering(t *testing.T) {
+	inTempDir(t)
+
+	wallets := newWallets()
+	wallets.AddWallet()
+	if err := wallets.SaveFileEncrypted("3000", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	file := fmt.Sprintf(encryptedWalletFile, "3000")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]func([]byte) []byte{
+		// the salt and the verifier are left alone, so the passphrase still checks out
+		"changed ciphertext": func(data []byte) []byte {
+			data[len(data)-1] ^= 1
+			return data
+		},
+		"changed nonce": func(data []byte) []byte {
+			data[saltLength+verifierLength] ^= 1
+			return data
+		},
+		"cut off ciphertext": func(data []byte) []byte {
+			return data[:len(data)-10]
+		},
+		"cut off header": func(data []byte) []byte {
+			return data[:saltLength]
+		},
+	}
+	for name, tamper := range tests {
+		if err := ioutil.WriteFile(file, tamper(append([]byte{}, data...)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := CreateWalletsEncrypted("3000", "correct horse"); !errors.Is(err, ErrWalletTampered) {
+			t.Errorf("%s: returned %v, want ErrWalletTampered", name, err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package wallet
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+const (
+	// HardenedIndex child indexes from here on use hardened derivation, they can't be derived from the parent public key
+	HardenedIndex = uint32(0x80000000)
+	// the key of the HMAC that creates the master key, the same as BIP32 so seeds are compatible with other wallets
+	masterKeySalt = "Bitcoin seed"
+	// BIP32 allows seeds between 128 and 512 bits
+	minSeedLength = 16
+	maxSeedLength = 64
+)
+
+// ErrInvalidChild is returned when a child index creates an invalid key. The chance is lower than 1 in 2^127, the next index should be used
+var ErrInvalidChild = errors.New("child index creates an invalid key")
+
+// HDWallet a hierarchical deterministic wallet (BIP32). Every child wallet is derived from the master seed
+//
+// backing up the seed once is enough to restore every wallet that was ever derived from it.
+// Derived keys are always on the secp256k1 curve
+type HDWallet struct {
+	// the master seed, usually 64 bytes
+	Seed []byte
+}
+
+// extendedKey a private key together with the chain code that is used to derive its children
+type extendedKey struct {
+	key       []byte
+	chainCode []byte
+}
+
+// NewHDWalletFromEntropy creates an HD wallet that uses the entropy as master seed. The entropy must be between 16 and 64 bytes
+func NewHDWalletFromEntropy(entropy []byte) (*HDWallet, error) {
+	if len(entropy) < minSeedLength || len(entropy) > maxSeedLength {
+		return nil, fmt.Errorf("entropy must be between %d and %d bytes", minSeedLength, maxSeedLength)
+	}
+
+	hd := &HDWallet{Seed: append([]byte{}, entropy...)}
+	// seeds that create an invalid master key can't be used
+	if _, err := hd.master(); err != nil {
+		return nil, err
+	}
+
+	return hd, nil
+}
+
+// DeriveChild derives the wallet of a direct child of the master key, eg. m/0. Indexes from HardenedIndex on are hardened
+func (hd *HDWallet) DeriveChild(index uint32) (*Wallet, error) {
+	master, err := hd.master()
+	if err != nil {
+		return nil, err
+	}
+
+	child, err := master.child(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return child.wallet(), nil
+}
+
+// DeriveChildFromPath derives the wallet of a derivation path, eg. m/44'/0'/0'/0/0
+//
+// hardened indexes end with ' or h. The path "m" is the master key itself
+func (hd *HDWallet) DeriveChildFromPath(path string) (*Wallet, error) {
+	indexes, err := ParseDerivationPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hd.master()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, index := range indexes {
+		if key, err = key.child(index); err != nil {
+			return nil, err
+		}
+	}
+
+	return key.wallet(), nil
+}
+
+// ParseDerivationPath turns a derivation path into the child indexes, hardened indexes include the HardenedIndex offset
+func ParseDerivationPath(path string) ([]uint32, error) {
+	parts := strings.Split(strings.TrimSpace(path), "/")
+	if parts[0] != "m" {
+		return nil, fmt.Errorf("derivation path %q must start with m", path)
+	}
+
+	indexes := make([]uint32, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		offset := uint32(0)
+		if strings.HasSuffix(part, "'") || strings.HasSuffix(part, "h") {
+			offset = HardenedIndex
+			part = part[:len(part)-1]
+		}
+
+		// the index itself must fit below the hardened offset
+		index, err := strconv.ParseUint(part, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index %q in derivation path %q", part, path)
+		}
+
+		indexes = append(indexes, uint32(index)+offset)
+	}
+
+	return indexes, nil
+}
+
+// master creates the master key from the seed
+func (hd *HDWallet) master() (*extendedKey, error) {
+	mac := hmac.New(sha512.New, []byte(masterKeySalt))
+	mac.Write(hd.Seed)
+	sum := mac.Sum(nil)
+
+	if !validKey(sum[:32]) {
+		return nil, errors.New("seed creates an invalid master key")
+	}
+
+	return &extendedKey{sum[:32], sum[32:]}, nil
+}
+
+// child derives the private child key of an index
+//
+// hardened children hash the parent private key, normal children hash the compressed parent public key
+func (k *extendedKey) child(index uint32) (*extendedKey, error) {
+	var data []byte
+	if index >= HardenedIndex {
+		data = append([]byte{0x00}, k.key...)
+	} else {
+		data = secp256k1.PrivKeyFromBytes(k.key).PubKey().SerializeCompressed()
+	}
+
+	indexBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(indexBytes, index)
+	data = append(data, indexBytes...)
+
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+
+	n := secp256k1.S256().N
+	tweak := new(big.Int).SetBytes(sum[:32])
+	if tweak.Cmp(n) >= 0 {
+		return nil, ErrInvalidChild
+	}
+
+	// the child key is the parent key plus the tweak, modulo the curve order
+	key := tweak.Add(tweak, new(big.Int).SetBytes(k.key))
+	key.Mod(key, n)
+	if key.Sign() == 0 {
+		return nil, ErrInvalidChild
+	}
+
+	// keys are always 32 bytes, pad the big int
+	keyBytes := make([]byte, 32)
+	b := key.Bytes()
+	copy(keyBytes[32-len(b):], b)
+
+	return &extendedKey{keyBytes, sum[32:]}, nil
+}
+
+// wallet creates the wallet of the private key
+func (k *extendedKey) wallet() *Wallet {
+	private := secp256k1.PrivKeyFromBytes(k.key).ToECDSA()
+
+	// the public key is encoded the same way as the random wallets
+	pub := PublicKeyBytes(&private.PublicKey)
+	return &Wallet{PrivateKey: *private, PublicKey: pub, KeyType: KeyTypeSecp256k1}
+}
+
+// validKey checks that a private key is between 1 and the curve order
+func validKey(key []byte) bool {
+	k := new(big.Int).SetBytes(key)
+	return k.Sign() > 0 && k.Cmp(secp256k1.S256().N) < 0
+}
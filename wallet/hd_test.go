@@ -0,0 +1,134 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestDeriveChildFromPathMatchesBIP32(t *testing.T) {
+	// test vector 1 of BIP32
+	seed, err := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hd, err := NewHDWalletFromEntropy(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, key string
+	}{
+		{"m", "e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35"},
+		{"m/0'", "edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea"},
+		{"m/0'/1", "3c6cb8d0f6a264c91ea8b5030fadaa8e538b020f0a387421a12de9319dc93368"},
+		{"m/0'/1/2'", "cbce0d719ecf7431d88e6a89fa1483e02e35092af60c042b1df2ff59fa424dca"},
+		{"m/0'/1/2'/2", "0f479245fb19a38a1954c5c7c0ebab2f9bdfd96a17563ef28a6a4b1a2a764ef4"},
+		{"m/0'/1/2'/2/1000000000", "471b76e389e528d6de6d816857e012c5455051cad6660850e58372a6c3e6e7c8"},
+	}
+	for _, test := range tests {
+		w, err := hd.DeriveChildFromPath(test.path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.path, err)
+		}
+		if key := fmt.Sprintf("%064x", w.PrivateKey.D); key != test.key {
+			t.Errorf("%s: key %s, want %s", test.path, key, test.key)
+		}
+	}
+}
+
+func TestDeriveChildCreatesUniqueWallets(t *testing.T) {
+	hd, err := NewHDWalletFromEntropy(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]uint32)
+	for _, offset := range []uint32{0, HardenedIndex} {
+		for i := uint32(0); i < 20; i++ {
+			index := offset + i
+			w, err := hd.DeriveChild(index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			address := string(w.Address())
+			if _, err := ValidateAddress(address); err != nil {
+				t.Errorf("child %d: %v", index, err)
+			}
+			if other, ok := seen[address]; ok {
+				t.Errorf("child %d has the same address as child %d", index, other)
+			}
+			seen[address] = index
+
+			// the same index derives the same wallet again, with or without a path
+			path := fmt.Sprintf("m/%d", i)
+			if offset == HardenedIndex {
+				path += "'"
+			}
+			again, err := hd.DeriveChildFromPath(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(again.Address()) != address {
+				t.Errorf("%s derives another wallet than child %d", path, index)
+			}
+		}
+	}
+
+	// another seed derives other wallets
+	other, err := NewHDWalletFromEntropy(append(make([]byte, 31), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := other.DeriveChild(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := seen[string(w.Address())]; ok {
+		t.Error("two seeds derive the same child")
+	}
+}
+
+func TestParseDerivationPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		indexes []uint32
+	}{
+		{"m", []uint32{}},
+		{"m/0", []uint32{0}},
+		{"m/44'/0'/0'/0/0", []uint32{HardenedIndex + 44, HardenedIndex, HardenedIndex, 0, 0}},
+		{"m/44h/1", []uint32{HardenedIndex + 44, 1}},
+		{" m/2147483647 ", []uint32{HardenedIndex - 1}},
+		{"m/2147483647'", []uint32{^uint32(0)}},
+	}
+	for _, test := range tests {
+		indexes, err := ParseDerivationPath(test.path)
+		if err != nil {
+			t.Errorf("%q: %v", test.path, err)
+			continue
+		}
+		if fmt.Sprint(indexes) != fmt.Sprint(test.indexes) {
+			t.Errorf("%q: indexes %v, want %v", test.path, indexes, test.indexes)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"M/0",
+		"44'/0'",
+		"m/",
+		"m//0",
+		"m/-1",
+		"m/a",
+		"m/1''",
+		// the index has to fit below the hardened offset
+		"m/2147483648",
+		"m/2147483648'",
+	}
+	for _, path := range invalid {
+		if indexes, err := ParseDerivationPath(path); err == nil {
+			t.Errorf("%q: parsed as %v", path, indexes)
+		}
+	}
+}
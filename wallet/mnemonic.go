@@ -0,0 +1,126 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// each word encodes 11 bits
+	bitsPerWord = 11
+	// the amount of PBKDF2 rounds of the BIP39 seed
+	seedIterations = 2048
+	seedLength     = 64
+)
+
+// ErrInvalidChecksum is returned when the checksum of a mnemonic does not match its words, eg. a word was mistyped
+var ErrInvalidChecksum = errors.New("mnemonic checksum is not valid")
+
+// GenerateMnemonic creates a BIP39 mnemonic from random entropy of the given size. The bits must be 128, 160, 192, 224 or 256
+//
+// 128 bits create 12 words, every 32 bits add 3 more words
+func GenerateMnemonic(bits int) (string, error) {
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return "", fmt.Errorf("entropy must be 128, 160, 192, 224 or 256 bits, not %d", bits)
+	}
+
+	entropy := make([]byte, bits/8)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", err
+	}
+
+	return entropyToMnemonic(entropy), nil
+}
+
+// MnemonicToSeed validates the mnemonic and stretches it into a 64 byte seed with PBKDF2-HMAC-SHA512
+//
+// the seed can be passed to NewHDWalletFromEntropy. Different passphrases create different seeds from the same words.
+// The passphrase is not NFKD normalized, so only ascii passphrases are compatible with other wallets
+func MnemonicToSeed(mnemonic, passphrase string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	if _, err := mnemonicToEntropy(words); err != nil {
+		return nil, err
+	}
+
+	normalized := strings.Join(words, " ")
+	return pbkdf2.Key([]byte(normalized), []byte("mnemonic"+passphrase), seedIterations, seedLength, sha512.New), nil
+}
+
+// entropyToMnemonic appends the checksum to the entropy and looks up the word of every 11 bit group
+func entropyToMnemonic(entropy []byte) string {
+	checksumBits := len(entropy) * 8 / 32
+	total := len(entropy)*8 + checksumBits
+
+	// the checksum is the first bits of the sha256 of the entropy
+	hash := sha256.Sum256(entropy)
+	data := new(big.Int).SetBytes(entropy)
+	data.Lsh(data, uint(checksumBits))
+	data.Or(data, big.NewInt(int64(hash[0]>>(8-uint(checksumBits)))))
+
+	// read the groups from the back, the last word holds the checksum
+	words := make([]string, total/bitsPerWord)
+	mask := big.NewInt(1<<bitsPerWord - 1)
+	for i := len(words) - 1; i >= 0; i-- {
+		index := new(big.Int).And(data, mask).Int64()
+		words[i] = englishWordlist[index]
+		data.Rsh(data, bitsPerWord)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// mnemonicToEntropy turns the words back into the entropy and checks the checksum
+func mnemonicToEntropy(words []string) ([]byte, error) {
+	switch len(words) {
+	case 12, 15, 18, 21, 24:
+	default:
+		return nil, fmt.Errorf("mnemonic must have 12, 15, 18, 21 or 24 words, not %d", len(words))
+	}
+
+	data := new(big.Int)
+	for _, word := range words {
+		index, ok := wordIndex(word)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a BIP39 word", word)
+		}
+		data.Lsh(data, bitsPerWord)
+		data.Or(data, big.NewInt(int64(index)))
+	}
+
+	total := len(words) * bitsPerWord
+	checksumBits := total / 33
+	entropyBits := total - checksumBits
+
+	checksum := new(big.Int).And(data, big.NewInt(1<<uint(checksumBits)-1)).Int64()
+	data.Rsh(data, uint(checksumBits))
+
+	// the entropy is padded to its full size, big.Int drops the leading zeros
+	entropy := make([]byte, entropyBits/8)
+	b := data.Bytes()
+	copy(entropy[len(entropy)-len(b):], b)
+
+	hash := sha256.Sum256(entropy)
+	if int64(hash[0]>>(8-uint(checksumBits))) != checksum {
+		return nil, ErrInvalidChecksum
+	}
+
+	return entropy, nil
+}
+
+// wordIndex finds the index of a word, the wordlist is sorted so it can be searched
+func wordIndex(word string) (int, bool) {
+	index := sort.SearchStrings(englishWordlist, word)
+	if index < len(englishWordlist) && englishWordlist[index] == word {
+		return index, true
+	}
+
+	return 0, false
+}
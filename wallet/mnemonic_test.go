@@ -0,0 +1,108 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMnemonicMatchesTheBIP39Vectors(t *testing.T) {
+	// the vectors of the reference implementation, all seeds use the passphrase TREZOR
+	tests := []struct {
+		entropy, mnemonic, seed string
+	}{
+		{
+			"00000000000000000000000000000000",
+			"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+			"c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04",
+		},
+		{
+			"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f",
+			"legal winner thank year wave sausage worth useful legal winner thank yellow",
+			"2e8905819b8723fe2c1d161860e5ee1830318dbf49a83bd451cfb8440c28bd6fa457fe1296106559a3c80937a1c1069be3a3a5bd381ee6260e8d9739fce1f607",
+		},
+		{
+			"80808080808080808080808080808080",
+			"letter advice cage absurd amount doctor acoustic avoid letter advice cage above",
+			"d71de856f81a8acc65e6fc851a38d4d7ec216fd0796d0a6827a3ad6ed5511a30fa280f12eb2e47ed2ac03b5c462a0358d18d69fe4f985ec81778c1b370b652a8",
+		},
+		{
+			"ffffffffffffffffffffffffffffffff",
+			"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo wrong",
+			"ac27495480225222079d7be181583751e86f571027b0497b5b5d11218e0a8a13332572917f0f8e5a589620c6f15b11c61dee327651a14c34e18231052e48c069",
+		},
+		{
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon art",
+			"bda85446c68413707090a52022edd26a1c9462295029f2e60cd7c4f2bbd3097170af7a4d73245cafa9c3cca8d561a7c3de6f5d4a10be8ed2a5e608d68f92fcc8",
+		},
+	}
+	for _, test := range tests {
+		entropy, err := hex.DecodeString(test.entropy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mnemonic := entropyToMnemonic(entropy); mnemonic != test.mnemonic {
+			t.Errorf("entropy %s: mnemonic %q, want %q", test.entropy, mnemonic, test.mnemonic)
+		}
+
+		decoded, err := mnemonicToEntropy(strings.Fields(test.mnemonic))
+		if err != nil {
+			t.Fatalf("%q: %v", test.mnemonic, err)
+		}
+		if hex.EncodeToString(decoded) != test.entropy {
+			t.Errorf("%q: entropy %x, want %s", test.mnemonic, decoded, test.entropy)
+		}
+
+		seed, err := MnemonicToSeed(test.mnemonic, "TREZOR")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(seed) != test.seed {
+			t.Errorf("%q: seed %x, want %s", test.mnemonic, seed, test.seed)
+		}
+	}
+}
+
+func TestGenerateMnemonicRoundTrips(t *testing.T) {
+	for bits, words := range map[int]int{128: 12, 160: 15, 192: 18, 224: 21, 256: 24} {
+		mnemonic, err := GenerateMnemonic(bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(strings.Fields(mnemonic)); n != words {
+			t.Errorf("%d bits: %d words, want %d", bits, n, words)
+		}
+		if _, err := MnemonicToSeed(mnemonic, ""); err != nil {
+			t.Errorf("%d bits: %v", bits, err)
+		}
+	}
+
+	for _, bits := range []int{0, 96, 129, 288} {
+		if _, err := GenerateMnemonic(bits); err == nil {
+			t.Errorf("generated a mnemonic of %d bits", bits)
+		}
+	}
+}
+
+func TestMnemonicToSeedRejectsInvalidMnemonics(t *testing.T) {
+	valid := "legal winner thank year wave sausage worth useful legal winner thank yellow"
+
+	tests := map[string]string{
+		// the last word carries the checksum
+		"invalid checksum": strings.Replace(valid, "yellow", "year", 1),
+		"wrong word count": strings.TrimSuffix(valid, " yellow"),
+		"no words":         "",
+		"not a BIP39 word": strings.Replace(valid, "wave", "waves", 1),
+	}
+	for name, mnemonic := range tests {
+		if _, err := MnemonicToSeed(mnemonic, ""); err == nil {
+			t.Errorf("%s: %q was accepted", name, mnemonic)
+		}
+	}
+
+	if _, err := MnemonicToSeed(tests["invalid checksum"], ""); !errors.Is(err, ErrInvalidChecksum) {
+		t.Errorf("invalid checksum returned %v, want ErrInvalidChecksum", err)
+	}
+}
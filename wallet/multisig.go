@@ -0,0 +1,69 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// scriptVersion P2SH (pay to script hash) addresses use a different version so they can't be mistaken for regular addresses
+	scriptVersion = byte(0x05)
+
+	// script op codes used by the standard multisig redeem script
+	opSmallInt       = byte(0x50) // OP_1 through OP_16 are opSmallInt + n
+	opCheckMultiSig  = byte(0xae)
+	maxMultiSigKeys  = 16
+	maxPushDataBytes = 75
+)
+
+// RedeemScript encodes the standard m of n multisig script
+//
+// OP_m <key1> ... <keyN> OP_n OP_CHECKMULTISIG
+func RedeemScript(m, n int, pubKeys [][]byte) ([]byte, error) {
+	if n < 1 || n > maxMultiSigKeys {
+		return nil, fmt.Errorf("n must be between 1 and %d", maxMultiSigKeys)
+	}
+	if m < 1 || m > n {
+		return nil, errors.New("m must be between 1 and n")
+	}
+	if len(pubKeys) != n {
+		return nil, fmt.Errorf("expected %d public keys, got %d", n, len(pubKeys))
+	}
+
+	script := []byte{opSmallInt + byte(m)}
+	for _, key := range pubKeys {
+		// each key is pushed with its length in front of it
+		if len(key) == 0 || len(key) > maxPushDataBytes {
+			return nil, errors.New("invalid public key length")
+		}
+		script = append(script, byte(len(key)))
+		script = append(script, key...)
+	}
+	script = append(script, opSmallInt+byte(n), opCheckMultiSig)
+
+	return script, nil
+}
+
+// MultiSigAddress derives the P2SH address of an m of n multisig redeem script
+func MultiSigAddress(m, n int, pubKeys [][]byte) (string, error) {
+	script, err := RedeemScript(m, n, pubKeys)
+	if err != nil {
+		return "", err
+	}
+
+	return scriptAddress(script), nil
+}
+
+// scriptAddress hashes a script the same way as a public key and encodes it with the script version
+func scriptAddress(script []byte) string {
+	return string(AddressFromScriptHash(PublicKeyHash(script)))
+}
+
+// AddressFromScriptHash creates the P2SH address of a redeem script hash
+func AddressFromScriptHash(scriptHash []byte) []byte {
+	versionedHash := append([]byte{scriptVersion}, scriptHash...)
+	checksum := Checksum(versionedHash)
+	fullHash := append(versionedHash, checksum...)
+
+	return Base58Encode(fullHash)
+}
@@ -1,7 +1,7 @@
 package wallet
 
 import (
-	"log"
+	"errors"
 
 	"github.com/mr-tron/base58"
 )
@@ -17,11 +17,27 @@ func Base58Encode(input []byte) []byte {
 }
 
 // Base58Decode decodes a 58 base slice of bytes back to its original state
-func Base58Decode(input []byte) []byte {
-	decode, err := base58.Decode(string(input[:]))
+func Base58Decode(input []byte) ([]byte, error) {
+	return base58.Decode(string(input[:]))
+}
+
+// AddressToComponents decodes an address and splits it into the version, the public key hash and the checksum
+//
+// it is the inverse of Address(). Invalid input returns an error instead of panicking
+func AddressToComponents(address string) (version byte, pubKeyHash []byte, checksum []byte, err error) {
+	decoded, err := Base58Decode([]byte(address))
 	if err != nil {
-		log.Panic(err)
+		return 0, nil, nil, err
 	}
 
-	return decode
+	// there must be at least a version byte, a single hash byte and the checksum
+	if len(decoded) <= checksumLength+1 {
+		return 0, nil, nil, errors.New("address is too short")
+	}
+
+	version = decoded[0]
+	pubKeyHash = decoded[1 : len(decoded)-checksumLength]
+	checksum = decoded[len(decoded)-checksumLength:]
+
+	return version, pubKeyHash, checksum, nil
 }
@@ -6,8 +6,13 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
 	"log"
+	"math/big"
 
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 	"golang.org/x/crypto/ripemd160"
 )
 
@@ -17,17 +22,98 @@ const (
 	version = byte(0x00)
 )
 
+// Key types define which elliptic curve was used to create the key pair
+const (
+	// KeyTypeP256 NIST P256, the default curve
+	KeyTypeP256 = byte(0)
+	// KeyTypeSecp256k1 the curve used by Bitcoin and Ethereum
+	KeyTypeSecp256k1 = byte(1)
+)
+
+// AddressType defines what kind of output an address locks
+type AddressType int
+
+const (
+	// AddressTypeUnknown the version byte of the address is not known
+	AddressTypeUnknown AddressType = iota
+	// AddressTypeP2PKH pay to public key hash, a regular wallet address
+	AddressTypeP2PKH
+	// AddressTypeP2SH pay to script hash, eg. a multisig address
+	AddressTypeP2SH
+)
+
 // Wallet uses ecdsa (elyptical curve digital signing algorithm)
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
 	PublicKey  []byte
+	// the curve of the key pair
+	KeyType byte
+	// WatchOnly the wallet only knows an address, eg. of a cold storage wallet. It has no keys, so it can't sign
+	WatchOnly bool
+	// the public key hash of a watch only wallet. An address only holds the hash, the public key can't be recovered from it
+	WatchedPubKeyHash []byte
 }
 
 // Address returns the addess from the wallet. This includes the public key hash, the checksum and the version passed through a base58 algorithm
 func (w *Wallet) Address() []byte {
-	// generate the public hash key
-	pubHash := PublicKeyHash(w.PublicKey)
+	return AddressFromPubKeyHash(w.PubKeyHash())
+}
+
+// PubKeyHash returns the public key hash the outputs of the wallet are locked to
+func (w *Wallet) PubKeyHash() []byte {
+	if w.WatchOnly {
+		return w.WatchedPubKeyHash
+	}
+
+	return PublicKeyHash(w.PublicKey)
+}
 
+// storedWallet the gob encoding of a wallet
+//
+// the curves of crypto/elliptic have no exported fields since Go 1.20, gob can't encode ecdsa.PrivateKey with them anymore.
+// The key is stored as its numbers and the curve is restored from the key type
+type storedWallet struct {
+	D, X, Y           []byte
+	PublicKey         []byte
+	KeyType           byte
+	WatchOnly         bool
+	WatchedPubKeyHash []byte
+}
+
+// GobEncode encodes the wallet without its curve
+func (w Wallet) GobEncode() ([]byte, error) {
+	stored := storedWallet{PublicKey: w.PublicKey, KeyType: w.KeyType, WatchOnly: w.WatchOnly, WatchedPubKeyHash: w.WatchedPubKeyHash}
+	// watch only wallets have no key
+	if w.PrivateKey.D != nil {
+		stored.D, stored.X, stored.Y = w.PrivateKey.D.Bytes(), w.PrivateKey.X.Bytes(), w.PrivateKey.Y.Bytes()
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(stored); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode decodes a wallet encoded by GobEncode and restores the curve of its key type
+func (w *Wallet) GobDecode(data []byte) error {
+	var stored storedWallet
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&stored); err != nil {
+		return err
+	}
+
+	*w = Wallet{PublicKey: stored.PublicKey, KeyType: stored.KeyType, WatchOnly: stored.WatchOnly, WatchedPubKeyHash: stored.WatchedPubKeyHash}
+	if stored.D != nil {
+		w.PrivateKey.Curve = Curve(stored.KeyType)
+		w.PrivateKey.D = new(big.Int).SetBytes(stored.D)
+		w.PrivateKey.X = new(big.Int).SetBytes(stored.X)
+		w.PrivateKey.Y = new(big.Int).SetBytes(stored.Y)
+	}
+	return nil
+}
+
+// AddressFromPubKeyHash creates the address of a public key hash, eg. to show who an output is locked to
+func AddressFromPubKeyHash(pubHash []byte) []byte {
 	// attach the version to the hash
 	versionedHash := append([]byte{version}, pubHash...)
 
@@ -43,28 +129,36 @@ func (w *Wallet) Address() []byte {
 	return address
 }
 
-// ValidateAddress validates the validity of an address
+// ValidateAddress validates the validity of an address and returns its type
 //
 // take an address string -> convert to hash by passing through base68 decoder --> Remove the version (first 2 characters), remove the pub key hash, so that the remaining is the checksum
 // -> the final checksum should be like 2bc6c767
 //
 // then take the pub key hash, attach a new constant to it and pass it through our checksum function to create a new checksum and compare it
-func ValidateAddress(address string) bool {
-	// get the pubkeyhash by decoding it back to base64
-	pubKeyHash := Base58Decode([]byte(address))
-	// remove the version and hash to get the check sum
-	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]
-	// get the version digits
-	version := pubKeyHash[0]
-
-	// get just the pub key hash to rerun it through the checksum
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]
+func ValidateAddress(address string) (AddressType, error) {
+	// split the address into the version digits, the pub key hash and the check sum
+	addrVersion, pubKeyHash, actualChecksum, err := AddressToComponents(address)
+	if err != nil {
+		return AddressTypeUnknown, err
+	}
 
 	// create a new checksum
-	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
+	targetChecksum := Checksum(append([]byte{addrVersion}, pubKeyHash...))
 
 	// finally compare the provided checksum and the target
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	if bytes.Compare(actualChecksum, targetChecksum) != 0 {
+		return AddressTypeUnknown, errors.New("address checksum is not valid")
+	}
+
+	// the version tells us what kind of address it is
+	switch addrVersion {
+	case version:
+		return AddressTypeP2PKH, nil
+	case scriptVersion:
+		return AddressTypeP2SH, nil
+	default:
+		return AddressTypeUnknown, fmt.Errorf("unknown address version %d", addrVersion)
+	}
 }
 
 // NewKeyPair creates a new public private keypair 10^77 possibilities
@@ -80,18 +174,68 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 	}
 
 	// create a public key by taking the value of x as bytes and explode the value of y into a single value
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	pub := PublicKeyBytes(&private.PublicKey)
 	return *private, pub
 }
 
+// NewKeyPairSecp256k1 creates a new public private keypair on the secp256k1 curve
+func NewKeyPairSecp256k1() (ecdsa.PrivateKey, []byte, error) {
+	key, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return ecdsa.PrivateKey{}, nil, err
+	}
+
+	private := key.ToECDSA()
+
+	// the public key is encoded the same way as the P256 keys
+	pub := PublicKeyBytes(&private.PublicKey)
+	return *private, pub, nil
+}
+
 // MakeWallet creates a new wallet including key pairs
 func MakeWallet() *Wallet {
 	private, public := NewKeyPair()
-	wallet := Wallet{private, public}
+	wallet := Wallet{PrivateKey: private, PublicKey: public, KeyType: KeyTypeP256}
 
 	return &wallet
 }
 
+// MakeWalletWithKeyType creates a new wallet with a key pair on the curve of the key type
+func MakeWalletWithKeyType(keyType byte) (*Wallet, error) {
+	switch keyType {
+	case KeyTypeP256:
+		return MakeWallet(), nil
+	case KeyTypeSecp256k1:
+		private, public, err := NewKeyPairSecp256k1()
+		if err != nil {
+			return nil, err
+		}
+		return &Wallet{PrivateKey: private, PublicKey: public, KeyType: KeyTypeSecp256k1}, nil
+	default:
+		return nil, fmt.Errorf("unknown key type %d", keyType)
+	}
+}
+
+// PublicKeyBytes encodes a public key as x followed by y, both padded to the size of the curve
+//
+// the key is split in half to read it again, so a coordinate with leading zero bytes must not be shorter than the other
+func PublicKeyBytes(pub *ecdsa.PublicKey) []byte {
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	key := make([]byte, 2*size)
+	pub.X.FillBytes(key[:size])
+	pub.Y.FillBytes(key[size:])
+	return key
+}
+
+// Curve returns the elliptic curve of a key type
+func Curve(keyType byte) elliptic.Curve {
+	if keyType == KeyTypeSecp256k1 {
+		return secp256k1.S256()
+	}
+
+	return elliptic.P256()
+}
+
 // PublicKeyHash runs through several encryption algorithms to create the public key hash from a public key
 func PublicKeyHash(pubKey []byte) []byte {
 	pubHash := sha256.Sum256(pubKey)
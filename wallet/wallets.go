@@ -2,8 +2,8 @@ package wallet
 
 import (
 	"bytes"
-	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -12,18 +12,54 @@ import (
 
 const walletFile = "./tmp/wallets_%s.data"
 
+var (
+	// ErrWalletNotFound is returned when an address is not in the wallet file
+	ErrWalletNotFound = errors.New("wallet does not exist")
+	// ErrMultiSigWallet is returned when a single wallet is requested for a multisig address
+	ErrMultiSigWallet = errors.New("address is a multisig address, use the redeem script")
+	// ErrWatchOnly is returned when a watch only wallet has to sign or reveal a key it doesn't have
+	ErrWatchOnly = errors.New("wallet is watch only, it has no private key")
+)
+
 // Wallets creates a rudamentory database structure and avoid mixing with the block chain badger db
 type Wallets struct {
 	Wallets map[string]*Wallet
+	// multisig redeem scripts keyed by their P2SH address
+	RedeemScripts map[string][]byte
+	// master seed of the derived wallets, nil until SetHDWallet is called
+	HD *HDWallet
 }
 
 // CreateWallets reads from disc to initialize and populate wallets
-func CreateWallets(nodeID string) (*Wallets, error) {
+//
+// an optional BIP39 mnemonic seeds the HD wallet of a new wallet file. The seed of an existing wallet file is never replaced
+func CreateWallets(nodeID string, mnemonic ...string) (*Wallets, error) {
 	wallets := Wallets{}
 
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.RedeemScripts = make(map[string][]byte)
 
 	err := wallets.LoadFile(nodeID)
+	if len(mnemonic) == 0 || mnemonic[0] == "" {
+		return &wallets, err
+	}
+	if err == nil {
+		return &wallets, errors.New("wallet file already exists, a mnemonic can only seed a new wallet file")
+	}
+	if !os.IsNotExist(err) {
+		return &wallets, err
+	}
+
+	seed, merr := MnemonicToSeed(mnemonic[0], "")
+	if merr != nil {
+		return &wallets, merr
+	}
+	hd, merr := NewHDWalletFromEntropy(seed)
+	if merr != nil {
+		return &wallets, merr
+	}
+	wallets.SetHDWallet(hd)
+
 	return &wallets, err
 }
 
@@ -36,10 +72,94 @@ func (ws *Wallets) AddWallet() string {
 	return address
 }
 
+// AddMultiSig stores the redeem script of an m of n multisig wallet and returns the P2SH address
+func (ws *Wallets) AddMultiSig(m int, pubKeys [][]byte) (string, error) {
+	script, err := RedeemScript(m, len(pubKeys), pubKeys)
+	if err != nil {
+		return "", err
+	}
+
+	address := scriptAddress(script)
+	ws.RedeemScripts[address] = script
+	return address, nil
+}
+
+// SetHDWallet sets the HD wallet that AddDerivedWallet derives from. The seed is saved with the other wallets
+func (ws *Wallets) SetHDWallet(hd *HDWallet) {
+	ws.HD = hd
+}
+
+// AddDerivedWallet derives the wallet of a derivation path from the HD wallet and adds it to the wallets structure
+func (ws *Wallets) AddDerivedWallet(path string) (string, error) {
+	if ws.HD == nil {
+		return "", errors.New("no HD wallet, the master seed has to be set first")
+	}
+
+	wallet, err := ws.HD.DeriveChildFromPath(path)
+	if err != nil {
+		return "", err
+	}
+	address := fmt.Sprintf("%s", wallet.Address())
+
+	ws.Wallets[address] = wallet
+	return address, nil
+}
+
+// GetRedeemScript retrieves the redeem script of a multisig address
+func (ws Wallets) GetRedeemScript(address string) ([]byte, bool) {
+	script, ok := ws.RedeemScripts[address]
+	return script, ok
+}
+
+// AddWalletWithKeyType creates a new wallet using the curve of the key type and adds it to the wallets structure
+func (ws *Wallets) AddWalletWithKeyType(keyType byte) (string, error) {
+	wallet, err := MakeWalletWithKeyType(keyType)
+	if err != nil {
+		return "", err
+	}
+	address := fmt.Sprintf("%s", wallet.Address())
+
+	ws.Wallets[address] = wallet
+	return address, nil
+}
+
+// AddWatchAddress adds a watch only wallet for an address whose key is kept elsewhere, so its balance can be monitored
+//
+// only key addresses can be watched. Watching an address that is already watched does nothing
+func (ws *Wallets) AddWatchAddress(address string) error {
+	addressType, err := ValidateAddress(address)
+	if err != nil {
+		return err
+	}
+	if addressType != AddressTypeP2PKH {
+		return fmt.Errorf("%s is a script address, only key addresses can be watched", address)
+	}
+
+	if existing, ok := ws.Wallets[address]; ok {
+		if existing.WatchOnly {
+			return nil
+		}
+		return fmt.Errorf("the key of %s is already in the wallet file", address)
+	}
+
+	_, pubKeyHash, _, err := AddressToComponents(address)
+	if err != nil {
+		return err
+	}
+
+	ws.Wallets[address] = &Wallet{WatchOnly: true, WatchedPubKeyHash: pubKeyHash}
+	return nil
+}
+
 // GetAllAddresses returns an array of wallet addresses (aka map keys)
-func (ws Wallets) GetAllAddresses() []string {
+//
+// an optional watch only status only returns the addresses of watch only wallets, or of the wallets that have keys
+func (ws Wallets) GetAllAddresses(watchOnly ...bool) []string {
 	var addresses []string
-	for address := range ws.Wallets {
+	for address, wallet := range ws.Wallets {
+		if len(watchOnly) > 0 && wallet.WatchOnly != watchOnly[0] {
+			continue
+		}
 		addresses = append(addresses, address)
 	}
 
@@ -47,9 +167,20 @@ func (ws Wallets) GetAllAddresses() []string {
 
 }
 
-// GetWallet retrieves a single wallet based on the address
-func (ws Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
+// GetWallet retrieves a single wallet based on the address. Returns ErrWalletNotFound when the address is not in the wallet file
+//
+// multisig addresses don't have a single wallet, the redeem script must be used instead
+func (ws Wallets) GetWallet(address string) (Wallet, error) {
+	if _, ok := ws.RedeemScripts[address]; ok {
+		return Wallet{}, ErrMultiSigWallet
+	}
+
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return Wallet{}, ErrWalletNotFound
+	}
+
+	return *wallet, nil
 }
 
 // LoadFile loads the wallets from disc
@@ -59,34 +190,57 @@ func (ws *Wallets) LoadFile(nodeID string) error {
 		return err
 	}
 
-	var wallets Wallets
 	fileContent, err := ioutil.ReadFile(walletFile)
 	if err != nil {
 		return err
 	}
 
-	gob.Register(elliptic.P256())
-	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	if err := decoder.Decode(&wallets); err != nil {
+	if err := ws.decode(fileContent); err != nil {
 		log.Panic(err)
 	}
-
-	ws.Wallets = wallets.Wallets
 	return nil
 }
 
 // SaveFile saves the wallets to disc
 func (ws *Wallets) SaveFile(nodeID string) {
-	var content bytes.Buffer
 	walletFile := fmt.Sprintf(walletFile, nodeID)
 
-	gob.Register(elliptic.P256())
-	encoder := gob.NewEncoder(&content)
-	if err := encoder.Encode(ws); err != nil {
+	content, err := ws.encode()
+	if err != nil {
 		log.Panic(err)
 	}
 
-	if err := ioutil.WriteFile(walletFile, content.Bytes(), 0644); err != nil {
+	if err := ioutil.WriteFile(walletFile, content, 0644); err != nil {
 		log.Panic(err)
 	}
 }
+
+// encode gob encodes the wallets, the same bytes are written to the plaintext and the encrypted wallet files
+func (ws *Wallets) encode() ([]byte, error) {
+	var content bytes.Buffer
+
+	encoder := gob.NewEncoder(&content)
+	if err := encoder.Encode(ws); err != nil {
+		return nil, err
+	}
+
+	return content.Bytes(), nil
+}
+
+// decode replaces the wallets with the gob encoded wallets of the content
+func (ws *Wallets) decode(content []byte) error {
+	var wallets Wallets
+
+	decoder := gob.NewDecoder(bytes.NewReader(content))
+	if err := decoder.Decode(&wallets); err != nil {
+		return err
+	}
+
+	ws.Wallets = wallets.Wallets
+	ws.HD = wallets.HD
+	// wallet files created before multisig support don't have redeem scripts
+	if wallets.RedeemScripts != nil {
+		ws.RedeemScripts = wallets.RedeemScripts
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package wallet
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// wifVersion the version byte of a Wallet Import Format private key
+	wifVersion = byte(0x80)
+	// length of the private key in the WIF payload
+	privKeyLength = 32
+	auditLogFile  = "audit.log"
+)
+
+// WIF encodes the private key in Wallet Import Format
+//
+// the public keys of this wallet are not compressed, so the compression flag is not added.
+// The format does not include the curve, so the key type has to be known when the key is imported again
+func (w Wallet) WIF() string {
+	// the private key is always padded to 32 bytes
+	key := make([]byte, privKeyLength)
+	d := w.PrivateKey.D.Bytes()
+	copy(key[privKeyLength-len(d):], d)
+
+	versionedKey := append([]byte{wifVersion}, key...)
+	fullKey := append(versionedKey, Checksum(versionedKey)...)
+
+	return string(Base58Encode(fullKey))
+}
+
+// DumpPrivKey loads the wallet of an address and returns its private key in Wallet Import Format
+//
+// every export is written to the audit log, the key is not returned when the export can't be logged
+func DumpPrivKey(address, nodeID string) (string, error) {
+	wallets, err := CreateWallets(nodeID)
+	if err != nil {
+		return "", err
+	}
+
+	return wallets.DumpPrivKey(address)
+}
+
+// DumpPrivKey returns the private key of an address in Wallet Import Format, eg. for wallets loaded from an encrypted wallet file
+func (ws Wallets) DumpPrivKey(address string) (string, error) {
+	w, err := ws.GetWallet(address)
+	if err != nil {
+		return "", err
+	}
+	if w.WatchOnly {
+		return "", ErrWatchOnly
+	}
+
+	if err := writeAuditLog(fmt.Sprintf("private key exported for address %s", address)); err != nil {
+		return "", fmt.Errorf("could not write the audit log: %s", err)
+	}
+
+	return w.WIF(), nil
+}
+
+// writeAuditLog appends a timestamped line to ~/.questcoin/audit.log
+func writeAuditLog(message string) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(home, ".questcoin")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, auditLogFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s %s\n", time.Now().UTC().Format(time.RFC3339), message)
+	return err
+}